@@ -0,0 +1,106 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/phitux/dailytxt/backend/utils"
+)
+
+// commandUsage is printed for unknown commands
+const commandUsage = `Usage: dailytxt [command]
+
+Without a command the server is started.
+
+Commands:
+  migrate-sqlite [--db path]   Copy the JSON data tree in DATA_PATH into the SQLite database
+                               (default SQLITE_PATH). Stop the server before running it.
+                               An interrupted migration can be started again.
+  fsck [--repair]              Check the data in DATA_PATH for broken files, missing and unreferenced
+                               uploaded files and unknown tags. With --repair, broken files are moved
+                               to DATA_PATH/quarantine/. Stop the server before repairing.
+  admin <subcommand>           Manage users directly on DATA_PATH, see "dailytxt admin help".
+`
+
+// runCommand runs a command given on the command line and returns the exit code
+func runCommand(args []string) int {
+	switch args[0] {
+	case "migrate-sqlite":
+		return migrateSQLiteCommand(args[1:])
+	case "fsck":
+		return fsckCommand(args[1:])
+	case "admin":
+		return adminCommand(args[1:])
+	case "help", "-h", "--help":
+		fmt.Print(commandUsage)
+		return 0
+	default:
+		fmt.Fprintf(os.Stderr, "Unknown command %q\n\n%s", args[0], commandUsage)
+		return 2
+	}
+}
+
+// migrateSQLiteCommand migrates the JSON tree into the SQLite database
+func migrateSQLiteCommand(args []string) int {
+	flags := flag.NewFlagSet("migrate-sqlite", flag.ContinueOnError)
+	dbPath := flags.String("db", utils.Settings.SQLitePath, "path of the SQLite database")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+
+	if err := utils.MigrateToSQLite(utils.Settings.DataPath, *dbPath); err != nil {
+		fmt.Fprintf(os.Stderr, "Migration failed: %v\n", err)
+		return 1
+	}
+
+	fmt.Printf("Migration finished. Set STORAGE=sqlite (and SQLITE_PATH=%s if not the default) to use the database.\n", *dbPath)
+	return 0
+}
+
+// fsckCommand checks (and repairs) the data directory
+func fsckCommand(args []string) int {
+	flags := flag.NewFlagSet("fsck", flag.ContinueOnError)
+	repair := flags.Bool("repair", false, "move broken files to quarantine")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+
+	// The documents and the uploaded files are checked wherever they are stored
+	if err := utils.InitStorage(); err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to initialize storage: %v\n", err)
+		return 1
+	}
+
+	// Without STORAGE=filesystem, the documents are read from the store and broken ones can only be reported
+	var docs utils.DocumentStore
+	if utils.Settings.Storage != "filesystem" {
+		fmt.Printf("Note: STORAGE=%s, broken documents are reported but not repaired\n", utils.Settings.Storage)
+		docs = utils.Store
+	}
+
+	report, err := utils.RunFsck(utils.Settings.DataPath, docs, utils.Store, *repair)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Check failed: %v\n", err)
+		return 1
+	}
+
+	for _, issue := range report.Issues {
+		status := ""
+		if issue.Repaired {
+			status = " [repaired]"
+		}
+		fmt.Printf("%-7s %s: %s%s\n", strings.ToUpper(issue.Severity), issue.Path, issue.Message, status)
+	}
+	if report.QuarantineDir != "" {
+		fmt.Printf("Quarantined files were moved to %s\n", report.QuarantineDir)
+	}
+
+	if errors := report.Errors(); errors > 0 {
+		fmt.Printf("%d problems found (%d issues in total)\n", errors, len(report.Issues))
+		return 1
+	}
+	fmt.Printf("No errors found (%d issues in total)\n", len(report.Issues))
+	return 0
+}
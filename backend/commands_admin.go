@@ -0,0 +1,230 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/phitux/dailytxt/backend/handlers"
+	"github.com/phitux/dailytxt/backend/utils"
+)
+
+// adminUsage is printed for unknown admin subcommands
+const adminUsage = `Usage: dailytxt admin <subcommand>
+
+Subcommands:
+  list-users                       List all users with their disk usage
+  delete-user <id|username>        Delete a user and all of their data
+  open-registration [--minutes n]  Allow registration for n minutes (default 5, max 15)
+  create-user <username>           Create a user, the password is read from stdin
+  export <id|username> [--out f]   Write the encrypted backup zip of a user (default backup_user_<id>.zip)
+  settings                         Print the settings (without secrets)
+
+Changes to users (create-user, delete-user) should be made while the server is stopped.
+`
+
+// adminCommand runs an admin subcommand and returns the exit code
+func adminCommand(args []string) int {
+	if len(args) == 0 {
+		fmt.Fprint(os.Stderr, adminUsage)
+		return 2
+	}
+	if args[0] == "help" || args[0] == "-h" || args[0] == "--help" {
+		fmt.Print(adminUsage)
+		return 0
+	}
+
+	// All subcommands work on the configured storage
+	if err := utils.InitStorage(); err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to initialize storage: %v\n", err)
+		return 1
+	}
+
+	var err error
+	switch args[0] {
+	case "list-users":
+		err = adminListUsers()
+	case "delete-user":
+		err = adminDeleteUser(args[1:])
+	case "open-registration":
+		err = adminOpenRegistration(args[1:])
+	case "create-user":
+		err = adminCreateUser(args[1:])
+	case "export":
+		err = adminExport(args[1:])
+	case "settings":
+		err = adminSettings()
+	default:
+		fmt.Fprintf(os.Stderr, "Unknown admin subcommand %q\n\n%s", args[0], adminUsage)
+		return 2
+	}
+
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		return 1
+	}
+	return 0
+}
+
+func adminListUsers() error {
+	users, err := handlers.ListUsersWithDiskUsage()
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("%-6s %-30s %12s\n", "ID", "Username", "Disk usage")
+	for _, user := range users {
+		fmt.Printf("%-6d %-30s %12s\n", user.ID, user.Username, formatBytes(user.DiskUsage))
+	}
+	return nil
+}
+
+func adminDeleteUser(args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("usage: dailytxt admin delete-user <id|username>")
+	}
+	userID, err := lookupUser(args[0])
+	if err != nil {
+		return err
+	}
+
+	if err := handlers.DeleteUserByID(userID); err != nil {
+		return err
+	}
+	fmt.Printf("Deleted user %d\n", userID)
+	return nil
+}
+
+func adminOpenRegistration(args []string) error {
+	flags := flag.NewFlagSet("open-registration", flag.ContinueOnError)
+	minutes := flags.Int("minutes", 5, "duration in minutes")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *minutes <= 0 || *minutes > 15 {
+		return fmt.Errorf("minutes must be between 1 and 15")
+	}
+
+	duration := time.Duration(*minutes) * time.Minute
+	if err := utils.SetRegistrationOverride(duration); err != nil {
+		return err
+	}
+	fmt.Printf("Registration is open until %s\n", time.Now().Add(duration).Format(time.RFC3339))
+	return nil
+}
+
+func adminCreateUser(args []string) error {
+	if len(args) != 1 || strings.TrimSpace(args[0]) == "" {
+		return fmt.Errorf("usage: dailytxt admin create-user <username> (password on stdin)")
+	}
+
+	// Read the password from stdin, so that it doesn't end up in the shell history
+	fmt.Fprint(os.Stderr, "Password: ")
+	password, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && password == "" {
+		return fmt.Errorf("error reading password: %v", err)
+	}
+	password = strings.TrimRight(password, "\r\n")
+	if password == "" {
+		return fmt.Errorf("password must not be empty")
+	}
+
+	if _, err := handlers.Register(args[0], password); err != nil {
+		return err
+	}
+	fmt.Printf("Created user %s\n", args[0])
+	return nil
+}
+
+func adminExport(args []string) error {
+	if len(args) == 0 || strings.HasPrefix(args[0], "-") {
+		return fmt.Errorf("usage: dailytxt admin export <id|username> [--out file]")
+	}
+	userID, err := lookupUser(args[0])
+	if err != nil {
+		return err
+	}
+
+	flags := flag.NewFlagSet("export", flag.ContinueOnError)
+	out := flags.String("out", fmt.Sprintf("backup_user_%d.zip", userID), "output file")
+	if err := flags.Parse(args[1:]); err != nil {
+		return err
+	}
+
+	file, err := os.OpenFile(*out, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+
+	// The encrypted backup contains everything and needs no password
+	err = handlers.WriteBackup(file, userID, "", handlers.BackupRequest{
+		Encrypted:        true,
+		IncludeFiles:     true,
+		IncludeTemplates: true,
+		IncludeTags:      true,
+		IncludeBookmarks: true,
+	})
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(*out)
+		return err
+	}
+
+	fmt.Printf("Wrote encrypted backup of user %d to %s\n", userID, *out)
+	return nil
+}
+
+func adminSettings() error {
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(utils.GetAppSettings())
+}
+
+// lookupUser returns the ID of a user given by ID or username
+func lookupUser(user string) (int, error) {
+	users, err := utils.GetUsers()
+	if err != nil {
+		return 0, err
+	}
+	usersList, _ := users["users"].([]any)
+
+	id, idErr := strconv.Atoi(user)
+	for _, u := range usersList {
+		userMap, ok := u.(map[string]any)
+		if !ok {
+			continue
+		}
+		userID, ok := userMap["user_id"].(float64)
+		if !ok {
+			continue
+		}
+		username, _ := userMap["username"].(string)
+		if (idErr == nil && int(userID) == id) || strings.EqualFold(username, user) {
+			return int(userID), nil
+		}
+	}
+	return 0, fmt.Errorf("user %q not found", user)
+}
+
+// formatBytes formats a size in bytes for humans
+func formatBytes(size int64) string {
+	const unit = 1024
+	if size < unit {
+		return fmt.Sprintf("%d B", size)
+	}
+	value := float64(size)
+	for _, suffix := range []string{"KB", "MB", "GB", "TB"} {
+		value /= unit
+		if value < unit || suffix == "TB" {
+			return fmt.Sprintf("%.1f %s", value, suffix)
+		}
+	}
+	return ""
+}
@@ -2,11 +2,11 @@ package handlers
 
 import (
 	"encoding/json"
+	"fmt"
 	"log"
 	"net/http"
 	"os"
 	"path/filepath"
-	"strconv"
 	"strings"
 	"syscall"
 	"time"
@@ -75,13 +75,43 @@ func GetAdminData(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Read users.json
-	users, err := utils.GetUsers()
+	// Get all users with their disk usage
+	adminUsers, err := ListUsersWithDiskUsage()
 	if err != nil {
 		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
 		return
 	}
 
+	// Get free disk space
+	freeSpace, err := getFreeDiskSpace()
+	if err != nil {
+		log.Printf("Error getting free disk space: %v", err)
+		freeSpace = 0 // Default to 0 if we can't determine free space
+	}
+
+	// Check for old directory and get old users info
+	oldDirInfo := getOldDirectoryInfo()
+
+	// Get App Settings (Env-vars)
+	appSettings := utils.GetAppSettings()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{
+		"users":        adminUsers,
+		"free_space":   freeSpace,
+		"old_data":     oldDirInfo,
+		"app_settings": appSettings,
+	})
+}
+
+// ListUsersWithDiskUsage returns all users of users.json with their disk usage
+func ListUsersWithDiskUsage() ([]AdminUserResponse, error) {
+	// Read users.json
+	users, err := utils.GetUsers()
+	if err != nil {
+		return nil, err
+	}
+
 	// get users
 	usersList, ok := users["users"].([]any)
 	if !ok || len(usersList) == 0 {
@@ -113,44 +143,12 @@ func GetAdminData(w http.ResponseWriter, r *http.Request) {
 		})
 	}
 
-	// Get free disk space
-	freeSpace, err := getFreeDiskSpace()
-	if err != nil {
-		log.Printf("Error getting free disk space: %v", err)
-		freeSpace = 0 // Default to 0 if we can't determine free space
-	}
-
-	// Check for old directory and get old users info
-	oldDirInfo := getOldDirectoryInfo()
-
-	// Get App Settings (Env-vars)
-	appSettings := utils.GetAppSettings()
-
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(map[string]any{
-		"users":        adminUsers,
-		"free_space":   freeSpace,
-		"old_data":     oldDirInfo,
-		"app_settings": appSettings,
-	})
+	return adminUsers, nil
 }
 
 // calculateUserDiskUsage calculates the total disk usage for a user
 func calculateUserDiskUsage(userID int) int64 {
-	userDataDir := filepath.Join(utils.Settings.DataPath, strconv.Itoa(userID))
-	var totalSize int64
-
-	// Calculate size recursively
-	err := filepath.Walk(userDataDir, func(path string, info os.FileInfo, err error) error {
-		if err != nil {
-			return nil // Continue on errors
-		}
-		if !info.IsDir() {
-			totalSize += info.Size()
-		}
-		return nil
-	})
-
+	totalSize, err := utils.UserDiskUsage(userID)
 	if err != nil {
 		log.Printf("Error calculating disk usage for user %d: %v", userID, err)
 	}
@@ -244,7 +242,7 @@ func DeleteUser(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Use the shared delete function from users.go
-	if err := deleteUserByID(req.UserID); err != nil {
+	if err := DeleteUserByID(req.UserID); err != nil {
 		log.Printf("Error deleting user %d: %v", req.UserID, err)
 		errMsg := err.Error()
 		if strings.Contains(errMsg, "not found") {
@@ -315,7 +313,10 @@ func OpenRegistrationTemp(w http.ResponseWriter, r *http.Request) {
 		duration = req.Seconds
 	}
 
-	utils.SetRegistrationOverride(time.Duration(duration) * time.Second)
+	if err := utils.SetRegistrationOverride(time.Duration(duration) * time.Second); err != nil {
+		http.Error(w, fmt.Sprintf("Error opening registration: %v", err), http.StatusInternalServerError)
+		return
+	}
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(map[string]any{
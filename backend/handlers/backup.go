@@ -2,13 +2,15 @@ package handlers
 
 import (
 	"archive/zip"
+	"bytes"
 	"encoding/json"
 	"fmt"
+	"io"
 	"net/http"
-	"os"
 	"path/filepath"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/phitux/dailytxt/backend/utils"
 )
@@ -17,6 +19,7 @@ import (
 type BackupRequest struct {
 	Username         string `json:"username,omitempty"`
 	Password         string `json:"password"`
+	TOTPCode         string `json:"totpCode,omitempty"`
 	Encrypted        bool   `json:"encrypted"`
 	StartDate        string `json:"startDate,omitempty"`
 	EndDate          string `json:"endDate,omitempty"`
@@ -81,6 +84,18 @@ func BackupUser(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Same throttling as for the login
+	ip := utils.GetClientIP(r)
+	if wait, allowed := utils.StartLoginAttempt(ip, req.Username, time.Now()); !allowed {
+		utils.Logger.Printf("Backup for user '%s' from %s throttled", req.Username, ip)
+		tooManyLoginAttempts(w, wait)
+		return
+	}
+	loginResult := utils.LoginAborted
+	defer func() {
+		utils.FinishLoginAttempt(ip, req.Username, loginResult, time.Now())
+	}()
+
 	users, err := utils.GetUsers()
 	if err != nil {
 		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
@@ -107,22 +122,53 @@ func BackupUser(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Verify password
-	derivedKey, _, err := utils.CheckPasswordForUser(userID, req.Password)
+	derivedKey, availableBackupCodes, err := utils.CheckPasswordForUser(userID, req.Password)
 	if err != nil {
 		http.Error(w, "Invalid password", http.StatusBadRequest)
 		return
+	} else if derivedKey == "" {
+		if userID != 0 {
+			if err := utils.RecordFailedLogin(userID, ip, "password", time.Now()); err != nil {
+				utils.Logger.Printf("Error recording failed login for user '%s': %v", req.Username, err)
+			}
+		}
+		loginResult = utils.LoginFailed
+		http.Error(w, "Invalid password", http.StatusBadRequest)
+		return
+	}
+
+	// Without a session, the second factor is required as well (unless a backup code was used)
+	if derivedKey != "" && availableBackupCodes == -1 {
+		totpEnabled, err := utils.IsTOTPEnabled(userID)
+		if err != nil {
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+		if totpEnabled {
+			encKey, err := utils.GetEncryptionKey(userID, derivedKey)
+			if err != nil {
+				http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+				return
+			}
+			valid, err := utils.VerifyUserTOTP(userID, encKey, req.TOTPCode, time.Now())
+			if err != nil || !valid {
+				if err == nil {
+					if err := utils.RecordFailedLogin(userID, ip, "totp", time.Now()); err != nil {
+						utils.Logger.Printf("Error recording failed login for user '%s': %v", req.Username, err)
+					}
+					loginResult = utils.LoginFailed
+				}
+				http.Error(w, "Invalid TOTP code", http.StatusBadRequest)
+				return
+			}
+		}
 	}
+	loginResult = utils.LoginSucceeded
 
 	performBackup(w, userID, derivedKey, req)
 }
 
 func performBackup(w http.ResponseWriter, userID int, derivedKey string, req BackupRequest) {
-	// Defaults
-	includeFiles := req.IncludeFiles
-	includeTemplates := req.IncludeTemplates
-	includeTags := req.IncludeTags
-	includeBookmarks := req.IncludeBookmarks
-
 	// Get encryption key if needed (for decryption or file ops)
 	encKey, err := utils.GetEncryptionKey(userID, derivedKey)
 	if err != nil {
@@ -134,8 +180,25 @@ func performBackup(w http.ResponseWriter, userID int, derivedKey string, req Bac
 	w.Header().Set("Content-Type", "application/zip")
 	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"backup_user_%d.zip\"", userID))
 
-	zw := zip.NewWriter(w)
-	defer zw.Close()
+	if err := WriteBackup(w, userID, encKey, req); err != nil {
+		utils.Logger.Printf("Error writing backup of user %d: %v", userID, err)
+	}
+}
+
+// WriteBackup writes the backup zip of a user to out.
+// encKey is only needed for a readable (not encrypted) backup and may be empty otherwise.
+func WriteBackup(out io.Writer, userID int, encKey string, req BackupRequest) error {
+	if !req.Encrypted && encKey == "" {
+		return fmt.Errorf("a readable backup needs the encryption key")
+	}
+
+	// Defaults
+	includeFiles := req.IncludeFiles
+	includeTemplates := req.IncludeTemplates
+	includeTags := req.IncludeTags
+	includeBookmarks := req.IncludeBookmarks
+
+	zw := zip.NewWriter(out)
 
 	// 1. Export User Data if encrypted
 	if req.Encrypted {
@@ -243,21 +306,14 @@ func performBackup(w http.ResponseWriter, userID int, derivedKey string, req Bac
 	}
 
 	// 4. Export Log Entries
-	// Walk data/<userID>/<year>/<month.json>
-	userPath := filepath.Join(utils.Settings.DataPath, fmt.Sprintf("%d", userID))
-
 	// Collect file UUIDs to export (uuid -> targetFilename)
 	filesToExport := make(map[string]string)
 	// Track used filenames to handle duplicates (filename -> unused)
 	usedFilenames := make(map[string]bool)
 
-	entries, err := os.ReadDir(userPath)
+	years, err := utils.GetYears(userID)
 	if err == nil {
-		for _, yearEntry := range entries {
-			if !yearEntry.IsDir() {
-				continue
-			}
-			yearStr := yearEntry.Name()
+		for _, yearStr := range years {
 			year, err := strconv.Atoi(yearStr)
 			if err != nil {
 				continue
@@ -268,17 +324,12 @@ func performBackup(w http.ResponseWriter, userID int, derivedKey string, req Bac
 			// Ideally parsing StartDate/EndDate.
 			// Here we process month by month.
 
-			monthDir := filepath.Join(userPath, yearStr)
-			monthEntries, err := os.ReadDir(monthDir)
+			months, err := utils.GetMonths(userID, yearStr)
 			if err != nil {
 				continue
 			}
 
-			for _, monthEntry := range monthEntries {
-				if monthEntry.IsDir() || !strings.HasSuffix(monthEntry.Name(), ".json") {
-					continue
-				}
-				monthStr := strings.TrimSuffix(monthEntry.Name(), ".json")
+			for _, monthStr := range months {
 				month, err := strconv.Atoi(monthStr)
 				if err != nil {
 					continue
@@ -318,112 +369,122 @@ func performBackup(w http.ResponseWriter, userID int, derivedKey string, req Bac
 						continue
 					}
 
-					// Remove history
-					delete(day, "history")
-
-					if !includeTags {
-						delete(day, "tags")
-					}
-
-					if !includeBookmarks {
-						delete(day, "isBookmarked")
-					}
+					// The day itself and each of its entries
+					for _, part := range utils.DayParts(day) {
+						// Remove history
+						delete(part, "history")
 
-					if !includeFiles {
-						delete(day, "files")
-					} else if req.Encrypted {
-						if files, ok := day["files"].([]any); ok {
-							for _, f := range files {
-								if fileMap, ok := f.(map[string]any); ok {
-									uuid := ""
-									if u, ok := fileMap["uuid"].(string); ok {
-										uuid = u
-									} else if u, ok := fileMap["uuid_filename"].(string); ok {
-										uuid = u
-									}
-									if uuid != "" {
-										filesToExport[uuid] = uuid
-									}
-								}
-							}
+						if !includeTags {
+							delete(part, "tags")
 						}
-					}
 
-					// Decrypt keys if requested
-					if !req.Encrypted {
-						if encryptedText, ok := day["text"].(string); ok && encryptedText != "" {
-							decryptedText, err := utils.DecryptText(encryptedText, encKey)
-							if err == nil {
-								day["text"] = decryptedText
-							}
-						}
-
-						if encryptedDate, ok := day["date_written"].(string); ok && encryptedDate != "" {
-							decryptedDate, err := utils.DecryptText(encryptedDate, encKey)
-							if err == nil {
-								day["date_written"] = decryptedDate
-							}
+						if !includeBookmarks {
+							delete(part, "isBookmarked")
 						}
 
-						if includeFiles {
-							if files, ok := day["files"].([]any); ok {
-								newFiles := []any{}
+						if !includeFiles {
+							delete(part, "files")
+						} else if req.Encrypted {
+							if files, ok := part["files"].([]any); ok {
 								for _, f := range files {
 									if fileMap, ok := f.(map[string]any); ok {
-										// Determine filename
-										filename := ""
 										uuid := ""
 										if u, ok := fileMap["uuid"].(string); ok {
 											uuid = u
 										} else if u, ok := fileMap["uuid_filename"].(string); ok {
 											uuid = u
 										}
+										if uuid != "" {
+											filesToExport[uuid] = uuid
+										}
+									}
+								}
+							}
+						}
+
+						// Decrypt keys if requested
+						if !req.Encrypted {
+							if encryptedText, ok := part["text"].(string); ok && encryptedText != "" {
+								decryptedText, err := utils.DecryptText(encryptedText, encKey)
+								if err == nil {
+									part["text"] = decryptedText
+								}
+							}
+
+							if encryptedTime, ok := part["time"].(string); ok && encryptedTime != "" {
+								decryptedTime, err := utils.DecryptText(encryptedTime, encKey)
+								if err == nil {
+									part["time"] = decryptedTime
+								}
+							}
+
+							if encryptedDate, ok := part["date_written"].(string); ok && encryptedDate != "" {
+								decryptedDate, err := utils.DecryptText(encryptedDate, encKey)
+								if err == nil {
+									part["date_written"] = decryptedDate
+								}
+							}
 
-										if encFilename, ok := fileMap["enc_filename"].(string); ok {
-											decryptedFilename, err := utils.DecryptText(encFilename, encKey)
-											if err == nil {
-												filename = decryptedFilename
+							if includeFiles {
+								if files, ok := part["files"].([]any); ok {
+									newFiles := []any{}
+									for _, f := range files {
+										if fileMap, ok := f.(map[string]any); ok {
+											// Determine filename
+											filename := ""
+											uuid := ""
+											if u, ok := fileMap["uuid"].(string); ok {
+												uuid = u
+											} else if u, ok := fileMap["uuid_filename"].(string); ok {
+												uuid = u
 											}
-										}
 
-										// If we have uuid and filename, handle duplicate resolution for ZIP export
-										if includeFiles && uuid != "" && filename != "" {
-											// Check if we already processed this UUID (e.g. same file in multiple days?)
-											// If yes, reuse the assigned filename
-											targetName, exists := filesToExport[uuid]
-											if !exists {
-												targetName = filename
-												if usedFilenames[targetName] {
-													// Collision
-													ext := filepath.Ext(filename)
-													nameNoExt := strings.TrimSuffix(filename, ext)
-													counter := 2
-													for {
-														newName := fmt.Sprintf("%s (%d)%s", nameNoExt, counter, ext)
-														if !usedFilenames[newName] {
-															targetName = newName
-															break
+											if encFilename, ok := fileMap["enc_filename"].(string); ok {
+												decryptedFilename, err := utils.DecryptText(encFilename, encKey)
+												if err == nil {
+													filename = decryptedFilename
+												}
+											}
+
+											// If we have uuid and filename, handle duplicate resolution for ZIP export
+											if includeFiles && uuid != "" && filename != "" {
+												// Check if we already processed this UUID (e.g. same file in multiple days?)
+												// If yes, reuse the assigned filename
+												targetName, exists := filesToExport[uuid]
+												if !exists {
+													targetName = filename
+													if usedFilenames[targetName] {
+														// Collision
+														ext := filepath.Ext(filename)
+														nameNoExt := strings.TrimSuffix(filename, ext)
+														counter := 2
+														for {
+															newName := fmt.Sprintf("%s (%d)%s", nameNoExt, counter, ext)
+															if !usedFilenames[newName] {
+																targetName = newName
+																break
+															}
+															counter++
 														}
-														counter++
 													}
+													usedFilenames[targetName] = true
+													filesToExport[uuid] = targetName
 												}
-												usedFilenames[targetName] = true
-												filesToExport[uuid] = targetName
+												filename = targetName
 											}
-											filename = targetName
-										}
 
-										// Only keep filename in decrypted JSON
-										newFileMap := map[string]any{
-											"filename": filename,
+											// Only keep filename in decrypted JSON
+											newFileMap := map[string]any{
+												"filename": filename,
+											}
+											newFiles = append(newFiles, newFileMap)
 										}
-										newFiles = append(newFiles, newFileMap)
 									}
+									part["files"] = newFiles
 								}
-								day["files"] = newFiles
+							} else {
+								delete(part, "files")
 							}
-						} else {
-							delete(day, "files")
 						}
 					}
 
@@ -450,29 +511,31 @@ func performBackup(w http.ResponseWriter, userID int, derivedKey string, req Bac
 	// 5. Export Files
 	if includeFiles {
 		for uuid, targetName := range filesToExport {
-			filePath := filepath.Join(utils.Settings.DataPath, fmt.Sprintf("%d", userID), "files", uuid)
-			if _, err := os.Stat(filePath); err == nil {
-				rawContent, errRead := os.ReadFile(filePath)
-				if errRead == nil {
-					var contentToWrite []byte
-					if req.Encrypted {
-						contentToWrite = rawContent
-					} else {
-						decrypted, errDec := utils.DecryptFile(rawContent, encKey)
-						if errDec == nil {
-							contentToWrite = decrypted
-						} else {
-							utils.Logger.Printf("Error decrypting file %s: %v", uuid, errDec)
-							continue
-						}
-					}
+			var content io.ReadCloser
+			if req.Encrypted {
+				rawContent, errRead := utils.ReadFile(userID, uuid)
+				if errRead != nil {
+					continue
+				}
+				content = io.NopCloser(bytes.NewReader(rawContent))
+			} else {
+				decrypted, _, errDec := utils.OpenDecryptedFile(userID, uuid, encKey)
+				if errDec != nil {
+					utils.Logger.Printf("Error decrypting file %s: %v", uuid, errDec)
+					continue
+				}
+				content = decrypted
+			}
 
-					f, err := zw.Create(fmt.Sprintf("files/%s", targetName))
-					if err == nil {
-						f.Write(contentToWrite)
-					}
+			f, err := zw.Create(fmt.Sprintf("files/%s", targetName))
+			if err == nil {
+				if _, err := io.Copy(f, content); err != nil {
+					utils.Logger.Printf("Error writing file %s to backup: %v", uuid, err)
 				}
 			}
+			content.Close()
 		}
 	}
+
+	return zw.Close()
 }
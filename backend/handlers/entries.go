@@ -0,0 +1,472 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"html"
+	"net/http"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/phitux/dailytxt/backend/utils"
+)
+
+// decryptFileList returns the file entries of a list with their decrypted filenames
+func decryptFileList(list any, encKey string) ([]any, error) {
+	files := []any{}
+	filesList, _ := list.([]any)
+	for _, fileInterface := range filesList {
+		file, ok := fileInterface.(map[string]any)
+		if !ok {
+			continue
+		}
+
+		if encFilename, ok := file["enc_filename"].(string); ok {
+			decryptedFilename, err := utils.DecryptText(encFilename, encKey)
+			if err != nil {
+				return nil, fmt.Errorf("error decrypting filename: %v", err)
+			}
+			fileCopy := make(map[string]any)
+			for k, v := range file {
+				fileCopy[k] = v
+			}
+			fileCopy["filename"] = decryptedFilename
+			files = append(files, fileCopy)
+		}
+	}
+	return files, nil
+}
+
+// decryptEntries returns the entries of a day decrypted, in their order
+func decryptEntries(day map[string]any, encKey string) ([]map[string]any, error) {
+	result := []map[string]any{}
+	for _, entry := range utils.DayEntries(day) {
+		decrypted, err := decryptEntry(entry, encKey)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, decrypted)
+	}
+	return result, nil
+}
+
+// decryptEntry returns an entry (or the main text of a day) decrypted
+func decryptEntry(entry map[string]any, encKey string) (map[string]any, error) {
+	decrypted := map[string]any{
+		"id":                entry["id"],
+		"time":              "",
+		"text":              "",
+		"date_written":      "",
+		"tags":              []any{},
+		"revision":          getDayRevision(entry),
+		"history_available": len(toAnySlice(entry["history"])) > 0,
+	}
+	for _, field := range []string{"time", "text", "date_written"} {
+		if encrypted, ok := entry[field].(string); ok && encrypted != "" {
+			value, err := utils.DecryptText(encrypted, encKey)
+			if err != nil {
+				return nil, fmt.Errorf("error decrypting %s of entry: %v", field, err)
+			}
+			decrypted[field] = value
+		}
+	}
+	if tags, ok := entry["tags"].([]any); ok {
+		decrypted["tags"] = tags
+	}
+	files, err := decryptFileList(entry["files"], encKey)
+	if err != nil {
+		return nil, err
+	}
+	decrypted["files"] = files
+	if restoredFrom, ok := entry["restored_from"]; ok {
+		decrypted["restored_from"] = restoredFrom
+	}
+	return decrypted, nil
+}
+
+// readingEntries returns everything written on a day as entries, ordered by time: the main text of the day is
+// the entry utils.MainEntryID with the time of its date_written, among the further entries. Without a time it
+// comes first, so does it on the same time as an entry (like the day in the export and the search).
+// A day without main text, files and tags only has its further entries.
+func readingEntries(day map[string]any, encKey string) ([]map[string]any, error) {
+	entries, err := decryptEntries(day, encKey)
+	if err != nil {
+		return nil, err
+	}
+
+	text, _ := day["text"].(string)
+	if text == "" && len(toAnySlice(day["files"])) == 0 && len(toAnySlice(day["tags"])) == 0 {
+		return entries, nil
+	}
+	main, err := decryptEntry(day, encKey)
+	if err != nil {
+		return nil, err
+	}
+	main["id"] = utils.MainEntryID
+	mainTime := utils.MainEntryTime(main["date_written"].(string))
+	main["time"] = mainTime
+
+	// The entries are ordered by time already, entries without a time last
+	position := 0
+	if mainTime != "" {
+		for position < len(entries) {
+			entryTime, _ := entries[position]["time"].(string)
+			if entryTime == "" || entryTime >= mainTime {
+				break
+			}
+			position++
+		}
+	}
+	return slices.Insert(entries, position, main), nil
+}
+
+// parseEntryTime checks the time of an entry ("15:04")
+func parseEntryTime(value string) (string, error) {
+	t, err := time.Parse(utils.EntryTimeLayout, value)
+	if err != nil {
+		return "", fmt.Errorf("invalid time %q, expected HH:MM", value)
+	}
+	return t.Format(utils.EntryTimeLayout), nil
+}
+
+// GetEntries returns everything written on a day, the main text included (see readingEntries).
+// This is the view of a day for reading, GetLog returns the day for the editor.
+func GetEntries(w http.ResponseWriter, r *http.Request) {
+	// Get user ID and derived key from context
+	userID, ok := r.Context().Value(utils.UserIDKey).(int)
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	derivedKey, ok := r.Context().Value(utils.DerivedKeyKey).(string)
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	// Get parameters from URL
+	year, err := strconv.Atoi(r.URL.Query().Get("year"))
+	if err != nil {
+		http.Error(w, "Invalid year parameter", http.StatusBadRequest)
+		return
+	}
+	month, err := strconv.Atoi(r.URL.Query().Get("month"))
+	if err != nil {
+		http.Error(w, "Invalid month parameter", http.StatusBadRequest)
+		return
+	}
+	dayValue, err := strconv.Atoi(r.URL.Query().Get("day"))
+	if err != nil {
+		http.Error(w, "Invalid day parameter", http.StatusBadRequest)
+		return
+	}
+
+	// Get month data
+	content, err := utils.GetMonth(userID, year, month)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error retrieving month data: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	day := findDay(content, dayValue)
+	if day == nil {
+		utils.JSONResponse(w, http.StatusOK, map[string]any{"entries": []any{}})
+		return
+	}
+
+	// Get encryption key
+	encKey, err := utils.GetEncryptionKey(userID, derivedKey)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error getting encryption key: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	entries, err := readingEntries(day, encKey)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	utils.JSONResponse(w, http.StatusOK, map[string]any{
+		"entries": entries,
+	})
+}
+
+// EntryRequest represents the request body to create, update or delete an entry of a day
+type EntryRequest struct {
+	Day         int    `json:"day"`
+	Month       int    `json:"month"`
+	Year        int    `json:"year"`
+	ID          string `json:"id"`
+	Time        string `json:"time"`
+	Text        string `json:"text"`
+	DateWritten string `json:"date_written"`
+}
+
+// CreateEntry adds an entry to a day, the day is created if it doesn't exist yet
+func CreateEntry(w http.ResponseWriter, r *http.Request) {
+	// Get user ID and derived key from context
+	userID, ok := r.Context().Value(utils.UserIDKey).(int)
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	derivedKey, ok := r.Context().Value(utils.DerivedKeyKey).(string)
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	// Parse request body
+	var req EntryRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	entryTime, err := parseEntryTime(req.Time)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// Get encryption key
+	encKey, err := utils.GetEncryptionKey(userID, derivedKey)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error getting encryption key: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	id, err := utils.GenerateUUID()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error generating entry id: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	entry := map[string]any{
+		"id":       id,
+		"revision": 1,
+	}
+	for field, value := range map[string]string{
+		"time":         entryTime,
+		"text":         req.Text,
+		"date_written": html.EscapeString(req.DateWritten),
+	} {
+		encrypted, err := utils.EncryptText(value, encKey)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Error encrypting %s: %v", field, err), http.StatusInternalServerError)
+			return
+		}
+		entry[field] = encrypted
+	}
+	if entry["saved_at"], err = utils.EncryptSavedAt(time.Now(), encKey); err != nil {
+		http.Error(w, fmt.Sprintf("Error encrypting saved_at: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	// Lock the month while it is read, modified and written
+	defer utils.LockMonth(userID, req.Year, req.Month)()
+
+	// Get month data
+	content, err := utils.GetMonth(userID, req.Year, req.Month)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error retrieving month data: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	day := findDay(content, req.Day)
+	if day == nil {
+		day = map[string]any{"day": req.Day}
+		days, _ := content["days"].([]any)
+		content["days"] = append(days, day)
+	}
+	utils.SetDayEntries(day, append(utils.DayEntries(day), entry))
+	utils.SortDayEntries(day, encKey)
+
+	if err := utils.WriteMonth(userID, req.Year, req.Month, content); err != nil {
+		http.Error(w, fmt.Sprintf("Error writing month data: %v", err), http.StatusInternalServerError)
+		return
+	}
+	updateSearchIndex(r, req.Year, req.Month, content, req.Day)
+
+	w.Header().Set("ETag", revisionETag(1))
+	utils.JSONResponse(w, http.StatusOK, map[string]any{
+		"success":  true,
+		"id":       id,
+		"time":     entryTime,
+		"revision": 1,
+	})
+}
+
+// UpdateEntry saves the text (and optionally a new time) of an entry. Like SaveLog, the previous
+// text moves to the history of the entry and an If-Match header with an outdated revision is rejected.
+func UpdateEntry(w http.ResponseWriter, r *http.Request) {
+	// Get user ID and derived key from context
+	userID, ok := r.Context().Value(utils.UserIDKey).(int)
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	derivedKey, ok := r.Context().Value(utils.DerivedKeyKey).(string)
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	// Parse request body
+	var req EntryRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.ID == "" {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	entryTime := ""
+	if req.Time != "" {
+		var err error
+		if entryTime, err = parseEntryTime(req.Time); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	// Get encryption key
+	encKey, err := utils.GetEncryptionKey(userID, derivedKey)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error getting encryption key: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	// Lock the month while it is read, modified and written
+	defer utils.LockMonth(userID, req.Year, req.Month)()
+
+	// Get month data
+	content, err := utils.GetMonth(userID, req.Year, req.Month)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error retrieving month data: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	var entry map[string]any
+	day := findDay(content, req.Day)
+	if day != nil {
+		entry = utils.FindDayEntry(day, req.ID)
+	}
+	if entry == nil {
+		http.Error(w, "Entry not found", http.StatusNotFound)
+		return
+	}
+	if req.ID == utils.MainEntryID && entryTime != "" {
+		http.Error(w, "The main text has no time of its own", http.StatusBadRequest)
+		return
+	}
+
+	// Reject the save if the client edited an outdated revision
+	revision := getDayRevision(entry)
+	if ifMatch := r.Header.Get("If-Match"); ifMatch != "" && !matchesRevision(ifMatch, revision) {
+		revisionConflict(w, entry, encKey, revision)
+		return
+	}
+	revision++
+
+	encryptedText, err := utils.EncryptText(req.Text, encKey)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error encrypting text: %v", err), http.StatusInternalServerError)
+		return
+	}
+	encryptedDateWritten, err := utils.EncryptText(html.EscapeString(req.DateWritten), encKey)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error encrypting date_written: %v", err), http.StatusInternalServerError)
+		return
+	}
+	encryptedSavedAt, err := utils.EncryptSavedAt(time.Now(), encKey)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error encrypting saved_at: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	historyAvailable := addToHistory(entry) > 0 || len(toAnySlice(entry["history"])) > 0
+	entry["text"] = encryptedText
+	entry["date_written"] = encryptedDateWritten
+	entry["saved_at"] = encryptedSavedAt
+	entry["revision"] = revision
+	if entryTime != "" {
+		encryptedTime, err := utils.EncryptText(entryTime, encKey)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Error encrypting time: %v", err), http.StatusInternalServerError)
+			return
+		}
+		entry["time"] = encryptedTime
+		utils.SortDayEntries(day, encKey)
+	}
+
+	if err := utils.WriteMonth(userID, req.Year, req.Month, content); err != nil {
+		http.Error(w, fmt.Sprintf("Error writing month data: %v", err), http.StatusInternalServerError)
+		return
+	}
+	updateSearchIndex(r, req.Year, req.Month, content, req.Day)
+
+	// Autosave fills the history quickly, thin it out now and then
+	compactHistory(userID, encKey, false)
+
+	w.Header().Set("ETag", revisionETag(revision))
+	utils.JSONResponse(w, http.StatusOK, map[string]any{
+		"success":           true,
+		"history_available": historyAvailable,
+		"revision":          revision,
+	})
+}
+
+// DeleteEntry moves an entry of a day (with its files) to the trash
+func DeleteEntry(w http.ResponseWriter, r *http.Request) {
+	// Get user ID from context
+	userID, ok := r.Context().Value(utils.UserIDKey).(int)
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	// Parse request body
+	var req EntryRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.ID == "" {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	// Lock the month while it is read, modified and written
+	defer utils.LockMonth(userID, req.Year, req.Month)()
+
+	// Get month data
+	content, err := utils.GetMonth(userID, req.Year, req.Month)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error retrieving month data: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	var entry map[string]any
+	day := findDay(content, req.Day)
+	if day != nil {
+		entry = utils.RemoveDayEntry(day, req.ID)
+	}
+	if entry == nil {
+		http.Error(w, "Entry not found", http.StatusNotFound)
+		return
+	}
+
+	// Keep the entry in the trash, so it can be restored
+	trashID, err := utils.MoveToTrash(userID, utils.TrashEntry, req.Year, req.Month, req.Day, entry, time.Now())
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error moving entry to trash: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	if err := utils.WriteMonth(userID, req.Year, req.Month, content); err != nil {
+		// The entry is still part of the day, so it must not be in the trash as well
+		if _, err := utils.RemoveFromTrash(userID, trashID); err != nil {
+			utils.Logger.Printf("Warning: Failed to remove entry from trash for user %d: %v", userID, err)
+		}
+		http.Error(w, fmt.Sprintf("Error writing month data: %v", err), http.StatusInternalServerError)
+		return
+	}
+	updateSearchIndex(r, req.Year, req.Month, content, req.Day)
+
+	utils.JSONResponse(w, http.StatusOK, map[string]bool{"success": true})
+}
@@ -0,0 +1,97 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+)
+
+// The main text is listed among the entries at the time it was written
+func TestMainTextIsEntry(t *testing.T) {
+	user := newTestUser(t)
+	user.mustDo(t, SaveLog, "POST", "/logs/saveLog", LogRequest{Day: 3, Month: 5, Year: 2024, Text: "main text", DateWritten: "03.05.2024, 15:30"})
+	user.mustDo(t, CreateEntry, "POST", "/logs/createEntry", EntryRequest{Day: 3, Month: 5, Year: 2024, Time: "20:00", Text: "evening"})
+	user.mustDo(t, CreateEntry, "POST", "/logs/createEntry", EntryRequest{Day: 3, Month: 5, Year: 2024, Time: "08:00", Text: "morning"})
+
+	checkEntries := func(what string, entries []any) {
+		t.Helper()
+		if len(entries) != 3 {
+			t.Fatalf("%s: entries = %v, want the main text and two entries", what, entries)
+		}
+		if entry := entries[0].(map[string]any); entry["text"] != "morning" || entry["time"] != "08:00" {
+			t.Errorf("%s: first entry = %v, want the morning", what, entry)
+		}
+		main := entries[1].(map[string]any)
+		if main["id"] != "main" || main["text"] != "main text" || main["time"] != "15:30" {
+			t.Errorf("%s: second entry = %v, want the main text", what, main)
+		}
+		if entry := entries[2].(map[string]any); entry["text"] != "evening" || entry["time"] != "20:00" {
+			t.Errorf("%s: third entry = %v, want the evening", what, entry)
+		}
+	}
+
+	result := user.mustDo(t, GetEntries, "GET", "/logs/getEntries?day=3&month=5&year=2024", nil)
+	checkEntries("getEntries", result["entries"].([]any))
+
+	w := user.do(LoadMonthForReading, "GET", "/logs/loadMonthForReading?month=5&year=2024", nil)
+	var days []map[string]any
+	if w.Code != http.StatusOK || json.Unmarshal(w.Body.Bytes(), &days) != nil || len(days) != 1 {
+		t.Fatalf("loadMonthForReading = %d %s", w.Code, w.Body.String())
+	}
+	if days[0]["text"] != "main text" {
+		t.Errorf("loadMonthForReading lost the text of the day: %v", days[0])
+	}
+	checkEntries("loadMonthForReading", days[0]["entries"].([]any))
+
+	// The main entry can be edited like an entry, but it has no time of its own
+	user.mustDo(t, UpdateEntry, "POST", "/logs/updateEntry", EntryRequest{Day: 3, Month: 5, Year: 2024, ID: "main", Text: "edited", DateWritten: "03.05.2024, 16:00"})
+	log := user.mustDo(t, GetLog, "GET", "/logs/getLog?day=3&month=5&year=2024", nil)
+	if log["text"] != "edited" {
+		t.Errorf("text of the day after updating the main entry = %v", log["text"])
+	}
+	w = user.do(UpdateEntry, "POST", "/logs/updateEntry", EntryRequest{Day: 3, Month: 5, Year: 2024, ID: "main", Time: "09:00", Text: "edited"})
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("update of the main entry with a time: status %d, want %d", w.Code, http.StatusBadRequest)
+	}
+}
+
+func TestEntriesWithoutMainText(t *testing.T) {
+	user := newTestUser(t)
+	user.mustDo(t, CreateEntry, "POST", "/logs/createEntry", EntryRequest{Day: 3, Month: 5, Year: 2024, Time: "08:00", Text: "morning"})
+
+	result := user.mustDo(t, GetEntries, "GET", "/logs/getEntries?day=3&month=5&year=2024", nil)
+	entries := result["entries"].([]any)
+	if len(entries) != 1 || entries[0].(map[string]any)["id"] == "main" {
+		t.Errorf("entries = %v, want only the entry", entries)
+	}
+}
+
+// Without a time, the main text comes first, so does it on the time of an entry. GetLog lists the further entries only.
+func TestMainEntryOrder(t *testing.T) {
+	user := newTestUser(t)
+	user.mustDo(t, SaveLog, "POST", "/logs/saveLog", LogRequest{Day: 3, Month: 5, Year: 2024, Text: "main text"})
+	user.mustDo(t, CreateEntry, "POST", "/logs/createEntry", EntryRequest{Day: 3, Month: 5, Year: 2024, Time: "08:00", Text: "morning"})
+
+	firstID := func(what string) any {
+		t.Helper()
+		entries := user.mustDo(t, GetEntries, "GET", "/logs/getEntries?day=3&month=5&year=2024", nil)["entries"].([]any)
+		if len(entries) != 2 {
+			t.Fatalf("%s: entries = %v, want the main text and the entry", what, entries)
+		}
+		return entries[0].(map[string]any)["id"]
+	}
+	if id := firstID("without date_written"); id != "main" {
+		t.Errorf("without date_written: first entry %v, want main", id)
+	}
+
+	user.mustDo(t, UpdateEntry, "POST", "/logs/updateEntry", EntryRequest{Day: 3, Month: 5, Year: 2024, ID: "main", Text: "main text", DateWritten: "5/3/2024, 8:00 AM"})
+	if id := firstID("same time"); id != "main" {
+		t.Errorf("same time: first entry %v, want main", id)
+	}
+
+	log := user.mustDo(t, GetLog, "GET", "/logs/getLog?day=3&month=5&year=2024", nil)
+	entries := log["entries"].([]any)
+	if len(entries) != 1 || entries[0].(map[string]any)["text"] != "morning" {
+		t.Errorf("getLog entries = %v, want only the further entry", entries)
+	}
+}
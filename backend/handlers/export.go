@@ -27,10 +27,19 @@ type LogEntry struct {
 	Day         int
 	Text        string
 	DateWritten string
+	Time        string // Time of a further entry of the day, empty for the day itself
 	Files       []string
 	Tags        []int
 }
 
+// sortTime returns the time an entry is sorted by, for the day itself the time of its date_written
+func (e LogEntry) sortTime() string {
+	if e.Time == "" {
+		return utils.MainEntryTime(e.DateWritten)
+	}
+	return e.Time
+}
+
 type TranslationData struct {
 	Weekdays        []string `json:"weekdays"`
 	DateFormat      string   `json:"dateFormat"`
@@ -237,111 +246,117 @@ func ExportData(w http.ResponseWriter, r *http.Request) {
 					continue
 				}
 
-				entry := LogEntry{
-					Year:  year,
-					Month: month,
-					Day:   dayInt,
-				}
-
-				// Decrypt text and date_written
-				if text, ok := day["text"].(string); ok && text != "" {
-					decryptedText, err := utils.DecryptText(text, encKey)
-					if err != nil {
-						utils.Logger.Printf("Error decrypting text for %d-%d-%d: %v", year, month, dayInt, err)
-						continue
+				// The day itself and each of its entries become an entry of the export
+				for _, part := range utils.DayParts(day) {
+					entry := LogEntry{
+						Year:  year,
+						Month: month,
+						Day:   dayInt,
 					}
-					entry.Text = decryptedText
 
-					if dateWritten, ok := day["date_written"].(string); ok && dateWritten != "" {
-						decryptedDate, err := utils.DecryptText(dateWritten, encKey)
-						if err == nil {
-							entry.DateWritten = decryptedDate
+					// The further entries of a day are exported with their time
+					if encryptedTime, ok := part["time"].(string); ok && encryptedTime != "" {
+						if decryptedTime, err := utils.DecryptText(encryptedTime, encKey); err == nil {
+							entry.Time = decryptedTime
 						}
 					}
-				}
-
-				// Process files
-				if filesList, ok := day["files"].([]any); ok && len(filesList) > 0 {
-					for _, fileInterface := range filesList {
-						file, ok := fileInterface.(map[string]any)
-						if !ok {
-							continue
-						}
-
-						fileID, ok := file["uuid_filename"].(string)
-						if !ok {
-							continue
-						}
-
-						encFilename, ok := file["enc_filename"].(string)
-						if !ok {
-							continue
-						}
-
-						// Decrypt filename
-						decryptedFilename, err := utils.DecryptText(encFilename, encKey)
-						if err != nil {
-							utils.Logger.Printf("Error decrypting filename %s: %v", fileID, err)
-							continue
-						}
-
-						// Read and decrypt file content
-						fileContent, err := utils.ReadFile(userID, fileID)
-						if err != nil {
-							utils.Logger.Printf("Error reading file %s: %v", fileID, err)
-							continue
-						}
 
-						decryptedContent, err := utils.DecryptFile(fileContent, encKey)
+					// Decrypt text and date_written
+					if text, ok := part["text"].(string); ok && text != "" {
+						decryptedText, err := utils.DecryptText(text, encKey)
 						if err != nil {
-							utils.Logger.Printf("Error decrypting file %s: %v", fileID, err)
+							utils.Logger.Printf("Error decrypting text for %d-%d-%d: %v", year, month, dayInt, err)
 							continue
 						}
+						entry.Text = decryptedText
 
-						// Create unique filename to avoid conflicts in ZIP
-						dayKey := fmt.Sprintf("%d-%02d-%02d", year, month, dayInt)
-						if usedFilenamesPerDay[dayKey] == nil {
-							usedFilenamesPerDay[dayKey] = make(map[string]bool)
+						if dateWritten, ok := part["date_written"].(string); ok && dateWritten != "" {
+							decryptedDate, err := utils.DecryptText(dateWritten, encKey)
+							if err == nil {
+								entry.DateWritten = decryptedDate
+							}
 						}
-						uniqueFilename := generateUniqueFilename(usedFilenamesPerDay[dayKey], decryptedFilename)
+					}
 
-						// Add file to ZIP with unique filename
-						filePath := fmt.Sprintf("files/%d-%02d-%02d/%s", year, month, dayInt, uniqueFilename)
-						fileWriter, err := zipWriter.Create(filePath)
-						if err != nil {
-							utils.Logger.Printf("Error creating file in ZIP %s: %v", filePath, err)
-							continue
+					// Process files
+					if filesList, ok := part["files"].([]any); ok && len(filesList) > 0 {
+						for _, fileInterface := range filesList {
+							file, ok := fileInterface.(map[string]any)
+							if !ok {
+								continue
+							}
+
+							fileID, ok := file["uuid_filename"].(string)
+							if !ok {
+								continue
+							}
+
+							encFilename, ok := file["enc_filename"].(string)
+							if !ok {
+								continue
+							}
+
+							// Decrypt filename
+							decryptedFilename, err := utils.DecryptText(encFilename, encKey)
+							if err != nil {
+								utils.Logger.Printf("Error decrypting filename %s: %v", fileID, err)
+								continue
+							}
+
+							// Open file, it is decrypted while it is written into the ZIP
+							fileContent, _, err := utils.OpenDecryptedFile(userID, fileID, encKey)
+							if err != nil {
+								utils.Logger.Printf("Error reading file %s: %v", fileID, err)
+								continue
+							}
+
+							// Create unique filename to avoid conflicts in ZIP
+							dayKey := fmt.Sprintf("%d-%02d-%02d", year, month, dayInt)
+							if usedFilenamesPerDay[dayKey] == nil {
+								usedFilenamesPerDay[dayKey] = make(map[string]bool)
+							}
+							uniqueFilename := generateUniqueFilename(usedFilenamesPerDay[dayKey], decryptedFilename)
+
+							// Add file to ZIP with unique filename
+							filePath := fmt.Sprintf("files/%d-%02d-%02d/%s", year, month, dayInt, uniqueFilename)
+							fileWriter, err := zipWriter.Create(filePath)
+							if err != nil {
+								utils.Logger.Printf("Error creating file in ZIP %s: %v", filePath, err)
+								fileContent.Close()
+								continue
+							}
+
+							_, err = io.Copy(fileWriter, fileContent)
+							fileContent.Close()
+							if err != nil {
+								utils.Logger.Printf("Error writing file to ZIP %s: %v", filePath, err)
+								continue
+							}
+
+							entry.Files = append(entry.Files, uniqueFilename)
 						}
-
-						_, err = fileWriter.Write(decryptedContent)
-						if err != nil {
-							utils.Logger.Printf("Error writing file to ZIP %s: %v", filePath, err)
-							continue
-						}
-
-						entry.Files = append(entry.Files, uniqueFilename)
 					}
-				}
 
-				// Add tags
-				if tags, ok := day["tags"].([]any); ok && len(tags) > 0 {
-					for _, tag := range tags {
-						if tagID, ok := tag.(float64); ok {
-							entry.Tags = append(entry.Tags, int(tagID))
+					// Add tags
+					if tags, ok := part["tags"].([]any); ok && len(tags) > 0 {
+						for _, tag := range tags {
+							if tagID, ok := tag.(float64); ok {
+								entry.Tags = append(entry.Tags, int(tagID))
+							}
 						}
 					}
-				}
 
-				// Add entry if it has content
-				if entry.Text != "" || len(entry.Files) > 0 || len(entry.Tags) > 0 {
-					allEntries = append(allEntries, entry)
+					// Add entry if it has content
+					if entry.Text != "" || len(entry.Files) > 0 || len(entry.Tags) > 0 {
+						allEntries = append(allEntries, entry)
 
-					// Add to yearly collections
-					yearlyEntries[year] = append(yearlyEntries[year], entry)
+						// Add to yearly collections
+						yearlyEntries[year] = append(yearlyEntries[year], entry)
 
-					// Add to monthly collections
-					monthKey := fmt.Sprintf("%d-%02d", year, month)
-					monthlyEntries[monthKey] = append(monthlyEntries[monthKey], entry)
+						// Add to monthly collections
+						monthKey := fmt.Sprintf("%d-%02d", year, month)
+						monthlyEntries[monthKey] = append(monthlyEntries[monthKey], entry)
+					}
 				}
 			}
 		}
@@ -428,15 +443,22 @@ func generateHTML(entries []LogEntry, userID int, derivedKey string, includeTags
 		}
 	}
 
-	// Sort entries by date (year, month, day)
-	sort.Slice(entries, func(i, j int) bool {
+	// Sort entries by date (year, month, day), then by time. The day itself is sorted by the time of its
+	// date_written, before a further entry of the same time.
+	sort.SliceStable(entries, func(i, j int) bool {
 		if entries[i].Year != entries[j].Year {
 			return entries[i].Year < entries[j].Year
 		}
 		if entries[i].Month != entries[j].Month {
 			return entries[i].Month < entries[j].Month
 		}
-		return entries[i].Day < entries[j].Day
+		if entries[i].Day != entries[j].Day {
+			return entries[i].Day < entries[j].Day
+		}
+		if entries[i].sortTime() != entries[j].sortTime() {
+			return entries[i].sortTime() < entries[j].sortTime()
+		}
+		return entries[i].Time == "" && entries[j].Time != ""
 	})
 
 	var html strings.Builder
@@ -819,6 +841,9 @@ func generateHTML(entries []LogEntry, userID int, derivedKey string, includeTags
 		dateStr = strings.ReplaceAll(dateStr, "%D", fmt.Sprintf("%02d", entry.Day))   // day with leading zero
 		dateStr = strings.ReplaceAll(dateStr, "%M", fmt.Sprintf("%02d", entry.Month)) // month with leading zero
 		dateStr = strings.ReplaceAll(dateStr, "%Y", fmt.Sprintf("%d", entry.Year))    // year
+		if entry.Time != "" {
+			dateStr += " – " + entry.Time
+		}
 		html.WriteString(fmt.Sprintf(`        <div class="entry-date">%s</div>
 `, htmlpkg.EscapeString(dateStr)))
 
@@ -3,10 +3,10 @@ package handlers
 import (
 	"encoding/json"
 	"fmt"
-	"io"
 	"net/http"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/phitux/dailytxt/backend/utils"
 )
@@ -71,6 +71,9 @@ func UploadFile(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Optional entry of the day the file belongs to
+	entryID := r.FormValue("entry_id")
+
 	// Get file
 	file, header, err := r.FormFile("file")
 	if err != nil {
@@ -79,42 +82,21 @@ func UploadFile(w http.ResponseWriter, r *http.Request) {
 	}
 	defer file.Close()
 
-	// Get encryption key first (before reading large file)
+	// Get encryption key
 	encKey, err := utils.GetEncryptionKey(userID, derivedKey)
 	if err != nil {
 		http.Error(w, fmt.Sprintf("Error getting encryption key: %v", err), http.StatusInternalServerError)
 		return
 	}
 
-	// Read file into a buffer (more memory efficient)
-	fileBytes, err := io.ReadAll(file)
-	if err != nil {
-		http.Error(w, fmt.Sprintf("Error reading file: %v", err), http.StatusInternalServerError)
-		return
-	}
-	// Ensure fileBytes is cleared when function exits
-	defer func() { fileBytes = nil }()
-
-	// Encrypt file
-	encryptedFile, err := utils.EncryptFile(fileBytes, encKey)
-	if err != nil {
-		http.Error(w, fmt.Sprintf("Error encrypting file: %v", err), http.StatusInternalServerError)
-		return
-	}
-	// Ensure encryptedFile is cleared when function exits
-	defer func() { encryptedFile = nil }()
-
-	// Clear original file data from memory immediately after encryption
-	fileBytes = nil
-
-	// Write file
-	if err := utils.WriteFile(encryptedFile, userID, uuid); err != nil {
+	// Encrypt and write the file chunk by chunk
+	if err := utils.WriteEncryptedFile(file, header.Size, userID, uuid, encKey); err != nil {
 		http.Error(w, fmt.Sprintf("Error writing file: %v", err), http.StatusInternalServerError)
 		return
 	}
 
-	// Clear encrypted data from memory immediately after writing
-	encryptedFile = nil
+	// Lock the month while it is read, modified and written
+	defer utils.LockMonth(userID, year, month)()
 
 	// Get month data
 	content, err := utils.GetMonth(userID, year, month)
@@ -137,47 +119,62 @@ func UploadFile(w http.ResponseWriter, r *http.Request) {
 		"size":          header.Size,
 	}
 
-	// Add file to day
-	days, ok := content["days"].([]any)
-	if !ok {
-		days = []any{}
-	}
-
-	dayFound := false
-	for i, dayInterface := range days {
-		dayObj, ok := dayInterface.(map[string]any)
+	if entryID != "" {
+		// Add file to the entry
+		var entry map[string]any
+		if dayObj := findDay(content, day); dayObj != nil {
+			entry = utils.FindDayEntry(dayObj, entryID)
+		}
+		if entry == nil {
+			utils.RemoveFile(userID, uuid)
+			http.Error(w, "Entry not found", http.StatusNotFound)
+			return
+		}
+		files, _ := entry["files"].([]any)
+		entry["files"] = append(files, newFile)
+	} else {
+		// Add file to day
+		days, ok := content["days"].([]any)
 		if !ok {
-			continue
+			days = []any{}
 		}
 
-		dayNum, ok := dayObj["day"].(float64)
-		if !ok || int(dayNum) != day {
-			continue
+		dayFound := false
+		for i, dayInterface := range days {
+			dayObj, ok := dayInterface.(map[string]any)
+			if !ok {
+				continue
+			}
+
+			dayNum, ok := dayObj["day"].(float64)
+			if !ok || int(dayNum) != day {
+				continue
+			}
+
+			// Add file to existing day
+			dayFound = true
+			files, ok := dayObj["files"].([]any)
+			if !ok {
+				files = []any{}
+			}
+			files = append(files, newFile)
+			dayObj["files"] = files
+			days[i] = dayObj
+			break
 		}
 
-		// Add file to existing day
-		dayFound = true
-		files, ok := dayObj["files"].([]any)
-		if !ok {
-			files = []any{}
+		if !dayFound {
+			// Create new day with file
+			days = append(days, map[string]any{
+				"day":   day,
+				"files": []any{newFile},
+			})
 		}
-		files = append(files, newFile)
-		dayObj["files"] = files
-		days[i] = dayObj
-		break
-	}
 
-	if !dayFound {
-		// Create new day with file
-		days = append(days, map[string]any{
-			"day":   day,
-			"files": []any{newFile},
-		})
+		// Update days array
+		content["days"] = days
 	}
 
-	// Update days array
-	content["days"] = days
-
 	// Write month data
 	if err := utils.WriteMonth(userID, year, month, content); err != nil {
 		// Cleanup on error
@@ -185,6 +182,7 @@ func UploadFile(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, fmt.Sprintf("Error writing month data: %v", err), http.StatusInternalServerError)
 		return
 	}
+	updateSearchIndex(r, year, month, content, day)
 
 	// Return success
 	utils.JSONResponse(w, http.StatusOK, map[string]bool{
@@ -220,36 +218,21 @@ func DownloadFile(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Read file
-	encryptedFile, err := utils.ReadFile(userID, uuid)
+	// Open file, it is decrypted while it is sent
+	file, _, err := utils.OpenDecryptedFile(userID, uuid, encKey)
 	if err != nil {
 		http.Error(w, fmt.Sprintf("Error reading file: %v", err), http.StatusInternalServerError)
 		return
 	}
-	// Ensure encryptedFile is cleared when function exits
-	defer func() { encryptedFile = nil }()
-
-	// Decrypt file
-	decryptedFile, err := utils.DecryptFile(encryptedFile, encKey)
-	if err != nil {
-		http.Error(w, fmt.Sprintf("Error decrypting file: %v", err), http.StatusInternalServerError)
-		return
-	}
-	// Ensure decryptedFile is cleared when function exits
-	defer func() { decryptedFile = nil }()
-
-	// Clear encrypted data from memory immediately after decryption
-	encryptedFile = nil
+	defer file.Close()
 
 	// Set response headers for streaming
 	w.Header().Set("Content-Type", "application/octet-stream")
 	w.Header().Set("Content-Disposition", "attachment")
 
-	// Write file to response
-	if _, err := w.Write(decryptedFile); err != nil {
-		http.Error(w, fmt.Sprintf("Error writing response: %v", err), http.StatusInternalServerError)
-		return
-	}
+	// Write file to response. Range requests (e.g. for seeking in audio and video)
+	// are answered with 206 and only the chunks holding the range are decrypted.
+	http.ServeContent(w, r, "", time.Time{}, file)
 }
 
 // DeleteFile handles deleting a file
@@ -301,6 +284,9 @@ func DeleteFile(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Lock the month while it is read, modified and written
+	defer utils.LockMonth(userID, year, month)()
+
 	// Get month data
 	content, err := utils.GetMonth(userID, year, month)
 	if err != nil {
@@ -317,7 +303,8 @@ func DeleteFile(w http.ResponseWriter, r *http.Request) {
 
 	// Find day and file
 	fileFound := false
-	for i, dayInterface := range days {
+	trashID := ""
+	for _, dayInterface := range days {
 		dayObj, ok := dayInterface.(map[string]any)
 		if !ok {
 			continue
@@ -328,35 +315,41 @@ func DeleteFile(w http.ResponseWriter, r *http.Request) {
 			continue
 		}
 
-		// Check for files
-		files, ok := dayObj["files"].([]any)
-		if !ok {
-			continue
-		}
-
-		// Find file
-		for j, fileInterface := range files {
-			file, ok := fileInterface.(map[string]any)
+		// The file belongs to the day itself or to one of its entries
+		for _, part := range utils.DayParts(dayObj) {
+			files, ok := part["files"].([]any)
 			if !ok {
 				continue
 			}
 
-			uuidFilename, ok := file["uuid_filename"].(string)
-			if !ok || uuidFilename != uuid {
-				continue
-			}
+			// Find file
+			for j, fileInterface := range files {
+				file, ok := fileInterface.(map[string]any)
+				if !ok {
+					continue
+				}
+
+				uuidFilename, ok := file["uuid_filename"].(string)
+				if !ok || uuidFilename != uuid {
+					continue
+				}
 
-			// Remove file from array
-			if err := utils.RemoveFile(userID, uuid); err != nil {
-				http.Error(w, fmt.Sprintf("Failed to delete file: %v", err), http.StatusInternalServerError)
-				return
+				// Keep the file in the trash, so it can be restored
+				trashID, err = utils.MoveToTrash(userID, utils.TrashFile, year, month, day, file, time.Now())
+				if err != nil {
+					http.Error(w, fmt.Sprintf("Failed to move file to trash: %v", err), http.StatusInternalServerError)
+					return
+				}
+
+				// Remove file from array
+				part["files"] = append(files[:j], files[j+1:]...)
+				fileFound = true
+				break
 			}
 
-			files = append(files[:j], files[j+1:]...)
-			dayObj["files"] = files
-			days[i] = dayObj
-			fileFound = true
-			break
+			if fileFound {
+				break
+			}
 		}
 
 		if fileFound {
@@ -374,9 +367,14 @@ func DeleteFile(w http.ResponseWriter, r *http.Request) {
 
 	// Write month data
 	if err := utils.WriteMonth(userID, year, month, content); err != nil {
+		// The file is still part of the day, so it must not be in the trash as well
+		if _, err := utils.RemoveFromTrash(userID, trashID); err != nil {
+			utils.Logger.Printf("Warning: Failed to remove file from trash for user %d: %v", userID, err)
+		}
 		http.Error(w, fmt.Sprintf("Failed to write changes of deleted file: %v", err), http.StatusInternalServerError)
 		return
 	}
+	updateSearchIndex(r, year, month, content, day)
 
 	// Return success
 	utils.JSONResponse(w, http.StatusOK, map[string]bool{
@@ -432,6 +430,9 @@ func RenameFile(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Lock the month while it is read, modified and written
+	defer utils.LockMonth(userID, req.Year, req.Month)()
+
 	// Get month data
 	content, err := utils.GetMonth(userID, req.Year, req.Month)
 	if err != nil {
@@ -473,20 +474,10 @@ func RenameFile(w http.ResponseWriter, r *http.Request) {
 			continue
 		}
 
-		files, ok := day["files"].([]any)
-		if !ok {
-			continue
-		}
-
-		// Find and rename the specific file
-		for _, f := range files {
-			file, ok := f.(map[string]any)
-			if !ok {
-				continue
-			}
-
-			if uuid, ok := file["uuid_filename"].(string); ok && uuid == req.UUID {
-				file["enc_filename"] = enc_filename
+		// Find and rename the specific file, of the day itself or of one of its entries
+		for _, f := range utils.DayFiles(day) {
+			if uuid, ok := f["uuid_filename"].(string); ok && uuid == req.UUID {
+				f["enc_filename"] = enc_filename
 				found = true
 				break
 			}
@@ -510,6 +501,7 @@ func RenameFile(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, fmt.Sprintf("Error writing month data: %v", err), http.StatusInternalServerError)
 		return
 	}
+	updateSearchIndex(r, req.Year, req.Month, content, req.Day)
 
 	utils.Logger.Printf("File renamed successfully for user %d: %s -> %s", userID, req.UUID, req.NewFilename)
 	utils.JSONResponse(w, http.StatusOK, map[string]bool{"success": true})
@@ -521,6 +513,7 @@ type ReorderFilesRequest struct {
 	Month     int            `json:"month"`
 	Year      int            `json:"year"`
 	FileOrder map[string]int `json:"file_order"` // UUID -> order index
+	EntryID   string         `json:"entry_id"`   // Reorder the files of an entry instead of the day
 }
 
 // ReorderFiles handles reordering files within a day
@@ -547,6 +540,9 @@ func ReorderFiles(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Lock the month while it is read, modified and written
+	defer utils.LockMonth(userID, req.Year, req.Month)()
+
 	// Get month data
 	content, err := utils.GetMonth(userID, req.Year, req.Month)
 	if err != nil {
@@ -576,6 +572,13 @@ func ReorderFiles(w http.ResponseWriter, r *http.Request) {
 			continue
 		}
 
+		// The files of an entry are ordered on their own
+		if req.EntryID != "" {
+			if day = utils.FindDayEntry(day, req.EntryID); day == nil {
+				break
+			}
+		}
+
 		files, ok := day["files"].([]any)
 		if !ok {
 			continue
@@ -0,0 +1,92 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/phitux/dailytxt/backend/utils"
+)
+
+// testUser is a registered user of a test, with the derived key a session would hold
+type testUser struct {
+	id         int
+	derivedKey string
+}
+
+// newTestUser points the storage to a fresh in-memory backend and registers a user in it.
+// Cheap Argon2 parameters keep the derived keys fast (password hashes never go below t=5).
+func newTestUser(t testing.TB) *testUser {
+	t.Helper()
+
+	utils.Store = utils.NewMemoryStorage()
+	utils.Settings.Argon2Time = 1
+	utils.Settings.Argon2MemoryKiB = 1024
+	utils.Settings.Argon2Threads = 1
+
+	if ok, err := Register("alice", "password"); !ok || err != nil {
+		t.Fatalf("registering the test user: %v", err)
+	}
+	derivedKey, _, err := utils.CheckPasswordForUser(1, "password")
+	if err != nil || derivedKey == "" {
+		t.Fatalf("checking the password of the test user: %v", err)
+	}
+
+	// The history compaction after a save runs in the background, it would outlive the test and its storage
+	historyCompactionsMutex.Lock()
+	historyCompactions[1] = &HistoryCompactionStatus{LastRun: time.Now().Add(time.Hour)}
+	historyCompactionsMutex.Unlock()
+
+	return &testUser{id: 1, derivedKey: derivedKey}
+}
+
+// encKey returns the encryption key of the user
+func (u *testUser) encKey(t testing.TB) string {
+	t.Helper()
+
+	encKey, err := utils.GetEncryptionKey(u.id, u.derivedKey)
+	if err != nil {
+		t.Fatalf("getting the encryption key: %v", err)
+	}
+	return encKey
+}
+
+// request returns a request of the user, like RequireAuth passes it on after checking the session.
+// A body is sent as JSON.
+func (u *testUser) request(method, target string, body any) *http.Request {
+	var reader bytes.Reader
+	if body != nil {
+		data, _ := json.Marshal(body)
+		reader.Reset(data)
+	}
+	r := httptest.NewRequest(method, target, &reader)
+	ctx := context.WithValue(r.Context(), utils.UserIDKey, u.id)
+	ctx = context.WithValue(ctx, utils.DerivedKeyKey, u.derivedKey)
+	return r.WithContext(ctx)
+}
+
+// do runs a handler with a request of the user
+func (u *testUser) do(handler http.HandlerFunc, method, target string, body any) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	handler(w, u.request(method, target, body))
+	return w
+}
+
+// mustDo runs a handler as the user and decodes its JSON response, the status has to be 200
+func (u *testUser) mustDo(t testing.TB, handler http.HandlerFunc, method, target string, body any) map[string]any {
+	t.Helper()
+
+	w := u.do(handler, method, target, body)
+	if w.Code != http.StatusOK {
+		t.Fatalf("%s %s: status %d: %s", method, target, w.Code, w.Body.String())
+	}
+	var result map[string]any
+	if err := json.Unmarshal(w.Body.Bytes(), &result); err != nil {
+		t.Fatalf("%s %s: decoding response %q: %v", method, target, w.Body.String(), err)
+	}
+	return result
+}
@@ -0,0 +1,265 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/phitux/dailytxt/backend/utils"
+)
+
+// findHistoryVersion returns the history entry of a day with the given version, or nil
+func findHistoryVersion(day map[string]any, version int) map[string]any {
+	history, _ := day["history"].([]any)
+	for _, historyItem := range history {
+		if historyEntry, ok := historyItem.(map[string]any); ok && !utils.IsHistoryEvent(historyEntry) && getHistoryVersion(historyEntry) == version {
+			return historyEntry
+		}
+	}
+	return nil
+}
+
+// historyTarget returns the day or, with an entry id, the entry of the day the history belongs to.
+// Returns nil if there is no such day or entry.
+func historyTarget(day map[string]any, entryID string) map[string]any {
+	if day == nil || entryID == "" {
+		return day
+	}
+	return utils.FindDayEntry(day, entryID)
+}
+
+// RestoreHistoryVersionRequest represents the request body to restore a version of a day
+type RestoreHistoryVersionRequest struct {
+	Day     int    `json:"day"`
+	Month   int    `json:"month"`
+	Year    int    `json:"year"`
+	Version int    `json:"version"`
+	EntryID string `json:"entry_id"` // Restore a version of an entry of the day
+}
+
+// RestoreHistoryVersion makes a version of the history the current text of a day (or of an entry of it).
+// The current text moves to the history like on a save, the restored text keeps its date_written
+// and remembers the version it was restored from. The restore itself is recorded as an event in the history.
+func RestoreHistoryVersion(w http.ResponseWriter, r *http.Request) {
+	// Get user ID and derived key from context
+	userID, ok := r.Context().Value(utils.UserIDKey).(int)
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	derivedKey, ok := r.Context().Value(utils.DerivedKeyKey).(string)
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	// Parse request body
+	var req RestoreHistoryVersionRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	// Lock the month while it is read, modified and written
+	defer utils.LockMonth(userID, req.Year, req.Month)()
+
+	// Get month data
+	content, err := utils.GetMonth(userID, req.Year, req.Month)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error retrieving month data: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	// Get encryption key
+	encKey, err := utils.GetEncryptionKey(userID, derivedKey)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error getting encryption key: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	day := historyTarget(findDay(content, req.Day), req.EntryID)
+	if day == nil {
+		http.Error(w, "Day not found", http.StatusNotFound)
+		return
+	}
+
+	historyEntry := findHistoryVersion(day, req.Version)
+	if historyEntry == nil {
+		http.Error(w, "Version not found", http.StatusNotFound)
+		return
+	}
+
+	// Reject the restore if the client saw an outdated revision
+	revision := getDayRevision(day)
+	if ifMatch := r.Header.Get("If-Match"); ifMatch != "" && !matchesRevision(ifMatch, revision) {
+		revisionConflict(w, day, encKey, revision)
+		return
+	}
+	restoredText, _ := historyEntry["text"].(string)
+	restoredDate, _ := historyEntry["date_written"].(string)
+
+	text, err := utils.DecryptText(restoredText, encKey)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error decrypting history text: %v", err), http.StatusInternalServerError)
+		return
+	}
+	dateWritten, err := utils.DecryptText(restoredDate, encKey)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error decrypting history date: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	// The restore counts as a save
+	encryptedSavedAt, err := utils.EncryptSavedAt(time.Now(), encKey)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error encrypting saved_at: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	// The ciphertexts are reused, they are encrypted with the same key
+	addToHistory(day)
+	history, _ := day["history"].([]any)
+	day["history"] = append(history, map[string]any{
+		"event":         utils.HistoryEventRestore,
+		"restored_from": req.Version,
+		"saved_at":      encryptedSavedAt,
+	})
+	day["text"] = restoredText
+	day["date_written"] = restoredDate
+	day["saved_at"] = encryptedSavedAt
+	day["restored_from"] = req.Version
+	revision++
+	day["revision"] = revision
+
+	if err := utils.WriteMonth(userID, req.Year, req.Month, content); err != nil {
+		http.Error(w, fmt.Sprintf("Error writing month data: %v", err), http.StatusInternalServerError)
+		return
+	}
+	updateSearchIndex(r, req.Year, req.Month, content, req.Day)
+
+	w.Header().Set("ETag", revisionETag(revision))
+	utils.JSONResponse(w, http.StatusOK, map[string]any{
+		"success":       true,
+		"text":          text,
+		"date_written":  dateWritten,
+		"restored_from": req.Version,
+		"revision":      revision,
+	})
+}
+
+// GetHistoryDiff returns a line diff between two versions of a day (or of an entry with entry_id).
+// The versions are numbers of the history or "current" for the current text (the default of "to").
+func GetHistoryDiff(w http.ResponseWriter, r *http.Request) {
+	// Get user ID and derived key from context
+	userID, ok := r.Context().Value(utils.UserIDKey).(int)
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	derivedKey, ok := r.Context().Value(utils.DerivedKeyKey).(string)
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	// Get parameters
+	day, err := strconv.Atoi(r.URL.Query().Get("day"))
+	if err != nil {
+		http.Error(w, "Invalid day parameter", http.StatusBadRequest)
+		return
+	}
+	month, err := strconv.Atoi(r.URL.Query().Get("month"))
+	if err != nil {
+		http.Error(w, "Invalid month parameter", http.StatusBadRequest)
+		return
+	}
+	year, err := strconv.Atoi(r.URL.Query().Get("year"))
+	if err != nil {
+		http.Error(w, "Invalid year parameter", http.StatusBadRequest)
+		return
+	}
+	from := r.URL.Query().Get("from")
+	if from == "" {
+		http.Error(w, "Missing from parameter", http.StatusBadRequest)
+		return
+	}
+	to := r.URL.Query().Get("to")
+	if to == "" {
+		to = "current"
+	}
+
+	// Get encryption key
+	encKey, err := utils.GetEncryptionKey(userID, derivedKey)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error getting encryption key: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	// Get month data
+	content, err := utils.GetMonth(userID, year, month)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error retrieving month data: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	dayObj := historyTarget(findDay(content, day), r.URL.Query().Get("entry_id"))
+	if dayObj == nil {
+		http.Error(w, "Day not found", http.StatusNotFound)
+		return
+	}
+
+	// versionText returns the decrypted text of a version
+	versionText := func(version string) (string, int, error) {
+		container := dayObj
+		if version != "current" {
+			number, err := strconv.Atoi(version)
+			if err != nil {
+				return "", http.StatusBadRequest, fmt.Errorf("invalid version %q", version)
+			}
+			if container = findHistoryVersion(dayObj, number); container == nil {
+				return "", http.StatusNotFound, fmt.Errorf("version %d not found", number)
+			}
+		}
+		encryptedText, _ := container["text"].(string)
+		if encryptedText == "" {
+			return "", http.StatusOK, nil
+		}
+		text, err := utils.DecryptText(encryptedText, encKey)
+		if err != nil {
+			return "", http.StatusInternalServerError, fmt.Errorf("error decrypting text: %v", err)
+		}
+		return text, http.StatusOK, nil
+	}
+
+	fromText, status, err := versionText(from)
+	if err != nil {
+		http.Error(w, err.Error(), status)
+		return
+	}
+	toText, status, err := versionText(to)
+	if err != nil {
+		http.Error(w, err.Error(), status)
+		return
+	}
+
+	lines := utils.DiffLines(fromText, toText)
+	added, removed := 0, 0
+	for _, line := range lines {
+		switch line.Op {
+		case utils.DiffInsert:
+			added++
+		case utils.DiffDelete:
+			removed++
+		}
+	}
+
+	utils.JSONResponse(w, http.StatusOK, map[string]any{
+		"from":    from,
+		"to":      to,
+		"lines":   lines,
+		"added":   added,
+		"removed": removed,
+	})
+}
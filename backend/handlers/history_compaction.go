@@ -0,0 +1,157 @@
+package handlers
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/phitux/dailytxt/backend/utils"
+)
+
+// historyCompactionInterval is the minimum time between two automatic compactions of a user
+const historyCompactionInterval = time.Hour
+
+// HistoryCompactionStatus is the state of the history compaction of a user
+type HistoryCompactionStatus struct {
+	Running  bool                            `json:"running"`
+	LastRun  time.Time                       `json:"last_run"`
+	Progress utils.HistoryCompactionProgress `json:"progress"`
+	Error    string                          `json:"error,omitempty"`
+}
+
+// historyCompactions keeps track of the history compactions of all users
+var historyCompactions = make(map[int]*HistoryCompactionStatus)
+var historyCompactionsMutex sync.Mutex
+
+// historyRetentionFromSettings reads the retention policy of the user settings
+func historyRetentionFromSettings(settings map[string]any) utils.HistoryRetention {
+	defaults := GetDefaultSettings()["historyRetention"].(map[string]any)
+	retention, _ := settings["historyRetention"].(map[string]any)
+
+	number := func(key string) int {
+		if value, ok := retention[key].(float64); ok && value >= 0 {
+			return int(value)
+		}
+		return defaults[key].(int)
+	}
+	enabled, ok := retention["enabled"].(bool)
+	if !ok {
+		enabled = defaults["enabled"].(bool)
+	}
+
+	return utils.HistoryRetention{
+		Enabled:        enabled,
+		KeepAllHours:   number("keepAllHours"),
+		KeepHourlyDays: number("keepHourlyDays"),
+		KeepDailyDays:  number("keepDailyDays"),
+	}
+}
+
+// compactHistory prunes the history of a user in the background according to the retention policy
+// of the user settings. Unless force is set, it runs at most once per historyCompactionInterval.
+// The key of the user is only known during requests, so the compaction is started by them.
+func compactHistory(userID int, encKey string, force bool) bool {
+	historyCompactionsMutex.Lock()
+	status, exists := historyCompactions[userID]
+	if exists && (status.Running || (!force && time.Since(status.LastRun) < historyCompactionInterval)) {
+		historyCompactionsMutex.Unlock()
+		return false
+	}
+	status = &HistoryCompactionStatus{Running: true, LastRun: time.Now()}
+	historyCompactions[userID] = status
+	historyCompactionsMutex.Unlock()
+
+	report := func(progress utils.HistoryCompactionProgress) {
+		historyCompactionsMutex.Lock()
+		status.Progress = progress
+		historyCompactionsMutex.Unlock()
+	}
+	finish := func(err error) {
+		historyCompactionsMutex.Lock()
+		status.Running = false
+		if err != nil {
+			status.Error = err.Error()
+		}
+		historyCompactionsMutex.Unlock()
+	}
+
+	go func() {
+		settings, err := loadUserSettings(userID, encKey)
+		if err != nil {
+			utils.Logger.Printf("History compaction of user %d: %v", userID, err)
+			finish(err)
+			return
+		}
+		policy := historyRetentionFromSettings(settings)
+		if !policy.Enabled {
+			finish(nil)
+			return
+		}
+
+		progress, err := utils.CompactUserHistory(userID, policy, encKey, time.Now(), report)
+		if err != nil {
+			utils.Logger.Printf("History compaction of user %d failed: %v", userID, err)
+		}
+		if progress.RemovedVersions > 0 {
+			utils.Logger.Printf("History compaction of user %d removed %d versions and reclaimed %d bytes", userID, progress.RemovedVersions, progress.ReclaimedBytes)
+		}
+		finish(err)
+	}()
+
+	return true
+}
+
+// CompactHistory starts the compaction of the history of the user right away
+func CompactHistory(w http.ResponseWriter, r *http.Request) {
+	// Get user ID and derived key from context
+	userID, ok := r.Context().Value(utils.UserIDKey).(int)
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	derivedKey, ok := r.Context().Value(utils.DerivedKeyKey).(string)
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	encKey, err := utils.GetEncryptionKey(userID, derivedKey)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error getting encryption key: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	if !compactHistory(userID, encKey, true) {
+		utils.JSONResponse(w, http.StatusConflict, map[string]any{
+			"error": "History compaction already in progress.",
+		})
+		return
+	}
+
+	utils.JSONResponse(w, http.StatusOK, map[string]bool{
+		"success": true,
+	})
+}
+
+// GetHistoryCompactionStatus returns the state of the last history compaction of the user,
+// including the reclaimed bytes
+func GetHistoryCompactionStatus(w http.ResponseWriter, r *http.Request) {
+	// Get user ID from context
+	userID, ok := r.Context().Value(utils.UserIDKey).(int)
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	historyCompactionsMutex.Lock()
+	defer historyCompactionsMutex.Unlock()
+
+	// Without a compaction yet, last_run is the zero time
+	status, exists := historyCompactions[userID]
+	if !exists {
+		status = &HistoryCompactionStatus{}
+	}
+
+	utils.JSONResponse(w, http.StatusOK, *status)
+}
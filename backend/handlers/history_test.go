@@ -0,0 +1,102 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/phitux/dailytxt/backend/utils"
+)
+
+// getHistory returns the decoded history of day 3 of May 2024
+func getHistory(t *testing.T, user *testUser, query string) []map[string]any {
+	t.Helper()
+
+	w := user.do(GetHistory, "GET", "/logs/getHistory?day=3&month=5&year=2024"+query, nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("getHistory: %d %s", w.Code, w.Body.String())
+	}
+	var history []map[string]any
+	if err := json.Unmarshal(w.Body.Bytes(), &history); err != nil {
+		t.Fatal(err)
+	}
+	return history
+}
+
+func TestRestoreHistoryVersionRecordsEvent(t *testing.T) {
+	user := newTestUser(t)
+	user.mustDo(t, SaveLog, "POST", "/logs/saveLog", LogRequest{Day: 3, Month: 5, Year: 2024, Text: "first"})
+	user.mustDo(t, SaveLog, "POST", "/logs/saveLog", LogRequest{Day: 3, Month: 5, Year: 2024, Text: "second"})
+
+	restored := user.mustDo(t, RestoreHistoryVersion, "POST", "/logs/restoreHistoryVersion", RestoreHistoryVersionRequest{Day: 3, Month: 5, Year: 2024, Version: 1})
+	if restored["text"] != "first" || restored["restored_from"] != float64(1) {
+		t.Fatalf("restore = %v, want the first text", restored)
+	}
+
+	// The versions only, as before
+	versions := getHistory(t, user, "")
+	if len(versions) != 2 || versions[0]["text"] != "first" || versions[1]["text"] != "second" {
+		t.Errorf("history = %v, want the versions first and second", versions)
+	}
+
+	// The restore is recorded right away, after the version it replaced
+	history := getHistory(t, user, "&events=true")
+	if len(history) != 3 {
+		t.Fatalf("history with events = %v, want 2 versions and the restore", history)
+	}
+	event := history[2]
+	if event["event"] != "restore" || event["restored_from"] != float64(1) || event["saved_at"] == nil {
+		t.Errorf("restore event = %v", event)
+	}
+
+	// The event is no version, restoring it is not possible
+	w := user.do(RestoreHistoryVersion, "POST", "/logs/restoreHistoryVersion", RestoreHistoryVersionRequest{Day: 3, Month: 5, Year: 2024, Version: 0})
+	if w.Code != http.StatusNotFound {
+		t.Errorf("restore of version 0: status %d, want %d", w.Code, http.StatusNotFound)
+	}
+}
+
+// A version that doesn't exist is not found, no matter which revision the client saw
+func TestRestoreMissingHistoryVersion(t *testing.T) {
+	user := newTestUser(t)
+	user.mustDo(t, SaveLog, "POST", "/logs/saveLog", LogRequest{Day: 3, Month: 5, Year: 2024, Text: "first"})
+	user.mustDo(t, SaveLog, "POST", "/logs/saveLog", LogRequest{Day: 3, Month: 5, Year: 2024, Text: "second"})
+
+	r := user.request("POST", "/logs/restoreHistoryVersion", RestoreHistoryVersionRequest{Day: 3, Month: 5, Year: 2024, Version: 7})
+	r.Header.Set("If-Match", `"1"`)
+	w := httptest.NewRecorder()
+	RestoreHistoryVersion(w, r)
+	if w.Code != http.StatusNotFound {
+		t.Errorf("restore of a missing version with an outdated revision: status %d, want %d", w.Code, http.StatusNotFound)
+	}
+
+	// An existing version with an outdated revision is a conflict
+	r = user.request("POST", "/logs/restoreHistoryVersion", RestoreHistoryVersionRequest{Day: 3, Month: 5, Year: 2024, Version: 1})
+	r.Header.Set("If-Match", `"1"`)
+	w = httptest.NewRecorder()
+	RestoreHistoryVersion(w, r)
+	if w.Code != http.StatusConflict {
+		t.Errorf("restore with an outdated revision: status %d, want %d", w.Code, http.StatusConflict)
+	}
+}
+
+// Before the first compaction the status is the zero status, like any other status
+func TestHistoryCompactionStatusBeforeFirstRun(t *testing.T) {
+	user := newTestUser(t)
+	historyCompactionsMutex.Lock()
+	delete(historyCompactions, user.id)
+	historyCompactionsMutex.Unlock()
+
+	w := user.do(GetHistoryCompactionStatus, "GET", "/logs/historyCompactionStatus", nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", w.Code, w.Body.String())
+	}
+	var status HistoryCompactionStatus
+	if err := json.Unmarshal(w.Body.Bytes(), &status); err != nil {
+		t.Fatal(err)
+	}
+	if status.Running || !status.LastRun.IsZero() || status.Progress != (utils.HistoryCompactionProgress{}) || status.Error != "" {
+		t.Errorf("status = %+v, want the zero status", status)
+	}
+}
@@ -138,7 +138,7 @@ func ImportData(w http.ResponseWriter, r *http.Request) {
 		found := false
 		if utils.VerifyPassword(password, storedHash) {
 			// Password correct
-			dkBytes, err := utils.DeriveKeyFromPassword(password, salt)
+			dkBytes, err := utils.DeriveKeyFromPassword(password, salt, utils.KDFParamsOf(userMap))
 			if err != nil {
 				http.Error(w, "Error deriving key", http.StatusInternalServerError)
 				return
@@ -160,7 +160,7 @@ func ImportData(w http.ResponseWriter, r *http.Request) {
 						encDerKey := getString(codeMap, "enc_derived_key")
 
 						// Derive temp key from backup code
-						tempKeyBytes, err := utils.DeriveKeyFromPassword(password, codeSalt)
+						tempKeyBytes, err := utils.DeriveKeyFromPassword(password, codeSalt, utils.KDFParamsOf(codeMap))
 						if err != nil {
 							continue
 						}
@@ -184,37 +184,7 @@ func ImportData(w http.ResponseWriter, r *http.Request) {
 		}
 
 		// Now that we have the imported derived_key, decrypt enc_enc_key
-
-		// Decode derived key
-		derivedKeyBytes, err := base64.StdEncoding.DecodeString(importKey)
-		if err != nil {
-			http.Error(w, "error decoding derived key", http.StatusInternalServerError)
-			return
-		}
-
-		// Create Fernet cipher
-		aead, err := utils.CreateAEAD(derivedKeyBytes)
-		if err != nil {
-			http.Error(w, "error creating cipher", http.StatusInternalServerError)
-			return
-		}
-
-		// Decode encrypted key
-		encEncKeyBytes, err := base64.StdEncoding.DecodeString(encEncKey)
-		if err != nil {
-			http.Error(w, "error decoding encrypted key", http.StatusInternalServerError)
-			return
-		}
-
-		// Extract nonce from encrypted key
-		if len(encEncKeyBytes) < aead.NonceSize() {
-			http.Error(w, "encrypted key too short", http.StatusInternalServerError)
-			return
-		}
-		nonce, encKeyBytes := encEncKeyBytes[:aead.NonceSize()], encEncKeyBytes[aead.NonceSize():]
-
-		// Decrypt key
-		keyBytes, err := aead.Open(nil, nonce, encKeyBytes, nil)
+		keyBytes, err := utils.UnwrapEncryptionKey(userMap, importKey)
 		if err != nil {
 			http.Error(w, "error decrypting key", http.StatusInternalServerError)
 			return
@@ -237,8 +207,10 @@ func ImportData(w http.ResponseWriter, r *http.Request) {
 	tagIDMap := make(map[int]int)
 
 	// Load current tags
+	unlockTags := utils.LockTags(userID)
 	currentTagsRaw, err := utils.GetTags(userID)
 	if err != nil {
+		unlockTags()
 		http.Error(w, "Error loading tags", http.StatusInternalServerError)
 		return
 	}
@@ -326,6 +298,7 @@ func ImportData(w http.ResponseWriter, r *http.Request) {
 			utils.WriteTags(userID, currentTagsRaw)
 		}
 	}
+	unlockTags()
 
 	// 6. Process Files
 	// Map FileKey -> NewUUID and Size
@@ -418,30 +391,30 @@ func ImportData(w http.ResponseWriter, r *http.Request) {
 				days, _ := mData["days"].([]any)
 
 				// Load existing month
+				unlockMonth := utils.LockMonth(userID, year, month)
 				currentMonthData, _ := utils.GetMonth(userID, year, month)
 				if currentMonthData["days"] == nil {
 					currentMonthData["days"] = []any{}
 				}
 				cDays := currentMonthData["days"].([]any)
 
-				for _, d := range days {
-					importDay := d.(map[string]any)
-					dayNum := int(getFloat64(importDay, "day"))
-
-					// Decrypt Import Day
-					var plainText, plainDate string
+				// importDayPart re-encrypts the day or an entry of a day with the current key and maps its files and tags
+				importDayPart := func(part map[string]any) {
+					var plainText, plainDate, plainTime string
 
 					if isEncrypted {
-						plainText, _ = utils.DecryptText(getString(importDay, "text"), importEncKey)
-						plainDate, _ = utils.DecryptText(getString(importDay, "date_written"), importEncKey)
+						plainText, _ = utils.DecryptText(getString(part, "text"), importEncKey)
+						plainDate, _ = utils.DecryptText(getString(part, "date_written"), importEncKey)
+						plainTime, _ = utils.DecryptText(getString(part, "time"), importEncKey)
 					} else {
-						plainText = getString(importDay, "text")
-						plainDate = getString(importDay, "date_written")
+						plainText = getString(part, "text")
+						plainDate = getString(part, "date_written")
+						plainTime = getString(part, "time")
 					}
 
 					// Handle Files
 					var newFiles []any
-					if files, ok := importDay["files"].([]any); ok {
+					if files, ok := part["files"].([]any); ok {
 						for _, fi := range files {
 							fMap := fi.(map[string]any)
 
@@ -474,14 +447,14 @@ func ImportData(w http.ResponseWriter, r *http.Request) {
 					}
 
 					if len(newFiles) > 0 {
-						importDay["files"] = newFiles
+						part["files"] = newFiles
 					} else {
-						delete(importDay, "files")
+						delete(part, "files")
 					}
 
 					// Handle Tags
 					var newTagIDs []any
-					if tags, ok := importDay["tags"].([]any); ok {
+					if tags, ok := part["tags"].([]any); ok {
 						for _, tid := range tags {
 							oldID := int(tid.(float64))
 							if newID, ok := tagIDMap[oldID]; ok {
@@ -491,24 +464,44 @@ func ImportData(w http.ResponseWriter, r *http.Request) {
 					}
 
 					if len(newTagIDs) > 0 {
-						importDay["tags"] = newTagIDs
+						part["tags"] = newTagIDs
 					} else {
-						delete(importDay, "tags")
+						delete(part, "tags")
 					}
 
-					// Re-Encrypt Text/Date
+					// Re-Encrypt Text/Date/Time
 					if plainText != "" {
 						encText, _ := utils.EncryptText(plainText, currentEncKey)
-						importDay["text"] = encText
+						part["text"] = encText
 					} else {
-						delete(importDay, "text")
+						delete(part, "text")
 					}
 
 					if plainDate != "" {
 						encDate, _ := utils.EncryptText(plainDate, currentEncKey)
-						importDay["date_written"] = encDate
+						part["date_written"] = encDate
 					} else {
-						delete(importDay, "date_written")
+						delete(part, "date_written")
+					}
+
+					if plainTime != "" {
+						encTime, _ := utils.EncryptText(plainTime, currentEncKey)
+						part["time"] = encTime
+					} else {
+						delete(part, "time")
+					}
+				}
+
+				for _, d := range days {
+					importDay := d.(map[string]any)
+					dayNum := int(getFloat64(importDay, "day"))
+
+					// Re-encrypt the day and its entries
+					for i, part := range utils.DayParts(importDay) {
+						if _, hasID := part["id"]; !hasID && i > 0 {
+							part["id"], _ = utils.GenerateUUID()
+						}
+						importDayPart(part)
 					}
 
 					// Merge into cDays
@@ -539,11 +532,15 @@ func ImportData(w http.ResponseWriter, r *http.Request) {
 									}
 								}
 
-								history = append(history, map[string]any{
+								historyEntry := map[string]any{
 									"version":      float64(maxVer + 1),
 									"text":         cDay["text"],
 									"date_written": cDay["date_written"],
-								})
+								}
+								if savedAt, ok := cDay["saved_at"]; ok {
+									historyEntry["saved_at"] = savedAt
+								}
+								history = append(history, historyEntry)
 
 								importDay["history"] = history
 
@@ -554,6 +551,14 @@ func ImportData(w http.ResponseWriter, r *http.Request) {
 								}
 							}
 
+							// keep existing entries that are not part of the import
+							for _, entry := range utils.DayEntries(cDay) {
+								if id, _ := entry["id"].(string); utils.FindDayEntry(importDay, id) == nil {
+									utils.SetDayEntries(importDay, append(utils.DayEntries(importDay), entry))
+								}
+							}
+							utils.SortDayEntries(importDay, currentEncKey)
+
 							// merge existing files to importDay["files"]
 							if cFiles, ok := cDay["files"].([]any); ok {
 								var impFiles []any
@@ -576,6 +581,7 @@ func ImportData(w http.ResponseWriter, r *http.Request) {
 				}
 				currentMonthData["days"] = cDays
 				utils.WriteMonth(userID, year, month, currentMonthData)
+				unlockMonth()
 			}
 		}
 	}
@@ -595,6 +601,7 @@ func ImportData(w http.ResponseWriter, r *http.Request) {
 		rc.Close()
 
 		if items, ok := tmplData["templates"].([]any); ok {
+			unlockTemplates := utils.LockTemplates(userID)
 			currTmplData, _ := utils.GetTemplates(userID)
 			if currTmplData["templates"] == nil {
 				currTmplData["templates"] = []any{}
@@ -630,9 +637,15 @@ func ImportData(w http.ResponseWriter, r *http.Request) {
 			}
 			currTmplData["templates"] = cItems
 			utils.WriteTemplates(userID, currTmplData)
+			unlockTemplates()
 		}
 	}
 
+	// Many days may have changed, the search index is rebuilt by the next search
+	if err := utils.InvalidateSearchIndex(userID); err != nil {
+		utils.Logger.Printf("Error invalidating the search index of user %d: %v", userID, err)
+	}
+
 	// Success
 	utils.JSONResponse(w, http.StatusOK, map[string]any{"success": true})
 }
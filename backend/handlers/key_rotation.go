@@ -0,0 +1,216 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/phitux/dailytxt/backend/utils"
+)
+
+// keyRotationProgress keeps track of the key rotations of all users
+var keyRotationProgress = make(map[int]MigrationProgress)
+var keyRotationProgressMutex sync.Mutex
+var activeKeyRotations = make(map[int]bool)
+var activeKeyRotationsMutex sync.Mutex
+
+// runKeyRotation re-encrypts the data of a user in the background, unless it is already running
+func runKeyRotation(userID int, oldKey, newKey string) bool {
+	activeKeyRotationsMutex.Lock()
+	if activeKeyRotations[userID] {
+		activeKeyRotationsMutex.Unlock()
+		return false
+	}
+	activeKeyRotations[userID] = true
+	activeKeyRotationsMutex.Unlock()
+
+	progressChan := make(chan utils.MigrationProgress, 10)
+
+	go func() {
+		for progress := range progressChan {
+			keyRotationProgressMutex.Lock()
+			keyRotationProgress[userID] = MigrationProgress{
+				Phase:          progress.Phase,
+				ProcessedItems: progress.ProcessedItems,
+				TotalItems:     progress.TotalItems,
+				ErrorCount:     progress.ErrorCount,
+			}
+			keyRotationProgressMutex.Unlock()
+		}
+	}()
+
+	go func() {
+		defer func() {
+			activeKeyRotationsMutex.Lock()
+			activeKeyRotations[userID] = false
+			activeKeyRotationsMutex.Unlock()
+		}()
+		defer close(progressChan)
+
+		utils.Logger.Printf("Starting key rotation for user ID %d", userID)
+		if err := utils.RotateUserData(userID, oldKey, newKey, progressChan); err != nil {
+			utils.Logger.Printf("Key rotation failed for user ID %d: %v", userID, err)
+		}
+	}()
+
+	return true
+}
+
+// resumeKeyRotation continues an interrupted key rotation (e.g. by a restart) of a user
+func resumeKeyRotation(userID int, derivedKey string) {
+	oldKey, newKey, err := utils.PendingKeyRotation(userID, derivedKey)
+	if err != nil {
+		utils.Logger.Printf("Error checking key rotation of user ID %d: %v", userID, err)
+		return
+	}
+	if oldKey == "" {
+		return
+	}
+	if runKeyRotation(userID, oldKey, newKey) {
+		utils.Logger.Printf("Resuming key rotation for user ID %d", userID)
+	}
+}
+
+// RotateEncryptionKeyRequest represents the request body to rotate the encryption key
+type RotateEncryptionKeyRequest struct {
+	Password string `json:"password"`
+}
+
+// RotateEncryptionKey replaces the encryption key of the user and re-encrypts all data in the background.
+// All sessions are logged out, backup codes and the share token are issued again.
+func RotateEncryptionKey(w http.ResponseWriter, r *http.Request) {
+	// Get user info from context
+	userID, ok := r.Context().Value(utils.UserIDKey).(int)
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	username, ok := r.Context().Value(utils.UsernameKey).(string)
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	currentDerivedKey, ok := r.Context().Value(utils.DerivedKeyKey).(string)
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var req RotateEncryptionKeyRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	// The new key is wrapped with the password, so a backup code is not accepted here
+	derivedKey, availableBackupCodes, err := utils.CheckPasswordForUser(userID, req.Password)
+	if err != nil || len(derivedKey) == 0 || availableBackupCodes != -1 {
+		utils.JSONResponse(w, http.StatusOK, map[string]any{
+			"success":            false,
+			"password_incorrect": true,
+		})
+		return
+	}
+
+	activeKeyRotationsMutex.Lock()
+	isActive := activeKeyRotations[userID]
+	activeKeyRotationsMutex.Unlock()
+	if isActive {
+		utils.JSONResponse(w, http.StatusConflict, map[string]any{
+			"error": "Key rotation already in progress. Please wait until it completes.",
+		})
+		return
+	}
+
+	rotation, err := utils.StartKeyRotation(userID, req.Password, derivedKey)
+	if err != nil {
+		if errors.Is(err, utils.ErrKeyRotationPending) {
+			// The last rotation was interrupted, finish it first
+			resumeKeyRotation(userID, currentDerivedKey)
+			utils.JSONResponse(w, http.StatusConflict, map[string]any{
+				"error": "The last key rotation is not finished yet. It was resumed, please wait until it completes.",
+			})
+			return
+		}
+		http.Error(w, fmt.Sprintf("Error rotating encryption key: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	// All sessions hold the old derived key
+	if err := utils.DeleteUserSessions(userID); err != nil {
+		http.Error(w, fmt.Sprintf("Error ending sessions: %v", err), http.StatusInternalServerError)
+		return
+	}
+	token, err := utils.CreateSession(userID, username, rotation.DerivedKey, utils.GetClientIP(r), r.UserAgent())
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error creating session: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     "token",
+		Value:    token,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+		Path:     "/",
+		Expires:  time.Now().Add(time.Duration(utils.Settings.LogoutAfterDays) * 24 * time.Hour),
+	})
+
+	runKeyRotation(userID, rotation.OldKey, rotation.NewKey)
+	utils.Logger.Printf("Encryption key of user ID %d replaced", userID)
+
+	response := map[string]any{
+		"success": true,
+	}
+	if rotation.BackupCodes != nil {
+		response["backup_codes"] = rotation.BackupCodes
+	}
+	if rotation.ShareToken != "" {
+		response["share_token"] = rotation.ShareToken
+	}
+	utils.JSONResponse(w, http.StatusOK, response)
+}
+
+// GetKeyRotationProgress returns the progress of the key rotation of the user
+func GetKeyRotationProgress(w http.ResponseWriter, r *http.Request) {
+	// Get user ID and derived key from context
+	userID, ok := r.Context().Value(utils.UserIDKey).(int)
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	derivedKey, ok := r.Context().Value(utils.DerivedKeyKey).(string)
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	keyRotationProgressMutex.Lock()
+	progress, exists := keyRotationProgress[userID]
+	keyRotationProgressMutex.Unlock()
+
+	// A rotation interrupted by a restart continues as soon as the user is back
+	if !exists {
+		resumeKeyRotation(userID, derivedKey)
+	}
+
+	activeKeyRotationsMutex.Lock()
+	isActive := activeKeyRotations[userID]
+	activeKeyRotationsMutex.Unlock()
+
+	if !exists {
+		utils.JSONResponse(w, http.StatusOK, map[string]any{
+			"rotation_in_progress": isActive,
+			"progress":             map[string]string{"phase": "not_started"},
+		})
+		return
+	}
+
+	utils.JSONResponse(w, http.StatusOK, map[string]any{
+		"rotation_in_progress": isActive && progress.Phase != "completed",
+		"progress":             progress,
+	})
+}
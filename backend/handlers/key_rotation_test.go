@@ -0,0 +1,323 @@
+package handlers
+
+import (
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/phitux/dailytxt/backend/utils"
+)
+
+// setupRotationData writes a month with history, entries and files, the trash, tags, templates and settings of
+// the test user and enables TOTP, backup codes and a share token. Returns the TOTP secret.
+func setupRotationData(t *testing.T, user *testUser, encKey string) string {
+	t.Helper()
+
+	must := func(err error) {
+		t.Helper()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	encrypt := func(text string) string {
+		t.Helper()
+		ciphertext, err := utils.EncryptText(text, encKey)
+		must(err)
+		return ciphertext
+	}
+	writeBlob := func(uuid, content string) {
+		t.Helper()
+		must(utils.WriteEncryptedFile(strings.NewReader(content), int64(len(content)), user.id, uuid, encKey))
+	}
+
+	writeBlob("file-day", "content of the day file")
+	writeBlob("file-entry", "content of the entry file")
+	writeBlob("file-trash", "content of the deleted file")
+	must(utils.WriteMonth(user.id, 2024, 5, map[string]any{"days": []any{
+		map[string]any{
+			"day":          3,
+			"text":         encrypt("main text"),
+			"date_written": encrypt("03.05.2024, 21:15"),
+			"history": []any{
+				map[string]any{"version": 1, "text": encrypt("first version"),
+					"saved_at": encrypt("2024-05-03T21:00:00Z")},
+			},
+			"files": []any{
+				map[string]any{"uuid_filename": "file-day", "enc_filename": encrypt("day.txt")},
+			},
+			"entries": []any{
+				map[string]any{
+					"id":   "e1",
+					"time": encrypt("08:30"),
+					"text": encrypt("morning entry"),
+					"history": []any{
+						map[string]any{"version": 1, "text": encrypt("early entry")},
+					},
+					"files": []any{
+						map[string]any{"uuid_filename": "file-entry", "enc_filename": encrypt("entry.txt")},
+					},
+				},
+			},
+		},
+	}}))
+
+	now := time.Now()
+	_, err := utils.MoveToTrash(user.id, utils.TrashDay, 2024, 5, 4, map[string]any{
+		"day":  4,
+		"text": encrypt("deleted day"),
+	}, now)
+	must(err)
+	_, err = utils.MoveToTrash(user.id, utils.TrashFile, 2024, 5, 3, map[string]any{
+		"uuid_filename": "file-trash",
+		"enc_filename":  encrypt("deleted.txt"),
+	}, now)
+	must(err)
+
+	must(utils.WriteTags(user.id, map[string]any{"tags": []any{map[string]any{
+		"id":    1,
+		"icon":  encrypt("🌲"),
+		"name":  encrypt("forest"),
+		"color": encrypt("#00ff00"),
+	}}}))
+	must(utils.WriteTemplates(user.id, map[string]any{"templates": []any{map[string]any{
+		"name": encrypt("daily"),
+		"text": encrypt("What happened today?"),
+	}}}))
+	must(utils.WriteUserSettings(user.id, encrypt(`{"theme": "dark"}`)))
+
+	// TOTP, backup codes and a share token
+	secret, err := utils.GenerateTOTPSecret()
+	must(err)
+	must(utils.SavePendingTOTP(user.id, encrypt(secret)))
+	code, err := utils.TOTPCode(secret, now)
+	must(err)
+	if ok, err := utils.ConfirmTOTP(user.id, encKey, code, now); !ok || err != nil {
+		t.Fatalf("confirming TOTP: %v", err)
+	}
+	_, codeData, err := utils.GenerateBackupCodes(user.derivedKey)
+	must(err)
+	must(utils.SaveBackupCodes(user.id, codeData))
+	_, tokenHash, encDerivedKey, err := utils.NewShareToken(user.derivedKey)
+	must(err)
+	must(utils.SaveShareToken(user.id, tokenHash, encDerivedKey))
+
+	return secret
+}
+
+// checkRotated fails unless every text, file and secret of the test user decrypts with the new key only
+func checkRotated(t *testing.T, user *testUser, rotation *utils.KeyRotation, secret string) {
+	t.Helper()
+
+	if oldKey, _, err := utils.PendingKeyRotation(user.id, rotation.DerivedKey); oldKey != "" || err != nil {
+		t.Errorf("the rotation is still pending: %v", err)
+	}
+
+	checkText := func(what, ciphertext, want string) {
+		t.Helper()
+		if text, err := utils.DecryptText(ciphertext, rotation.NewKey); err != nil || text != want {
+			t.Errorf("%s with the new key = %q, %v, want %q", what, text, err, want)
+		}
+		if _, err := utils.DecryptText(ciphertext, rotation.OldKey); err == nil {
+			t.Errorf("%s still decrypts with the old key", what)
+		}
+	}
+	checkBlob := func(uuid, want string) {
+		t.Helper()
+		file, _, err := utils.OpenDecryptedFile(user.id, uuid, rotation.NewKey)
+		if err != nil {
+			t.Errorf("file %s with the new key: %v", uuid, err)
+			return
+		}
+		content, err := io.ReadAll(file)
+		file.Close()
+		if err != nil || string(content) != want {
+			t.Errorf("file %s = %q, %v, want %q", uuid, content, err, want)
+		}
+		if file, _, err := utils.OpenDecryptedFile(user.id, uuid, rotation.OldKey); err == nil {
+			file.Close()
+			t.Errorf("file %s still decrypts with the old key", uuid)
+		}
+	}
+
+	month, err := utils.GetMonth(user.id, 2024, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	day := month["days"].([]any)[0].(map[string]any)
+	checkText("text", day["text"].(string), "main text")
+	checkText("date_written", day["date_written"].(string), "03.05.2024, 21:15")
+	version := day["history"].([]any)[0].(map[string]any)
+	checkText("history text", version["text"].(string), "first version")
+	checkText("history saved_at", version["saved_at"].(string), "2024-05-03T21:00:00Z")
+	checkText("filename", day["files"].([]any)[0].(map[string]any)["enc_filename"].(string), "day.txt")
+	checkBlob("file-day", "content of the day file")
+
+	entry := utils.DayEntries(day)[0]
+	checkText("entry time", entry["time"].(string), "08:30")
+	checkText("entry text", entry["text"].(string), "morning entry")
+	checkText("entry history", entry["history"].([]any)[0].(map[string]any)["text"].(string), "early entry")
+	checkText("entry filename", entry["files"].([]any)[0].(map[string]any)["enc_filename"].(string), "entry.txt")
+	checkBlob("file-entry", "content of the entry file")
+
+	trash, err := utils.GetTrash(user.id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	items := utils.TrashItems(trash)
+	if len(items) != 2 {
+		t.Fatalf("%d trash items, want 2", len(items))
+	}
+	checkText("deleted day", items[0]["entry"].(map[string]any)["text"].(string), "deleted day")
+	checkText("deleted filename", items[1]["entry"].(map[string]any)["enc_filename"].(string), "deleted.txt")
+	checkBlob("file-trash", "content of the deleted file")
+
+	tags, err := utils.GetTags(user.id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tag := tags["tags"].([]any)[0].(map[string]any)
+	checkText("tag icon", tag["icon"].(string), "🌲")
+	checkText("tag name", tag["name"].(string), "forest")
+	checkText("tag color", tag["color"].(string), "#00ff00")
+	templates, err := utils.GetTemplates(user.id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := templates["templates"].([]any)[0].(map[string]any)
+	checkText("template name", template["name"].(string), "daily")
+	checkText("template text", template["text"].(string), "What happened today?")
+	settings, err := utils.GetUserSettings(user.id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkText("settings", settings, `{"theme": "dark"}`)
+
+	stored := storedUser(t)
+	checkText("TOTP secret", stored["totp"].(map[string]any)["enc_secret"].(string), secret)
+
+	// Backup codes and the share token give the new derived key, the old derived key is worthless
+	if len(rotation.BackupCodes) == 0 || rotation.ShareToken == "" {
+		t.Fatalf("no new backup codes (%d) or share token", len(rotation.BackupCodes))
+	}
+	derivedKey, _, err := utils.CheckPasswordForUser(user.id, rotation.BackupCodes[0])
+	if err != nil || derivedKey == "" {
+		t.Fatalf("login with a new backup code: %v", err)
+	}
+	if encKey, err := utils.GetEncryptionKey(user.id, derivedKey); err != nil || encKey != rotation.NewKey {
+		t.Errorf("the backup code doesn't give the new key: %v", err)
+	}
+	shareDerivedKey, err := utils.DecryptText(stored["share_enc_derived_key"].(string), rotation.ShareToken)
+	if err != nil {
+		t.Fatalf("decrypting the derived key of the share token: %v", err)
+	}
+	if encKey, err := utils.GetEncryptionKey(user.id, shareDerivedKey); err != nil || encKey != rotation.NewKey {
+		t.Errorf("the share token doesn't give the new key: %v", err)
+	}
+	if _, err := utils.GetEncryptionKey(user.id, user.derivedKey); err == nil {
+		t.Error("the old derived key still unwraps the encryption key")
+	}
+}
+
+// waitForKeyRotation waits until the background rotation of the test user has completed
+func waitForKeyRotation(t *testing.T, user *testUser) {
+	t.Helper()
+
+	deadline := time.Now().Add(10 * time.Second)
+	for time.Now().Before(deadline) {
+		activeKeyRotationsMutex.Lock()
+		active := activeKeyRotations[user.id]
+		activeKeyRotationsMutex.Unlock()
+		keyRotationProgressMutex.Lock()
+		phase := keyRotationProgress[user.id].Phase
+		keyRotationProgressMutex.Unlock()
+
+		if !active && (phase == "completed" || phase == "failed") {
+			if phase == "failed" {
+				t.Fatal("the key rotation failed")
+			}
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("the key rotation didn't finish")
+}
+
+// resetKeyRotations forgets the rotations of earlier tests
+func resetKeyRotations(t *testing.T) {
+	t.Helper()
+
+	activeKeyRotationsMutex.Lock()
+	activeKeyRotations = make(map[int]bool)
+	activeKeyRotationsMutex.Unlock()
+	keyRotationProgressMutex.Lock()
+	keyRotationProgress = make(map[int]MigrationProgress)
+	keyRotationProgressMutex.Unlock()
+}
+
+func TestKeyRotation(t *testing.T) {
+	user := newTestUser(t)
+	encKey := user.encKey(t)
+	secret := setupRotationData(t, user, encKey)
+
+	rotation, err := utils.StartKeyRotation(user.id, "password", user.derivedKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rotation.OldKey != encKey || rotation.NewKey == encKey {
+		t.Fatal("the rotation doesn't replace the key of the user")
+	}
+	if _, err := utils.StartKeyRotation(user.id, "password", rotation.DerivedKey); err != utils.ErrKeyRotationPending {
+		t.Errorf("second start: %v, want ErrKeyRotationPending", err)
+	}
+
+	if err := utils.RotateUserData(user.id, rotation.OldKey, rotation.NewKey, nil); err != nil {
+		t.Fatal(err)
+	}
+	checkRotated(t, user, rotation, secret)
+}
+
+func TestResumeKeyRotation(t *testing.T) {
+	resetKeyRotations(t)
+	user := newTestUser(t)
+	encKey := user.encKey(t)
+	secret := setupRotationData(t, user, encKey)
+
+	// The server stopped right after the key was replaced, only the tags were re-encrypted
+	rotation, err := utils.StartKeyRotation(user.id, "password", user.derivedKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tags, err := utils.GetTags(user.id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tag := tags["tags"].([]any)[0].(map[string]any)
+	for _, field := range []string{"icon", "name", "color"} {
+		text, err := utils.DecryptText(tag[field].(string), rotation.OldKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tag[field], err = utils.EncryptText(text, rotation.NewKey); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := utils.WriteTags(user.id, tags); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, ok := storedUser(t)["key_rotation"].(map[string]any)["enc_old_key"].(string); !ok {
+		t.Fatal("no enc_old_key in the pending rotation")
+	}
+	oldKey, newKey, err := utils.PendingKeyRotation(user.id, rotation.DerivedKey)
+	if err != nil || oldKey != rotation.OldKey || newKey != rotation.NewKey {
+		t.Fatalf("PendingKeyRotation = %v, want the keys of the rotation", err)
+	}
+
+	resumeKeyRotation(user.id, rotation.DerivedKey)
+	waitForKeyRotation(t, user)
+	checkRotated(t, user, rotation, secret)
+	if _, pending := storedUser(t)["key_rotation"]; pending {
+		t.Error("key_rotation is still stored")
+	}
+}
@@ -0,0 +1,79 @@
+package handlers
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+	"testing"
+
+	"github.com/phitux/dailytxt/backend/utils"
+)
+
+// TestConcurrentMonthUpdates saves days and tags a day of the same month from many goroutines at once.
+// Without the lock of the month, the read-modify-write cycles overwrite each other's changes.
+// Run with -race.
+func TestConcurrentMonthUpdates(t *testing.T) {
+	user := newTestUser(t)
+	const workers, rounds = 25, 10
+
+	var wg sync.WaitGroup
+	errs := make(chan string, 2*workers)
+	for i := range workers {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			for round := range rounds {
+				w := user.do(SaveLog, "POST", "/logs/saveLog", LogRequest{Day: i + 2, Month: 5, Year: 2024, Text: fmt.Sprintf("text %d/%d", i, round)})
+				if w.Code != http.StatusOK {
+					errs <- fmt.Sprintf("saveLog of day %d: %d %s", i+2, w.Code, w.Body.String())
+					return
+				}
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			for round := range rounds {
+				tagID := i*rounds + round + 1
+				w := user.do(AddTagToLog, "POST", "/logs/addTagToLog", TagLogRequest{Day: 1, Month: 5, Year: 2024, TagID: tagID})
+				if w.Code != http.StatusOK {
+					errs <- fmt.Sprintf("addTagToLog of tag %d: %d %s", tagID, w.Code, w.Body.String())
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+
+	content, err := utils.GetMonth(user.id, 2024, 5)
+	if err != nil {
+		t.Fatalf("reading the month: %v", err)
+	}
+	encKey := user.encKey(t)
+
+	texts := map[int]string{}
+	var tags []any
+	for _, d := range content["days"].([]any) {
+		day := d.(map[string]any)
+		dayNum := int(day["day"].(float64))
+		if dayNum == 1 {
+			tags, _ = day["tags"].([]any)
+			continue
+		}
+		if texts[dayNum], err = utils.DecryptText(day["text"].(string), encKey); err != nil {
+			t.Fatalf("decrypting day %d: %v", dayNum, err)
+		}
+	}
+
+	for i := range workers {
+		if want := fmt.Sprintf("text %d/%d", i, rounds-1); texts[i+2] != want {
+			t.Errorf("day %d = %q, want %q", i+2, texts[i+2], want)
+		}
+	}
+	if len(tags) != workers*rounds {
+		t.Errorf("day 1 has %d tags, want %d", len(tags), workers*rounds)
+	}
+}
@@ -7,6 +7,7 @@ import (
 	"net/http"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/phitux/dailytxt/backend/utils"
 )
@@ -41,6 +42,9 @@ func SaveLog(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Lock the month while it is read, modified and written
+	defer utils.LockMonth(userID, req.Year, req.Month)()
+
 	// Get month data
 	content, err := utils.GetMonth(userID, req.Year, req.Month)
 	if err != nil {
@@ -48,6 +52,22 @@ func SaveLog(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Get encryption key
+	encKey, err := utils.GetEncryptionKey(userID, derivedKey)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error getting encryption key: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	// Reject the save if the client edited an outdated revision
+	currentDay := findDay(content, req.Day)
+	revision := getDayRevision(currentDay)
+	if ifMatch := r.Header.Get("If-Match"); ifMatch != "" && !matchesRevision(ifMatch, revision) {
+		revisionConflict(w, currentDay, encKey, revision)
+		return
+	}
+	revision++
+
 	// Check if there's a previous log to move to history
 	historyAvailable := false
 	days, ok := content["days"].([]any)
@@ -64,34 +84,8 @@ func SaveLog(w http.ResponseWriter, r *http.Request) {
 			}
 
 			// If this day has text, move it to history
-			if text, ok := day["text"].(string); ok && text != "" {
+			if addToHistory(day) > 0 {
 				historyAvailable = true
-				historyVersion := 0
-
-				// Get or create history array
-				var history []any
-				if historyArray, ok := day["history"].([]any); ok {
-					history = historyArray
-					// Find highest version
-					for _, historyItem := range history {
-						if historyMap, ok := historyItem.(map[string]any); ok {
-							if version, ok := historyMap["version"].(float64); ok && int(version) > historyVersion {
-								historyVersion = int(version)
-							}
-						}
-					}
-				} else {
-					history = []any{}
-				}
-
-				historyVersion++
-				history = append(history, map[string]any{
-					"version":      historyVersion,
-					"text":         day["text"],
-					"date_written": day["date_written"],
-				})
-
-				day["history"] = history
 				days[i] = day
 			}
 			break
@@ -99,13 +93,6 @@ func SaveLog(w http.ResponseWriter, r *http.Request) {
 		content["days"] = days
 	}
 
-	// Get encryption key
-	encKey, err := utils.GetEncryptionKey(userID, derivedKey)
-	if err != nil {
-		http.Error(w, fmt.Sprintf("Error getting encryption key: %v", err), http.StatusInternalServerError)
-		return
-	}
-
 	// Encrypt text and date_written
 	encryptedText, err := utils.EncryptText(req.Text, encKey)
 	if err != nil {
@@ -119,6 +106,12 @@ func SaveLog(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	encryptedSavedAt, err := utils.EncryptSavedAt(time.Now(), encKey)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error encrypting saved_at: %v", err), http.StatusInternalServerError)
+		return
+	}
+
 	// Save new log
 	found := false
 	if days, ok := content["days"].([]any); ok {
@@ -136,6 +129,8 @@ func SaveLog(w http.ResponseWriter, r *http.Request) {
 			// Update existing day
 			day["text"] = encryptedText
 			day["date_written"] = encryptedDateWritten
+			day["saved_at"] = encryptedSavedAt
+			day["revision"] = revision
 			days[i] = day
 			found = true
 			break
@@ -147,6 +142,8 @@ func SaveLog(w http.ResponseWriter, r *http.Request) {
 				"day":          req.Day,
 				"text":         encryptedText,
 				"date_written": encryptedDateWritten,
+				"saved_at":     encryptedSavedAt,
+				"revision":     revision,
 			})
 		}
 
@@ -158,6 +155,8 @@ func SaveLog(w http.ResponseWriter, r *http.Request) {
 				"day":          req.Day,
 				"text":         encryptedText,
 				"date_written": encryptedDateWritten,
+				"saved_at":     encryptedSavedAt,
+				"revision":     revision,
 			},
 		}
 	}
@@ -167,15 +166,144 @@ func SaveLog(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, fmt.Sprintf("Error writing month data: %v", err), http.StatusInternalServerError)
 		return
 	}
+	updateSearchIndex(r, req.Year, req.Month, content, req.Day)
+
+	// Autosave fills the history quickly, thin it out now and then
+	compactHistory(userID, encKey, false)
 
 	// Return success
+	w.Header().Set("ETag", revisionETag(revision))
 	utils.JSONResponse(w, http.StatusOK, map[string]any{
 		"success":           true,
 		"history_available": historyAvailable,
+		"revision":          revision,
+	})
+}
+
+// findDay returns the day entry of a month, or nil if the day has no entry
+func findDay(content map[string]any, dayValue int) map[string]any {
+	days, ok := content["days"].([]any)
+	if !ok {
+		return nil
+	}
+
+	for _, dayInterface := range days {
+		day, ok := dayInterface.(map[string]any)
+		if !ok {
+			continue
+		}
+		if dayNum, ok := day["day"].(float64); ok && int(dayNum) == dayValue {
+			return day
+		}
+	}
+
+	return nil
+}
+
+// addToHistory moves the current text of a day to its history and returns the version number
+// of the new history entry (0 if the day has no text)
+func addToHistory(day map[string]any) int {
+	text, ok := day["text"].(string)
+	if !ok || text == "" {
+		return 0
+	}
+
+	// Get or create history array
+	history, _ := day["history"].([]any)
+	historyVersion := 0
+	for _, historyItem := range history {
+		if historyMap, ok := historyItem.(map[string]any); ok {
+			historyVersion = max(historyVersion, getHistoryVersion(historyMap))
+		}
+	}
+
+	historyVersion++
+	historyEntry := map[string]any{
+		"version":      historyVersion,
+		"text":         day["text"],
+		"date_written": day["date_written"],
+	}
+	if savedAt, ok := day["saved_at"]; ok {
+		historyEntry["saved_at"] = savedAt
+	}
+	// A text that was restored from an older version keeps this information in the history
+	if restoredFrom, ok := day["restored_from"]; ok {
+		historyEntry["restored_from"] = restoredFrom
+		delete(day, "restored_from")
+	}
+	day["history"] = append(history, historyEntry)
+
+	return historyVersion
+}
+
+// getDayRevision returns the revision counter of a day (0 if it has never been saved)
+func getDayRevision(day map[string]any) int {
+	switch revision := day["revision"].(type) {
+	case float64:
+		return int(revision)
+	case int:
+		return revision
+	}
+	return 0
+}
+
+// getHistoryVersion returns the version number of a history entry
+func getHistoryVersion(entry map[string]any) int {
+	switch version := entry["version"].(type) {
+	case float64:
+		return int(version)
+	case int:
+		return version
+	}
+	return 0
+}
+
+// revisionETag formats a revision counter as ETag
+func revisionETag(revision int) string {
+	return fmt.Sprintf("\"%d\"", revision)
+}
+
+// revisionConflict responds with the current text of a day, after a client edited an outdated revision
+func revisionConflict(w http.ResponseWriter, currentDay map[string]any, encKey string, revision int) {
+	var err error
+	currentText := ""
+	currentDateWritten := ""
+	if encryptedText, ok := currentDay["text"].(string); ok && encryptedText != "" {
+		if currentText, err = utils.DecryptText(encryptedText, encKey); err != nil {
+			http.Error(w, fmt.Sprintf("Error decrypting text: %v", err), http.StatusInternalServerError)
+			return
+		}
+	}
+	if encryptedDate, ok := currentDay["date_written"].(string); ok && encryptedDate != "" {
+		if currentDateWritten, err = utils.DecryptText(encryptedDate, encKey); err != nil {
+			http.Error(w, fmt.Sprintf("Error decrypting date_written: %v", err), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	w.Header().Set("ETag", revisionETag(revision))
+	utils.JSONResponse(w, http.StatusConflict, map[string]any{
+		"success":      false,
+		"conflict":     true,
+		"text":         currentText,
+		"date_written": currentDateWritten,
+		"revision":     revision,
 	})
 }
 
-// GetLog handles retrieving a log entry
+// matchesRevision checks the revision against the ETags of an If-Match header
+func matchesRevision(ifMatch string, revision int) bool {
+	for _, tag := range strings.Split(ifMatch, ",") {
+		tag = strings.TrimPrefix(strings.TrimSpace(tag), "W/")
+		if tag == "*" || tag == revisionETag(revision) || tag == strconv.Itoa(revision) {
+			return true
+		}
+	}
+	return false
+}
+
+// GetLog returns a day for the editor: the main text with the fields of the day and, in "entries", only the
+// further entries, each edited on its own. GetEntries lists the main text among the entries for reading.
 func GetLog(w http.ResponseWriter, r *http.Request) {
 	// Get user ID and derived key from context
 	userID, ok := r.Context().Value(utils.UserIDKey).(int)
@@ -219,7 +347,10 @@ func GetLog(w http.ResponseWriter, r *http.Request) {
 		"date_written": "",
 		"files":        []any{},
 		"tags":         []any{},
+		"entries":      []any{},
+		"revision":     0,
 	}
+	w.Header().Set("ETag", revisionETag(0))
 
 	// Check if days exist
 	days, ok := content["days"].([]any)
@@ -276,28 +407,10 @@ func GetLog(w http.ResponseWriter, r *http.Request) {
 		}
 
 		// Decrypt filenames if files exist
-		files := []any{}
-		if filesList, ok := day["files"].([]any); ok {
-			for _, fileInterface := range filesList {
-				file, ok := fileInterface.(map[string]any)
-				if !ok {
-					continue
-				}
-
-				if encFilename, ok := file["enc_filename"].(string); ok {
-					decryptedFilename, err := utils.DecryptText(encFilename, encKey)
-					if err != nil {
-						http.Error(w, fmt.Sprintf("Error decrypting filename: %v", err), http.StatusInternalServerError)
-						return
-					}
-					fileCopy := make(map[string]any)
-					for k, v := range file {
-						fileCopy[k] = v
-					}
-					fileCopy["filename"] = decryptedFilename
-					files = append(files, fileCopy)
-				}
-			}
+		files, err := decryptFileList(day["files"], encKey)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
 		}
 
 		// Get tags
@@ -306,14 +419,29 @@ func GetLog(w http.ResponseWriter, r *http.Request) {
 			tags = tagsList
 		}
 
+		// Decrypt the further entries of the day
+		entries, err := decryptEntries(day, encKey)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
 		// Return log data
-		utils.JSONResponse(w, http.StatusOK, map[string]any{
+		revision := getDayRevision(day)
+		result := map[string]any{
 			"text":              text,
 			"date_written":      dateWritten,
 			"files":             files,
 			"tags":              tags,
+			"entries":           entries,
 			"history_available": historyAvailable,
-		})
+			"revision":          revision,
+		}
+		if restoredFrom, ok := day["restored_from"]; ok {
+			result["restored_from"] = restoredFrom
+		}
+		w.Header().Set("ETag", revisionETag(revision))
+		utils.JSONResponse(w, http.StatusOK, result)
 		return
 	}
 
@@ -366,13 +494,13 @@ func GetMarkedDays(w http.ResponseWriter, r *http.Request) {
 				continue
 			}
 
-			// Check for text
-			if _, ok := day["text"].(string); ok {
+			// Check for text or entries
+			if _, ok := day["text"].(string); ok || utils.DayHasEntries(day) {
 				daysWithLogs = append(daysWithLogs, int(dayNum))
 			}
 
-			// Check for files
-			if files, ok := day["files"].([]any); ok && len(files) > 0 {
+			// Check for files (of the day or its entries)
+			if len(utils.DayFiles(day)) > 0 {
 				daysWithFiles = append(daysWithFiles, int(dayNum))
 			}
 
@@ -434,6 +562,9 @@ func BookmarkDay(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Lock the month while it is read, modified and written
+	defer utils.LockMonth(userID, year, month)()
+
 	// Get month data
 	content, err := utils.GetMonth(userID, year, month)
 	if err != nil {
@@ -489,6 +620,7 @@ func BookmarkDay(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, fmt.Sprintf("Failed to bookmark day - error writing log: %v", err), http.StatusInternalServerError)
 		return
 	}
+	updateSearchIndex(r, year, month, content, day)
 
 	// Return success
 	utils.JSONResponse(w, http.StatusOK, map[string]any{
@@ -576,16 +708,23 @@ func GetALookBack(w http.ResponseWriter, r *http.Request) {
 				continue
 			}
 
-			text, ok := dayLog["text"].(string)
-			if !ok || text == "" {
-				continue
+			// Decrypt the texts of the day and its entries
+			texts := []string{}
+			for _, part := range utils.DayParts(dayLog) {
+				text, ok := part["text"].(string)
+				if !ok || text == "" {
+					continue
+				}
+				decryptedText, err := utils.DecryptText(text, encKey)
+				if err != nil || decryptedText == "" {
+					continue
+				}
+				texts = append(texts, decryptedText)
 			}
-
-			// Decrypt text
-			decryptedText, err := utils.DecryptText(text, encKey)
-			if err != nil {
+			if len(texts) == 0 {
 				continue
 			}
+			decryptedText := strings.Join(texts, "\n\n")
 
 			results = append(results, map[string]any{
 				"years_old": currentYear - year,
@@ -704,30 +843,24 @@ func LoadMonthForReading(w http.ResponseWriter, r *http.Request) {
 
 		// Decrypt filenames if files exist
 		if filesList, ok := day["files"].([]any); ok && len(filesList) > 0 {
-			files := []any{}
-			for _, fileInterface := range filesList {
-				file, ok := fileInterface.(map[string]any)
-				if !ok {
-					continue
-				}
-
-				if encFilename, ok := file["enc_filename"].(string); ok {
-					decryptedFilename, err := utils.DecryptText(encFilename, encKey)
-					if err != nil {
-						http.Error(w, fmt.Sprintf("Error decrypting filename: %v", err), http.StatusInternalServerError)
-						return
-					}
-					fileCopy := make(map[string]any)
-					for k, v := range file {
-						fileCopy[k] = v
-					}
-					fileCopy["filename"] = decryptedFilename
-					files = append(files, fileCopy)
-				}
+			files, err := decryptFileList(filesList, encKey)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
 			}
 			resultDay["files"] = files
 		}
 
+		// All texts of the day as entries, ordered by time
+		entries, err := readingEntries(day, encKey)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if len(entries) > 0 {
+			resultDay["entries"] = entries
+		}
+
 		// Add day to result if it has content
 		if _, hasText := resultDay["text"]; hasText {
 			result = append(result, resultDay)
@@ -735,6 +868,8 @@ func LoadMonthForReading(w http.ResponseWriter, r *http.Request) {
 			result = append(result, resultDay)
 		} else if _, hasTags := resultDay["tags"]; hasTags {
 			result = append(result, resultDay)
+		} else if _, hasEntries := resultDay["entries"]; hasEntries {
+			result = append(result, resultDay)
 		}
 	}
 
@@ -742,7 +877,8 @@ func LoadMonthForReading(w http.ResponseWriter, r *http.Request) {
 	utils.JSONResponse(w, http.StatusOK, result)
 }
 
-// GetHistory handles retrieving log history
+// GetHistory handles retrieving log history.
+// With events=true, the events of the history (restores) are listed between the versions.
 func GetHistory(w http.ResponseWriter, r *http.Request) {
 	// Get user ID and derived key from context
 	userID, ok := r.Context().Value(utils.UserIDKey).(int)
@@ -789,6 +925,7 @@ func GetHistory(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Invalid year parameter", http.StatusBadRequest)
 		return
 	}
+	withEvents := r.URL.Query().Get("events") == "true"
 
 	// Get encryption key
 	encKey, err := utils.GetEncryptionKey(userID, derivedKey)
@@ -823,6 +960,12 @@ func GetHistory(w http.ResponseWriter, r *http.Request) {
 			continue
 		}
 
+		// The history of an entry of the day
+		if dayObj = historyTarget(dayObj, r.URL.Query().Get("entry_id")); dayObj == nil {
+			utils.JSONResponse(w, http.StatusOK, []any{})
+			return
+		}
+
 		// Check for history
 		history, ok := dayObj["history"].([]any)
 		if !ok || len(history) == 0 {
@@ -838,6 +981,26 @@ func GetHistory(w http.ResponseWriter, r *http.Request) {
 				continue
 			}
 
+			if utils.IsHistoryEvent(historyEntry) {
+				if !withEvents {
+					continue
+				}
+				eventResult := map[string]any{
+					"event":         historyEntry["event"],
+					"restored_from": historyEntry["restored_from"],
+				}
+				if savedAt, ok := historyEntry["saved_at"].(string); ok && savedAt != "" {
+					decryptedSavedAt, err := utils.DecryptText(savedAt, encKey)
+					if err != nil {
+						http.Error(w, fmt.Sprintf("Error decrypting history save time: %v", err), http.StatusInternalServerError)
+						return
+					}
+					eventResult["saved_at"] = decryptedSavedAt
+				}
+				result = append(result, eventResult)
+				continue
+			}
+
 			text, ok := historyEntry["text"].(string)
 			if !ok {
 				continue
@@ -861,10 +1024,23 @@ func GetHistory(w http.ResponseWriter, r *http.Request) {
 				return
 			}
 
-			result = append(result, map[string]any{
+			historyResult := map[string]any{
+				"version":      getHistoryVersion(historyEntry),
 				"text":         decryptedText,
 				"date_written": decryptedDate,
-			})
+			}
+			if restoredFrom, ok := historyEntry["restored_from"]; ok {
+				historyResult["restored_from"] = restoredFrom
+			}
+			if savedAt, ok := historyEntry["saved_at"].(string); ok && savedAt != "" {
+				decryptedSavedAt, err := utils.DecryptText(savedAt, encKey)
+				if err != nil {
+					http.Error(w, fmt.Sprintf("Error decrypting history save time: %v", err), http.StatusInternalServerError)
+					return
+				}
+				historyResult["saved_at"] = decryptedSavedAt
+			}
+			result = append(result, historyResult)
 		}
 
 		// Return history
@@ -879,9 +1055,6 @@ func GetHistory(w http.ResponseWriter, r *http.Request) {
 // DeleteDay deletes all data of the specified day
 // Also delete files, that might be uploaded
 func DeleteDay(w http.ResponseWriter, r *http.Request) {
-	utils.UsersFileMutex.Lock()
-	defer utils.UsersFileMutex.Unlock()
-
 	// Get user ID from context
 	userID, ok := r.Context().Value(utils.UserIDKey).(int)
 	if !ok {
@@ -906,6 +1079,9 @@ func DeleteDay(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Lock the month while it is read, modified and written
+	defer utils.LockMonth(userID, year, month)()
+
 	// Get month data
 	content, err := utils.GetMonth(userID, year, month)
 	if err != nil {
@@ -930,23 +1106,11 @@ func DeleteDay(w http.ResponseWriter, r *http.Request) {
 			continue
 		}
 
-		// Delete associated files before removing the day entry
-		if filesList, ok := day["files"].([]any); ok && len(filesList) > 0 {
-			for _, fileInterface := range filesList {
-				file, ok := fileInterface.(map[string]any)
-				if !ok {
-					continue
-				}
-
-				if fileID, ok := file["uuid_filename"].(string); ok {
-					// Delete the actual file from the filesystem
-					err := utils.RemoveFile(userID, fileID)
-					if err != nil {
-						utils.Logger.Printf("Warning: Failed to delete file %s for user %d: %v", fileID, userID, err)
-						// Continue with deletion even if file removal fails
-					}
-				}
-			}
+		// Keep the day (with its files) in the trash, so it can be restored
+		trashID, err := utils.MoveToTrash(userID, utils.TrashDay, year, month, dayValue, day, time.Now())
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Error moving day to trash: %v", err), http.StatusInternalServerError)
+			return
 		}
 
 		// Remove the day from the days array
@@ -954,9 +1118,14 @@ func DeleteDay(w http.ResponseWriter, r *http.Request) {
 		content["days"] = days
 
 		if err := utils.WriteMonth(userID, year, month, content); err != nil {
+			// The day is still there, so it must not be in the trash as well
+			if _, err := utils.RemoveFromTrash(userID, trashID); err != nil {
+				utils.Logger.Printf("Warning: Failed to remove day from trash for user %d: %v", userID, err)
+			}
 			http.Error(w, fmt.Sprintf("Error writing month data: %v", err), http.StatusInternalServerError)
 			return
 		}
+		updateSearchIndex(r, year, month, content, dayValue)
 
 		utils.JSONResponse(w, http.StatusOK, map[string]bool{"success": true})
 		return
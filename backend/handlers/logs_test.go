@@ -0,0 +1,95 @@
+package handlers
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/phitux/dailytxt/backend/utils"
+)
+
+func TestSaveAndGetLog(t *testing.T) {
+	user := newTestUser(t)
+
+	saved := user.mustDo(t, SaveLog, "POST", "/logs/saveLog", LogRequest{Day: 3, Month: 5, Year: 2024, Text: "Hello world", DateWritten: "today"})
+	if saved["revision"] != float64(1) {
+		t.Errorf("revision after the first save = %v, want 1", saved["revision"])
+	}
+
+	log := user.mustDo(t, GetLog, "GET", "/logs/getLog?day=3&month=5&year=2024", nil)
+	if log["text"] != "Hello world" || log["date_written"] != "today" {
+		t.Errorf("getLog = %v, want the saved text and date", log)
+	}
+
+	empty := user.mustDo(t, GetLog, "GET", "/logs/getLog?day=4&month=5&year=2024", nil)
+	if empty["text"] != "" || empty["revision"] != float64(0) {
+		t.Errorf("getLog of an empty day = %v", empty)
+	}
+}
+
+func TestSaveLogEncryptsTheMonth(t *testing.T) {
+	user := newTestUser(t)
+	user.mustDo(t, SaveLog, "POST", "/logs/saveLog", LogRequest{Day: 3, Month: 5, Year: 2024, Text: "a very secret text"})
+
+	data, err := utils.Store.ReadMonth(user.id, 2024, 5)
+	if err != nil {
+		t.Fatalf("reading the month: %v", err)
+	}
+	if bytes.Contains(data, []byte("secret")) {
+		t.Errorf("the month document contains the plain text: %s", data)
+	}
+}
+
+func TestSaveLogKeepsHistory(t *testing.T) {
+	user := newTestUser(t)
+	user.mustDo(t, SaveLog, "POST", "/logs/saveLog", LogRequest{Day: 3, Month: 5, Year: 2024, Text: "first"})
+	saved := user.mustDo(t, SaveLog, "POST", "/logs/saveLog", LogRequest{Day: 3, Month: 5, Year: 2024, Text: "second"})
+	if saved["history_available"] != true {
+		t.Errorf("history_available after the second save = %v, want true", saved["history_available"])
+	}
+
+	w := user.do(GetHistory, "GET", "/logs/getHistory?day=3&month=5&year=2024", nil)
+	if w.Code != http.StatusOK || !bytes.Contains(w.Body.Bytes(), []byte(`"text":"first"`)) {
+		t.Errorf("getHistory = %d %s, want the first text", w.Code, w.Body.String())
+	}
+}
+
+func TestSaveLogRejectsOutdatedRevision(t *testing.T) {
+	user := newTestUser(t)
+	user.mustDo(t, SaveLog, "POST", "/logs/saveLog", LogRequest{Day: 3, Month: 5, Year: 2024, Text: "first"})
+	user.mustDo(t, SaveLog, "POST", "/logs/saveLog", LogRequest{Day: 3, Month: 5, Year: 2024, Text: "second"})
+
+	r := user.request("POST", "/logs/saveLog", LogRequest{Day: 3, Month: 5, Year: 2024, Text: "edited the first"})
+	r.Header.Set("If-Match", `"1"`)
+	w := httptest.NewRecorder()
+	SaveLog(w, r)
+	if w.Code != http.StatusConflict {
+		t.Fatalf("save with an outdated revision: status %d, want %d", w.Code, http.StatusConflict)
+	}
+
+	log := user.mustDo(t, GetLog, "GET", "/logs/getLog?day=3&month=5&year=2024", nil)
+	if log["text"] != "second" {
+		t.Errorf("text after the rejected save = %v, want second", log["text"])
+	}
+}
+
+func TestDeleteDayMovesItToTheTrash(t *testing.T) {
+	user := newTestUser(t)
+	user.mustDo(t, SaveLog, "POST", "/logs/saveLog", LogRequest{Day: 3, Month: 5, Year: 2024, Text: "deleted soon"})
+	user.mustDo(t, DeleteDay, "GET", "/logs/deleteDay?day=3&month=5&year=2024", nil)
+
+	log := user.mustDo(t, GetLog, "GET", "/logs/getLog?day=3&month=5&year=2024", nil)
+	if log["text"] != "" {
+		t.Errorf("text of the deleted day = %v, want none", log["text"])
+	}
+
+	trash := user.mustDo(t, GetTrash, "GET", "/logs/getTrash", nil)
+	items, _ := trash["items"].([]any)
+	if len(items) != 1 {
+		t.Fatalf("trash items = %v, want the deleted day", trash["items"])
+	}
+	if item, _ := items[0].(map[string]any); item["text"] != "deleted soon" {
+		t.Errorf("trash item = %v, want the text of the day", item)
+	}
+}
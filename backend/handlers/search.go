@@ -1,19 +1,21 @@
 package handlers
 
 import (
+	"encoding/base64"
+	"encoding/json"
 	"fmt"
 	"net/http"
-	"os"
-	"path/filepath"
-	"regexp"
+	"net/url"
 	"sort"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/phitux/dailytxt/backend/utils"
 )
 
-// SearchTag handles searching logs by tag
+// SearchTag handles searching logs by tag. Search with a tag: filter does the same,
+// this endpoint is kept for existing clients.
 func SearchTag(w http.ResponseWriter, r *http.Request) {
 	// Get user ID and derived key from context
 	userID, ok := r.Context().Value(utils.UserIDKey).(int)
@@ -46,150 +48,452 @@ func SearchTag(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Get all years and months
-	years, err := utils.GetYears(userID)
+	index, err := utils.OpenSearchIndex(userID, encKey)
 	if err != nil {
-		http.Error(w, fmt.Sprintf("Error retrieving years: %v", err), http.StatusInternalServerError)
+		http.Error(w, fmt.Sprintf("Error opening search index: %v", err), http.StatusInternalServerError)
 		return
 	}
 
-	// Search for tag
+	// The same as a search for tag:<name>, the tag may be used by the day itself or by its entries
+	query := &searchQuery{kind: queryTag, tags: map[int]bool{tagID: true}}
 	results := []any{}
-	for _, year := range years {
-		yearInt, _ := strconv.Atoi(year)
-		months, err := utils.GetMonths(userID, year)
-		if err != nil {
-			continue
+	query.each(index, func(doc *utils.SearchDoc) bool {
+		context := query.context(doc)
+		result := map[string]any{
+			"year":       doc.Year,
+			"month":      doc.Month,
+			"day":        doc.Day,
+			"text":       context.html(),
+			"snippet":    context.snippet,
+			"highlights": context.highlights(),
 		}
+		if doc.EntryID != "" {
+			result["entry_id"] = doc.EntryID
+		}
+		results = append(results, result)
+		return true
+	})
 
-		for _, month := range months {
-			monthInt, _ := strconv.Atoi(month)
-			content, err := utils.GetMonth(userID, yearInt, monthInt)
-			if err != nil {
-				continue
-			}
+	// Return results
+	utils.JSONResponse(w, http.StatusOK, results)
+}
+
+// searchLanguage returns the language of the user settings, to stem the words of a search
+func searchLanguage(userID int, encKey string) string {
+	settings, err := loadUserSettings(userID, encKey)
+	if err != nil {
+		utils.Logger.Printf("Error loading the settings of user %d for a search: %v", userID, err)
+		return ""
+	}
+	language, _ := settings["language"].(string)
+	return language
+}
+
+// maxSearchLimit is the maximum number of results of a page
+const maxSearchLimit = 500
+
+// searchOptions are the order, paging and streaming options of a search
+type searchOptions struct {
+	order  string        // "date" (the default) or "relevance"
+	limit  int           // results per page, 0 for all results at once
+	cursor *searchCursor // the page starts after this result
+	stream string        // "ndjson" or "sse" to stream the results
+	fuzzy  bool          // match words with typos as well
+
+	// The scope of the search: the current texts (the default), the history and the trash
+	current, history, trash bool
+}
+
+// searchCursor marks the last result of a page. It is handed out encoded, as next_cursor.
+type searchCursor struct {
+	Key   string  `json:"k"`
+	Score float64 `json:"s,omitempty"`
+}
+
+// encode returns the cursor as a string for the client
+func (c *searchCursor) encode() string {
+	data, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+// parseSearchOptions reads the options of a search: order, limit, cursor, stream, fuzzy and scope
+func parseSearchOptions(r *http.Request) (searchOptions, error) {
+	params := r.URL.Query()
+	opts := searchOptions{order: "date", stream: params.Get("stream"), current: true}
 
-			days, ok := content["days"].([]any)
-			if !ok {
-				continue
+	if order := params.Get("order"); order != "" {
+		if order != "date" && order != "relevance" {
+			return opts, fmt.Errorf("invalid order %q, expected date or relevance", order)
+		}
+		opts.order = order
+	}
+	if limit := params.Get("limit"); limit != "" {
+		n, err := strconv.Atoi(limit)
+		if err != nil || n < 1 {
+			return opts, fmt.Errorf("invalid limit %q", limit)
+		}
+		opts.limit = min(n, maxSearchLimit)
+	}
+	if cursor := params.Get("cursor"); cursor != "" {
+		data, err := base64.RawURLEncoding.DecodeString(cursor)
+		opts.cursor = &searchCursor{}
+		if err != nil || json.Unmarshal(data, opts.cursor) != nil {
+			return opts, fmt.Errorf("invalid cursor")
+		}
+	}
+	if fuzzy := params.Get("fuzzy"); fuzzy != "" {
+		var err error
+		if opts.fuzzy, err = strconv.ParseBool(fuzzy); err != nil {
+			return opts, fmt.Errorf("invalid value %q for fuzzy, expected true or false", fuzzy)
+		}
+	}
+	if scope := params.Get("scope"); scope != "" {
+		opts.current = false
+		for _, part := range strings.Split(scope, ",") {
+			switch strings.TrimSpace(part) {
+			case "current":
+				opts.current = true
+			case "history":
+				opts.history = true
+			case "trash":
+				opts.trash = true
+			default:
+				return opts, fmt.Errorf("invalid scope %q, expected current, history or trash", part)
 			}
+		}
+	}
+	if opts.stream != "" && opts.stream != "ndjson" && opts.stream != "sse" {
+		return opts, fmt.Errorf("invalid stream %q, expected ndjson or sse", opts.stream)
+	}
+	return opts, nil
+}
+
+// searchHit is a day or an entry that matches a search
+type searchHit struct {
+	doc   *utils.SearchDoc
+	key   string
+	score float64
+}
+
+// searchDocKey orders docs like utils.SortSearchDocs: by date, the day before its entries in the order of their time.
+// The versions in the history follow their day or entry, the deleted items of a date come last.
+func searchDocKey(doc *utils.SearchDoc) string {
+	key := doc.Date()
+	if doc.TrashID != "" {
+		key += "/2/" + doc.TrashID
+	}
+	if doc.EntryID == "" {
+		key += "/0"
+	} else {
+		key += "/1/" + doc.Time + "/" + doc.EntryID
+	}
+	if doc.Version > 0 {
+		key += fmt.Sprintf("/h/%06d", doc.Version)
+	}
+	return key
+}
+
+// scopeDocs returns the docs of the history and the trash a search looks into besides the index,
+// ordered by searchDocKey
+func scopeDocs(userID int, encKey string, opts searchOptions) ([]*utils.SearchDoc, error) {
+	var docs []*utils.SearchDoc
+	if opts.history {
+		history, err := utils.HistorySearchDocs(userID, encKey)
+		if err != nil {
+			return nil, fmt.Errorf("error searching the history: %v", err)
+		}
+		docs = append(docs, history...)
+	}
+	if opts.trash {
+		trash, err := utils.TrashSearchDocs(userID, encKey)
+		if err != nil {
+			return nil, fmt.Errorf("error searching the trash: %v", err)
+		}
+		docs = append(docs, trash...)
+	}
 
-			// Check each day for the tag
-			for _, dayInterface := range days {
-				day, ok := dayInterface.(map[string]any)
-				if !ok {
-					continue
-				}
-
-				dayNum, ok := day["day"].(float64)
-				if !ok {
-					continue
-				}
-
-				tags, ok := day["tags"].([]any)
-				if !ok {
-					continue
-				}
-
-				// Check if tag is in tags
-				found := false
-				for _, t := range tags {
-					if tagIDFloat, ok := t.(float64); ok && int(tagIDFloat) == tagID {
-						found = true
-						break
-					}
-				}
-
-				if !found {
-					continue
-				}
-
-				// Get text snippet
-				context := ""
-				if text, ok := day["text"].(string); ok && text != "" {
-					decryptedText, err := utils.DecryptText(text, encKey)
-					if err != nil {
-						continue
-					}
-					// Get first few words
-					words := strings.Fields(decryptedText)
-					if len(words) > 5 {
-						context = strings.Join(words[:5], " ")
-					} else {
-						context = decryptedText
-					}
-				}
-
-				// Add to results
-				results = append(results, map[string]any{
-					"year":  yearInt,
-					"month": monthInt,
-					"day":   int(dayNum),
-					"text":  context,
-				})
+	keys := make(map[*utils.SearchDoc]string, len(docs))
+	for _, doc := range docs {
+		keys[doc] = searchDocKey(doc)
+	}
+	sort.Slice(docs, func(i, j int) bool {
+		return keys[docs[i]] < keys[docs[j]]
+	})
+	return docs, nil
+}
+
+// eachSearchDoc calls fn for the docs that match the query, until fn returns false: the docs of the index
+// if the current texts are in the scope of the search, merged with the docs of the history and the trash
+// in the order of searchDocKey
+func eachSearchDoc(index *utils.SearchIndex, query *searchQuery, opts searchOptions, extra []*utils.SearchDoc, fn func(doc *utils.SearchDoc) bool) {
+	// emitExtra calls fn for the extra docs before the key, or for all that are left with an empty key
+	next := 0
+	emitExtra := func(key string) bool {
+		for ; next < len(extra) && (key == "" || searchDocKey(extra[next]) < key); next++ {
+			if query.matches(extra[next]) && !fn(extra[next]) {
+				return false
 			}
 		}
+		return true
 	}
 
-	// Return results
-	utils.JSONResponse(w, http.StatusOK, results)
+	stopped := false
+	if opts.current {
+		query.each(index, func(doc *utils.SearchDoc) bool {
+			stopped = !emitExtra(searchDocKey(doc)) || !fn(doc)
+			return !stopped
+		})
+	}
+	if !stopped {
+		emitExtra("")
+	}
 }
 
-// Helper functions for search
-func getStartIndex(text string, index int) int {
-	if index == 0 {
-		return 0
+// after reports whether a hit comes after the cursor in the order of the search
+func (h searchHit) after(cursor *searchCursor, relevance bool) bool {
+	if cursor == nil {
+		return true
 	}
+	if relevance && h.score != cursor.Score {
+		return h.score < cursor.Score
+	}
+	return h.key > cursor.Key
+}
 
-	for i := 0; i < 3; i++ {
-		startIndex := strings.LastIndex(text[:index-1], " ")
-		index = startIndex
-		if startIndex == -1 {
-			return 0
+// searchHits runs a search query and calls emit for the hits of the requested page, in the order of the search.
+// In date order, the hits are emitted while the index is searched. In relevance order, all hits are ranked first.
+// Returns the cursor of the next page, or nil on the last page.
+// extra are the docs of the history and the trash (see scopeDocs).
+func searchHits(index *utils.SearchIndex, query *searchQuery, opts searchOptions, extra []*utils.SearchDoc, emit func(hit searchHit)) *searchCursor {
+	relevance := opts.order == "relevance"
+	now := time.Now()
+
+	var ranked []searchHit
+	var last *searchHit
+	var next *searchCursor
+	count := 0
+	eachSearchDoc(index, query, opts, extra, func(doc *utils.SearchDoc) bool {
+		hit := searchHit{doc: doc, key: searchDocKey(doc)}
+		if relevance {
+			hit.score = query.score(doc, now)
+		}
+		if !hit.after(opts.cursor, relevance) {
+			return true
 		}
+		if relevance {
+			ranked = append(ranked, hit)
+			return true
+		}
+
+		// One more hit than the page holds means there is a next page
+		if opts.limit > 0 && count == opts.limit {
+			next = &searchCursor{Key: last.key}
+			return false
+		}
+		emit(hit)
+		count++
+		last = &hit
+		return true
+	})
+	if !relevance {
+		return next
 	}
 
-	return index + 1
+	sort.SliceStable(ranked, func(i, j int) bool {
+		if ranked[i].score != ranked[j].score {
+			return ranked[i].score > ranked[j].score
+		}
+		return ranked[i].key < ranked[j].key
+	})
+	if opts.limit > 0 && len(ranked) > opts.limit {
+		ranked = ranked[:opts.limit]
+		lastHit := ranked[len(ranked)-1]
+		next = &searchCursor{Key: lastHit.key, Score: lastHit.score}
+	}
+	for _, hit := range ranked {
+		emit(hit)
+	}
+	return next
 }
 
-func getEndIndex(text string, index int) int {
-	if index == len(text)-1 {
-		return len(text)
+// respondSearch runs a search query on the search index of a user and writes one result per matching
+// day or entry, matches in an entry have its entry_id. Matches in the history have the version and a
+// link to its history, matches in the trash the id of the trash item. Without paging or streaming, the
+// results are a plain list, like before there were options.
+func respondSearch(w http.ResponseWriter, userID int, encKey string, query *searchQuery, opts searchOptions) {
+	index, err := utils.OpenSearchIndex(userID, encKey)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error opening search index: %v", err), http.StatusInternalServerError)
+		return
+	}
+	extra, err := scopeDocs(userID, encKey, opts)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error searching: %v", err), http.StatusInternalServerError)
+		return
 	}
 
-	for i := 0; i < 3; i++ {
-		endIndex := strings.Index(text[index+1:], " ")
-		if endIndex == -1 {
-			return len(text)
+	result := func(hit searchHit) map[string]any {
+		context := query.context(hit.doc)
+		result := map[string]any{
+			"year":       strconv.Itoa(hit.doc.Year),
+			"month":      fmt.Sprintf("%02d", hit.doc.Month),
+			"day":        hit.doc.Day,
+			"text":       context.html(),
+			"snippet":    context.snippet,
+			"highlights": context.highlights(),
+		}
+		if hit.doc.EntryID != "" {
+			result["entry_id"] = hit.doc.EntryID
+		}
+		if hit.doc.Version > 0 {
+			result["version"] = hit.doc.Version
+			result["history_url"] = historyURL(hit.doc)
+		}
+		if hit.doc.TrashID != "" {
+			result["trash_id"] = hit.doc.TrashID
 		}
-		index = index + 1 + endIndex
+		if opts.order == "relevance" {
+			result["score"] = hit.score
+		}
+		return result
+	}
+
+	if opts.stream != "" {
+		streamSearch(w, index, query, opts, extra, result)
+		return
+	}
+
+	results := []any{}
+	next := searchHits(index, query, opts, extra, func(hit searchHit) {
+		results = append(results, result(hit))
+	})
+	if opts.limit == 0 && opts.cursor == nil {
+		utils.JSONResponse(w, http.StatusOK, results)
+		return
 	}
 
-	return index
+	response := map[string]any{"results": results, "next_cursor": nil}
+	if next != nil {
+		response["next_cursor"] = next.encode()
+	}
+	utils.JSONResponse(w, http.StatusOK, response)
 }
 
-func getContext(text, searchString string, exact bool) string {
-	// Replace whitespace with non-breaking space
-	re := regexp.MustCompile(`\s+`)
-	text = re.ReplaceAllString(text, " ")
+// historyURL returns the link to the history of the day or entry of a doc, see GetHistory
+func historyURL(doc *utils.SearchDoc) string {
+	params := url.Values{}
+	params.Set("year", strconv.Itoa(doc.Year))
+	params.Set("month", strconv.Itoa(doc.Month))
+	params.Set("day", strconv.Itoa(doc.Day))
+	if doc.EntryID != "" {
+		params.Set("entry_id", doc.EntryID)
+	}
+	return "/api/logs/getHistory?" + params.Encode()
+}
 
-	var pos int
-	if exact {
-		pos = strings.Index(text, searchString)
+// streamSearch writes the results of a search as they are found, as NDJSON (one result per line) or as
+// server-sent "result" events. The results of a month are flushed together. The stream ends with
+// {"done": true, "next_cursor": ...}, as a line or as a "done" event.
+func streamSearch(w http.ResponseWriter, index *utils.SearchIndex, query *searchQuery, opts searchOptions, extra []*utils.SearchDoc, result func(hit searchHit) map[string]any) {
+	if opts.stream == "sse" {
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
 	} else {
-		pos = strings.Index(strings.ToLower(text), strings.ToLower(searchString))
+		w.Header().Set("Content-Type", "application/x-ndjson")
 	}
+	// Keep proxies like nginx from buffering the stream
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+
+	controller := http.NewResponseController(w)
+	write := func(event string, data any) {
+		line, err := json.Marshal(data)
+		if err != nil {
+			utils.Logger.Printf("Error encoding search result: %v", err)
+			return
+		}
+		if opts.stream == "sse" {
+			fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event, line)
+		} else {
+			fmt.Fprintf(w, "%s\n", line)
+		}
+	}
+
+	month := ""
+	next := searchHits(index, query, opts, extra, func(hit searchHit) {
+		if hitMonth := hit.doc.Date()[:7]; hitMonth != month {
+			if month != "" {
+				controller.Flush()
+			}
+			month = hitMonth
+		}
+		write("result", result(hit))
+	})
 
-	if pos == -1 {
-		return "<em>DailyTxT: Error formatting...</em>"
+	done := map[string]any{"done": true, "next_cursor": nil}
+	if next != nil {
+		done["next_cursor"] = next.encode()
 	}
+	write("done", done)
+	controller.Flush()
+}
+
+// updateSearchIndex indexes a day again after the month was written. The search index only speeds up
+// the search, so errors are logged and the index is rebuilt by the next search.
+func updateSearchIndex(r *http.Request, year, month int, content map[string]any, day int) {
+	userID, _ := r.Context().Value(utils.UserIDKey).(int)
+	derivedKey, _ := r.Context().Value(utils.DerivedKeyKey).(string)
 
-	start := getStartIndex(text, pos)
-	end := getEndIndex(text, pos+len(searchString)-1)
-	return text[start:pos] + "<b>" + text[pos:pos+len(searchString)] + "</b>" + text[pos+len(searchString):end]
+	encKey, err := utils.GetEncryptionKey(userID, derivedKey)
+	if err == nil {
+		err = utils.UpdateSearchIndexDay(userID, encKey, year, month, content, day)
+	}
+	if err != nil {
+		utils.Logger.Printf("Error updating the search index of user %d: %v", userID, err)
+		if err := utils.InvalidateSearchIndex(userID); err != nil {
+			utils.Logger.Printf("Error invalidating the search index of user %d: %v", userID, err)
+		}
+	}
 }
 
-// Search handles searching logs for text
+// RebuildSearchIndex builds the search index of the user from scratch
+func RebuildSearchIndex(w http.ResponseWriter, r *http.Request) {
+	// Get user ID and derived key from context
+	userID, ok := r.Context().Value(utils.UserIDKey).(int)
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	derivedKey, ok := r.Context().Value(utils.DerivedKeyKey).(string)
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	// Get encryption key
+	encKey, err := utils.GetEncryptionKey(userID, derivedKey)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error getting encryption key: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	index, err := utils.RebuildSearchIndex(userID, encKey)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error rebuilding search index: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	utils.JSONResponse(w, http.StatusOK, map[string]any{
+		"success":   true,
+		"documents": len(index.AllDocs()),
+	})
+}
+
+// Search handles searching logs with a search query (see searchQuery), given as q
+// or, like before the query syntax, as searchString. The results are ordered by date or,
+// with order=relevance, by their score. limit and cursor page through them and
+// stream=ndjson or stream=sse streams them (see respondSearch). fuzzy=true tolerates typos.
+// scope is a comma separated list of what is searched: current (the default), history and trash.
 func Search(w http.ResponseWriter, r *http.Request) {
 	// Get user ID and derived key from context
 	userID, ok := r.Context().Value(utils.UserIDKey).(int)
@@ -204,7 +508,10 @@ func Search(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Get query parameter
-	searchString := r.URL.Query().Get("searchString")
+	searchString := r.URL.Query().Get("q")
+	if searchString == "" {
+		searchString = r.URL.Query().Get("searchString")
+	}
 	if searchString == "" {
 		http.Error(w, "Missing search parameter", http.StatusBadRequest)
 		return
@@ -217,196 +524,33 @@ func Search(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Get user directory
-	userDir := filepath.Join(utils.Settings.DataPath, strconv.Itoa(userID))
-	results := []any{}
-
-	// Traverse all years and months
-	yearEntries, err := os.ReadDir(userDir)
+	// Get all years
+	years, err := utils.GetYears(userID)
 	if err != nil {
+		http.Error(w, fmt.Sprintf("Error retrieving years: %v", err), http.StatusInternalServerError)
+		return
+	}
+	if len(years) == 0 {
 		http.Error(w, "No logs found to be searched", http.StatusNotFound)
 		return
 	}
 
-	// Regex to match year directories (4 digits)
-	yearRegex := regexp.MustCompile(`^\d{4}$`)
-
-	for _, yearEntry := range yearEntries {
-		if !yearEntry.IsDir() || !yearRegex.MatchString(yearEntry.Name()) {
-			continue
-		}
-		year := yearEntry.Name()
-
-		// Read month files in year directory
-		yearDir := filepath.Join(userDir, year)
-		monthEntries, err := os.ReadDir(yearDir)
-		if err != nil {
-			continue
-		}
-
-		// Regex to match month files (2 digits + .json)
-		monthRegex := regexp.MustCompile(`^(\d{2})\.json$`)
-
-		for _, monthEntry := range monthEntries {
-			if monthEntry.IsDir() {
-				continue
-			}
-
-			matches := monthRegex.FindStringSubmatch(monthEntry.Name())
-			if len(matches) != 2 {
-				continue
-			}
-			month := matches[1]
-
-			// Get month content
-			monthInt, _ := strconv.Atoi(month)
-			yearInt, _ := strconv.Atoi(year)
-			content, err := utils.GetMonth(userID, yearInt, monthInt)
-			if err != nil {
-				continue
-			}
-
-			days, ok := content["days"].([]any)
-			if !ok {
-				continue
-			}
-
-			// Process each day
-			for _, dayInterface := range days {
-				dayLog, ok := dayInterface.(map[string]any)
-				if !ok {
-					continue
-				}
-
-				dayNum, ok := dayLog["day"].(float64)
-				if !ok {
-					continue
-				}
-				day := int(dayNum)
-
-				// Check text
-				if text, ok := dayLog["text"].(string); ok {
-					decryptedText, err := utils.DecryptText(text, encKey)
-					if err != nil {
-						continue
-					}
-
-					// Apply search logic
-					if strings.HasPrefix(searchString, "\"") && strings.HasSuffix(searchString, "\"") {
-						// Exact match
-						searchTerm := searchString[1 : len(searchString)-1]
-						if strings.Contains(decryptedText, searchTerm) {
-							context := getContext(decryptedText, searchTerm, true)
-							results = append(results, map[string]any{
-								"year":  year,
-								"month": month,
-								"day":   day,
-								"text":  context,
-							})
-						}
-					} else if strings.Contains(searchString, "|") {
-						// OR search
-						words := strings.SplitSeq(searchString, "|")
-						for word := range words {
-							wordTrimmed := strings.TrimSpace(word)
-							if strings.Contains(strings.ToLower(decryptedText), strings.ToLower(wordTrimmed)) {
-								context := getContext(decryptedText, wordTrimmed, false)
-								results = append(results, map[string]any{
-									"year":  year,
-									"month": month,
-									"day":   day,
-									"text":  context,
-								})
-								break
-							}
-						}
-					} else if strings.Contains(searchString, " ") {
-						// AND search
-						words := strings.Split(searchString, " ")
-						allWordsMatch := true
-						for _, word := range words {
-							wordTrimmed := strings.TrimSpace(word)
-							if !strings.Contains(strings.ToLower(decryptedText), strings.ToLower(wordTrimmed)) {
-								allWordsMatch = false
-								break
-							}
-						}
-						if allWordsMatch {
-							context := getContext(decryptedText, strings.TrimSpace(words[0]), false)
-							results = append(results, map[string]any{
-								"year":  year,
-								"month": month,
-								"day":   day,
-								"text":  context,
-							})
-						}
-					} else {
-						// Simple search
-						if strings.Contains(strings.ToLower(decryptedText), strings.ToLower(searchString)) {
-							context := getContext(decryptedText, searchString, false)
-							results = append(results, map[string]any{
-								"year":  year,
-								"month": month,
-								"day":   day,
-								"text":  context,
-							})
-						}
-					}
-				}
-
-				// Check filenames
-				if files, ok := dayLog["files"].([]any); ok {
-					for _, fileInterface := range files {
-						file, ok := fileInterface.(map[string]any)
-						if !ok {
-							continue
-						}
-
-						if encFilename, ok := file["enc_filename"].(string); ok {
-							decryptedFilename, err := utils.DecryptText(encFilename, encKey)
-							if err != nil {
-								continue
-							}
-
-							if strings.Contains(strings.ToLower(decryptedFilename), strings.ToLower(searchString)) {
-								context := "📎 " + decryptedFilename
-								results = append(results, map[string]any{
-									"year":  year,
-									"month": month,
-									"day":   day,
-									"text":  context,
-								})
-								break
-							}
-						}
-					}
-				}
-			}
-		}
+	// Tag filters refer to the names of the tags
+	tags, err := loadAndDecryptTags(userID, derivedKey)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error retrieving tags: %v", err), http.StatusInternalServerError)
+		return
+	}
+	opts, err := parseSearchOptions(r)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Invalid search: %v", err), http.StatusBadRequest)
+		return
+	}
+	query, err := parseSearchQuery(searchString, tags, searchLanguage(userID, encKey), opts.fuzzy)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Invalid search: %v", err), http.StatusBadRequest)
+		return
 	}
 
-	// Sort results by date
-	sort.Slice(results, func(i, j int) bool {
-		ri := results[i].(map[string]any)
-		rj := results[j].(map[string]any)
-
-		yearI, _ := strconv.Atoi(ri["year"].(string))
-		yearJ, _ := strconv.Atoi(rj["year"].(string))
-		if yearI != yearJ {
-			return yearI < yearJ
-		}
-
-		monthI, _ := strconv.Atoi(ri["month"].(string))
-		monthJ, _ := strconv.Atoi(rj["month"].(string))
-		if monthI != monthJ {
-			return monthI < monthJ
-		}
-
-		dayI := ri["day"].(int)
-		dayJ := rj["day"].(int)
-		return dayI < dayJ
-	})
-
-	// Return results
-	utils.JSONResponse(w, http.StatusOK, results)
+	respondSearch(w, userID, encKey, query, opts)
 }
@@ -0,0 +1,561 @@
+package handlers
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/phitux/dailytxt/backend/utils"
+)
+
+// A search query combines terms with AND (or just a space), OR (or "|") and NOT (or a leading "-")
+// and groups them with parentheses. Words match the text or the filenames of a day or an entry,
+// ignoring case and diacritics, and words with the same stem. "Quoted phrases" match the text
+// exactly. Filters narrow the search down:
+//
+//	tag:work  tag:"on the road"  file:pdf  before:2024-01-01  after:2023-12-31
+//	year:2022  bookmarked:true  has:files  has:tags
+//
+// Something that looks like a filter but isn't one (like 12:30) is searched as a word.
+
+type queryKind int
+
+const (
+	queryWord queryKind = iota
+	queryPhrase
+	queryAnd
+	queryOr
+	queryNot
+	queryTag
+	queryFile
+	queryBefore
+	queryAfter
+	queryYear
+	queryBookmarked
+	queryHas
+)
+
+// searchQuery is a parsed search query, a tree of terms, filters and operators
+type searchQuery struct {
+	kind     queryKind
+	value    string       // word, phrase, filename, date ("2006-01-02") or what a day has ("files", "tags")
+	year     int          // year:
+	flag     bool         // bookmarked:
+	tags     map[int]bool // ids of the tags of tag:
+	children []*searchQuery
+
+	matcher *wordMatcher // matches a word, set by prepare
+	texts   searchTexts  // the prepared texts of the search, set by prepare
+}
+
+// queryToken is a word, an operator or a quoted phrase of a search query
+type queryToken struct {
+	text   string
+	phrase bool
+}
+
+// tokenizeQuery splits a search query into words, phrases, parentheses and operators
+func tokenizeQuery(query string) []queryToken {
+	var tokens []queryToken
+	runes := []rune(query)
+
+	// quoted reads a quoted text starting at runes[i], returns it and the index after the closing quote
+	quoted := func(i int) (string, int) {
+		end := i + 1
+		for end < len(runes) && runes[end] != '"' {
+			end++
+		}
+		return string(runes[i+1 : end]), end + 1
+	}
+
+	for i := 0; i < len(runes); {
+		r := runes[i]
+		switch {
+		case unicode.IsSpace(r):
+			i++
+		case r == '(' || r == ')' || r == '|':
+			tokens = append(tokens, queryToken{text: string(r)})
+			i++
+		case r == '"':
+			var phrase string
+			phrase, i = quoted(i)
+			tokens = append(tokens, queryToken{text: phrase, phrase: true})
+		case r == '-' && i+1 < len(runes) && !unicode.IsSpace(runes[i+1]):
+			tokens = append(tokens, queryToken{text: "NOT"})
+			i++
+		default:
+			start := i
+			for i < len(runes) && !unicode.IsSpace(runes[i]) && !strings.ContainsRune(`()|"`, runes[i]) {
+				i++
+			}
+			word := string(runes[start:i])
+
+			// A filter with a quoted value, like tag:"on the road"
+			if strings.HasSuffix(word, ":") && i < len(runes) && runes[i] == '"' {
+				var value string
+				value, i = quoted(i)
+				word += value
+			}
+			tokens = append(tokens, queryToken{text: word})
+		}
+	}
+	return tokens
+}
+
+// queryParser parses the tokens of a search query. tagIDs maps lowercased tag names to their ids.
+type queryParser struct {
+	tokens []queryToken
+	pos    int
+	tagIDs map[string][]int
+}
+
+// isOperator reports whether the next token is one of the given operators
+func (p *queryParser) isOperator(operators ...string) bool {
+	if p.pos >= len(p.tokens) || p.tokens[p.pos].phrase {
+		return false
+	}
+	for _, operator := range operators {
+		if p.tokens[p.pos].text == operator {
+			return true
+		}
+	}
+	return false
+}
+
+// parseOr parses terms combined with OR
+func (p *queryParser) parseOr() (*searchQuery, error) {
+	first, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	children := []*searchQuery{first}
+	for p.isOperator("OR", "|") {
+		p.pos++
+		next, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		children = append(children, next)
+	}
+	if len(children) == 1 {
+		return first, nil
+	}
+	return &searchQuery{kind: queryOr, children: children}, nil
+}
+
+// parseAnd parses terms combined with AND or just written one after another
+func (p *queryParser) parseAnd() (*searchQuery, error) {
+	var children []*searchQuery
+	for p.pos < len(p.tokens) && !p.isOperator("OR", "|", ")") {
+		if p.isOperator("AND") {
+			p.pos++
+			continue
+		}
+		child, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		children = append(children, child)
+	}
+
+	switch len(children) {
+	case 0:
+		return nil, fmt.Errorf("missing search term")
+	case 1:
+		return children[0], nil
+	}
+	return &searchQuery{kind: queryAnd, children: children}, nil
+}
+
+// parseUnary parses a term that may be negated with NOT
+func (p *queryParser) parseUnary() (*searchQuery, error) {
+	if p.isOperator("NOT") {
+		p.pos++
+		if p.pos >= len(p.tokens) {
+			return nil, fmt.Errorf("missing search term after NOT")
+		}
+		child, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return &searchQuery{kind: queryNot, children: []*searchQuery{child}}, nil
+	}
+	return p.parsePrimary()
+}
+
+// parsePrimary parses a group in parentheses, a phrase, a filter or a word
+func (p *queryParser) parsePrimary() (*searchQuery, error) {
+	if p.pos >= len(p.tokens) {
+		return nil, fmt.Errorf("missing search term")
+	}
+
+	if p.isOperator("(") {
+		p.pos++
+		group, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if !p.isOperator(")") {
+			return nil, fmt.Errorf("missing closing parenthesis")
+		}
+		p.pos++
+		return group, nil
+	}
+
+	token := p.tokens[p.pos]
+	p.pos++
+	if token.phrase {
+		return &searchQuery{kind: queryPhrase, value: token.text}, nil
+	}
+	return p.parseTerm(token.text)
+}
+
+// parseTerm parses a filter or a word
+func (p *queryParser) parseTerm(word string) (*searchQuery, error) {
+	name, value, ok := strings.Cut(word, ":")
+	if !ok || value == "" {
+		return &searchQuery{kind: queryWord, value: word}, nil
+	}
+
+	switch strings.ToLower(name) {
+	case "tag":
+		tags := map[int]bool{}
+		for _, id := range p.tagIDs[strings.ToLower(value)] {
+			tags[id] = true
+		}
+		return &searchQuery{kind: queryTag, value: value, tags: tags}, nil
+	case "file":
+		return &searchQuery{kind: queryFile, value: value}, nil
+	case "before", "after":
+		if _, err := time.Parse("2006-01-02", value); err != nil {
+			return nil, fmt.Errorf("invalid date %q, expected YYYY-MM-DD", value)
+		}
+		kind := queryBefore
+		if strings.ToLower(name) == "after" {
+			kind = queryAfter
+		}
+		return &searchQuery{kind: kind, value: value}, nil
+	case "year":
+		year, err := strconv.Atoi(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid year %q", value)
+		}
+		return &searchQuery{kind: queryYear, year: year}, nil
+	case "bookmarked":
+		flag, err := strconv.ParseBool(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid value %q for bookmarked, expected true or false", value)
+		}
+		return &searchQuery{kind: queryBookmarked, flag: flag}, nil
+	case "has":
+		value = strings.ToLower(value)
+		if value != "files" && value != "tags" {
+			return nil, fmt.Errorf("invalid value %q for has, expected files or tags", value)
+		}
+		return &searchQuery{kind: queryHas, value: value}, nil
+	}
+	return &searchQuery{kind: queryWord, value: word}, nil
+}
+
+// parseSearchQuery parses a search query. tags are the tags of the user for tag: filters,
+// without them tag: filters match nothing. Words are stemmed for the language of the user
+// (see stemmers) and, with fuzzy, match words with a typo as well.
+func parseSearchQuery(query string, tags map[int]Tag, language string, fuzzy bool) (*searchQuery, error) {
+	tagIDs := map[string][]int{}
+	for id, tag := range tags {
+		name := strings.ToLower(tag.Name)
+		tagIDs[name] = append(tagIDs[name], id)
+	}
+
+	p := &queryParser{tokens: tokenizeQuery(query), tagIDs: tagIDs}
+	if len(p.tokens) == 0 {
+		return nil, fmt.Errorf("empty search")
+	}
+	parsed, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if p.pos < len(p.tokens) {
+		return nil, fmt.Errorf("unexpected %q", p.tokens[p.pos].text)
+	}
+	parsed.prepare(searchTexts{}, language, fuzzy)
+	return parsed, nil
+}
+
+// prepare sets up the words of the query for matching, with the stemmer of the language of the user
+// and, if fuzzy is set, tolerating typos. All terms share the prepared texts.
+func (q *searchQuery) prepare(texts searchTexts, language string, fuzzy bool) {
+	q.texts = texts
+	if q.kind == queryWord {
+		q.matcher = newWordMatcher(q.value, language, fuzzy)
+	}
+	for _, child := range q.children {
+		child.prepare(texts, language, fuzzy)
+	}
+}
+
+// matchText returns the span of the first match of a word, phrase or file: filter in a text,
+// in runes of the prepared text
+func (q *searchQuery) matchText(text string) (int, int, bool) {
+	t := q.texts.get(text)
+	switch q.kind {
+	case queryWord:
+		return q.matcher.find(t)
+	case queryPhrase:
+		return t.indexExact(q.value)
+	case queryFile:
+		return t.indexFolded(q.value)
+	}
+	return 0, 0, false
+}
+
+// matchingFile returns the first filename of a doc that the term matches, and the span of the match
+func (q *searchQuery) matchingFile(doc *utils.SearchDoc) (string, int, int, bool) {
+	for _, filename := range doc.Files {
+		if start, end, ok := q.matchText(filename); ok {
+			return filename, start, end, true
+		}
+	}
+	return "", 0, 0, false
+}
+
+// matches reports whether a day or an entry matches the query
+func (q *searchQuery) matches(doc *utils.SearchDoc) bool {
+	switch q.kind {
+	case queryWord:
+		if _, _, ok := q.matchText(doc.Text); ok {
+			return true
+		}
+		_, _, _, ok := q.matchingFile(doc)
+		return ok
+	case queryPhrase:
+		_, _, ok := q.matchText(doc.Text)
+		return ok
+	case queryAnd:
+		for _, child := range q.children {
+			if !child.matches(doc) {
+				return false
+			}
+		}
+		return true
+	case queryOr:
+		for _, child := range q.children {
+			if child.matches(doc) {
+				return true
+			}
+		}
+		return false
+	case queryNot:
+		return !q.children[0].matches(doc)
+	case queryTag:
+		for _, tag := range doc.Tags {
+			if q.tags[tag] {
+				return true
+			}
+		}
+		return false
+	case queryFile:
+		_, _, _, ok := q.matchingFile(doc)
+		return ok
+	case queryBefore:
+		return doc.Date() < q.value
+	case queryAfter:
+		return doc.Date() > q.value
+	case queryYear:
+		return doc.Year == q.year
+	case queryBookmarked:
+		return doc.Bookmarked == q.flag
+	case queryHas:
+		if q.value == "files" {
+			return len(doc.Files) > 0
+		}
+		return len(doc.Tags) > 0
+	}
+	return false
+}
+
+// candidates returns the docs of the index that may match the query, found by the trigrams of its
+// words and phrases. Returns nil if every doc has to be checked.
+func (q *searchQuery) candidates(index *utils.SearchIndex) map[*utils.SearchDoc]bool {
+	switch q.kind {
+	case queryWord:
+		docs := map[*utils.SearchDoc]bool{}
+		for _, doc := range index.Candidates([]string{q.matcher.candidateTerm()}, true) {
+			docs[doc] = true
+		}
+		if q.matcher.distance > 0 {
+			for _, doc := range index.FuzzyCandidates(string(q.matcher.term), q.matcher.distance) {
+				docs[doc] = true
+			}
+		}
+		return docs
+	case queryPhrase:
+		docs := map[*utils.SearchDoc]bool{}
+		for _, doc := range index.Candidates([]string{q.value}, true) {
+			docs[doc] = true
+		}
+		return docs
+	case queryAnd:
+		var docs map[*utils.SearchDoc]bool
+		for _, child := range q.children {
+			childDocs := child.candidates(index)
+			if childDocs == nil {
+				continue
+			}
+			if docs == nil {
+				docs = childDocs
+				continue
+			}
+			for doc := range docs {
+				if !childDocs[doc] {
+					delete(docs, doc)
+				}
+			}
+		}
+		return docs
+	case queryOr:
+		docs := map[*utils.SearchDoc]bool{}
+		for _, child := range q.children {
+			childDocs := child.candidates(index)
+			if childDocs == nil {
+				return nil
+			}
+			for doc := range childDocs {
+				docs[doc] = true
+			}
+		}
+		return docs
+	}
+	return nil
+}
+
+// terms returns the words, phrases and file: filters a match is looked for, in the order of the query.
+// Negated terms are left out.
+func (q *searchQuery) terms() []*searchQuery {
+	switch q.kind {
+	case queryWord, queryPhrase, queryFile:
+		return []*searchQuery{q}
+	case queryAnd, queryOr:
+		var terms []*searchQuery
+		for _, child := range q.children {
+			terms = append(terms, child.terms()...)
+		}
+		return terms
+	}
+	return nil
+}
+
+// searchContext is what a result shows of a match: a snippet and the position of the match in it, in runes
+type searchContext struct {
+	snippet   string
+	highlight *[2]int
+}
+
+// html returns the snippet with the match in <b>, as the search results always showed it
+func (c searchContext) html() string {
+	if c.highlight == nil {
+		return c.snippet
+	}
+	runes := []rune(c.snippet)
+	start, end := c.highlight[0], c.highlight[1]
+	return string(runes[:start]) + "<b>" + string(runes[start:end]) + "</b>" + string(runes[end:])
+}
+
+// highlights returns the positions of the matches in the snippet
+func (c searchContext) highlights() [][2]int {
+	if c.highlight == nil {
+		return [][2]int{}
+	}
+	return [][2]int{*c.highlight}
+}
+
+// context returns what is shown of a match: the text around the first term found in the text,
+// a matching filename or, if only filters matched, the first words of the text
+func (q *searchQuery) context(doc *utils.SearchDoc) searchContext {
+	terms := q.terms()
+	for _, term := range terms {
+		if term.kind == queryFile {
+			continue
+		}
+		if start, end, ok := term.matchText(doc.Text); ok {
+			snippet, highlight := q.texts.get(doc.Text).snippet(start, end)
+			return searchContext{snippet: snippet, highlight: &highlight}
+		}
+	}
+	for _, term := range terms {
+		if term.kind == queryPhrase {
+			continue
+		}
+		if filename, start, end, ok := term.matchingFile(doc); ok {
+			// The paperclip and the space are two runes
+			return searchContext{
+				snippet:   "📎 " + string(q.texts.get(filename).runes),
+				highlight: &[2]int{start + 2, end + 2},
+			}
+		}
+	}
+
+	words := strings.Fields(doc.Text)
+	if len(words) > 5 {
+		words = words[:5]
+	}
+	return searchContext{snippet: strings.Join(words, " ")}
+}
+
+// each calls fn for the docs of the index that match the query, ordered by date, until fn returns false
+func (q *searchQuery) each(index *utils.SearchIndex, fn func(doc *utils.SearchDoc) bool) {
+	var docs []*utils.SearchDoc
+	if candidates := q.candidates(index); candidates != nil {
+		for doc := range candidates {
+			docs = append(docs, doc)
+		}
+		utils.SortSearchDocs(docs)
+	} else {
+		docs = index.AllDocs()
+	}
+
+	for _, doc := range docs {
+		if q.matches(doc) && !fn(doc) {
+			return
+		}
+	}
+}
+
+// score rates how well a day or an entry matches the query: how often its terms occur (a matching
+// filename counts twice) on a logarithmic scale, plus a boost for recent days that fades over the years.
+// The age is counted in days, so a score doesn't change during a day.
+func (q *searchQuery) score(doc *utils.SearchDoc, now time.Time) float64 {
+	occurrences := 0
+	for _, term := range q.terms() {
+		switch term.kind {
+		case queryWord:
+			occurrences += term.matcher.count(q.texts.get(doc.Text))
+		case queryPhrase:
+			if term.value != "" {
+				occurrences += strings.Count(string(q.texts.get(doc.Text).runes), term.value)
+			}
+			continue
+		}
+		for _, filename := range doc.Files {
+			if _, _, ok := term.matchText(filename); ok {
+				occurrences += 2
+			}
+		}
+	}
+	if occurrences == 0 {
+		// Only filters matched
+		occurrences = 1
+	}
+
+	days := 0.0
+	if date, err := time.Parse("2006-01-02", doc.Date()); err == nil {
+		today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+		days = max(today.Sub(date).Hours()/24, 0)
+	}
+
+	score := math.Log1p(float64(occurrences)) + 1/(1+days/365)
+	return math.Round(score*1e4) / 1e4
+}
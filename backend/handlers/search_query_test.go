@@ -0,0 +1,290 @@
+package handlers
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/phitux/dailytxt/backend/utils"
+)
+
+// describe writes a parsed query as a term, e.g. (or (and a b) (not "c d"))
+func describe(q *searchQuery) string {
+	children := func(name string) string {
+		parts := []string{name}
+		for _, child := range q.children {
+			parts = append(parts, describe(child))
+		}
+		return "(" + strings.Join(parts, " ") + ")"
+	}
+
+	switch q.kind {
+	case queryWord:
+		return q.value
+	case queryPhrase:
+		return fmt.Sprintf("%q", q.value)
+	case queryAnd:
+		return children("and")
+	case queryOr:
+		return children("or")
+	case queryNot:
+		return children("not")
+	case queryTag:
+		ids := []int{}
+		for id := range q.tags {
+			ids = append(ids, id)
+		}
+		sort.Ints(ids)
+		return fmt.Sprintf("tag:%q%v", q.value, ids)
+	case queryFile:
+		return "file:" + q.value
+	case queryBefore:
+		return "before:" + q.value
+	case queryAfter:
+		return "after:" + q.value
+	case queryYear:
+		return fmt.Sprintf("year:%d", q.year)
+	case queryBookmarked:
+		return fmt.Sprintf("bookmarked:%t", q.flag)
+	case queryHas:
+		return "has:" + q.value
+	}
+	return "?"
+}
+
+// searchTestTags are the tags of the user in the search tests
+var searchTestTags = map[int]Tag{
+	1: {ID: 1, Name: "On the road"},
+	2: {ID: 2, Name: "work"},
+	3: {ID: 3, Name: "Work"},
+}
+
+func TestTokenizeQuery(t *testing.T) {
+	word := func(text string) queryToken { return queryToken{text: text} }
+	phrase := func(text string) queryToken { return queryToken{text: text, phrase: true} }
+
+	tests := []struct {
+		query string
+		want  []queryToken
+	}{
+		{"lake  garden", []queryToken{word("lake"), word("garden")}},
+		{"-lake", []queryToken{word("NOT"), word("lake")}},
+		{"a - b", []queryToken{word("a"), word("-"), word("b")}},
+		{"(a|b)c", []queryToken{word("("), word("a"), word("|"), word("b"), word(")"), word("c")}},
+		{`"on the lake" x`, []queryToken{phrase("on the lake"), word("x")}},
+		{`a"b c"d`, []queryToken{word("a"), phrase("b c"), word("d")}},
+		{`"unterminated phrase`, []queryToken{phrase("unterminated phrase")}},
+		{`tag:"on the road" x`, []queryToken{word("tag:on the road"), word("x")}},
+		{`tag:"unterminated`, []queryToken{word("tag:unterminated")}},
+		{"12:30 café", []queryToken{word("12:30"), word("café")}},
+		{"", nil},
+	}
+	for _, tt := range tests {
+		if got := tokenizeQuery(tt.query); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("tokenizeQuery(%q) = %v, want %v", tt.query, got, tt.want)
+		}
+	}
+}
+
+func TestParseSearchQuery(t *testing.T) {
+	tests := []struct {
+		query string
+		want  string
+	}{
+		// AND binds stronger than OR, NOT stronger than both
+		{"a b OR c", "(or (and a b) c)"},
+		{"a OR b c", "(or a (and b c))"},
+		{"a AND b | c d", "(or (and a b) (and c d))"},
+		{"a | b | c", "(or a b c)"},
+		{"-a b", "(and (not a) b)"},
+		{"NOT a OR b", "(or (not a) b)"},
+		{"NOT NOT a", "(not (not a))"},
+		{"-(a | b) c", "(and (not (or a b)) c)"},
+		{"a (b | c)", "(and a (or b c))"},
+		{"((a))", "a"},
+		{`"the lake" -"the sea"`, `(and "the lake" (not "the sea"))`},
+		{`"or" and`, `(and "or" and)`},
+
+		// Filters
+		{`tag:"on the road"`, `tag:"on the road"[1]`},
+		{"tag:WORK", `tag:"WORK"[2 3]`},
+		{"tag:unknown", `tag:"unknown"[]`},
+		{"file:pdf", "file:pdf"},
+		{"before:2024-01-01 after:2023-12-31", "(and before:2024-01-01 after:2023-12-31)"},
+		{"year:2022 bookmarked:false has:Files", "(and year:2022 bookmarked:false has:files)"},
+
+		// Looks like a filter, but is a word
+		{"12:30", "12:30"},
+		{"note:", "note:"},
+		{"http://example.com", "http://example.com"},
+		{"-", "-"},
+	}
+	for _, tt := range tests {
+		query, err := parseSearchQuery(tt.query, searchTestTags, "", false)
+		if err != nil {
+			t.Errorf("parseSearchQuery(%q): %v", tt.query, err)
+			continue
+		}
+		if got := describe(query); got != tt.want {
+			t.Errorf("parseSearchQuery(%q) = %s, want %s", tt.query, got, tt.want)
+		}
+	}
+
+	invalid := []string{
+		"", "   ", "(", "(a", "a)", ")", "()", "a (b", "a OR", "OR a", "a | | b", "NOT", "a -(", "AND",
+		"before:2024-13-01", "after:yesterday", "year:abc", "bookmarked:maybe", "has:words",
+	}
+	for _, query := range invalid {
+		if parsed, err := parseSearchQuery(query, searchTestTags, "", false); err == nil {
+			t.Errorf("parseSearchQuery(%q) = %s, want an error", query, describe(parsed))
+		}
+	}
+}
+
+// searchTestDocs are the days and entries the search tests look through
+var searchTestDocs = []*utils.SearchDoc{
+	{Year: 2023, Month: 12, Day: 31, Text: "Coffee in the garden, then we walked to the lake", Tags: []int{2}},
+	{Year: 2024, Month: 1, Day: 1, Text: "Rain all day", Files: []string{"map of the lake.pdf"}, Bookmarked: true},
+	{Year: 2024, Month: 1, Day: 1, EntryID: "e1", Time: "20:00", Text: "Café with friends", Tags: []int{1}},
+	{Year: 2024, Month: 5, Day: 3, Text: "On the road again, lakes everywhere", Tags: []int{1, 3}},
+	{Year: 2024, Month: 5, Day: 4, Text: "Meeting at 12:30, then the garden"},
+}
+
+func TestSearchQueryMatches(t *testing.T) {
+	tests := []struct {
+		query string
+		want  []int // indexes of searchTestDocs
+	}{
+		{"lake", []int{0, 1, 3}},
+		{"LAKE garden", []int{0}},
+		{"lake -garden", []int{1, 3}},
+		{"lake OR café", []int{0, 1, 2, 3}},
+		{"cafe", []int{2}},
+		{`"the lake"`, []int{0}},
+		{`"The Lake"`, []int{}},
+		{"-lake", []int{2, 4}},
+		{"(coffee | rain) -bookmarked:true", []int{0}},
+		{"12:30", []int{4}},
+		{`tag:"on the road"`, []int{2, 3}},
+		{"tag:work", []int{0, 3}},
+		{"tag:unknown", []int{}},
+		{"file:PDF", []int{1}},
+		{"before:2024-01-01", []int{0}},
+		{"after:2024-01-01", []int{3, 4}},
+		{"after:2023-12-31 before:2024-01-02", []int{1, 2}},
+		{"year:2024 -has:tags", []int{1, 4}},
+		{"has:files", []int{1}},
+		{"bookmarked:true | garden", []int{0, 1, 4}},
+	}
+	for _, tt := range tests {
+		query, err := parseSearchQuery(tt.query, searchTestTags, "", false)
+		if err != nil {
+			t.Errorf("parseSearchQuery(%q): %v", tt.query, err)
+			continue
+		}
+		got := []int{}
+		for i, doc := range searchTestDocs {
+			if query.matches(doc) {
+				got = append(got, i)
+			}
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%q matches %v, want %v", tt.query, got, tt.want)
+		}
+	}
+}
+
+// The candidates of the index narrow the search down, but never drop a doc that matches
+func TestSearchQueryCandidates(t *testing.T) {
+	user := newTestUser(t)
+	encKey := user.encKey(t)
+
+	// The docs of searchTestDocs as days and entries of the user
+	months := map[[2]int][]any{}
+	days := map[[3]int]map[string]any{}
+	encrypt := func(text string) string {
+		t.Helper()
+		ciphertext, err := utils.EncryptText(text, encKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return ciphertext
+	}
+	for _, doc := range searchTestDocs {
+		part := map[string]any{"text": encrypt(doc.Text), "tags": []any{}}
+		for _, tag := range doc.Tags {
+			part["tags"] = append(part["tags"].([]any), tag)
+		}
+		for i, filename := range doc.Files {
+			part["files"] = []any{map[string]any{"uuid_filename": fmt.Sprintf("file-%d", i), "enc_filename": encrypt(filename)}}
+		}
+
+		key := [3]int{doc.Year, doc.Month, doc.Day}
+		if doc.EntryID == "" {
+			part["day"] = doc.Day
+			part["isBookmarked"] = doc.Bookmarked
+			days[key] = part
+			months[[2]int{doc.Year, doc.Month}] = append(months[[2]int{doc.Year, doc.Month}], part)
+			continue
+		}
+		part["id"] = doc.EntryID
+		part["time"] = encrypt(doc.Time)
+		days[key]["entries"] = []any{part}
+	}
+	for month, monthDays := range months {
+		if err := utils.WriteMonth(user.id, month[0], month[1], map[string]any{"days": monthDays}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	index, err := utils.OpenSearchIndex(user.id, encKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	docs := index.AllDocs()
+	if len(docs) != len(searchTestDocs) {
+		t.Fatalf("the index has %d docs, want %d", len(docs), len(searchTestDocs))
+	}
+
+	queries := []struct {
+		query    string
+		narrowed bool // whether the candidates are fewer than all docs
+	}{
+		{"lake", true},
+		{"lake garden", true},
+		{"lake -garden", true},
+		{"-garden lake", true},
+		{"lake -(garden | rain)", true},
+		{"lake | café", true},
+		{`"the lake" | coffee`, true},
+		{"lake | tag:work", false},
+		{"(lake before:2024-01-01) | bookmarked:true", false},
+		{`tag:"on the road" (road | café)`, true},
+		{"-lake", false},
+		{"NOT (lake garden)", false},
+		{"has:files", false},
+		{"a", false},
+		{"lak", true},
+		{"lakes", true},
+		{"12:30", true},
+		{"year:2024 (rain | -lake)", false},
+	}
+	for _, fuzzy := range []bool{false, true} {
+		for _, tt := range queries {
+			query, err := parseSearchQuery(tt.query, searchTestTags, "en", fuzzy)
+			if err != nil {
+				t.Fatalf("parseSearchQuery(%q): %v", tt.query, err)
+			}
+			candidates := query.candidates(index)
+			for _, doc := range docs {
+				if query.matches(doc) && candidates != nil && !candidates[doc] {
+					t.Errorf("%q (fuzzy %t): candidates drop %s %s %q", tt.query, fuzzy, doc.Date(), doc.EntryID, doc.Text)
+				}
+			}
+			if narrowed := candidates != nil && len(candidates) < len(docs); !fuzzy && narrowed != tt.narrowed {
+				t.Errorf("%q: narrowed down to %d candidates, want narrowed %t", tt.query, len(candidates), tt.narrowed)
+			}
+		}
+	}
+}
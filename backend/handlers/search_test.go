@@ -0,0 +1,123 @@
+package handlers
+
+import (
+	"math/rand"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/phitux/dailytxt/backend/utils"
+)
+
+// benchmarkWords are the words of the generated texts, "zeppelin" is rare
+var benchmarkWords = strings.Fields("the day was long and we walked to the lake with friends " +
+	"after work I read a book about the mountains while it rained outside coffee garden train")
+
+// setupSearchBenchmark writes three years of days with generated texts for the test user and
+// returns the parsed query for a rare word
+func setupSearchBenchmark(b *testing.B) (*testUser, string, *searchQuery) {
+	b.Helper()
+
+	user := newTestUser(b)
+	encKey := user.encKey(b)
+	random := rand.New(rand.NewSource(1))
+	for year := 2021; year <= 2023; year++ {
+		for month := 1; month <= 12; month++ {
+			days := []any{}
+			for day := 1; day <= 28; day++ {
+				words := make([]string, 150)
+				for i := range words {
+					words[i] = benchmarkWords[random.Intn(len(benchmarkWords))]
+				}
+				if day == 14 && month%4 == 0 {
+					words[random.Intn(len(words))] = "zeppelin"
+				}
+				text, err := utils.EncryptText(strings.Join(words, " "), encKey)
+				if err != nil {
+					b.Fatal(err)
+				}
+				days = append(days, map[string]any{"day": day, "text": text})
+			}
+			if err := utils.WriteMonth(user.id, year, month, map[string]any{"days": days}); err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+
+	query, err := parseSearchQuery("zeppelin", nil, "", false)
+	if err != nil {
+		b.Fatal(err)
+	}
+	return user, encKey, query
+}
+
+// checkSearchHits fails the benchmark unless the search found the days with the rare word
+func checkSearchHits(b *testing.B, hits int) {
+	b.Helper()
+	if hits != 9 {
+		b.Fatalf("%d hits, want 9", hits)
+	}
+}
+
+// BenchmarkSearchIndex searches with the search index, like Search does
+func BenchmarkSearchIndex(b *testing.B) {
+	user, encKey, query := setupSearchBenchmark(b)
+	if _, err := utils.OpenSearchIndex(user.id, encKey); err != nil {
+		b.Fatal(err)
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		index, err := utils.OpenSearchIndex(user.id, encKey)
+		if err != nil {
+			b.Fatal(err)
+		}
+		hits := 0
+		query.each(index, func(doc *utils.SearchDoc) bool {
+			hits++
+			return true
+		})
+		checkSearchHits(b, hits)
+	}
+}
+
+// BenchmarkSearchLinearScan searches by decrypting every month, like the search did before the index
+func BenchmarkSearchLinearScan(b *testing.B) {
+	user, encKey, query := setupSearchBenchmark(b)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		hits := 0
+		years, err := utils.GetYears(user.id)
+		if err != nil {
+			b.Fatal(err)
+		}
+		for _, year := range years {
+			months, err := utils.GetMonths(user.id, year)
+			if err != nil {
+				b.Fatal(err)
+			}
+			for _, month := range months {
+				yearInt, _ := strconv.Atoi(year)
+				monthInt, _ := strconv.Atoi(month)
+				content, err := utils.GetMonth(user.id, yearInt, monthInt)
+				if err != nil {
+					b.Fatal(err)
+				}
+				days, _ := content["days"].([]any)
+				for _, d := range days {
+					day, _ := d.(map[string]any)
+					encText, _ := day["text"].(string)
+					text, err := utils.DecryptText(encText, encKey)
+					if err != nil {
+						b.Fatalf("decrypting %s-%s: %v", year, month, err)
+					}
+					if query.matches(&utils.SearchDoc{Year: yearInt, Month: monthInt, Text: text}) {
+						hits++
+					}
+				}
+			}
+		}
+		checkSearchHits(b, hits)
+	}
+}
@@ -0,0 +1,278 @@
+package handlers
+
+import (
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/phitux/dailytxt/backend/utils"
+)
+
+// searchText is a text prepared for searching: whitespace is collapsed to single spaces, the folded
+// runes (see utils.FoldRunes) point back to the runes of the text and the words are split up.
+type searchText struct {
+	runes  []rune
+	folded []rune
+	origin []int
+	words  [][2]int // spans of the space separated words in folded
+}
+
+func newSearchText(text string) *searchText {
+	t := &searchText{runes: []rune(strings.Join(strings.Fields(text), " "))}
+	t.folded, t.origin = utils.FoldRunes(t.runes)
+
+	start := -1
+	for i, r := range t.folded {
+		switch {
+		case r == ' ' && start >= 0:
+			t.words = append(t.words, [2]int{start, i})
+			start = -1
+		case r != ' ' && start < 0:
+			start = i
+		}
+	}
+	if start >= 0 {
+		t.words = append(t.words, [2]int{start, len(t.folded)})
+	}
+	return t
+}
+
+// span converts a span of folded runes to a span of the runes of the text. The combining marks after
+// the last rune (dropped by folding) belong to the span.
+func (t *searchText) span(start, end int) (int, int) {
+	if start >= end {
+		if start < len(t.origin) {
+			return t.origin[start], t.origin[start]
+		}
+		return len(t.runes), len(t.runes)
+	}
+	if end == len(t.origin) {
+		return t.origin[start], len(t.runes)
+	}
+	return t.origin[start], max(t.origin[end-1]+1, t.origin[end])
+}
+
+// indexExact returns the span of the first occurrence of a phrase, compared exactly
+func (t *searchText) indexExact(phrase string) (int, int, bool) {
+	text := string(t.runes)
+	phrase = strings.Join(strings.Fields(phrase), " ")
+	i := strings.Index(text, phrase)
+	if i < 0 {
+		return 0, 0, false
+	}
+	start := utf8.RuneCountInString(text[:i])
+	return start, start + utf8.RuneCountInString(phrase), true
+}
+
+// indexFolded returns the span of the first occurrence of a term, ignoring case and diacritics
+func (t *searchText) indexFolded(term string) (int, int, bool) {
+	folded, foldedTerm := string(t.folded), utils.FoldText(strings.Join(strings.Fields(term), " "))
+	i := strings.Index(folded, foldedTerm)
+	if i < 0 {
+		return 0, 0, false
+	}
+	start := utf8.RuneCountInString(folded[:i])
+	start, end := t.span(start, start+utf8.RuneCountInString(foldedTerm))
+	return start, end, true
+}
+
+// snippet returns the text around the runes [start, end), up to three words before and after,
+// and the position of the match in the snippet, in runes
+func (t *searchText) snippet(start, end int) (string, [2]int) {
+	from, spaces := start, 0
+	for ; from > 0; from-- {
+		if t.runes[from-1] == ' ' {
+			if spaces++; spaces == 4 {
+				break
+			}
+		}
+	}
+	to, spaces := end, 0
+	for ; to < len(t.runes); to++ {
+		if t.runes[to] == ' ' {
+			if spaces++; spaces == 4 {
+				break
+			}
+		}
+	}
+	return string(t.runes[from:to]), [2]int{start - from, end - from}
+}
+
+// searchTexts keeps the prepared texts of a search, a text is checked by several terms
+type searchTexts map[string]*searchText
+
+// get returns the prepared text, texts may be nil
+func (texts searchTexts) get(text string) *searchText {
+	if t, ok := texts[text]; ok {
+		return t
+	}
+	t := newSearchText(text)
+	if texts != nil {
+		texts[text] = t
+	}
+	return t
+}
+
+// stemmers reduce a folded word to its stem for the languages of the user settings. They only cut off
+// endings, so a stem is always the beginning of the word.
+var stemmers = map[string]func(string) string{
+	"de": stemGerman,
+	"en": stemEnglish,
+	"fr": stemFrench,
+}
+
+// stemmerFor returns the stemmer of a language like "de" or "fr-CA", or nil
+func stemmerFor(language string) func(string) string {
+	language, _, _ = strings.Cut(strings.ToLower(language), "-")
+	return stemmers[language]
+}
+
+// stripSuffix cuts off the first of the suffixes the word ends with, if at least minStem runes are left
+func stripSuffix(word string, minStem int, suffixes ...string) string {
+	for _, suffix := range suffixes {
+		if strings.HasSuffix(word, suffix) && utf8.RuneCountInString(word)-utf8.RuneCountInString(suffix) >= minStem {
+			return strings.TrimSuffix(word, suffix)
+		}
+	}
+	return word
+}
+
+func stemGerman(word string) string {
+	// Twice, for endings like "-ern" or "-ens" on top of plurals
+	for range 2 {
+		word = stripSuffix(word, 3, "ern", "em", "en", "er", "es", "e", "s", "n")
+	}
+	return word
+}
+
+func stemEnglish(word string) string {
+	return stripSuffix(word, 3, "ies", "ied", "ing", "ed", "es", "s", "y")
+}
+
+func stemFrench(word string) string {
+	return stripSuffix(word, 3, "issements", "issement", "ements", "ement", "euses", "euse", "eaux", "ees", "ee", "es", "e", "s", "x")
+}
+
+// fuzzyDistance is the edit distance allowed for a word of the given length, short words must match
+func fuzzyDistance(length int) int {
+	switch {
+	case length >= 8:
+		return 2
+	case length >= 4:
+		return 1
+	}
+	return 0
+}
+
+// withinDistance reports whether the edit (Levenshtein) distance of a and b is at most limit
+func withinDistance(a, b []rune, limit int) bool {
+	if len(a)-len(b) > limit || len(b)-len(a) > limit {
+		return false
+	}
+	previous := make([]int, len(b)+1)
+	current := make([]int, len(b)+1)
+	for j := range previous {
+		previous[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		current[0] = i
+		rowMin := i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			current[j] = min(previous[j]+1, current[j-1]+1, previous[j-1]+cost)
+			rowMin = min(rowMin, current[j])
+		}
+		if rowMin > limit {
+			return false
+		}
+		previous, current = current, previous
+	}
+	return previous[len(b)] <= limit
+}
+
+// isWordRune reports whether r is part of a word rather than punctuation around it
+func isWordRune(r rune) bool {
+	return unicode.IsLetter(r) || unicode.IsDigit(r)
+}
+
+// wordMatcher finds a search word in texts: within a word, ignoring case and diacritics, as a word with
+// the same stem, or as a word within a small edit distance (if fuzzy)
+type wordMatcher struct {
+	term     []rune
+	stem     func(string) string
+	termStem string
+	distance int
+}
+
+func newWordMatcher(word, language string, fuzzy bool) *wordMatcher {
+	m := &wordMatcher{term: []rune(utils.FoldText(word)), stem: stemmerFor(language)}
+	if m.stem != nil {
+		m.termStem = m.stem(string(m.term))
+	}
+	if fuzzy {
+		m.distance = fuzzyDistance(len(m.term))
+	}
+	return m
+}
+
+// matchWord checks a folded word, returns the span of the match in the word
+func (m *wordMatcher) matchWord(word []rune) (int, int, bool) {
+	if i := strings.Index(string(word), string(m.term)); i >= 0 {
+		start := utf8.RuneCountInString(string(word)[:i])
+		return start, start + len(m.term), true
+	}
+
+	// The word without punctuation around it
+	start, end := 0, len(word)
+	for start < end && !isWordRune(word[start]) {
+		start++
+	}
+	for end > start && !isWordRune(word[end-1]) {
+		end--
+	}
+	if start == end {
+		return 0, 0, false
+	}
+
+	if m.stem != nil && m.stem(string(word[start:end])) == m.termStem {
+		return start, end, true
+	}
+	if m.distance > 0 && withinDistance(word[start:end], m.term, m.distance) {
+		return start, end, true
+	}
+	return 0, 0, false
+}
+
+// find returns the span of the first match in a text, in runes of the text
+func (m *wordMatcher) find(t *searchText) (int, int, bool) {
+	for _, word := range t.words {
+		if start, end, ok := m.matchWord(t.folded[word[0]:word[1]]); ok {
+			start, end = t.span(word[0]+start, word[0]+end)
+			return start, end, true
+		}
+	}
+	return 0, 0, false
+}
+
+// count returns how many words of a text match
+func (m *wordMatcher) count(t *searchText) int {
+	count := 0
+	for _, word := range t.words {
+		if _, _, ok := m.matchWord(t.folded[word[0]:word[1]]); ok {
+			count++
+		}
+	}
+	return count
+}
+
+// candidateTerm returns a part of the word that every text it matches contains, its stem (the beginning
+// of the word) or the word itself. Fuzzy matches are not covered, see SearchIndex.FuzzyCandidates.
+func (m *wordMatcher) candidateTerm() string {
+	if m.stem != nil {
+		return m.termStem
+	}
+	return string(m.term)
+}
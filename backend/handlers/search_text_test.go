@@ -0,0 +1,134 @@
+package handlers
+
+import (
+	"testing"
+
+	"github.com/phitux/dailytxt/backend/utils"
+)
+
+func TestStemmers(t *testing.T) {
+	tests := []struct {
+		stem  func(string) string
+		words []string // all with the same stem
+		want  string
+	}{
+		{stemGerman, []string{"haus", "hauses", "hauser", "hausern"}, "hau"},
+		{stemGerman, []string{"madchen", "madchens"}, "madch"},
+		{stemGerman, []string{"kind", "kinder", "kindern", "kindes"}, "kind"},
+		{stemEnglish, []string{"walk", "walks", "walked", "walking"}, "walk"},
+		{stemEnglish, []string{"story", "stories"}, "stor"},
+		{stemEnglish, []string{"bus"}, "bus"},
+		{stemFrench, []string{"heureuse", "heureuses"}, "heur"},
+		{stemFrench, []string{"rapide", "rapides", "rapidement"}, "rapid"},
+		{stemFrench, []string{"belle", "belles"}, "bell"},
+	}
+	for _, tt := range tests {
+		for _, word := range tt.words {
+			if got := tt.stem(word); got != tt.want {
+				t.Errorf("stem of %q = %q, want %q", word, got, tt.want)
+			}
+		}
+	}
+
+	if stemmerFor("fr-CA") == nil || stemmerFor("DE") == nil || stemmerFor("it") != nil || stemmerFor("") != nil {
+		t.Error("stemmerFor picks the wrong stemmers")
+	}
+}
+
+func TestWithinDistance(t *testing.T) {
+	tests := []struct {
+		a, b  string
+		limit int
+		want  bool
+	}{
+		{"kitten", "sitting", 3, true},
+		{"kitten", "sitting", 2, false},
+		{"flaw", "lawn", 2, true},
+		{"flaw", "lawn", 1, false},
+		{"zeppelin", "zepelin", 1, true},
+		{"", "abc", 3, true},
+		{"abc", "", 2, false},
+		{"straße", "strase", 1, true},
+		{"日本語", "日本", 1, true},
+		{"日本語", "本日", 1, false},
+	}
+	for _, tt := range tests {
+		if got := withinDistance([]rune(tt.a), []rune(tt.b), tt.limit); got != tt.want {
+			t.Errorf("withinDistance(%q, %q, %d) = %t, want %t", tt.a, tt.b, tt.limit, got, tt.want)
+		}
+	}
+}
+
+// Words match inflected forms in the language of the user and, with fuzzy, typos
+func TestWordMatcherInflections(t *testing.T) {
+	tests := []struct {
+		word, language string
+		fuzzy          bool
+		text           string
+		want           string // the matched text, "" for no match
+	}{
+		{"Häuser", "de", false, "Im Haus war es warm", "Haus"},
+		{"Häuser", "de", false, "Die Hauses", "Hauses"},
+		{"haus", "de", false, "Die Häuser am See", "Häus"}, // within the word
+		{"Mädchen", "de", false, "Zwei MADCHENS spielten", "MADCHEN"},
+		{"walking", "en", false, "We walked home.", "walked"},
+		{"stories", "en", false, "A story (short)", "story"},
+		{"heureuses", "fr", false, "Elle est heureuse.", "heureuse"},
+		{"heureuses", "", false, "Elle est heureuse.", ""},
+		{"walking", "", false, "We walked home.", ""},
+		{"zeppelin", "en", false, "A Zepelin flew by", ""},
+		{"zeppelin", "en", true, "A Zepelin flew by", "Zepelin"},
+		{"cat", "en", true, "A cut", ""},
+	}
+	for _, tt := range tests {
+		m := newWordMatcher(tt.word, tt.language, tt.fuzzy)
+		text := newSearchText(tt.text)
+		got := ""
+		if start, end, ok := m.find(text); ok {
+			got = string(text.runes[start:end])
+		}
+		if got != tt.want {
+			t.Errorf("%q (%s, fuzzy %t) in %q matched %q, want %q", tt.word, tt.language, tt.fuzzy, tt.text, got, tt.want)
+		}
+	}
+}
+
+// Highlights count runes of the text, also where a letter folds to several runes or to none
+func TestSearchContextMultiByte(t *testing.T) {
+	tests := []struct {
+		query string
+		doc   utils.SearchDoc
+		want  string
+	}{
+		{"mädchen", utils.SearchDoc{Text: "Das 🙂 Mädchen aß Kuchen"}, "Das 🙂 <b>Mädchen</b> aß Kuchen"},
+		{"strasse", utils.SearchDoc{Text: "Die Straße ist lang"}, "Die <b>Straße</b> ist lang"},
+		{"cafe", utils.SearchDoc{Text: "Im Café am Markt"}, "Im <b>Café</b> am Markt"},
+		{"cafe", utils.SearchDoc{Text: "Im Cafe\u0301 am Markt"}, "Im <b>Cafe\u0301</b> am Markt"},
+		{"cafe", utils.SearchDoc{Text: "Im Cafe\u0301"}, "Im <b>Cafe\u0301</b>"},
+		{"strass", utils.SearchDoc{Text: "Die Straße"}, "Die <b>Straß</b>e"}, // half of ß
+		{`"über die"`, utils.SearchDoc{Text: "Wir gingen über die Brücke"}, "Wir gingen <b>über die</b> Brücke"},
+		{"brucke", utils.SearchDoc{Text: "Émile und Zoë gingen über die Brücke nach Köln zurück heute"},
+			"gingen über die <b>Brücke</b> nach Köln zurück"},
+		{"plane", utils.SearchDoc{Files: []string{"Große Pläne.pdf"}}, "📎 Große <b>Pläne</b>.pdf"},
+		{"has:files", utils.SearchDoc{Text: "Ein Tag am Meer mit Möwen und Wind", Files: []string{"a.jpg"}}, "Ein Tag am Meer mit"},
+	}
+	for _, tt := range tests {
+		query, err := parseSearchQuery(tt.query, nil, "", false)
+		if err != nil {
+			t.Fatalf("parseSearchQuery(%q): %v", tt.query, err)
+		}
+		if !query.matches(&tt.doc) {
+			t.Errorf("%q doesn't match %q", tt.query, tt.doc.Text)
+			continue
+		}
+		context := query.context(&tt.doc)
+		if got := context.html(); got != tt.want {
+			t.Errorf("%q: snippet %q, want %q", tt.query, got, tt.want)
+		}
+		for _, highlight := range context.highlights() {
+			if highlight[0] < 0 || highlight[1] > len([]rune(context.snippet)) || highlight[0] >= highlight[1] {
+				t.Errorf("%q: highlight %v out of the snippet %q", tt.query, highlight, context.snippet)
+			}
+		}
+	}
+}
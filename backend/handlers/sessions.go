@@ -0,0 +1,117 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/phitux/dailytxt/backend/utils"
+)
+
+// SessionResponse describes an active session of the user
+type SessionResponse struct {
+	ID        string    `json:"id"`
+	CreatedAt time.Time `json:"created_at"`
+	LastSeen  time.Time `json:"last_seen"`
+	IP        string    `json:"ip"`
+	UserAgent string    `json:"user_agent"`
+	Current   bool      `json:"current"`
+}
+
+// GetSessions lists the active sessions of the user
+func GetSessions(w http.ResponseWriter, r *http.Request) {
+	// Get user ID and session from context
+	userID, ok := r.Context().Value(utils.UserIDKey).(int)
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	currentID, _ := r.Context().Value(utils.SessionIDKey).(string)
+
+	sessions, err := utils.ListUserSessions(userID)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error reading sessions: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	result := []SessionResponse{}
+	for _, session := range sessions {
+		result = append(result, SessionResponse{
+			ID:        session.ID,
+			CreatedAt: session.CreatedAt,
+			LastSeen:  session.LastSeen,
+			IP:        session.IP,
+			UserAgent: session.UserAgent,
+			Current:   session.ID == currentID,
+		})
+	}
+
+	utils.JSONResponse(w, http.StatusOK, result)
+}
+
+// RevokeSession logs out one session of the user
+func RevokeSession(w http.ResponseWriter, r *http.Request) {
+	// Get user ID and session from context
+	userID, ok := r.Context().Value(utils.UserIDKey).(int)
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	currentID, _ := r.Context().Value(utils.SessionIDKey).(string)
+
+	var req struct {
+		ID string `json:"id"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.ID == "" {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	if err := utils.DeleteUserSession(userID, req.ID); err != nil {
+		http.Error(w, fmt.Sprintf("Error revoking session: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	// Revoking the own session is a logout
+	if req.ID == currentID {
+		http.SetCookie(w, &http.Cookie{
+			Name:     "token",
+			Value:    "",
+			HttpOnly: true,
+			SameSite: http.SameSiteLaxMode,
+			Path:     "/",
+			Expires:  time.Unix(0, 0),
+			MaxAge:   -1,
+		})
+	}
+
+	utils.JSONResponse(w, http.StatusOK, map[string]any{
+		"success": true,
+		"current": req.ID == currentID,
+	})
+}
+
+// RevokeOtherSessions logs out all sessions of the user except the current one
+func RevokeOtherSessions(w http.ResponseWriter, r *http.Request) {
+	// Get user ID and session from context
+	userID, ok := r.Context().Value(utils.UserIDKey).(int)
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	currentID, ok := r.Context().Value(utils.SessionIDKey).(string)
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	if err := utils.DeleteOtherSessions(userID, currentID); err != nil {
+		http.Error(w, fmt.Sprintf("Error revoking sessions: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	utils.JSONResponse(w, http.StatusOK, map[string]bool{
+		"success": true,
+	})
+}
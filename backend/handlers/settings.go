@@ -31,9 +31,49 @@ func GetDefaultSettings() map[string]any {
 		"firstDayOfWeek":                 "monday",
 		"showChangelogOnUpdate":          true,
 		"writeDateFormat":                "2-digit",
+		"historyRetention": map[string]any{
+			"enabled":        true,
+			"keepAllHours":   24,
+			"keepHourlyDays": 7,
+			"keepDailyDays":  0,
+		},
 	}
 }
 
+// loadUserSettings returns the decrypted settings of a user, with defaults for missing keys
+func loadUserSettings(userID int, encKey string) (map[string]any, error) {
+	defaultSettings := GetDefaultSettings()
+
+	encryptedSettings, err := utils.GetUserSettings(userID)
+	if err != nil {
+		return nil, fmt.Errorf("error retrieving user settings: %v", err)
+	}
+	if len(encryptedSettings) == 0 {
+		return defaultSettings, nil
+	}
+
+	decryptedSettings, err := utils.DecryptText(encryptedSettings, encKey)
+	if err != nil {
+		return nil, fmt.Errorf("error decrypting settings: %v", err)
+	}
+
+	var settings map[string]any
+	if err := json.Unmarshal([]byte(decryptedSettings), &settings); err != nil {
+		return nil, fmt.Errorf("error parsing settings: %v", err)
+	}
+	if settings == nil {
+		settings = map[string]any{}
+	}
+
+	// Apply defaults for missing keys
+	for key, value := range defaultSettings {
+		if _, exists := settings[key]; !exists {
+			settings[key] = value
+		}
+	}
+	return settings, nil
+}
+
 // GetUserSettings retrieves user settings
 func GetUserSettings(w http.ResponseWriter, r *http.Request) {
 	// Get user ID from context
@@ -50,49 +90,20 @@ func GetUserSettings(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Get user settings
-	encryptedSettings, err := utils.GetUserSettings(userID)
-	if err != nil {
-		http.Error(w, fmt.Sprintf("Error retrieving user settings: %v", err), http.StatusInternalServerError)
-		return
-	}
-
-	// Default settings
-	defaultSettings := GetDefaultSettings()
-
-	// If no settings found, return defaults
-	if len(encryptedSettings) == 0 {
-		utils.JSONResponse(w, http.StatusOK, defaultSettings)
-		return
-	}
-
-	// Decrypt settings
+	// Get encryption key
 	encKey, err := utils.GetEncryptionKey(userID, derivedKey)
 	if err != nil {
 		http.Error(w, fmt.Sprintf("Error getting encryption key: %v", err), http.StatusInternalServerError)
 		return
 	}
 
-	decryptedSettings, err := utils.DecryptText(encryptedSettings, encKey)
+	// Get user settings
+	settings, err := loadUserSettings(userID, encKey)
 	if err != nil {
-		http.Error(w, fmt.Sprintf("Error decrypting settings: %v", err), http.StatusInternalServerError)
+		http.Error(w, fmt.Sprintf("Error loading user settings: %v", err), http.StatusInternalServerError)
 		return
 	}
 
-	// Parse JSON
-	var settings map[string]any
-	if err := json.Unmarshal([]byte(decryptedSettings), &settings); err != nil {
-		http.Error(w, fmt.Sprintf("Error parsing settings: %v", err), http.StatusInternalServerError)
-		return
-	}
-
-	// Apply defaults for missing keys
-	for key, value := range defaultSettings {
-		if _, exists := settings[key]; !exists {
-			settings[key] = value
-		}
-	}
-
 	// Return settings
 	utils.JSONResponse(w, http.StatusOK, settings)
 }
@@ -120,6 +131,9 @@ func SaveUserSettings(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Lock the settings while they are read, modified and written
+	defer utils.LockSettings(userID)()
+
 	// Get existing settings
 	encryptedSettings, err := utils.GetUserSettings(userID)
 	if err != nil {
@@ -5,12 +5,7 @@ import (
 	"encoding/base64"
 	"encoding/json"
 	"fmt"
-	"net"
 	"net/http"
-	"os"
-	"path/filepath"
-	"regexp"
-	"sort"
 	"strconv"
 	"strings"
 	"time"
@@ -74,28 +69,6 @@ func getVerifiedShareEmail(r *http.Request, tokenHash string, userID int) string
 	return email
 }
 
-func getClientIP(r *http.Request) string {
-	forwardedFor := strings.TrimSpace(r.Header.Get("X-Forwarded-For"))
-	if forwardedFor != "" {
-		parts := strings.Split(forwardedFor, ",")
-		if len(parts) > 0 {
-			return strings.TrimSpace(parts[0])
-		}
-	}
-
-	realIP := strings.TrimSpace(r.Header.Get("X-Real-IP"))
-	if realIP != "" {
-		return realIP
-	}
-
-	host, _, err := net.SplitHostPort(r.RemoteAddr)
-	if err == nil && host != "" {
-		return host
-	}
-
-	return r.RemoteAddr
-}
-
 func logShareAccess(userID int, email, ip, event, path string) {
 	if err := utils.AddShareAccessLog(userID, email, ip, event, path, time.Now()); err != nil {
 		utils.Logger.Printf("Failed to add share access log for user %d: %v", userID, err)
@@ -518,7 +491,7 @@ func RequestShareVerificationCode(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	logShareAccess(userID, email, getClientIP(r), "code_requested", r.URL.Path)
+	logShareAccess(userID, email, utils.GetClientIP(r), "code_requested", r.URL.Path)
 
 	utils.JSONResponse(w, http.StatusOK, map[string]any{
 		"success": true,
@@ -579,7 +552,7 @@ func VerifyShareVerificationCode(w http.ResponseWriter, r *http.Request) {
 		Expires:  expiresAt,
 	})
 
-	logShareAccess(userID, email, getClientIP(r), "verified", r.URL.Path)
+	logShareAccess(userID, email, utils.GetClientIP(r), "verified", r.URL.Path)
 
 	utils.JSONResponse(w, http.StatusOK, map[string]any{
 		"success": true,
@@ -599,20 +572,8 @@ func GenerateShareToken(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Generate a new random token (32 bytes, base64 URL-encoded)
-	token := utils.GenerateSecretToken()
-
-	// Compute SHA-256 hash of the raw token bytes for storage
-	tokenBytes, err := base64.URLEncoding.DecodeString(token)
-	if err != nil {
-		http.Error(w, "Error generating token", http.StatusInternalServerError)
-		return
-	}
-	hash := sha256.Sum256(tokenBytes)
-	tokenHash := base64.URLEncoding.EncodeToString(hash[:])
-
-	// Encrypt the user's derived key using the share token as the encryption key
-	encDerivedKey, err := utils.EncryptText(derivedKey, token)
+	// Generate a new random token
+	token, tokenHash, encDerivedKey, err := utils.NewShareToken(derivedKey)
 	if err != nil {
 		http.Error(w, "Error generating token", http.StatusInternalServerError)
 		return
@@ -712,10 +673,10 @@ func SharedGetMarkedDays(w http.ResponseWriter, r *http.Request) {
 			if !ok {
 				continue
 			}
-			if _, ok := day["text"].(string); ok {
+			if _, ok := day["text"].(string); ok || utils.DayHasEntries(day) {
 				daysWithLogs = append(daysWithLogs, int(dayNum))
 			}
-			if files, ok := day["files"].([]any); ok && len(files) > 0 {
+			if len(utils.DayFiles(day)) > 0 {
 				daysWithFiles = append(daysWithFiles, int(dayNum))
 			}
 			if bookmarked, ok := day["isBookmarked"].(bool); ok && bookmarked {
@@ -734,7 +695,7 @@ func SharedGetMarkedDays(w http.ResponseWriter, r *http.Request) {
 	if required {
 		email = getVerifiedShareEmail(r, tokenHash, userID)
 	}
-	logShareAccess(userID, email, getClientIP(r), "access", r.URL.Path)
+	logShareAccess(userID, email, utils.GetClientIP(r), "access", r.URL.Path)
 }
 
 // SharedLoadMonthForReading returns decrypted diary entries for a month, using a share token.
@@ -834,35 +795,31 @@ func SharedLoadMonthForReading(w http.ResponseWriter, r *http.Request) {
 		}
 
 		if filesList, ok := day["files"].([]any); ok && len(filesList) > 0 {
-			files := []any{}
-			for _, fileInterface := range filesList {
-				file, ok := fileInterface.(map[string]any)
-				if !ok {
-					continue
-				}
-				if encFilename, ok := file["enc_filename"].(string); ok {
-					decryptedFilename, err := utils.DecryptText(encFilename, encKey)
-					if err != nil {
-						http.Error(w, fmt.Sprintf("Error decrypting filename: %v", err), http.StatusInternalServerError)
-						return
-					}
-					fileCopy := make(map[string]any)
-					for k, v := range file {
-						fileCopy[k] = v
-					}
-					fileCopy["filename"] = decryptedFilename
-					files = append(files, fileCopy)
-				}
+			files, err := decryptFileList(filesList, encKey)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
 			}
 			resultDay["files"] = files
 		}
 
+		entries, err := readingEntries(day, encKey)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if len(entries) > 0 {
+			resultDay["entries"] = entries
+		}
+
 		if _, hasText := resultDay["text"]; hasText {
 			result = append(result, resultDay)
 		} else if _, hasFiles := resultDay["files"]; hasFiles {
 			result = append(result, resultDay)
 		} else if _, hasTags := resultDay["tags"]; hasTags {
 			result = append(result, resultDay)
+		} else if _, hasEntries := resultDay["entries"]; hasEntries {
+			result = append(result, resultDay)
 		}
 	}
 
@@ -872,10 +829,10 @@ func SharedLoadMonthForReading(w http.ResponseWriter, r *http.Request) {
 	if required {
 		email = getVerifiedShareEmail(r, tokenHash, userID)
 	}
-	logShareAccess(userID, email, getClientIP(r), "access", r.URL.Path)
+	logShareAccess(userID, email, utils.GetClientIP(r), "access", r.URL.Path)
 }
 
-// SharedSearch searches across all shared logs for a given search string.
+// SharedSearch searches across all shared logs with a search query, given as q or searchString.
 func SharedSearch(w http.ResponseWriter, r *http.Request) {
 	userID, derivedKey, tokenHash, err := validateShareToken(r)
 	if err != nil {
@@ -894,7 +851,10 @@ func SharedSearch(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	searchString := r.URL.Query().Get("searchString")
+	searchString := r.URL.Query().Get("q")
+	if searchString == "" {
+		searchString = r.URL.Query().Get("searchString")
+	}
 	if strings.TrimSpace(searchString) == "" {
 		http.Error(w, "Missing search parameter", http.StatusBadRequest)
 		return
@@ -906,184 +866,30 @@ func SharedSearch(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	userDir := filepath.Join(utils.Settings.DataPath, strconv.Itoa(userID))
-	results := []any{}
-
-	yearEntries, err := os.ReadDir(userDir)
+	opts, err := parseSearchOptions(r)
 	if err != nil {
-		utils.JSONResponse(w, http.StatusOK, results)
+		http.Error(w, fmt.Sprintf("Invalid search: %v", err), http.StatusBadRequest)
 		return
 	}
-
-	yearRegex := regexp.MustCompile(`^\d{4}$`)
-	monthRegex := regexp.MustCompile(`^(\d{2})\.json$`)
-
-	for _, yearEntry := range yearEntries {
-		if !yearEntry.IsDir() || !yearRegex.MatchString(yearEntry.Name()) {
-			continue
-		}
-		year := yearEntry.Name()
-		yearDir := filepath.Join(userDir, year)
-		monthEntries, err := os.ReadDir(yearDir)
-		if err != nil {
-			continue
-		}
-
-		for _, monthEntry := range monthEntries {
-			if monthEntry.IsDir() {
-				continue
-			}
-
-			matches := monthRegex.FindStringSubmatch(monthEntry.Name())
-			if len(matches) != 2 {
-				continue
-			}
-
-			month := matches[1]
-			monthInt, _ := strconv.Atoi(month)
-			yearInt, _ := strconv.Atoi(year)
-			content, err := utils.GetMonth(userID, yearInt, monthInt)
-			if err != nil {
-				continue
-			}
-
-			days, ok := content["days"].([]any)
-			if !ok {
-				continue
-			}
-
-			for _, dayInterface := range days {
-				dayLog, ok := dayInterface.(map[string]any)
-				if !ok {
-					continue
-				}
-
-				dayNum, ok := dayLog["day"].(float64)
-				if !ok {
-					continue
-				}
-				day := int(dayNum)
-
-				if text, ok := dayLog["text"].(string); ok {
-					decryptedText, err := utils.DecryptText(text, encKey)
-					if err == nil {
-						if strings.HasPrefix(searchString, "\"") && strings.HasSuffix(searchString, "\"") {
-							searchTerm := searchString[1 : len(searchString)-1]
-							if strings.Contains(decryptedText, searchTerm) {
-								context := getContext(decryptedText, searchTerm, true)
-								results = append(results, map[string]any{
-									"year":  year,
-									"month": month,
-									"day":   day,
-									"text":  context,
-								})
-							}
-						} else if strings.Contains(searchString, "|") {
-							words := strings.SplitSeq(searchString, "|")
-							for word := range words {
-								wordTrimmed := strings.TrimSpace(word)
-								if strings.Contains(strings.ToLower(decryptedText), strings.ToLower(wordTrimmed)) {
-									context := getContext(decryptedText, wordTrimmed, false)
-									results = append(results, map[string]any{
-										"year":  year,
-										"month": month,
-										"day":   day,
-										"text":  context,
-									})
-									break
-								}
-							}
-						} else if strings.Contains(searchString, " ") {
-							words := strings.Split(searchString, " ")
-							allWordsMatch := true
-							for _, word := range words {
-								wordTrimmed := strings.TrimSpace(word)
-								if !strings.Contains(strings.ToLower(decryptedText), strings.ToLower(wordTrimmed)) {
-									allWordsMatch = false
-									break
-								}
-							}
-							if allWordsMatch {
-								context := getContext(decryptedText, strings.TrimSpace(words[0]), false)
-								results = append(results, map[string]any{
-									"year":  year,
-									"month": month,
-									"day":   day,
-									"text":  context,
-								})
-							}
-						} else {
-							if strings.Contains(strings.ToLower(decryptedText), strings.ToLower(searchString)) {
-								context := getContext(decryptedText, searchString, false)
-								results = append(results, map[string]any{
-									"year":  year,
-									"month": month,
-									"day":   day,
-									"text":  context,
-								})
-							}
-						}
-					}
-				}
-
-				if files, ok := dayLog["files"].([]any); ok {
-					for _, fileInterface := range files {
-						file, ok := fileInterface.(map[string]any)
-						if !ok {
-							continue
-						}
-
-						if encFilename, ok := file["enc_filename"].(string); ok {
-							decryptedFilename, err := utils.DecryptText(encFilename, encKey)
-							if err != nil {
-								continue
-							}
-
-							if strings.Contains(strings.ToLower(decryptedFilename), strings.ToLower(searchString)) {
-								context := "📎 " + decryptedFilename
-								results = append(results, map[string]any{
-									"year":  year,
-									"month": month,
-									"day":   day,
-									"text":  context,
-								})
-								break
-							}
-						}
-					}
-				}
-			}
-		}
+	if !opts.current || opts.history || opts.trash {
+		http.Error(w, "Invalid search: only the current texts of a shared diary can be searched", http.StatusBadRequest)
+		return
 	}
 
-	sort.Slice(results, func(i, j int) bool {
-		ri := results[i].(map[string]any)
-		rj := results[j].(map[string]any)
-
-		yearI, _ := strconv.Atoi(ri["year"].(string))
-		yearJ, _ := strconv.Atoi(rj["year"].(string))
-		if yearI != yearJ {
-			return yearI < yearJ
-		}
-
-		monthI, _ := strconv.Atoi(ri["month"].(string))
-		monthJ, _ := strconv.Atoi(rj["month"].(string))
-		if monthI != monthJ {
-			return monthI < monthJ
-		}
-
-		dayI := ri["day"].(int)
-		dayJ := rj["day"].(int)
-		return dayI < dayJ
-	})
+	// The names of the tags are not shared, so tag: filters match nothing
+	query, err := parseSearchQuery(searchString, nil, searchLanguage(userID, encKey), opts.fuzzy)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Invalid search: %v", err), http.StatusBadRequest)
+		return
+	}
 
-	utils.JSONResponse(w, http.StatusOK, results)
+	respondSearch(w, userID, encKey, query, opts)
 
 	email := ""
 	if required {
 		email = getVerifiedShareEmail(r, tokenHash, userID)
 	}
-	logShareAccess(userID, email, getClientIP(r), "access", r.URL.Path)
+	logShareAccess(userID, email, utils.GetClientIP(r), "access", r.URL.Path)
 }
 
 // SharedDownloadFile decrypts and streams a file, using a share token.
@@ -1117,32 +923,22 @@ func SharedDownloadFile(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	encryptedFile, err := utils.ReadFile(userID, uuid)
+	file, _, err := utils.OpenDecryptedFile(userID, uuid, encKey)
 	if err != nil {
 		http.Error(w, fmt.Sprintf("Error reading file: %v", err), http.StatusInternalServerError)
 		return
 	}
-	defer func() { encryptedFile = nil }()
-
-	decryptedFile, err := utils.DecryptFile(encryptedFile, encKey)
-	if err != nil {
-		http.Error(w, fmt.Sprintf("Error decrypting file: %v", err), http.StatusInternalServerError)
-		return
-	}
-	defer func() { decryptedFile = nil }()
-
-	encryptedFile = nil
+	defer file.Close()
 
 	w.Header().Set("Content-Type", "application/octet-stream")
 	w.Header().Set("Content-Disposition", "attachment")
 
-	if _, err := w.Write(decryptedFile); err != nil {
-		utils.Logger.Printf("Error writing shared file response: %v", err)
-	}
+	// Supports range requests, like DownloadFile
+	http.ServeContent(w, r, "", time.Time{}, file)
 
 	email := ""
 	if required {
 		email = getVerifiedShareEmail(r, tokenHash, userID)
 	}
-	logShareAccess(userID, email, getClientIP(r), "access", r.URL.Path)
+	logShareAccess(userID, email, utils.GetClientIP(r), "access", r.URL.Path)
 }
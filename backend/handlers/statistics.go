@@ -14,6 +14,7 @@ import (
 // - each logged day with amount of words for each day
 // - amount of files for each day
 // - tags for each day
+// - amount of further entries for each day
 func GetStatistics(w http.ResponseWriter, r *http.Request) {
 	// Get user ID and derived key from context
 	userID, ok := r.Context().Value(utils.UserIDKey).(int)
@@ -44,6 +45,7 @@ func GetStatistics(w http.ResponseWriter, r *http.Request) {
 		FileSizeBytes int64 `json:"fileSizeBytes"`
 		Tags          []int `json:"tags"`
 		IsBookmarked  bool  `json:"isBookmarked"`
+		EntryCount    int   `json:"entryCount"`
 	}
 
 	dayStats := []DayStat{}
@@ -83,45 +85,47 @@ func GetStatistics(w http.ResponseWriter, r *http.Request) {
 				}
 				dayNum := int(dayNumFloat)
 
-				// Word count (decrypt text if present)
+				// Word count (decrypt texts of the day and its entries if present)
 				wordCount := 0
-				if encText, ok := dayMap["text"].(string); ok && encText != "" {
-					if decrypted, err := utils.DecryptText(encText, encKey); err == nil {
-						// Count words using Fields (splits on any whitespace)
-						words := strings.Fields(decrypted)
-						wordCount = len(words)
+				for _, part := range utils.DayParts(dayMap) {
+					if encText, ok := part["text"].(string); ok && encText != "" {
+						if decrypted, err := utils.DecryptText(encText, encKey); err == nil {
+							// Count words using Fields (splits on any whitespace)
+							words := strings.Fields(decrypted)
+							wordCount += len(words)
+						}
 					}
 				}
 
 				// File count and total size
-				fileCount := 0
+				dayFiles := utils.DayFiles(dayMap)
+				fileCount := len(dayFiles)
 				var totalFileSize int64 = 0
-				if filesAny, ok := dayMap["files"].([]any); ok {
-					fileCount = len(filesAny)
-					// Calculate total file size for this day
-					for _, fileInterface := range filesAny {
-						if fileMap, ok := fileInterface.(map[string]any); ok {
-							if sizeAny, ok := fileMap["size"]; ok {
-								// Handle both int64 and float64 types
-								switch size := sizeAny.(type) {
-								case int64:
-									totalFileSize += size
-								case float64:
-									totalFileSize += int64(size)
-								case int:
-									totalFileSize += int64(size)
-								}
-							}
+				// Calculate total file size for this day
+				for _, fileMap := range dayFiles {
+					if sizeAny, ok := fileMap["size"]; ok {
+						// Handle both int64 and float64 types
+						switch size := sizeAny.(type) {
+						case int64:
+							totalFileSize += size
+						case float64:
+							totalFileSize += int64(size)
+						case int:
+							totalFileSize += int64(size)
 						}
 					}
 				}
 
-				// Tags (IDs are numeric)
+				// Tags (IDs are numeric), each tag once even if several entries have it
 				var tagIDs []int
-				if tagsAny, ok := dayMap["tags"].([]any); ok {
-					for _, t := range tagsAny {
-						if tf, ok := t.(float64); ok {
-							tagIDs = append(tagIDs, int(tf))
+				seenTags := map[int]bool{}
+				for _, part := range utils.DayParts(dayMap) {
+					if tagsAny, ok := part["tags"].([]any); ok {
+						for _, t := range tagsAny {
+							if tf, ok := t.(float64); ok && !seenTags[int(tf)] {
+								seenTags[int(tf)] = true
+								tagIDs = append(tagIDs, int(tf))
+							}
 						}
 					}
 				}
@@ -145,6 +149,7 @@ func GetStatistics(w http.ResponseWriter, r *http.Request) {
 					FileSizeBytes: totalFileSize,
 					Tags:          tagIDs,
 					IsBookmarked:  isBookmarked,
+					EntryCount:    len(utils.DayEntries(dayMap)),
 				})
 			}
 		}
@@ -38,6 +38,9 @@ func EditTag(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Lock the tags while they are read, modified and written
+	defer utils.LockTags(userID)()
+
 	// Get tags
 	content, err := utils.GetTags(userID)
 	if err != nil {
@@ -152,53 +155,21 @@ func DeleteTag(w http.ResponseWriter, r *http.Request) {
 
 		for _, month := range months {
 			monthInt, _ := strconv.Atoi(month)
-			content, err := utils.GetMonth(userID, yearInt, monthInt)
-			if err != nil {
-				continue
-			}
-
-			days, ok := content["days"].([]any)
-			if !ok {
-				continue
-			}
-
-			// Check each day for the tag
-			modified := false
-			for i, dayInterface := range days {
-				day, ok := dayInterface.(map[string]any)
-				if !ok {
-					continue
-				}
-
-				tags, ok := day["tags"].([]any)
-				if !ok {
-					continue
-				}
-
-				// Find and remove the tag
-				for j, tagID := range tags {
-					if tagIDFloat, ok := tagID.(float64); ok && int(tagIDFloat) == id {
-						// Remove tag
-						tags = append(tags[:j], tags[j+1:]...)
-						day["tags"] = tags
-						days[i] = day
-						modified = true
-						break
-					}
-				}
-			}
-
-			// Write updated month if modified
-			if modified {
-				content["days"] = days
-				if err := utils.WriteMonth(userID, yearInt, monthInt, content); err != nil {
-					http.Error(w, fmt.Sprintf("Failed to delete tag - error writing log: %v", err), http.StatusInternalServerError)
-					return
-				}
+			if err := removeTagFromMonth(userID, yearInt, monthInt, id); err != nil {
+				http.Error(w, fmt.Sprintf("Failed to delete tag - error writing log: %v", err), http.StatusInternalServerError)
+				return
 			}
 		}
 	}
 
+	// The search index still has the tag on its days, it is rebuilt by the next search
+	if err := utils.InvalidateSearchIndex(userID); err != nil {
+		utils.Logger.Printf("Error invalidating the search index of user %d: %v", userID, err)
+	}
+
+	// Lock the tags while they are read, modified and written
+	defer utils.LockTags(userID)()
+
 	// Get tags
 	content, err := utils.GetTags(userID)
 	if err != nil {
@@ -247,12 +218,62 @@ func DeleteTag(w http.ResponseWriter, r *http.Request) {
 	})
 }
 
+// removeTagFromMonth removes a tag from all days (and their entries) of a month
+func removeTagFromMonth(userID, year, month, id int) error {
+	defer utils.LockMonth(userID, year, month)()
+
+	content, err := utils.GetMonth(userID, year, month)
+	if err != nil {
+		return nil
+	}
+
+	days, ok := content["days"].([]any)
+	if !ok {
+		return nil
+	}
+
+	// Check each day for the tag
+	modified := false
+	for _, dayInterface := range days {
+		day, ok := dayInterface.(map[string]any)
+		if !ok {
+			continue
+		}
+
+		// The tag may be used by the day itself and by its entries
+		for _, part := range utils.DayParts(day) {
+			tags, ok := part["tags"].([]any)
+			if !ok {
+				continue
+			}
+
+			// Find and remove the tag
+			for j, tagID := range tags {
+				if tagIDFloat, ok := tagID.(float64); ok && int(tagIDFloat) == id {
+					// Remove tag
+					part["tags"] = append(tags[:j], tags[j+1:]...)
+					modified = true
+					break
+				}
+			}
+		}
+	}
+
+	// Write updated month if modified
+	if !modified {
+		return nil
+	}
+	content["days"] = days
+	return utils.WriteMonth(userID, year, month, content)
+}
+
 // TagLogRequest represents the tag log request
 type TagLogRequest struct {
-	Day   int `json:"day"`
-	Month int `json:"month"`
-	Year  int `json:"year"`
-	TagID int `json:"tag_id"`
+	Day     int    `json:"day"`
+	Month   int    `json:"month"`
+	Year    int    `json:"year"`
+	TagID   int    `json:"tag_id"`
+	EntryID string `json:"entry_id"` // Tag an entry of the day instead of the day itself
 }
 
 // AddTagToLog handles adding a tag to a log
@@ -271,6 +292,9 @@ func AddTagToLog(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Lock the month while it is read, modified and written
+	defer utils.LockMonth(userID, req.Year, req.Month)()
+
 	// Get month data
 	content, err := utils.GetMonth(userID, req.Year, req.Month)
 	if err != nil {
@@ -299,7 +323,14 @@ func AddTagToLog(w http.ResponseWriter, r *http.Request) {
 
 		// Day found, add tag
 		dayFound = true
-		tags, ok := day["tags"].([]any)
+		target := day
+		if req.EntryID != "" {
+			if target = utils.FindDayEntry(day, req.EntryID); target == nil {
+				http.Error(w, "Entry not found", http.StatusNotFound)
+				return
+			}
+		}
+		tags, ok := target["tags"].([]any)
 		if !ok {
 			tags = []any{}
 		}
@@ -315,12 +346,16 @@ func AddTagToLog(w http.ResponseWriter, r *http.Request) {
 
 		if !tagExists {
 			tags = append(tags, float64(req.TagID))
-			day["tags"] = tags
+			target["tags"] = tags
 			days[i] = day
 		}
 		break
 	}
 
+	if !dayFound && req.EntryID != "" {
+		http.Error(w, "Entry not found", http.StatusNotFound)
+		return
+	}
 	if !dayFound {
 		// Create new day with tag
 		days = append(days, map[string]any{
@@ -337,6 +372,7 @@ func AddTagToLog(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, fmt.Sprintf("Failed to write tag - error writing log: %v", err), http.StatusInternalServerError)
 		return
 	}
+	updateSearchIndex(r, req.Year, req.Month, content, req.Day)
 
 	// Return success
 	utils.JSONResponse(w, http.StatusOK, map[string]bool{
@@ -360,6 +396,9 @@ func RemoveTagFromLog(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Lock the month while it is read, modified and written
+	defer utils.LockMonth(userID, req.Year, req.Month)()
+
 	// Get month data
 	content, err := utils.GetMonth(userID, req.Year, req.Month)
 	if err != nil {
@@ -388,7 +427,14 @@ func RemoveTagFromLog(w http.ResponseWriter, r *http.Request) {
 		}
 
 		// Day found, check for tags
-		tags, ok := day["tags"].([]any)
+		target := day
+		if req.EntryID != "" {
+			if target = utils.FindDayEntry(day, req.EntryID); target == nil {
+				http.Error(w, "Entry not found", http.StatusNotFound)
+				return
+			}
+		}
+		tags, ok := target["tags"].([]any)
 		if !ok {
 			http.Error(w, "Failed to remove tag - not found in log", http.StatusInternalServerError)
 			return
@@ -399,7 +445,7 @@ func RemoveTagFromLog(w http.ResponseWriter, r *http.Request) {
 			if tagIDFloat, ok := tagID.(float64); ok && int(tagIDFloat) == req.TagID {
 				// Remove tag
 				tags = append(tags[:j], tags[j+1:]...)
-				day["tags"] = tags
+				target["tags"] = tags
 				days[i] = day
 				found = true
 				break
@@ -426,6 +472,7 @@ func RemoveTagFromLog(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, fmt.Sprintf("Failed to remove tag - error writing log: %v", err), http.StatusInternalServerError)
 		return
 	}
+	updateSearchIndex(r, req.Year, req.Month, content, req.Day)
 
 	// Return success
 	utils.JSONResponse(w, http.StatusOK, map[string]bool{
@@ -540,6 +587,9 @@ func SaveTags(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Lock the tags while they are read, modified and written
+	defer utils.LockTags(userID)()
+
 	// Get tags
 	content, err := utils.GetTags(userID)
 	if err != nil {
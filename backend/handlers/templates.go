@@ -143,6 +143,7 @@ func SaveTemplates(w http.ResponseWriter, r *http.Request) {
 	content["templates"] = templates
 
 	// Write templates
+	defer utils.LockTemplates(userID)()
 	if err := utils.WriteTemplates(userID, content); err != nil {
 		http.Error(w, fmt.Sprintf("Error writing templates: %v", err), http.StatusInternalServerError)
 		return
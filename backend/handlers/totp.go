@@ -0,0 +1,293 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/phitux/dailytxt/backend/utils"
+)
+
+// GetTOTPStatus returns whether two-factor authentication is enabled for the user
+func GetTOTPStatus(w http.ResponseWriter, r *http.Request) {
+	// Get user ID from context
+	userID, ok := r.Context().Value(utils.UserIDKey).(int)
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	enabled, err := utils.IsTOTPEnabled(userID)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error reading TOTP status: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	utils.JSONResponse(w, http.StatusOK, map[string]bool{
+		"enabled": enabled,
+	})
+}
+
+// SetupTOTPRequest represents the request body to start the TOTP setup
+type SetupTOTPRequest struct {
+	Password string `json:"password"`
+}
+
+// SetupTOTP creates a new TOTP secret for the user. It is only used for logins after a first code was confirmed.
+func SetupTOTP(w http.ResponseWriter, r *http.Request) {
+	// Get user info from context
+	userID, ok := r.Context().Value(utils.UserIDKey).(int)
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	username, ok := r.Context().Value(utils.UsernameKey).(string)
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var req SetupTOTPRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	// check password
+	derivedKey, _, err := utils.CheckPasswordForUser(userID, req.Password)
+	if err != nil || len(derivedKey) == 0 {
+		utils.JSONResponse(w, http.StatusOK, map[string]any{
+			"success":            false,
+			"password_incorrect": true,
+		})
+		return
+	}
+
+	encKey, err := utils.GetEncryptionKey(userID, derivedKey)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error getting encryption key: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	secret, err := utils.GenerateTOTPSecret()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	encSecret, err := utils.EncryptText(secret, encKey)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error encrypting TOTP secret: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	if err := utils.SavePendingTOTP(userID, encSecret); err != nil {
+		http.Error(w, fmt.Sprintf("Error saving TOTP secret: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	utils.JSONResponse(w, http.StatusOK, map[string]any{
+		"success": true,
+		"secret":  secret,
+		"uri":     utils.TOTPURI(secret, username),
+	})
+}
+
+// TOTPCodeRequest represents a request body holding a TOTP code
+type TOTPCodeRequest struct {
+	Code string `json:"code"`
+}
+
+// ConfirmTOTP enables TOTP after the user entered a first valid code of the new secret
+func ConfirmTOTP(w http.ResponseWriter, r *http.Request) {
+	// Get user ID and derived key from context
+	userID, ok := r.Context().Value(utils.UserIDKey).(int)
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	derivedKey, ok := r.Context().Value(utils.DerivedKeyKey).(string)
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var req TOTPCodeRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	encKey, err := utils.GetEncryptionKey(userID, derivedKey)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error getting encryption key: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	valid, err := utils.ConfirmTOTP(userID, encKey, req.Code, time.Now())
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error confirming TOTP: %v", err), http.StatusBadRequest)
+		return
+	}
+	if !valid {
+		utils.JSONResponse(w, http.StatusOK, map[string]any{
+			"success":      false,
+			"code_invalid": true,
+		})
+		return
+	}
+
+	utils.Logger.Printf("TOTP enabled for user ID %d", userID)
+
+	utils.JSONResponse(w, http.StatusOK, map[string]bool{
+		"success": true,
+	})
+}
+
+// DisableTOTPRequest represents the request body to disable TOTP
+type DisableTOTPRequest struct {
+	Password string `json:"password"`
+}
+
+// DisableTOTP turns two-factor authentication off again (password required)
+func DisableTOTP(w http.ResponseWriter, r *http.Request) {
+	// Get user ID from context
+	userID, ok := r.Context().Value(utils.UserIDKey).(int)
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var req DisableTOTPRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	// check password
+	derivedKey, availableBackupCodes, err := utils.CheckPasswordForUser(userID, req.Password)
+	if err != nil || len(derivedKey) == 0 {
+		utils.JSONResponse(w, http.StatusOK, map[string]any{
+			"success":            false,
+			"password_incorrect": true,
+		})
+		return
+	}
+
+	if err := utils.DisableTOTP(userID); err != nil {
+		http.Error(w, fmt.Sprintf("Error disabling TOTP: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	utils.Logger.Printf("TOTP disabled for user ID %d", userID)
+
+	utils.JSONResponse(w, http.StatusOK, map[string]any{
+		"success":                true,
+		"available_backup_codes": availableBackupCodes,
+	})
+}
+
+// LoginTOTPRequest represents the second login step
+type LoginTOTPRequest struct {
+	Challenge string `json:"challenge"`
+	Code      string `json:"code"`
+}
+
+// LoginTOTP completes a login of a user with TOTP enabled
+func LoginTOTP(w http.ResponseWriter, r *http.Request) {
+	var req LoginTOTPRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	now := time.Now()
+	userID, username, derivedKey, password, err := utils.UseLoginChallenge(req.Challenge, now)
+	if err != nil {
+		if errors.Is(err, utils.ErrLoginChallengeNotFound) {
+			// The password has to be entered again
+			http.Error(w, "Login expired", http.StatusUnauthorized)
+			return
+		}
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+
+	// Wrong codes count like wrong passwords
+	ip := utils.GetClientIP(r)
+	if wait, allowed := utils.StartLoginAttempt(ip, username, now); !allowed {
+		utils.Logger.Printf("Login for user '%s' from %s throttled", username, ip)
+		tooManyLoginAttempts(w, wait)
+		return
+	}
+	loginResult := utils.LoginAborted
+	defer func() {
+		utils.FinishLoginAttempt(ip, username, loginResult, time.Now())
+	}()
+
+	encKey, err := utils.GetEncryptionKey(userID, derivedKey)
+	if err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+
+	valid, err := utils.VerifyUserTOTP(userID, encKey, req.Code, now)
+	if err != nil {
+		utils.Logger.Printf("Error checking TOTP code for user '%s': %v", username, err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	if !valid {
+		utils.Logger.Printf("Login failed. TOTP code for user '%s' is incorrect", username)
+		if err := utils.RecordFailedLogin(userID, ip, "totp", now); err != nil {
+			utils.Logger.Printf("Error recording failed login for user '%s': %v", username, err)
+		}
+		loginResult = utils.LoginFailed
+		utils.JSONResponse(w, http.StatusOK, map[string]any{
+			"success":      false,
+			"code_invalid": true,
+		})
+		return
+	}
+	utils.DeleteLoginChallenge(req.Challenge)
+
+	// Upgrade the Argon2 parameters, if they were raised
+	derivedKey = upgradeUserKDF(userID, password, derivedKey)
+
+	// Create session
+	token, err := utils.CreateSession(userID, username, derivedKey, ip, r.UserAgent())
+	if err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	loginResult = utils.LoginSucceeded
+
+	// Continue an interrupted key rotation
+	resumeKeyRotation(userID, derivedKey)
+
+	// Show the user the failed attempts since the last login
+	failedLogins, failedLoginsCount, err := utils.TakeFailedLogins(userID)
+	if err != nil {
+		utils.Logger.Printf("Error reading failed logins of user '%s': %v", username, err)
+	}
+
+	// Set cookie
+	http.SetCookie(w, &http.Cookie{
+		Name:     "token",
+		Value:    token,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+		Path:     "/",
+		Expires:  time.Now().Add(time.Duration(utils.Settings.LogoutAfterDays) * 24 * time.Hour),
+	})
+
+	utils.JSONResponse(w, http.StatusOK, map[string]any{
+		"success":                true,
+		"migration_started":      false,
+		"username":               username,
+		"available_backup_codes": -1,
+		"failed_logins":          failedLogins,
+		"failed_logins_count":    failedLoginsCount,
+	})
+}
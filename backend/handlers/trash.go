@@ -0,0 +1,414 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/phitux/dailytxt/backend/utils"
+)
+
+// trashItemInt reads a number (year, month, day) of a trash item
+func trashItemInt(item map[string]any, key string) int {
+	switch value := item[key].(type) {
+	case float64:
+		return int(value)
+	case int:
+		return value
+	}
+	return 0
+}
+
+// decryptTrashFile returns the filename and size of a file entry
+func decryptTrashFile(file map[string]any, encKey string) (map[string]any, error) {
+	filename := ""
+	if encFilename, ok := file["enc_filename"].(string); ok && encFilename != "" {
+		decrypted, err := utils.DecryptText(encFilename, encKey)
+		if err != nil {
+			return nil, fmt.Errorf("error decrypting filename: %v", err)
+		}
+		filename = decrypted
+	}
+	return map[string]any{
+		"filename": filename,
+		"size":     file["size"],
+	}, nil
+}
+
+// GetTrash returns the deleted days, entries and files of the user
+func GetTrash(w http.ResponseWriter, r *http.Request) {
+	// Get user ID and derived key from context
+	userID, ok := r.Context().Value(utils.UserIDKey).(int)
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	derivedKey, ok := r.Context().Value(utils.DerivedKeyKey).(string)
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	// Get encryption key
+	encKey, err := utils.GetEncryptionKey(userID, derivedKey)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error getting encryption key: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	content, err := utils.GetTrash(userID)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error retrieving trash: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	items := []map[string]any{}
+	for _, item := range utils.TrashItems(content) {
+		itemType, _ := item["type"].(string)
+		entry, _ := item["entry"].(map[string]any)
+		if entry == nil {
+			continue
+		}
+
+		result := map[string]any{
+			"id":         item["id"],
+			"type":       itemType,
+			"year":       trashItemInt(item, "year"),
+			"month":      trashItemInt(item, "month"),
+			"day":        trashItemInt(item, "day"),
+			"deleted_at": item["deleted_at"],
+			"purge_at":   nil, // never purged automatically, the age is unknown
+		}
+		if purgeAt, ok := utils.TrashItemPurgeAt(item); ok {
+			result["purge_at"] = purgeAt.Format(time.RFC3339)
+		}
+
+		switch itemType {
+		case utils.TrashDay, utils.TrashEntry:
+			text := ""
+			if encryptedText, ok := entry["text"].(string); ok && encryptedText != "" {
+				if text, err = utils.DecryptText(encryptedText, encKey); err != nil {
+					http.Error(w, fmt.Sprintf("Error decrypting text: %v", err), http.StatusInternalServerError)
+					return
+				}
+			}
+			result["text"] = text
+
+			if itemType == utils.TrashEntry {
+				entryTime := ""
+				if encryptedTime, ok := entry["time"].(string); ok && encryptedTime != "" {
+					if entryTime, err = utils.DecryptText(encryptedTime, encKey); err != nil {
+						http.Error(w, fmt.Sprintf("Error decrypting time: %v", err), http.StatusInternalServerError)
+						return
+					}
+				}
+				result["time"] = entryTime
+			}
+
+			files := []map[string]any{}
+			for _, file := range utils.TrashItemFiles(item) {
+				decrypted, err := decryptTrashFile(file, encKey)
+				if err != nil {
+					http.Error(w, fmt.Sprintf("Error decrypting file: %v", err), http.StatusInternalServerError)
+					return
+				}
+				files = append(files, decrypted)
+			}
+			result["files"] = files
+
+		case utils.TrashFile:
+			decrypted, err := decryptTrashFile(entry, encKey)
+			if err != nil {
+				http.Error(w, fmt.Sprintf("Error decrypting file: %v", err), http.StatusInternalServerError)
+				return
+			}
+			result["filename"] = decrypted["filename"]
+			result["size"] = decrypted["size"]
+		}
+
+		items = append(items, result)
+	}
+
+	utils.JSONResponse(w, http.StatusOK, map[string]any{
+		"items": items,
+	})
+}
+
+// RestoreFromTrashRequest represents the request body to restore a trash item.
+// Without a date the item is restored to the date it was deleted from.
+type RestoreFromTrashRequest struct {
+	ID    string `json:"id"`
+	Year  int    `json:"year"`
+	Month int    `json:"month"`
+	Day   int    `json:"day"`
+}
+
+// RestoreFromTrash merges a deleted day, entry or file back into its original date or into a chosen one.
+// An entry is added to the entries of the day, a file to the files of the day itself.
+func RestoreFromTrash(w http.ResponseWriter, r *http.Request) {
+	// Get user ID and derived key from context
+	userID, ok := r.Context().Value(utils.UserIDKey).(int)
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	derivedKey, ok := r.Context().Value(utils.DerivedKeyKey).(string)
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var req RestoreFromTrashRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.ID == "" {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	content, err := utils.GetTrash(userID)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error retrieving trash: %v", err), http.StatusInternalServerError)
+		return
+	}
+	item := utils.FindTrashItem(content, req.ID)
+	if item == nil {
+		http.Error(w, "Trash item not found", http.StatusNotFound)
+		return
+	}
+	itemType, _ := item["type"].(string)
+	entry, _ := item["entry"].(map[string]any)
+	if entry == nil || (itemType != utils.TrashDay && itemType != utils.TrashEntry && itemType != utils.TrashFile) {
+		http.Error(w, "Invalid trash item", http.StatusInternalServerError)
+		return
+	}
+
+	// Target date
+	year, month, day := trashItemInt(item, "year"), trashItemInt(item, "month"), trashItemInt(item, "day")
+	if req.Year != 0 || req.Month != 0 || req.Day != 0 {
+		year, month, day = req.Year, req.Month, req.Day
+	}
+	if date := time.Date(year, time.Month(month), day, 0, 0, 0, 0, time.UTC); date.Year() != year || int(date.Month()) != month || date.Day() != day {
+		http.Error(w, "Invalid date", http.StatusBadRequest)
+		return
+	}
+
+	// Get encryption key
+	encKey, err := utils.GetEncryptionKey(userID, derivedKey)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error getting encryption key: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	// Lock the month while it is read, modified and written
+	defer utils.LockMonth(userID, year, month)()
+
+	monthContent, err := utils.GetMonth(userID, year, month)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error retrieving month data: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	days, _ := monthContent["days"].([]any)
+	var target map[string]any
+	for _, dayInterface := range days {
+		dayObj, ok := dayInterface.(map[string]any)
+		if !ok {
+			continue
+		}
+		if dayNum, ok := dayObj["day"].(float64); ok && int(dayNum) == day {
+			target = dayObj
+			break
+		}
+	}
+
+	if itemType == utils.TrashDay && target != nil {
+		// A day with text is not overwritten, another date has to be chosen
+		if encryptedText, ok := target["text"].(string); ok && encryptedText != "" {
+			text, err := utils.DecryptText(encryptedText, encKey)
+			if err != nil {
+				http.Error(w, fmt.Sprintf("Error decrypting text: %v", err), http.StatusInternalServerError)
+				return
+			}
+			if text != "" {
+				utils.JSONResponse(w, http.StatusConflict, map[string]any{
+					"success":  false,
+					"conflict": true,
+					"year":     year,
+					"month":    month,
+					"day":      day,
+				})
+				return
+			}
+		}
+	}
+
+	// The item is restored only once, even if restored concurrently. The removed item is used,
+	// as it may have been re-encrypted by a key rotation meanwhile.
+	item, err = utils.RemoveFromTrash(userID, req.ID)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error removing item from trash: %v", err), http.StatusInternalServerError)
+		return
+	}
+	if item == nil {
+		http.Error(w, "Trash item not found", http.StatusNotFound)
+		return
+	}
+	entry, _ = item["entry"].(map[string]any)
+	if entry == nil {
+		http.Error(w, "Invalid trash item", http.StatusInternalServerError)
+		return
+	}
+
+	if target == nil {
+		target = map[string]any{"day": float64(day)}
+		days = append(days, target)
+	}
+
+	switch itemType {
+	case utils.TrashDay:
+		mergeTrashDay(target, entry, encKey)
+	case utils.TrashEntry:
+		utils.SetDayEntries(target, append(utils.DayEntries(target), entry))
+		utils.SortDayEntries(target, encKey)
+	case utils.TrashFile:
+		files, _ := target["files"].([]any)
+		target["files"] = append(files, entry)
+	}
+	monthContent["days"] = days
+
+	if err := utils.WriteMonth(userID, year, month, monthContent); err != nil {
+		// Keep the item in the trash, so it isn't lost
+		deletedAt, ok := utils.TrashItemDeletedAt(item)
+		if !ok {
+			deletedAt = time.Now()
+		}
+		if _, trashErr := utils.MoveToTrash(userID, itemType, trashItemInt(item, "year"), trashItemInt(item, "month"), trashItemInt(item, "day"), entry, deletedAt); trashErr != nil {
+			utils.Logger.Printf("Error returning item to trash for user %d: %v", userID, trashErr)
+		}
+		http.Error(w, fmt.Sprintf("Error writing month data: %v", err), http.StatusInternalServerError)
+		return
+	}
+	updateSearchIndex(r, year, month, monthContent, day)
+
+	utils.JSONResponse(w, http.StatusOK, map[string]any{
+		"success": true,
+		"year":    year,
+		"month":   month,
+		"day":     day,
+	})
+}
+
+// mergeTrashDay merges a deleted day into a day without text. The deleted history comes first,
+// the history of the target day is numbered after it. Tags, files and entries of both days are kept.
+func mergeTrashDay(target, deleted map[string]any, encKey string) {
+	target["text"] = deleted["text"]
+	target["date_written"] = deleted["date_written"]
+	if savedAt, ok := deleted["saved_at"]; ok {
+		target["saved_at"] = savedAt
+	} else {
+		delete(target, "saved_at")
+	}
+
+	history := []any{}
+	version := 0
+	addHistory := func(items any) {
+		list, _ := items.([]any)
+		for _, historyItem := range list {
+			historyMap, ok := historyItem.(map[string]any)
+			if !ok {
+				continue
+			}
+			if !utils.IsHistoryEvent(historyMap) {
+				version++
+				historyMap["version"] = version
+			}
+			history = append(history, historyMap)
+		}
+	}
+	addHistory(deleted["history"])
+	addHistory(target["history"])
+	if len(history) > 0 {
+		target["history"] = history
+	}
+
+	tags, _ := target["tags"].([]any)
+	for _, tag := range toAnySlice(deleted["tags"]) {
+		found := false
+		for _, existing := range tags {
+			if existing == tag {
+				found = true
+				break
+			}
+		}
+		if !found {
+			tags = append(tags, tag)
+		}
+	}
+	if len(tags) > 0 {
+		target["tags"] = tags
+	}
+
+	if deletedFiles := toAnySlice(deleted["files"]); len(deletedFiles) > 0 {
+		files, _ := target["files"].([]any)
+		target["files"] = append(files, deletedFiles...)
+	}
+
+	if deletedEntries := utils.DayEntries(deleted); len(deletedEntries) > 0 {
+		utils.SetDayEntries(target, append(utils.DayEntries(target), deletedEntries...))
+		utils.SortDayEntries(target, encKey)
+	}
+
+	if bookmarked, _ := deleted["isBookmarked"].(bool); bookmarked {
+		target["isBookmarked"] = true
+	}
+
+	target["revision"] = max(getDayRevision(target), getDayRevision(deleted)) + 1
+}
+
+// toAnySlice returns a JSON array, or nil
+func toAnySlice(value any) []any {
+	list, _ := value.([]any)
+	return list
+}
+
+// PurgeTrashRequest represents the request body to purge the trash.
+// Without an id the whole trash is emptied.
+type PurgeTrashRequest struct {
+	ID string `json:"id"`
+}
+
+// PurgeTrash deletes items of the trash for good
+func PurgeTrash(w http.ResponseWriter, r *http.Request) {
+	// Get user ID from context
+	userID, ok := r.Context().Value(utils.UserIDKey).(int)
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var req PurgeTrashRequest
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+	}
+
+	purged, err := utils.PurgeTrash(userID, func(item map[string]any) bool {
+		id, _ := item["id"].(string)
+		return req.ID == "" || id == req.ID
+	})
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error purging trash: %v", err), http.StatusInternalServerError)
+		return
+	}
+	if req.ID != "" && purged == 0 {
+		http.Error(w, "Trash item not found", http.StatusNotFound)
+		return
+	}
+
+	utils.JSONResponse(w, http.StatusOK, map[string]any{
+		"success": true,
+		"purged":  purged,
+	})
+}
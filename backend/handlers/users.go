@@ -5,6 +5,7 @@ import (
 	"encoding/base64"
 	"encoding/json"
 	"fmt"
+	"math"
 	"net/http"
 	"strconv"
 	"strings"
@@ -29,6 +30,18 @@ func Login(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Throttle password guessing (and the expensive Argon2 verification)
+	ip := utils.GetClientIP(r)
+	if wait, allowed := utils.StartLoginAttempt(ip, req.Username, time.Now()); !allowed {
+		utils.Logger.Printf("Login for user '%s' from %s throttled", req.Username, ip)
+		tooManyLoginAttempts(w, wait)
+		return
+	}
+	loginResult := utils.LoginAborted
+	defer func() {
+		utils.FinishLoginAttempt(ip, req.Username, loginResult, time.Now())
+	}()
+
 	// Get users
 	users, err := utils.GetUsers()
 	if err != nil {
@@ -67,6 +80,7 @@ func Login(w http.ResponseWriter, r *http.Request) {
 		oldUsers, err := utils.GetOldUsers()
 		if err != nil {
 			utils.Logger.Printf("Error accessing old users: %v", err)
+			loginResult = utils.LoginFailed
 			http.Error(w, "User/Password combination not found", http.StatusNotFound)
 			return
 		}
@@ -74,6 +88,7 @@ func Login(w http.ResponseWriter, r *http.Request) {
 		oldUsersList, ok := oldUsers["users"].([]any)
 		if !ok || len(oldUsersList) == 0 {
 			utils.Logger.Printf("Login failed. User '%s' not found in new or old data", req.Username)
+			loginResult = utils.LoginFailed
 			http.Error(w, "User/Password combination not found", http.StatusNotFound)
 			return
 		}
@@ -94,6 +109,7 @@ func Login(w http.ResponseWriter, r *http.Request) {
 
 		if oldUser == nil {
 			utils.Logger.Printf("Login failed. User '%s' not found in new or old data", req.Username)
+			loginResult = utils.LoginFailed
 			http.Error(w, "User/Password combination not found", http.StatusNotFound)
 			return
 		}
@@ -102,6 +118,7 @@ func Login(w http.ResponseWriter, r *http.Request) {
 		oldHashedPassword, ok := oldUser["password"].(string)
 		if !ok {
 			utils.Logger.Printf("Login failed. Password not found for '%s'", req.Username)
+			loginResult = utils.LoginFailed
 			http.Error(w, "User/Password combination not found", http.StatusNotFound)
 			return
 		}
@@ -109,11 +126,13 @@ func Login(w http.ResponseWriter, r *http.Request) {
 		// Verify old password
 		if !utils.VerifyOldPassword(req.Password, oldHashedPassword) {
 			utils.Logger.Printf("Login failed. Old password for user '%s' is incorrect", req.Username)
+			loginResult = utils.LoginFailed
 			http.Error(w, "User/Password combination not found", http.StatusNotFound)
 			return
 		}
 
 		// Start migration
+		loginResult = utils.LoginSucceeded
 		utils.Logger.Printf("User '%s' found in old data. Starting migration...", req.Username)
 
 		// Check if there is already a migration in progress for this user
@@ -189,16 +208,59 @@ func Login(w http.ResponseWriter, r *http.Request) {
 		return
 	} else if derivedKey == "" {
 		utils.Logger.Printf("Login failed. Password for user '%s' is incorrect", req.Username)
+		if err := utils.RecordFailedLogin(userID, ip, "password", time.Now()); err != nil {
+			utils.Logger.Printf("Error recording failed login for user '%s': %v", req.Username, err)
+		}
+		loginResult = utils.LoginFailed
 		http.Error(w, "User/Password combination not found", http.StatusNotFound)
 		return
 	}
 
-	// Create JWT token
-	token, err := utils.GenerateToken(userID, username, derivedKey)
+	// With TOTP enabled, the code is asked in a second step (POST /users/login/totp).
+	// A backup code is the recovery path for a lost authenticator, it skips the second step.
+	if availableBackupCodes == -1 {
+		totpEnabled, err := utils.IsTOTPEnabled(userID)
+		if err != nil {
+			utils.Logger.Printf("Error checking TOTP for user '%s': %v", req.Username, err)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+		if totpEnabled {
+			challenge, err := utils.CreateLoginChallenge(userID, username, derivedKey, req.Password, time.Now())
+			if err != nil {
+				http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+				return
+			}
+
+			utils.JSONResponse(w, http.StatusOK, map[string]any{
+				"migration_started": false,
+				"username":          username,
+				"totp_required":     true,
+				"challenge":         challenge,
+			})
+			return
+		}
+
+		// Upgrade the Argon2 parameters, if they were raised (not with a backup code, it isn't the password)
+		derivedKey = upgradeUserKDF(userID, req.Password, derivedKey)
+	}
+
+	// Create session
+	token, err := utils.CreateSession(userID, username, derivedKey, ip, r.UserAgent())
 	if err != nil {
 		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
 		return
 	}
+	loginResult = utils.LoginSucceeded
+
+	// Continue an interrupted key rotation
+	resumeKeyRotation(userID, derivedKey)
+
+	// Show the user the failed attempts since the last login
+	failedLogins, failedLoginsCount, err := utils.TakeFailedLogins(userID)
+	if err != nil {
+		utils.Logger.Printf("Error reading failed logins of user '%s': %v", username, err)
+	}
 
 	// Set cookie
 	http.SetCookie(w, &http.Cookie{
@@ -215,6 +277,29 @@ func Login(w http.ResponseWriter, r *http.Request) {
 		"migration_started":      false,
 		"username":               username,
 		"available_backup_codes": availableBackupCodes,
+		"failed_logins":          failedLogins,
+		"failed_logins_count":    failedLoginsCount,
+	})
+}
+
+// upgradeUserKDF upgrades the Argon2 parameters of a user on login and returns the derived key for the new session.
+// A failed upgrade doesn't stop the login.
+func upgradeUserKDF(userID int, password, derivedKey string) string {
+	newDerivedKey, err := utils.UpgradeUserKDF(userID, password, derivedKey)
+	if err != nil {
+		utils.Logger.Printf("Error upgrading Argon2 parameters of user %d: %v", userID, err)
+		return derivedKey
+	}
+	return newDerivedKey
+}
+
+// tooManyLoginAttempts answers a throttled login attempt
+func tooManyLoginAttempts(w http.ResponseWriter, wait time.Duration) {
+	seconds := int(math.Ceil(wait.Seconds()))
+	w.Header().Set("Retry-After", strconv.Itoa(seconds))
+	utils.JSONResponse(w, http.StatusTooManyRequests, map[string]any{
+		"error":       "Too many failed login attempts",
+		"retry_after": seconds,
 	})
 }
 
@@ -294,7 +379,7 @@ func Register(username string, password string) (bool, error) {
 	}
 
 	// Create new user data
-	hashedPassword, err := utils.HashPassword(password)
+	hashedPassword, err := utils.HashPassword(password, "")
 	if err != nil {
 		return false, fmt.Errorf("internal Server Error: %d", http.StatusInternalServerError)
 	}
@@ -308,7 +393,8 @@ func Register(username string, password string) (bool, error) {
 	saltBase64 := base64.StdEncoding.EncodeToString(salt)
 
 	// Create encryption key
-	derivedKey, err := utils.DeriveKeyFromPassword(password, saltBase64)
+	kdfParams := utils.CurrentKDFParams()
+	derivedKey, err := utils.DeriveKeyFromPassword(password, saltBase64, kdfParams)
 	if err != nil {
 		return false, fmt.Errorf("internal Server Error: %d", http.StatusInternalServerError)
 	}
@@ -345,6 +431,7 @@ func Register(username string, password string) (bool, error) {
 					"username":         username,
 					"password":         hashedPassword,
 					"salt":             salt,
+					"kdf":              kdfParams.ToMap(),
 					"enc_enc_key":      encEncKey,
 				},
 			},
@@ -371,6 +458,7 @@ func Register(username string, password string) (bool, error) {
 			"username":         username,
 			"password":         hashedPassword,
 			"salt":             salt,
+			"kdf":              kdfParams.ToMap(),
 			"enc_enc_key":      encEncKey,
 		})
 
@@ -388,6 +476,14 @@ func Register(username string, password string) (bool, error) {
 
 // Logout handles user logout
 func Logout(w http.ResponseWriter, r *http.Request) {
+	// End the session
+	if cookie, err := r.Cookie("token"); err == nil {
+		if err := utils.DeleteSession(cookie.Value); err != nil {
+			http.Error(w, fmt.Sprintf("Error ending session: %v", err), http.StatusInternalServerError)
+			return
+		}
+	}
+
 	// Delete token cookie
 	http.SetCookie(w, &http.Cookie{
 		Name:     "token",
@@ -414,8 +510,8 @@ func CheckLogin(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Validate JWT token
-	claims, err := utils.ValidateToken(cookie.Value)
+	// Look up the session
+	session, _, err := utils.GetSession(cookie.Value)
 	if err != nil {
 		http.Error(w, "Unauthorized", http.StatusUnauthorized)
 		return
@@ -423,8 +519,8 @@ func CheckLogin(w http.ResponseWriter, r *http.Request) {
 
 	// Return user info
 	utils.JSONResponse(w, http.StatusOK, map[string]any{
-		"user_id":  claims.UserID,
-		"username": claims.Username,
+		"user_id":  session.UserID,
+		"username": session.Username,
 	})
 }
 
@@ -575,7 +671,8 @@ func ChangePassword(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	newHashedPassword, err := utils.HashPassword(req.NewPassword)
+	previousHash, _ := user["password"].(string)
+	newHashedPassword, err := utils.HashPassword(req.NewPassword, previousHash)
 	if err != nil {
 		utils.JSONResponse(w, http.StatusInternalServerError, map[string]any{
 			"success": false,
@@ -619,7 +716,8 @@ func ChangePassword(w http.ResponseWriter, r *http.Request) {
 	}
 
 	saltBase64 := base64.StdEncoding.EncodeToString(salt)
-	newDerivedKey, err := utils.DeriveKeyFromPassword(req.NewPassword, saltBase64)
+	kdfParams := utils.CurrentKDFParams()
+	newDerivedKey, err := utils.DeriveKeyFromPassword(req.NewPassword, saltBase64, kdfParams)
 	if err != nil {
 		utils.JSONResponse(w, http.StatusInternalServerError, map[string]any{
 			"success": false,
@@ -650,6 +748,7 @@ func ChangePassword(w http.ResponseWriter, r *http.Request) {
 
 	// Update user data with new salt and encrypted key
 	user["salt"] = saltBase64
+	user["kdf"] = kdfParams.ToMap()
 	user["enc_enc_key"] = encEncKey
 
 	// Remove backup codes if they exist
@@ -672,8 +771,15 @@ func ChangePassword(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// create new JWT token with updated derived key
-	token, err := utils.GenerateToken(userID, user["username"].(string), base64.StdEncoding.EncodeToString(newDerivedKey))
+	// Log out all sessions (they hold the old derived key) and start a new one
+	if err := utils.DeleteUserSessions(userID); err != nil {
+		utils.JSONResponse(w, http.StatusInternalServerError, map[string]any{
+			"success": false,
+			"message": fmt.Sprintf("Error ending sessions: %v", err),
+		})
+		return
+	}
+	token, err := utils.CreateSession(userID, user["username"].(string), base64.StdEncoding.EncodeToString(newDerivedKey), utils.GetClientIP(r), r.UserAgent())
 	if err != nil {
 		utils.JSONResponse(w, http.StatusInternalServerError, map[string]any{
 			"success": false,
@@ -703,9 +809,9 @@ type DeleteAccountRequest struct {
 	Password string `json:"password"`
 }
 
-// deleteUserByID deletes a user by their user ID from the system
-// This is a shared function used by both DeleteAccount and admin DeleteUser
-func deleteUserByID(userID int) error {
+// DeleteUserByID deletes a user by their user ID from the system
+// This is a shared function used by DeleteAccount, admin DeleteUser and the admin command line
+func DeleteUserByID(userID int) error {
 	utils.UsersFileMutex.Lock()
 	defer utils.UsersFileMutex.Unlock()
 
@@ -751,6 +857,11 @@ func deleteUserByID(userID int) error {
 		return fmt.Errorf("error deleting user data of ID %d: %v", userID, err)
 	}
 
+	// Log out all sessions of the user
+	if err := utils.DeleteUserSessions(userID); err != nil {
+		return fmt.Errorf("error deleting sessions of ID %d: %v", userID, err)
+	}
+
 	return nil
 }
 
@@ -786,7 +897,7 @@ func DeleteAccount(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Use the shared delete function
-	if err := deleteUserByID(userID); err != nil {
+	if err := DeleteUserByID(userID); err != nil {
 		utils.JSONResponse(w, http.StatusOK, map[string]any{
 			"success": false,
 			"message": err.Error(),
@@ -975,6 +1086,11 @@ func ChangeUsername(w http.ResponseWriter, r *http.Request) {
 
 	utils.Logger.Printf("Username changed for user ID %d to '%s'", userID, req.NewUsername)
 
+	// Keep the sessions of the user in sync
+	if err := utils.UpdateSessionsUsername(userID, req.NewUsername); err != nil {
+		utils.Logger.Printf("Error updating sessions of user %d: %v", userID, err)
+	}
+
 	utils.JSONResponse(w, http.StatusOK, map[string]any{
 		"success":                true,
 		"available_backup_codes": availableBackupCodes,
@@ -0,0 +1,116 @@
+package handlers
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/phitux/dailytxt/backend/utils"
+)
+
+// storedUser returns the entry of the test user in users.json
+func storedUser(t *testing.T) map[string]any {
+	t.Helper()
+
+	users, err := utils.GetUsers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return users["users"].([]any)[0].(map[string]any)
+}
+
+// login logs the test user in and returns the derived key of the new session
+func login(t *testing.T, user *testUser) string {
+	t.Helper()
+
+	w := user.do(Login, "POST", "/users/login", LoginRequest{Username: "alice", Password: "password"})
+	if w.Code != http.StatusOK {
+		t.Fatalf("login: %d %s", w.Code, w.Body.String())
+	}
+	for _, cookie := range w.Result().Cookies() {
+		if cookie.Name == "token" {
+			_, derivedKey, err := utils.GetSession(cookie.Value)
+			if err != nil {
+				t.Fatalf("session of the login: %v", err)
+			}
+			return derivedKey
+		}
+	}
+	t.Fatal("login didn't set a session cookie")
+	return ""
+}
+
+// TestLoginUpgradesKDF raises the Argon2 parameters (above the minimum of password hashes, t=5) and checks that the next login replaces the derived key
+// without keeping the old one around
+func TestLoginUpgradesKDF(t *testing.T) {
+	user := newTestUser(t)
+	utils.Settings.LogoutAfterDays = 30
+	encKey := user.encKey(t)
+	oldSession, err := utils.CreateSession(user.id, "alice", user.derivedKey, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	utils.Settings.Argon2Time = 6
+	derivedKey := login(t, user)
+	if derivedKey == user.derivedKey {
+		t.Fatalf("the derived key wasn't upgraded")
+	}
+
+	if got, err := utils.GetEncryptionKey(user.id, derivedKey); err != nil || got != encKey {
+		t.Errorf("encryption key with the new derived key = %q, %v", got, err)
+	}
+	if _, err := utils.GetEncryptionKey(user.id, user.derivedKey); err == nil {
+		t.Errorf("the old derived key still unwraps the encryption key")
+	}
+	if _, _, err := utils.GetSession(oldSession); err != utils.ErrSessionNotFound {
+		t.Errorf("the session with the old derived key survived the upgrade: %v", err)
+	}
+
+	stored := storedUser(t)
+	if _, ok := stored["legacy_keys"]; ok {
+		t.Errorf("the old derived key is kept in legacy_keys")
+	}
+	if utils.KDFParamsOf(stored).Time != 6 {
+		t.Errorf("kdf = %v, want t=6", stored["kdf"])
+	}
+	if !strings.Contains(stored["password"].(string), "t=6") {
+		t.Errorf("the password hash wasn't upgraded: %s", stored["password"])
+	}
+
+	// Nothing left to upgrade on the next login
+	if again := login(t, user); again != derivedKey {
+		t.Errorf("the derived key changed again on the next login")
+	}
+}
+
+// Backup codes hold the derived key, it can't be replaced without them. Only the password hash is upgraded.
+func TestLoginUpgradeKeepsDerivedKeyOfBackupCodes(t *testing.T) {
+	user := newTestUser(t)
+	utils.Settings.LogoutAfterDays = 30
+	codes, codeData, err := utils.GenerateBackupCodes(user.derivedKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := utils.SaveBackupCodes(user.id, codeData); err != nil {
+		t.Fatal(err)
+	}
+
+	utils.Settings.Argon2Time = 6
+	if derivedKey := login(t, user); derivedKey != user.derivedKey {
+		t.Errorf("the derived key was replaced although backup codes hold it")
+	}
+	stored := storedUser(t)
+	if !strings.Contains(stored["password"].(string), "t=6") {
+		t.Errorf("the password hash wasn't upgraded: %s", stored["password"])
+	}
+	if utils.KDFParamsOf(stored).Time != 1 {
+		t.Errorf("kdf = %v, want the old parameters", stored["kdf"])
+	}
+
+	derivedKey, _, err := utils.CheckPasswordForUser(user.id, codes[0])
+	if err != nil || derivedKey != user.derivedKey {
+		t.Fatalf("login with a backup code = %q, %v", derivedKey, err)
+	}
+	user.encKey(t)
+}
@@ -21,18 +21,27 @@ var AppVersion string
 // longTimeoutEndpoints defines endpoints that need extended/none timeouts
 // Paths are checked against the request URL path as seen by the top-level handler.
 var longTimeoutEndpoints = map[string]bool{
-	"/api/logs/uploadFile":    true,
-	"/api/logs/downloadFile":  true,
-	"/api/share/downloadFile": true,
-	"/api/logs/exportData":    true,
-	"/api/users/login":        true,
+	"/api/logs/uploadFile":         true,
+	"/api/logs/downloadFile":       true,
+	"/api/share/downloadFile":      true,
+	"/api/logs/exportData":         true,
+	"/api/logs/rebuildSearchIndex": true,
+	"/api/users/login":             true,
+}
+
+// streamingEndpoints can stream their response (with the stream parameter), which needs no timeout either
+var streamingEndpoints = map[string]bool{
+	"/api/logs/search":        true,
+	"/api/logs/searchString":  true,
+	"/api/share/search":       true,
+	"/api/share/searchString": true,
 }
 
 // timeoutMiddleware applies different timeouts based on the endpoint
 func timeoutMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		// Check if this endpoint needs a long timeout
-		if longTimeoutEndpoints[r.URL.Path] {
+		if longTimeoutEndpoints[r.URL.Path] || (streamingEndpoints[r.URL.Path] && r.URL.Query().Get("stream") != "") {
 			// No timeout for these endpoints - let them run as long as needed
 			next.ServeHTTP(w, r)
 		} else {
@@ -67,9 +76,25 @@ func main() {
 		logger.Fatalf("Failed to initialize settings: %v", err)
 	}
 
+	// Run a command instead of the server, if one is given
+	if len(os.Args) > 1 {
+		os.Exit(runCommand(os.Args[1:]))
+	}
+
+	// Set up the storage backend
+	if err := utils.InitStorage(); err != nil {
+		logger.Fatalf("Failed to initialize storage: %v", err)
+	}
+
 	// Check and handle old data migration if needed
 	utils.HandleOldData(logger)
 
+	// Purge expired items of the trash
+	utils.StartTrashPurge()
+
+	// Write the last-seen times of the sessions in batches
+	utils.StartSessionFlush()
+
 	// API sub-router
 	api := http.NewServeMux()
 
@@ -78,6 +103,7 @@ func main() {
 
 	// Users
 	api.HandleFunc("POST /users/login", handlers.Login)
+	api.HandleFunc("POST /users/login/totp", handlers.LoginTOTP)
 	api.HandleFunc("GET /users/migrationProgress", handlers.GetMigrationProgress)
 	api.HandleFunc("GET /users/isRegistrationAllowed", handlers.IsRegistrationAllowed)
 	api.HandleFunc("POST /users/register", handlers.RegisterHandler)
@@ -86,6 +112,8 @@ func main() {
 	api.HandleFunc("GET /users/getUserSettings", middleware.RequireAuth(handlers.GetUserSettings))
 	api.HandleFunc("POST /users/saveUserSettings", middleware.RequireAuth(handlers.SaveUserSettings))
 	api.HandleFunc("POST /users/changePassword", middleware.RequireAuth(handlers.ChangePassword))
+	api.HandleFunc("POST /users/rotateEncryptionKey", middleware.RequireAuth(handlers.RotateEncryptionKey))
+	api.HandleFunc("GET /users/keyRotationProgress", middleware.RequireAuth(handlers.GetKeyRotationProgress))
 	api.HandleFunc("POST /users/changeUsername", middleware.RequireAuth(handlers.ChangeUsername))
 	api.HandleFunc("POST /users/deleteAccount", middleware.RequireAuth(handlers.DeleteAccount))
 	api.HandleFunc("POST /users/createBackupCodes", middleware.RequireAuth(handlers.CreateBackupCodes))
@@ -105,11 +133,22 @@ func main() {
 	api.HandleFunc("GET /users/getShareSMTPSettings", middleware.RequireAuth(handlers.GetShareSMTPSettings))
 	api.HandleFunc("POST /users/saveShareSMTPSettings", middleware.RequireAuth(handlers.SaveShareSMTPSettings))
 	api.HandleFunc("POST /users/testShareSMTP", middleware.RequireAuth(handlers.TestShareSMTP))
+	api.HandleFunc("GET /users/sessions", middleware.RequireAuth(handlers.GetSessions))
+	api.HandleFunc("POST /users/revokeSession", middleware.RequireAuth(handlers.RevokeSession))
+	api.HandleFunc("POST /users/revokeOtherSessions", middleware.RequireAuth(handlers.RevokeOtherSessions))
+	api.HandleFunc("GET /users/totp/status", middleware.RequireAuth(handlers.GetTOTPStatus))
+	api.HandleFunc("POST /users/totp/setup", middleware.RequireAuth(handlers.SetupTOTP))
+	api.HandleFunc("POST /users/totp/confirm", middleware.RequireAuth(handlers.ConfirmTOTP))
+	api.HandleFunc("POST /users/totp/disable", middleware.RequireAuth(handlers.DisableTOTP))
 
 	// Logs
 	api.HandleFunc("POST /logs/saveLog", middleware.RequireAuth(handlers.SaveLog))
 	api.HandleFunc("GET /logs/getLog", middleware.RequireAuth(handlers.GetLog))
 	api.HandleFunc("GET /logs/getMarkedDays", middleware.RequireAuth(handlers.GetMarkedDays))
+	api.HandleFunc("GET /logs/getEntries", middleware.RequireAuth(handlers.GetEntries))
+	api.HandleFunc("POST /logs/createEntry", middleware.RequireAuth(handlers.CreateEntry))
+	api.HandleFunc("POST /logs/updateEntry", middleware.RequireAuth(handlers.UpdateEntry))
+	api.HandleFunc("POST /logs/deleteEntry", middleware.RequireAuth(handlers.DeleteEntry))
 	api.HandleFunc("GET /logs/getTags", middleware.RequireAuth(handlers.GetTags))
 	api.HandleFunc("POST /logs/saveNewTag", middleware.RequireAuth(handlers.SaveTags))
 	api.HandleFunc("POST /logs/editTag", middleware.RequireAuth(handlers.EditTag))
@@ -119,8 +158,10 @@ func main() {
 	api.HandleFunc("GET /logs/getTemplates", middleware.RequireAuth(handlers.GetTemplates))
 	api.HandleFunc("POST /logs/saveTemplates", middleware.RequireAuth(handlers.SaveTemplates))
 	api.HandleFunc("GET /logs/getALookBack", middleware.RequireAuth(handlers.GetALookBack))
+	api.HandleFunc("GET /logs/search", middleware.RequireAuth(handlers.Search))
 	api.HandleFunc("GET /logs/searchString", middleware.RequireAuth(handlers.Search))
 	api.HandleFunc("GET /logs/searchTag", middleware.RequireAuth(handlers.SearchTag))
+	api.HandleFunc("POST /logs/rebuildSearchIndex", middleware.RequireAuth(handlers.RebuildSearchIndex))
 	api.HandleFunc("GET /logs/loadMonthForReading", middleware.RequireAuth(handlers.LoadMonthForReading))
 	api.HandleFunc("POST /logs/uploadFile", middleware.RequireAuth(handlers.UploadFile))
 	api.HandleFunc("GET /logs/downloadFile", middleware.RequireAuth(handlers.DownloadFile))
@@ -128,8 +169,15 @@ func main() {
 	api.HandleFunc("POST /logs/renameFile", middleware.RequireAuth(handlers.RenameFile))
 	api.HandleFunc("POST /logs/reorderFiles", middleware.RequireAuth(handlers.ReorderFiles))
 	api.HandleFunc("GET /logs/getHistory", middleware.RequireAuth(handlers.GetHistory))
+	api.HandleFunc("POST /logs/restoreHistoryVersion", middleware.RequireAuth(handlers.RestoreHistoryVersion))
+	api.HandleFunc("GET /logs/historyDiff", middleware.RequireAuth(handlers.GetHistoryDiff))
+	api.HandleFunc("POST /logs/compactHistory", middleware.RequireAuth(handlers.CompactHistory))
+	api.HandleFunc("GET /logs/historyCompactionStatus", middleware.RequireAuth(handlers.GetHistoryCompactionStatus))
 	api.HandleFunc("GET /logs/bookmarkDay", middleware.RequireAuth(handlers.BookmarkDay))
 	api.HandleFunc("GET /logs/deleteDay", middleware.RequireAuth(handlers.DeleteDay))
+	api.HandleFunc("GET /logs/getTrash", middleware.RequireAuth(handlers.GetTrash))
+	api.HandleFunc("POST /logs/restoreFromTrash", middleware.RequireAuth(handlers.RestoreFromTrash))
+	api.HandleFunc("POST /logs/purgeTrash", middleware.RequireAuth(handlers.PurgeTrash))
 	api.HandleFunc("GET /logs/exportData", middleware.RequireAuth(handlers.ExportData))
 	api.HandleFunc("POST /logs/importData", middleware.RequireAuth(handlers.ImportData))
 	api.HandleFunc("POST /logs/backup", middleware.RequireAuth(handlers.Backup))
@@ -141,6 +189,7 @@ func main() {
 	api.HandleFunc("POST /share/verifyCode", handlers.VerifyShareVerificationCode)
 	api.HandleFunc("GET /share/getMarkedDays", handlers.SharedGetMarkedDays)
 	api.HandleFunc("GET /share/loadMonthForReading", handlers.SharedLoadMonthForReading)
+	api.HandleFunc("GET /share/search", handlers.SharedSearch)
 	api.HandleFunc("GET /share/searchString", handlers.SharedSearch)
 	api.HandleFunc("GET /share/downloadFile", handlers.SharedDownloadFile)
 
@@ -196,5 +245,10 @@ func main() {
 		logger.Fatalf("Server forced to shutdown: %v", err)
 	}
 
+	// Write the last-seen times of the sessions since the last flush
+	if err := utils.FlushSessions(); err != nil {
+		logger.Printf("Failed to flush sessions: %v", err)
+	}
+
 	logger.Println("Server stopped gracefully")
 }
@@ -23,7 +23,8 @@ func CORS(next http.Handler) http.Handler {
 		if allowed {
 			w.Header().Set("Access-Control-Allow-Origin", origin)
 			w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, DELETE, OPTIONS")
-			w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization, Content-Disposition")
+			w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization, Content-Disposition, If-Match, Range")
+			w.Header().Set("Access-Control-Expose-Headers", "ETag, Content-Range, Accept-Ranges")
 			w.Header().Set("Access-Control-Allow-Credentials", "true")
 		}
 
@@ -48,18 +49,24 @@ func RequireAuth(next http.HandlerFunc) http.HandlerFunc {
 			return
 		}
 
-		// Validate JWT token
-		claims, err := utils.ValidateToken(cookie.Value)
+		// Look up the session
+		session, derivedKey, err := utils.GetSession(cookie.Value)
 		if err != nil {
 			http.Error(w, "Unauthorized", http.StatusUnauthorized)
-			utils.Logger.Printf("Unauthorized access attempt, invalid token: %s %s", r.Method, r.URL.Path)
+			utils.Logger.Printf("Unauthorized access attempt, invalid session: %s %s", r.Method, r.URL.Path)
 			return
 		}
 
+		// Remember when and from where the session was used
+		if err := utils.TouchSession(session, utils.GetClientIP(r), r.UserAgent()); err != nil {
+			utils.Logger.Printf("Error updating session of user %d: %v", session.UserID, err)
+		}
+
 		// Add user info to request context
-		ctx := context.WithValue(r.Context(), utils.UserIDKey, claims.UserID)
-		ctx = context.WithValue(ctx, utils.UsernameKey, claims.Username)
-		ctx = context.WithValue(ctx, utils.DerivedKeyKey, claims.DerivedKey)
+		ctx := context.WithValue(r.Context(), utils.UserIDKey, session.UserID)
+		ctx = context.WithValue(ctx, utils.UsernameKey, session.Username)
+		ctx = context.WithValue(ctx, utils.DerivedKeyKey, derivedKey)
+		ctx = context.WithValue(ctx, utils.SessionIDKey, session.ID)
 
 		// Continue with the next handler
 		next.ServeHTTP(w, r.WithContext(ctx))
@@ -107,3 +114,8 @@ func (rw *responseWriter) WriteHeader(statusCode int) {
 	rw.statusCode = statusCode
 	rw.ResponseWriter.WriteHeader(statusCode)
 }
+
+// Unwrap returns the underlying ResponseWriter, so that streamed responses can be flushed
+func (rw *responseWriter) Unwrap() http.ResponseWriter {
+	return rw.ResponseWriter
+}
@@ -0,0 +1,142 @@
+package utils
+
+import "strings"
+
+// Operations of a diff line
+const (
+	DiffEqual  = "equal"
+	DiffInsert = "insert"
+	DiffDelete = "delete"
+)
+
+// DiffLine is a line of a line-based diff
+type DiffLine struct {
+	Op   string `json:"op"`
+	Text string `json:"text"`
+}
+
+// DiffLines computes the shortest line diff from a to b (Myers' algorithm)
+func DiffLines(a, b string) []DiffLine {
+	oldLines := splitLines(a)
+	newLines := splitLines(b)
+
+	// Common prefix and suffix don't need the algorithm
+	prefix := 0
+	for prefix < len(oldLines) && prefix < len(newLines) && oldLines[prefix] == newLines[prefix] {
+		prefix++
+	}
+	suffix := 0
+	for suffix < len(oldLines)-prefix && suffix < len(newLines)-prefix &&
+		oldLines[len(oldLines)-1-suffix] == newLines[len(newLines)-1-suffix] {
+		suffix++
+	}
+
+	result := make([]DiffLine, 0, len(oldLines)+len(newLines))
+	for _, line := range oldLines[:prefix] {
+		result = append(result, DiffLine{DiffEqual, line})
+	}
+	result = append(result, myersDiff(oldLines[prefix:len(oldLines)-suffix], newLines[prefix:len(newLines)-suffix])...)
+	for _, line := range oldLines[len(oldLines)-suffix:] {
+		result = append(result, DiffLine{DiffEqual, line})
+	}
+	return result
+}
+
+// splitLines splits a text into lines, an empty text has no lines
+func splitLines(text string) []string {
+	if text == "" {
+		return nil
+	}
+	return strings.Split(strings.ReplaceAll(text, "\r\n", "\n"), "\n")
+}
+
+// maxDiffEdits limits the work (and the memory of the trace) of the diff. Texts that differ in
+// more lines are shown as completely replaced.
+const maxDiffEdits = 1000
+
+// myersDiff finds the shortest edit script from a to b
+func myersDiff(a, b []string) []DiffLine {
+	n, m := len(a), len(b)
+	if n == 0 && m == 0 {
+		return nil
+	}
+
+	// v[k+offset] is the furthest x on diagonal k, trace keeps v of every step to walk back
+	offset := n + m + 1
+	v := make([]int, 2*offset+1)
+	var trace [][]int
+
+	found := false
+search:
+	for d := 0; d <= min(n+m, maxDiffEdits); d++ {
+		trace = append(trace, append([]int(nil), v[offset-d-1:offset+d+2]...))
+		for k := -d; k <= d; k += 2 {
+			var x int
+			if k == -d || (k != d && v[k-1+offset] < v[k+1+offset]) {
+				x = v[k+1+offset]
+			} else {
+				x = v[k-1+offset] + 1
+			}
+			y := x - k
+			for x < n && y < m && a[x] == b[y] {
+				x++
+				y++
+			}
+			v[k+offset] = x
+			if x >= n && y >= m {
+				found = true
+				break search
+			}
+		}
+	}
+	if !found {
+		result := make([]DiffLine, 0, n+m)
+		for _, line := range a {
+			result = append(result, DiffLine{DiffDelete, line})
+		}
+		for _, line := range b {
+			result = append(result, DiffLine{DiffInsert, line})
+		}
+		return result
+	}
+
+	// Walk back from the end
+	result := make([]DiffLine, 0, n+m)
+	x, y := n, m
+	for d := len(trace) - 1; d >= 0; d-- {
+		// trace[d] holds the diagonals -d-1 to d+1
+		v := trace[d]
+		at := func(k int) int { return v[k+d+1] }
+		k := x - y
+		var prevK int
+		if k == -d || (k != d && at(k-1) < at(k+1)) {
+			prevK = k + 1
+		} else {
+			prevK = k - 1
+		}
+		prevX := at(prevK)
+		prevY := prevX - prevK
+
+		for x > prevX && y > prevY {
+			x--
+			y--
+			result = append(result, DiffLine{DiffEqual, a[x]})
+		}
+		if d == 0 {
+			break
+		}
+		if x == prevX {
+			y--
+			result = append(result, DiffLine{DiffInsert, b[y]})
+		} else {
+			x--
+			result = append(result, DiffLine{DiffDelete, a[x]})
+		}
+	}
+
+	// The walk produced the lines from the end
+	for i, j := 0, len(result)-1; i < j; i, j = i+1, j-1 {
+		result[i], result[j] = result[j], result[i]
+	}
+	return result
+}
@@ -0,0 +1,150 @@
+package utils
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A day keeps its main text directly (text, date_written, tags, files), like days always did, so days
+// written before entries existed are read unchanged. Further entries of the day, e.g. one in the morning
+// and one in the evening, are kept in "entries", ordered by their time. An entry has the fields of a day
+// (with its own revision and history), an id and an encrypted time ("15:04"):
+//
+//	{"day": 5, "text": ..., "entries": [{"id": ..., "time": ..., "text": ..., "date_written": ..., "saved_at": ..., "revision": ..., "history": [...], "tags": [...], "files": [...]}]}
+
+// EntryTimeLayout is the layout of the time of an entry
+const EntryTimeLayout = "15:04"
+
+// MainEntryID is the id under which the main text of a day is handled like an entry.
+// It is never stored, the main text stays in the day itself.
+const MainEntryID = "main"
+
+// dateWrittenTime finds the time in a date_written, which the browser formats in the language of the user
+// (e.g. "03.05.2024, 15:30" or "5/3/2024, 3:30 PM")
+var dateWrittenTime = regexp.MustCompile(`(\d{1,2}):(\d{2})(?::\d{2})?(?:\s*([AaPp])\.?\s*[Mm]\.?)?`)
+
+// MainEntryTime returns the time ("15:04") of the main text of a day from its date_written, or "" if there is none
+func MainEntryTime(dateWritten string) string {
+	match := dateWrittenTime.FindStringSubmatch(dateWritten)
+	if match == nil {
+		return ""
+	}
+	hour, _ := strconv.Atoi(match[1])
+	minute, _ := strconv.Atoi(match[2])
+	switch strings.ToLower(match[3]) {
+	case "a":
+		if hour == 12 {
+			hour = 0
+		}
+	case "p":
+		if hour < 12 {
+			hour += 12
+		}
+	}
+	if hour > 23 || minute > 59 {
+		return ""
+	}
+	return fmt.Sprintf("%02d:%02d", hour, minute)
+}
+
+// DayEntries returns the entries of a day
+func DayEntries(day map[string]any) []map[string]any {
+	list, _ := day["entries"].([]any)
+	entries := make([]map[string]any, 0, len(list))
+	for _, item := range list {
+		if entry, ok := item.(map[string]any); ok {
+			entries = append(entries, entry)
+		}
+	}
+	return entries
+}
+
+// SetDayEntries replaces the entries of a day, a day without entries has no "entries" field
+func SetDayEntries(day map[string]any, entries []map[string]any) {
+	if len(entries) == 0 {
+		delete(day, "entries")
+		return
+	}
+	list := make([]any, len(entries))
+	for i, entry := range entries {
+		list[i] = entry
+	}
+	day["entries"] = list
+}
+
+// FindDayEntry returns the entry of a day with the given id, or nil. MainEntryID is the day itself.
+func FindDayEntry(day map[string]any, id string) map[string]any {
+	if id == MainEntryID {
+		return day
+	}
+	for _, entry := range DayEntries(day) {
+		if entryID, _ := entry["id"].(string); entryID == id {
+			return entry
+		}
+	}
+	return nil
+}
+
+// RemoveDayEntry removes the entry with the given id from a day and returns it, or nil
+func RemoveDayEntry(day map[string]any, id string) map[string]any {
+	entries := DayEntries(day)
+	for i, entry := range entries {
+		if entryID, _ := entry["id"].(string); entryID == id {
+			SetDayEntries(day, append(entries[:i], entries[i+1:]...))
+			return entry
+		}
+	}
+	return nil
+}
+
+// DayParts returns the day itself followed by its entries, everything that holds a text, tags and files
+func DayParts(day map[string]any) []map[string]any {
+	return append([]map[string]any{day}, DayEntries(day)...)
+}
+
+// DayFiles returns the file entries of a day and of all its entries
+func DayFiles(day map[string]any) []map[string]any {
+	var files []map[string]any
+	for _, part := range DayParts(day) {
+		list, _ := part["files"].([]any)
+		for _, file := range list {
+			if fileMap, ok := file.(map[string]any); ok {
+				files = append(files, fileMap)
+			}
+		}
+	}
+	return files
+}
+
+// DayHasEntries reports whether a day has entries besides its main text
+func DayHasEntries(day map[string]any) bool {
+	return len(DayEntries(day)) > 0
+}
+
+// SortDayEntries orders the entries of a day by their time. Entries whose time can't be read
+// are put last, in their current order.
+func SortDayEntries(day map[string]any, encKey string) {
+	entries := DayEntries(day)
+	times := make(map[string]string, len(entries))
+	for _, entry := range entries {
+		id, _ := entry["id"].(string)
+		times[id] = "99:99"
+		if encryptedTime, ok := entry["time"].(string); ok && encryptedTime != "" {
+			if entryTime, err := DecryptText(encryptedTime, encKey); err == nil {
+				if _, err := time.Parse(EntryTimeLayout, entryTime); err == nil {
+					times[id] = entryTime
+				}
+			}
+		}
+	}
+	sort.SliceStable(entries, func(a, b int) bool {
+		idA, _ := entries[a]["id"].(string)
+		idB, _ := entries[b]["id"].(string)
+		return times[idA] < times[idB]
+	})
+	SetDayEntries(day, entries)
+}
@@ -0,0 +1,21 @@
+package utils
+
+import "testing"
+
+func TestMainEntryTime(t *testing.T) {
+	tests := map[string]string{
+		"03.05.2024, 15:30":     "15:30",
+		"5/3/2024, 3:30 PM":     "15:30",
+		"5/3/2024, 12:05 AM":    "00:05",
+		"5/3/2024, 12:05 p. m.": "12:05",
+		"2024-05-03 07:45:10":   "07:45",
+		"03.05.2024":            "",
+		"":                      "",
+		"03.05.2024, 25:30":     "",
+	}
+	for dateWritten, want := range tests {
+		if got := MainEntryTime(dateWritten); got != want {
+			t.Errorf("MainEntryTime(%q) = %q, want %q", dateWritten, got, want)
+		}
+	}
+}
@@ -1,11 +1,13 @@
 package utils
 
 import (
+	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"io/fs"
 	"os"
-	"path/filepath"
 	"strconv"
 	"strings"
 	"sync"
@@ -18,28 +20,50 @@ var (
 	userSettingsMutex sync.RWMutex // FFor user settings
 )
 
+// encodeDocument encodes a JSON document, indented if indent is set
+func encodeDocument(content any, indent bool) ([]byte, error) {
+	var buf bytes.Buffer
+	encoder := json.NewEncoder(&buf)
+	if indent {
+		encoder.SetIndent("", fmt.Sprintf("%*s", Settings.Indent, ""))
+	}
+	if err := encoder.Encode(content); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// decodeDocument decodes a JSON document. An empty document is returned as empty map.
+func decodeDocument(data []byte) (map[string]any, error) {
+	content := map[string]any{}
+	if len(bytes.TrimSpace(data)) == 0 {
+		return content, nil
+	}
+	if err := json.Unmarshal(data, &content); err != nil {
+		return nil, err
+	}
+	if content == nil {
+		content = map[string]any{}
+	}
+	return content, nil
+}
+
 // GetUsers retrieves the users from the users.json file
 func GetUsers() (map[string]any, error) {
-	// Try to open the users.json file
-	filePath := filepath.Join(Settings.DataPath, "users.json")
-	file, err := os.Open(filePath)
+	// Try to read the users.json file
+	data, err := Store.ReadDoc("users.json")
 	if err != nil {
-		if os.IsNotExist(err) {
+		if errors.Is(err, fs.ErrNotExist) {
 			Logger.Printf("users.json - File not found")
 			return map[string]any{}, nil
 		}
 		Logger.Printf("Error opening users.json: %v", err)
 		return nil, fmt.Errorf("internal server error when trying to open users.json")
 	}
-	defer file.Close()
 
-	// Read the file content
-	var content map[string]any
-	decoder := json.NewDecoder(file)
-	if err := decoder.Decode(&content); err != nil {
-		if err == io.EOF {
-			return map[string]any{}, nil
-		}
+	// Decode the file content
+	content, err := decodeDocument(data)
+	if err != nil {
 		Logger.Printf("Error decoding users.json: %v", err)
 		return nil, fmt.Errorf("internal server error when trying to decode users.json")
 	}
@@ -49,55 +73,38 @@ func GetUsers() (map[string]any, error) {
 
 // WriteUsers writes the users to the users.json file
 func WriteUsers(content map[string]any) error {
-
-	// Create the users.json file
-	filePath := filepath.Join(Settings.DataPath, "users.json")
-	file, err := os.Create(filePath)
+	// Encode the content
+	data, err := encodeDocument(content, Settings.Indent > 0)
 	if err != nil {
-		Logger.Printf("Error creating users.json: %v", err)
-		return fmt.Errorf("internal server error when trying to create users.json")
-	}
-	defer file.Close()
-
-	// Write the content to the file
-	var encoder *json.Encoder
-	if Settings.Indent > 0 {
-		encoder = json.NewEncoder(file)
-		encoder.SetIndent("", fmt.Sprintf("%*s", Settings.Indent, ""))
-	} else {
-		encoder = json.NewEncoder(file)
-	}
-
-	if err := encoder.Encode(content); err != nil {
 		Logger.Printf("Error encoding users.json: %v", err)
 		return fmt.Errorf("internal server error when trying to encode users.json")
 	}
 
+	// Write the users.json file
+	if err := Store.WriteDoc("users.json", data); err != nil {
+		Logger.Printf("Error writing users.json: %v", err)
+		return fmt.Errorf("internal server error when trying to write users.json")
+	}
+
 	return nil
 }
 
 // GetMonth retrieves the logs for a specific month
 func GetMonth(userID int, year, month int) (map[string]any, error) {
-	// Try to open the month.json file
-	filePath := filepath.Join(Settings.DataPath, fmt.Sprintf("%d/%d/%02d.json", userID, year, month))
-	file, err := os.Open(filePath)
+	// Try to read the month.json file
+	data, err := Store.ReadMonth(userID, year, month)
 	if err != nil {
-		if os.IsNotExist(err) {
+		if errors.Is(err, fs.ErrNotExist) {
 			return map[string]any{}, nil
 		}
-		Logger.Printf("Error opening %s: %v", filePath, err)
+		Logger.Printf("Error opening %d/%d/%02d.json: %v", userID, year, month, err)
 		return nil, fmt.Errorf("internal server error when trying to open %d/%02d.json", year, month)
 	}
-	defer file.Close()
 
-	// Read the file content
-	var content map[string]any
-	decoder := json.NewDecoder(file)
-	if err := decoder.Decode(&content); err != nil {
-		if err == io.EOF {
-			return map[string]any{}, nil
-		}
-		Logger.Printf("Error decoding %s: %v", filePath, err)
+	// Decode the file content
+	content, err := decodeDocument(data)
+	if err != nil {
+		Logger.Printf("Error decoding %d/%d/%02d.json: %v", userID, year, month, err)
 		return nil, fmt.Errorf("internal server error when trying to decode %d/%02d.json", year, month)
 	}
 
@@ -106,123 +113,84 @@ func GetMonth(userID int, year, month int) (map[string]any, error) {
 
 // WriteMonth writes the logs for a specific month
 func WriteMonth(userID int, year, month int, content map[string]any) error {
-	// Create the directory if it doesn't exist
-	dirPath := filepath.Join(Settings.DataPath, fmt.Sprintf("%d/%d", userID, year))
-	if err := os.MkdirAll(dirPath, 0755); err != nil {
-		Logger.Printf("Error creating directory %s: %v", dirPath, err)
-		return fmt.Errorf("internal server error when trying to create directory %d/%d", userID, year)
-	}
-
-	// Create the month.json file
-	filePath := filepath.Join(dirPath, fmt.Sprintf("%02d.json", month))
-	file, err := os.Create(filePath)
+	// Encode the content
+	data, err := encodeDocument(content, Settings.Indent > 0)
 	if err != nil {
-		Logger.Printf("Error creating %s: %v", filePath, err)
-		return fmt.Errorf("internal server error when trying to create %d/%02d.json", year, month)
+		Logger.Printf("Error encoding %d/%d/%02d.json: %v", userID, year, month, err)
+		return fmt.Errorf("internal server error when trying to encode %d/%02d.json", year, month)
 	}
-	defer file.Close()
 
-	// Write the content to the file
-	var encoder *json.Encoder
-	if Settings.Indent > 0 {
-		encoder = json.NewEncoder(file)
-		encoder.SetIndent("", fmt.Sprintf("%*s", Settings.Indent, ""))
-	} else {
-		encoder = json.NewEncoder(file)
-	}
-
-	if err := encoder.Encode(content); err != nil {
-		Logger.Printf("Error encoding %s: %v", filePath, err)
-		return fmt.Errorf("internal server error when trying to encode %d/%02d.json", year, month)
+	// Write the month.json file
+	if err := Store.WriteMonth(userID, year, month, data); err != nil {
+		Logger.Printf("Error writing %d/%d/%02d.json: %v", userID, year, month, err)
+		return fmt.Errorf("internal server error when trying to write %d/%02d.json", year, month)
 	}
 
 	return nil
 }
 
-// GetTags retrieves the tags for a specific user
-func GetTags(userID int) (map[string]any, error) {
-	// Try to open the tags.json file
-	filePath := filepath.Join(Settings.DataPath, fmt.Sprintf("%d/tags.json", userID))
-	file, err := os.Open(filePath)
+// getUserDocument reads and decodes a JSON document of a user
+func getUserDocument(userID int, name string) (map[string]any, error) {
+	// Try to read the file
+	data, err := Store.ReadUserDoc(userID, name)
 	if err != nil {
-		if os.IsNotExist(err) {
+		if errors.Is(err, fs.ErrNotExist) {
 			return map[string]any{}, nil
 		}
-		Logger.Printf("Error opening %s: %v", filePath, err)
-		return nil, fmt.Errorf("internal server error when trying to open tags.json")
+		Logger.Printf("Error opening %d/%s: %v", userID, name, err)
+		return nil, fmt.Errorf("internal server error when trying to open %s", name)
 	}
-	defer file.Close()
 
-	// Read the file content
-	var content map[string]any
-	decoder := json.NewDecoder(file)
-	if err := decoder.Decode(&content); err != nil {
-		if err == io.EOF {
-			return map[string]any{}, nil
-		}
-		Logger.Printf("Error decoding %s: %v", filePath, err)
-		return nil, fmt.Errorf("internal server error when trying to decode tags.json")
+	// Decode the file content
+	content, err := decodeDocument(data)
+	if err != nil {
+		Logger.Printf("Error decoding %d/%s: %v", userID, name, err)
+		return nil, fmt.Errorf("internal server error when trying to decode %s", name)
 	}
 
 	return content, nil
 }
 
-// WriteTags writes the tags for a specific user
-func WriteTags(userID int, content map[string]any) error {
-	// Create the directory if it doesn't exist
-	dirPath := filepath.Join(Settings.DataPath, fmt.Sprintf("%d", userID))
-	if err := os.MkdirAll(dirPath, 0755); err != nil {
-		Logger.Printf("Error creating directory %s: %v", dirPath, err)
-		return fmt.Errorf("internal server error when trying to create directory %d", userID)
-	}
-
-	// Create the tags.json file
-	filePath := filepath.Join(dirPath, "tags.json")
-	file, err := os.Create(filePath)
+// writeUserDocument encodes and writes a JSON document of a user
+func writeUserDocument(userID int, name string, content map[string]any) error {
+	// Encode the content
+	data, err := encodeDocument(content, Settings.Development && Settings.Indent > 0)
 	if err != nil {
-		Logger.Printf("Error creating %s: %v", filePath, err)
-		return fmt.Errorf("internal server error when trying to create tags.json")
+		Logger.Printf("Error encoding %d/%s: %v", userID, name, err)
+		return fmt.Errorf("internal server error when trying to encode %s", name)
 	}
-	defer file.Close()
 
-	// Write the content to the file
-	var encoder *json.Encoder
-	if Settings.Development && Settings.Indent > 0 {
-		encoder = json.NewEncoder(file)
-		encoder.SetIndent("", fmt.Sprintf("%*s", Settings.Indent, ""))
-	} else {
-		encoder = json.NewEncoder(file)
-	}
-
-	if err := encoder.Encode(content); err != nil {
-		Logger.Printf("Error encoding %s: %v", filePath, err)
-		return fmt.Errorf("internal server error when trying to encode tags.json")
+	// Write the file
+	if err := Store.WriteUserDoc(userID, name, data); err != nil {
+		Logger.Printf("Error writing %d/%s: %v", userID, name, err)
+		return fmt.Errorf("internal server error when trying to write %s", name)
 	}
 
 	return nil
 }
 
+// GetTags retrieves the tags for a specific user
+func GetTags(userID int) (map[string]any, error) {
+	return getUserDocument(userID, "tags.json")
+}
+
+// WriteTags writes the tags for a specific user
+func WriteTags(userID int, content map[string]any) error {
+	return writeUserDocument(userID, "tags.json", content)
+}
+
 // GetUserSettings retrieves the settings for a specific user
 func GetUserSettings(userID int) (string, error) {
 	userSettingsMutex.RLock()
 	defer userSettingsMutex.RUnlock()
 
-	// Try to open the settings.encrypted file
-	filePath := filepath.Join(Settings.DataPath, fmt.Sprintf("%d/settings.encrypted", userID))
-	file, err := os.Open(filePath)
+	// Try to read the settings.encrypted file
+	content, err := Store.ReadUserDoc(userID, "settings.encrypted")
 	if err != nil {
-		if os.IsNotExist(err) {
+		if errors.Is(err, fs.ErrNotExist) {
 			return "", nil
 		}
-		Logger.Printf("Error opening %s: %v", filePath, err)
-		return "", fmt.Errorf("internal server error when trying to open settings.encrypted")
-	}
-	defer file.Close()
-
-	// Read the file content
-	content, err := io.ReadAll(file)
-	if err != nil {
-		Logger.Printf("Error reading %s: %v", filePath, err)
+		Logger.Printf("Error reading %d/settings.encrypted: %v", userID, err)
 		return "", fmt.Errorf("internal server error when trying to read settings.encrypted")
 	}
 
@@ -234,25 +202,9 @@ func WriteUserSettings(userID int, content string) error {
 	userSettingsMutex.Lock()
 	defer userSettingsMutex.Unlock()
 
-	// Create the directory if it doesn't exist
-	dirPath := filepath.Join(Settings.DataPath, fmt.Sprintf("%d", userID))
-	if err := os.MkdirAll(dirPath, 0755); err != nil {
-		Logger.Printf("Error creating directory %s: %v", dirPath, err)
-		return fmt.Errorf("internal server error when trying to create directory %d", userID)
-	}
-
-	// Create the settings.encrypted file
-	filePath := filepath.Join(dirPath, "settings.encrypted")
-	file, err := os.Create(filePath)
-	if err != nil {
-		Logger.Printf("Error creating %s: %v", filePath, err)
-		return fmt.Errorf("internal server error when trying to create settings.encrypted")
-	}
-	defer file.Close()
-
-	// Write the content to the file
-	if _, err := file.WriteString(content); err != nil {
-		Logger.Printf("Error writing %s: %v", filePath, err)
+	// Write the settings.encrypted file
+	if err := Store.WriteUserDoc(userID, "settings.encrypted", []byte(content)); err != nil {
+		Logger.Printf("Error writing %d/settings.encrypted: %v", userID, err)
 		return fmt.Errorf("internal server error when trying to write settings.encrypted")
 	}
 
@@ -261,126 +213,124 @@ func WriteUserSettings(userID int, content string) error {
 
 // GetTemplates retrieves the templates for a specific user
 func GetTemplates(userID int) (map[string]any, error) {
-	// Try to open the templates.json file
-	filePath := filepath.Join(Settings.DataPath, fmt.Sprintf("%d/templates.json", userID))
-	file, err := os.Open(filePath)
-	if err != nil {
-		if os.IsNotExist(err) {
-			Logger.Printf("%s - File not found", filePath)
-			return map[string]any{}, nil
-		}
-		Logger.Printf("Error opening %s: %v", filePath, err)
-		return nil, fmt.Errorf("internal server error when trying to open templates.json")
-	}
-	defer file.Close()
-
-	// Read the file content
-	var content map[string]any
-	decoder := json.NewDecoder(file)
-	if err := decoder.Decode(&content); err != nil {
-		if err == io.EOF {
-			return map[string]any{}, nil
-		}
-		Logger.Printf("Error decoding %s: %v", filePath, err)
-		return nil, fmt.Errorf("internal server error when trying to decode templates.json")
-	}
-
-	return content, nil
+	return getUserDocument(userID, "templates.json")
 }
 
 // WriteTemplates writes the templates for a specific user
 func WriteTemplates(userID int, content map[string]any) error {
-	// Create the directory if it doesn't exist
-	dirPath := filepath.Join(Settings.DataPath, fmt.Sprintf("%d", userID))
-	if err := os.MkdirAll(dirPath, 0755); err != nil {
-		Logger.Printf("Error creating directory %s: %v", dirPath, err)
-		return fmt.Errorf("internal server error when trying to create directory %d", userID)
-	}
-
-	// Create the templates.json file
-	filePath := filepath.Join(dirPath, "templates.json")
-	file, err := os.Create(filePath)
-	if err != nil {
-		Logger.Printf("Error creating %s: %v", filePath, err)
-		return fmt.Errorf("internal server error when trying to create templates.json")
-	}
-	defer file.Close()
-
-	// Write the content to the file
-	var encoder *json.Encoder
-	if Settings.Development && Settings.Indent > 0 {
-		encoder = json.NewEncoder(file)
-		encoder.SetIndent("", fmt.Sprintf("%*s", Settings.Indent, ""))
-	} else {
-		encoder = json.NewEncoder(file)
-	}
+	return writeUserDocument(userID, "templates.json", content)
+}
 
-	if err := encoder.Encode(content); err != nil {
-		Logger.Printf("Error encoding %s: %v", filePath, err)
-		return fmt.Errorf("internal server error when trying to encode templates.json")
+// WriteFile writes a file for a specific user
+func WriteFile(content []byte, userID int, uuid string) error {
+	if err := Store.WriteBlob(userID, uuid, content); err != nil {
+		Logger.Printf("Error writing file %s of user %d: %v", uuid, userID, err)
+		return fmt.Errorf("internal server error when trying to write file %s", uuid)
 	}
 
 	return nil
 }
 
-// WriteFile writes a file for a specific user
-func WriteFile(content []byte, userID int, uuid string) error {
-	// Create the directory if it doesn't exist
-	dirPath := filepath.Join(Settings.DataPath, fmt.Sprintf("%d/files", userID))
-	if err := os.MkdirAll(dirPath, 0755); err != nil {
-		Logger.Printf("Error creating directory %s: %v", dirPath, err)
-		return fmt.Errorf("internal server error when trying to create directory %d/files", userID)
+// ReadFile reads a file for a specific user
+func ReadFile(userID int, uuid string) ([]byte, error) {
+	content, err := Store.ReadBlob(userID, uuid)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			Logger.Printf("%d/files/%s - File not found", userID, uuid)
+			return nil, fmt.Errorf("file not found")
+		}
+		Logger.Printf("Error reading file %s of user %d: %v", uuid, userID, err)
+		return nil, fmt.Errorf("internal server error when trying to read file %s", uuid)
 	}
 
-	// Create the file
-	filePath := filepath.Join(dirPath, uuid)
-	file, err := os.Create(filePath)
+	return content, nil
+}
+
+// WriteEncryptedFile encrypts a file of size bytes read from r and stores it for a specific user.
+// The file is encrypted and stored chunk by chunk, so it is never held in memory as a whole.
+func WriteEncryptedFile(r io.Reader, size int64, userID int, uuid, key string) error {
+	encrypter, err := NewEncryptingReader(r, key)
 	if err != nil {
-		Logger.Printf("Error creating %s: %v", filePath, err)
-		return fmt.Errorf("internal server error when trying to create file %s", uuid)
+		return err
 	}
-	defer file.Close()
-
-	// Write the content to the file
-	if _, err := file.Write(content); err != nil {
-		Logger.Printf("Error writing %s: %v", filePath, err)
+	if err := Store.WriteBlobFrom(userID, uuid, encrypter, StreamCiphertextSize(size)); err != nil {
+		Logger.Printf("Error writing file %s of user %d: %v", uuid, userID, err)
 		return fmt.Errorf("internal server error when trying to write file %s", uuid)
 	}
 
 	return nil
 }
 
-// ReadFile reads a file for a specific user
-func ReadFile(userID int, uuid string) ([]byte, error) {
-	// Try to open the file
-	filePath := filepath.Join(Settings.DataPath, fmt.Sprintf("%d/files/%s", userID, uuid))
-	file, err := os.Open(filePath)
+// OpenDecryptedFile opens a file of a specific user for reading its plaintext and returns the plaintext size.
+// Files in the chunked format are decrypted while they are read and can seek without reading the chunks
+// before the position, older files are decrypted as a whole.
+// While the key of the user is rotated, files that are still encrypted with the old key are decrypted as well.
+func OpenDecryptedFile(userID int, uuid, key string) (io.ReadSeekCloser, int64, error) {
+	plaintext, size, err := openDecryptedFile(userID, uuid, key)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		if oldKey, ok := keyFallbacks.Load(key); ok {
+			if plaintext, size, err := openDecryptedFile(userID, uuid, oldKey.(string)); err == nil {
+				return plaintext, size, nil
+			}
+		}
+	}
 	if err != nil {
-		if os.IsNotExist(err) {
-			Logger.Printf("%s - File not found", filePath)
-			return nil, fmt.Errorf("file not found")
+		if errors.Is(err, fs.ErrNotExist) {
+			Logger.Printf("%d/files/%s - File not found", userID, uuid)
+			return nil, 0, fmt.Errorf("file not found")
 		}
-		Logger.Printf("Error opening %s: %v", filePath, err)
-		return nil, fmt.Errorf("internal server error when trying to open file %s", uuid)
+		Logger.Printf("Error opening file %s of user %d: %v", uuid, userID, err)
+		return nil, 0, fmt.Errorf("internal server error when trying to read file %s", uuid)
 	}
-	defer file.Close()
+	return plaintext, size, nil
+}
 
-	// Read the file content
-	content, err := io.ReadAll(file)
+// openDecryptedFile opens a file with exactly the provided key
+func openDecryptedFile(userID int, uuid, key string) (io.ReadSeekCloser, int64, error) {
+	blob, blobSize, err := Store.OpenBlob(userID, uuid)
 	if err != nil {
-		Logger.Printf("Error reading %s: %v", filePath, err)
-		return nil, fmt.Errorf("internal server error when trying to read file %s", uuid)
+		return nil, 0, err
 	}
 
-	return content, nil
+	// The start of the file tells the formats apart
+	header := make([]byte, streamHeaderSize)
+	n, err := io.ReadFull(blob, header)
+	if err != nil && err != io.ErrUnexpectedEOF {
+		blob.Close()
+		return nil, 0, err
+	}
+	if isStreamCiphertext(header[:n]) {
+		decrypter, err := newStreamDecrypter(header[:n], blob, blobSize, key)
+		if err != nil {
+			blob.Close()
+			return nil, 0, err
+		}
+		return readSeekCloser{decrypter, blob}, decrypter.size, nil
+	}
+
+	// Old format, decrypted as a whole
+	defer blob.Close()
+	rest, err := io.ReadAll(blob)
+	if err != nil {
+		return nil, 0, err
+	}
+	plaintext, err := decryptLegacyFile(append(header[:n], rest...), key)
+	if err != nil {
+		return nil, 0, err
+	}
+	return readSeekCloser{bytes.NewReader(plaintext), io.NopCloser(nil)}, int64(len(plaintext)), nil
+}
+
+// readSeekCloser reads from a reader and closes the underlying source
+type readSeekCloser struct {
+	io.ReadSeeker
+	io.Closer
 }
 
 // RemoveFile removes a file for a specific user
 func RemoveFile(userID int, uuid string) error {
-	// Try to remove the file
-	filePath := filepath.Join(Settings.DataPath, fmt.Sprintf("%d/files/%s", userID, uuid))
-	if err := os.Remove(filePath); err != nil {
-		Logger.Printf("Error removing %s: %v", filePath, err)
+	if err := Store.RemoveBlob(userID, uuid); err != nil {
+		Logger.Printf("Error removing file %s of user %d: %v", uuid, userID, err)
 		return fmt.Errorf("internal server error when trying to remove file %s", uuid)
 	}
 
@@ -389,64 +339,49 @@ func RemoveFile(userID int, uuid string) error {
 
 // GetYears returns the years available for a specific user
 func GetYears(userID int) ([]string, error) {
-	// Try to read the user directory
-	dirPath := filepath.Join(Settings.DataPath, fmt.Sprintf("%d", userID))
-	entries, err := os.ReadDir(dirPath)
+	years, err := Store.ListYears(userID)
 	if err != nil {
-		if os.IsNotExist(err) {
-			Logger.Printf("%s - Directory not found", dirPath)
-			return []string{}, nil
-		}
-		Logger.Printf("Error reading directory %s: %v", dirPath, err)
+		Logger.Printf("Error listing years of user %d: %v", userID, err)
 		return nil, fmt.Errorf("internal server error when trying to read directory %d", userID)
 	}
 
-	// Filter years
-	years := []string{}
-	for _, entry := range entries {
-		if entry.IsDir() && len(entry.Name()) == 4 {
-			// Check if the name is a valid year (4 digits)
-			if _, err := strconv.Atoi(entry.Name()); err == nil {
-				years = append(years, entry.Name())
-			}
-		}
+	result := make([]string, 0, len(years))
+	for _, year := range years {
+		result = append(result, strconv.Itoa(year))
 	}
 
-	return years, nil
+	return result, nil
 }
 
 // GetMonths returns the months available for a specific user and year
 func GetMonths(userID int, year string) ([]string, error) {
-	// Try to read the year directory
-	dirPath := filepath.Join(Settings.DataPath, fmt.Sprintf("%d/%s", userID, year))
-	entries, err := os.ReadDir(dirPath)
+	yearInt, err := strconv.Atoi(year)
 	if err != nil {
-		if os.IsNotExist(err) {
-			Logger.Printf("%s - Directory not found", dirPath)
-			return []string{}, nil
-		}
-		Logger.Printf("Error reading directory %s: %v", dirPath, err)
+		return []string{}, nil
+	}
+
+	months, err := Store.ListMonths(userID, yearInt)
+	if err != nil {
+		Logger.Printf("Error listing months of user %d in %s: %v", userID, year, err)
 		return nil, fmt.Errorf("internal server error when trying to read directory %d/%s", userID, year)
 	}
 
-	// Filter months
-	months := []string{}
-	for _, entry := range entries {
-		if !entry.IsDir() && strings.HasSuffix(entry.Name(), ".json") {
-			// Extract month from filename (remove .json)
-			month := strings.TrimSuffix(entry.Name(), ".json")
-			months = append(months, month)
-		}
+	result := make([]string, 0, len(months))
+	for _, month := range months {
+		result = append(result, fmt.Sprintf("%02d", month))
 	}
 
-	return months, nil
+	return result, nil
 }
 
+// DeleteUserData removes all documents and files of a user
 func DeleteUserData(userID int) error {
-	// Try to remove the user directory
-	dirPath := filepath.Join(Settings.DataPath, strconv.Itoa(userID))
-	if err := os.RemoveAll(dirPath); err != nil {
-		Logger.Printf("Error removing directory %s: %v", dirPath, err)
+	if err := Store.DeleteUserBlobs(userID); err != nil {
+		Logger.Printf("Error removing files of user %d: %v", userID, err)
+		return fmt.Errorf("internal server error when trying to remove user data for ID %d", userID)
+	}
+	if err := Store.DeleteUserDocs(userID); err != nil {
+		Logger.Printf("Error removing data of user %d: %v", userID, err)
 		return fmt.Errorf("internal server error when trying to remove user data for ID %d", userID)
 	}
 
@@ -0,0 +1,554 @@
+package utils
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// FsckIssue is a problem found in the data directory
+type FsckIssue struct {
+	Severity string // "error" or "warning"
+	Path     string // Relative to the data directory
+	Message  string
+	Repaired bool
+}
+
+// FsckReport is the result of RunFsck
+type FsckReport struct {
+	Issues        []FsckIssue
+	QuarantineDir string // Set if files were moved to quarantine
+}
+
+// Errors returns the number of errors that were not repaired
+func (r *FsckReport) Errors() int {
+	count := 0
+	for _, issue := range r.Issues {
+		if issue.Severity == "error" && !issue.Repaired {
+			count++
+		}
+	}
+	return count
+}
+
+// fsck holds the state of a check run
+type fsck struct {
+	dataPath      string
+	docs          DocumentStore // nil if the documents are the JSON tree in dataPath
+	blobs         BlobStore
+	repair        bool
+	quarantineDir string
+	report        *FsckReport
+}
+
+// RunFsck checks the documents and the blobs of the users. Only unencrypted structure is checked,
+// so no password is needed. With docs set, the documents are read from this store (e.g. SQLite),
+// otherwise from the JSON tree in dataPath. With repair set, broken files of the JSON tree and blobs
+// no day references are moved to <dataPath>/quarantine/<timestamp>/ (documents are restored from their
+// .bak, if possible) instead of being deleted. Broken documents of a store, missing blobs and unknown
+// tags are only reported. The server must not be running during a repair.
+func RunFsck(dataPath string, docs DocumentStore, blobs BlobStore, repair bool) (*FsckReport, error) {
+	f := &fsck{
+		dataPath:      dataPath,
+		docs:          docs,
+		blobs:         blobs,
+		repair:        repair,
+		quarantineDir: filepath.Join(dataPath, "quarantine", time.Now().Format("20060102-150405")),
+		report:        &FsckReport{},
+	}
+
+	// Users in users.json
+	users := f.checkUsers()
+	f.checkTempFiles(".")
+
+	// The documents of a store belong to the users in users.json, there are no user directories
+	if f.docs != nil {
+		userIDs := make([]int, 0, len(users))
+		for userID := range users {
+			userIDs = append(userIDs, userID)
+		}
+		sort.Ints(userIDs)
+		for _, userID := range userIDs {
+			if err := f.checkUser(userID); err != nil {
+				return nil, err
+			}
+		}
+		return f.report, nil
+	}
+
+	// User directories
+	entries, err := os.ReadDir(dataPath)
+	if err != nil {
+		return nil, fmt.Errorf("error reading data directory: %v", err)
+	}
+	dirs := map[int]bool{}
+	for _, entry := range entries {
+		if !entry.IsDir() || !isNumeric(entry.Name()) {
+			continue
+		}
+		userID, err := strconv.Atoi(entry.Name())
+		if err != nil {
+			continue
+		}
+		dirs[userID] = true
+
+		if !users[userID] {
+			f.warn(entry.Name(), "data directory without user in users.json")
+		}
+		if err := f.checkUser(userID); err != nil {
+			return nil, err
+		}
+	}
+
+	// Users without data
+	userIDs := make([]int, 0, len(users))
+	for userID := range users {
+		userIDs = append(userIDs, userID)
+	}
+	sort.Ints(userIDs)
+	for _, userID := range userIDs {
+		if !dirs[userID] {
+			f.warn("users.json", fmt.Sprintf("user %d has no data directory (no entries written yet?)", userID))
+		}
+	}
+
+	return f.report, nil
+}
+
+// checkUsers checks users.json and returns the IDs of the users
+func (f *fsck) checkUsers() map[int]bool {
+	users := map[int]bool{}
+
+	var content map[string]any
+	var exists bool
+	if f.docs != nil {
+		content, exists = f.readStoredDocument("users.json", func() ([]byte, error) { return f.docs.ReadDoc("users.json") })
+	} else {
+		content, exists = f.readDocument("users.json")
+	}
+	if !exists {
+		f.warn("users.json", "file does not exist")
+		return users
+	}
+	if content == nil {
+		return users
+	}
+
+	list, ok := content["users"].([]any)
+	if !ok {
+		f.error("users.json", "no users list", false)
+		return users
+	}
+	for i, item := range list {
+		user, ok := item.(map[string]any)
+		if !ok {
+			f.error("users.json", fmt.Sprintf("entry %d is not an object", i), false)
+			continue
+		}
+		id, ok := user["user_id"].(float64)
+		if !ok {
+			f.error("users.json", fmt.Sprintf("entry %d has no user_id", i), false)
+			continue
+		}
+		if users[int(id)] {
+			f.error("users.json", fmt.Sprintf("user_id %d is used more than once", int(id)), false)
+		}
+		users[int(id)] = true
+	}
+
+	return users
+}
+
+// checkUser checks the documents, months and blobs of a user
+func (f *fsck) checkUser(userID int) error {
+	userDir := strconv.Itoa(userID)
+
+	// Existing blobs
+	blobList, err := f.blobs.ListBlobs(userID)
+	if err != nil {
+		return fmt.Errorf("error listing files of user %d: %v", userID, err)
+	}
+	blobs := map[string]bool{}
+	for _, blob := range blobList {
+		blobs[blob.Name] = true
+	}
+
+	// Tags
+	tagIDs := map[int]bool{}
+	if tags, _ := f.readUserDocument(userID, "tags.json"); tags != nil {
+		list, _ := tags["tags"].([]any)
+		for _, item := range list {
+			if tag, ok := item.(map[string]any); ok {
+				if id, ok := tag["id"].(float64); ok {
+					tagIDs[int(id)] = true
+				}
+			}
+		}
+	}
+
+	// Other documents
+	f.readUserDocument(userID, "templates.json")
+	if f.docs == nil {
+		if info, err := os.Stat(filepath.Join(f.dataPath, userDir, "settings.encrypted")); err == nil && info.Size() == 0 {
+			f.error(filepath.Join(userDir, "settings.encrypted"), "file is empty", false)
+		}
+	}
+	f.checkTempFiles(userDir)
+	f.checkTempFiles(filepath.Join(userDir, "files"))
+
+	// Months
+	referenced := map[string]bool{}
+	check := f.checkMonthFiles
+	if f.docs != nil {
+		check = f.checkStoredMonths
+	}
+	monthsComplete, err := check(userID, func(monthPath string, content map[string]any) {
+		f.checkMonth(monthPath, content, blobs, tagIDs, referenced)
+	})
+	if err != nil {
+		return err
+	}
+
+	// Trash, its files are still referenced
+	trashPath := filepath.Join(userDir, "trash.json")
+	if trash, exists := f.readUserDocument(userID, "trash.json"); trash != nil {
+		f.checkTrash(trashPath, trash, blobs, referenced)
+	} else if exists {
+		monthsComplete = false
+	}
+
+	// Blobs that no day references
+	orphans := []string{}
+	for _, blob := range blobList {
+		if !referenced[blob.Name] {
+			orphans = append(orphans, blob.Name)
+		}
+	}
+	for _, name := range orphans {
+		blobPath := filepath.Join(userDir, "files", name)
+		if !f.repair {
+			f.error(blobPath, "file is not referenced by any day", false)
+			continue
+		}
+		if !monthsComplete {
+			// The unreadable months might reference it
+			f.error(blobPath, "file is not referenced by any day (not quarantined, as some months of the user are unreadable)", false)
+			continue
+		}
+		if err := f.quarantineBlob(userID, name); err != nil {
+			f.error(blobPath, fmt.Sprintf("file is not referenced by any day, quarantine failed: %v", err), false)
+			continue
+		}
+		f.error(blobPath, "file is not referenced by any day, moved to quarantine", true)
+	}
+
+	return nil
+}
+
+// checkMonthFiles calls checkMonth for the month files in the JSON tree of a user.
+// Returns false if a month could not be read.
+func (f *fsck) checkMonthFiles(userID int, checkMonth func(monthPath string, content map[string]any)) (bool, error) {
+	userDir := strconv.Itoa(userID)
+	complete := true
+
+	entries, err := os.ReadDir(filepath.Join(f.dataPath, userDir))
+	if err != nil {
+		return false, fmt.Errorf("error reading directory of user %d: %v", userID, err)
+	}
+	for _, entry := range entries {
+		if !entry.IsDir() || len(entry.Name()) != 4 || !isNumeric(entry.Name()) {
+			continue
+		}
+		yearDir := filepath.Join(userDir, entry.Name())
+		f.checkTempFiles(yearDir)
+
+		months, err := os.ReadDir(filepath.Join(f.dataPath, yearDir))
+		if err != nil {
+			return false, fmt.Errorf("error reading %s: %v", yearDir, err)
+		}
+		for _, month := range months {
+			name := month.Name()
+			if month.IsDir() || strings.HasPrefix(name, ".") || strings.HasSuffix(name, ".bak") {
+				continue
+			}
+			monthPath := filepath.Join(yearDir, name)
+			if number := strings.TrimSuffix(name, ".json"); number == name || len(number) != 2 || !isNumeric(number) {
+				f.warn(monthPath, "unexpected file in year directory")
+				continue
+			}
+
+			content, _ := f.readDocument(monthPath)
+			if content == nil {
+				complete = false
+				continue
+			}
+			checkMonth(monthPath, content)
+		}
+	}
+	return complete, nil
+}
+
+// checkStoredMonths calls checkMonth for the months of a user in the document store.
+// Returns false if a month could not be read.
+func (f *fsck) checkStoredMonths(userID int, checkMonth func(monthPath string, content map[string]any)) (bool, error) {
+	complete := true
+
+	years, err := f.docs.ListYears(userID)
+	if err != nil {
+		return false, fmt.Errorf("error listing years of user %d: %v", userID, err)
+	}
+	for _, year := range years {
+		months, err := f.docs.ListMonths(userID, year)
+		if err != nil {
+			return false, fmt.Errorf("error listing months of user %d in %d: %v", userID, year, err)
+		}
+		for _, month := range months {
+			monthPath := filepath.Join(strconv.Itoa(userID), strconv.Itoa(year), fmt.Sprintf("%02d.json", month))
+			content, _ := f.readStoredDocument(monthPath, func() ([]byte, error) { return f.docs.ReadMonth(userID, year, month) })
+			if content == nil {
+				complete = false
+				continue
+			}
+			checkMonth(monthPath, content)
+		}
+	}
+	return complete, nil
+}
+
+// checkMonth checks the days of a month document
+func (f *fsck) checkMonth(monthPath string, content map[string]any, blobs map[string]bool, tagIDs map[int]bool, referenced map[string]bool) {
+	days, ok := content["days"].([]any)
+	if !ok {
+		if _, exists := content["days"]; exists {
+			f.error(monthPath, "days is not a list", false)
+		}
+		return
+	}
+
+	for i, item := range days {
+		day, ok := item.(map[string]any)
+		if !ok {
+			f.error(monthPath, fmt.Sprintf("day entry %d is not an object", i), false)
+			continue
+		}
+
+		// Day number
+		label := fmt.Sprintf("day entry %d", i)
+		if number, ok := day["day"].(float64); !ok || number != float64(int(number)) || number < 1 || number > 31 {
+			f.error(monthPath, fmt.Sprintf("%s has no valid day", label), false)
+		} else {
+			label = fmt.Sprintf("day %d", int(number))
+		}
+
+		if entries, exists := day["entries"]; exists {
+			if _, ok := entries.([]any); !ok {
+				f.error(monthPath, fmt.Sprintf("%s: entries is not a list", label), false)
+			}
+		}
+		for j, entry := range DayEntries(day) {
+			if id, _ := entry["id"].(string); id == "" {
+				f.error(monthPath, fmt.Sprintf("%s: entry %d has no id", label, j), false)
+			}
+		}
+
+		// Files and tags of the day and of its entries
+		for j, part := range DayParts(day) {
+			partLabel := label
+			if j > 0 {
+				partLabel = fmt.Sprintf("%s entry %v", label, part["id"])
+			}
+			f.checkDayPart(monthPath, partLabel, part, blobs, tagIDs, referenced)
+		}
+	}
+}
+
+// checkDayPart checks the files and tags of a day or an entry of a day
+func (f *fsck) checkDayPart(monthPath, label string, part map[string]any, blobs map[string]bool, tagIDs map[int]bool, referenced map[string]bool) {
+	// Files
+	files, _ := part["files"].([]any)
+	for j, fileItem := range files {
+		file, ok := fileItem.(map[string]any)
+		uuid, _ := file["uuid_filename"].(string)
+		if !ok || uuid == "" {
+			f.error(monthPath, fmt.Sprintf("%s: file entry %d has no uuid_filename", label, j), false)
+			continue
+		}
+		referenced[uuid] = true
+		if !blobs[uuid] {
+			f.error(monthPath, fmt.Sprintf("%s: file %s does not exist", label, uuid), false)
+		}
+	}
+
+	// Tags
+	tags, _ := part["tags"].([]any)
+	for _, tag := range tags {
+		id, ok := tag.(float64)
+		if !ok {
+			f.error(monthPath, fmt.Sprintf("%s: invalid tag %v", label, tag), false)
+			continue
+		}
+		if !tagIDs[int(id)] {
+			f.error(monthPath, fmt.Sprintf("%s: tag %d does not exist in tags.json", label, int(id)), false)
+		}
+	}
+}
+
+// checkTrash checks the items of the trash document
+func (f *fsck) checkTrash(trashPath string, content map[string]any, blobs map[string]bool, referenced map[string]bool) {
+	for i, item := range TrashItems(content) {
+		if _, ok := item["entry"].(map[string]any); !ok {
+			f.error(trashPath, fmt.Sprintf("trash item %d has no entry", i), false)
+			continue
+		}
+		for _, file := range TrashItemFiles(item) {
+			uuid, _ := file["uuid_filename"].(string)
+			if uuid == "" {
+				f.error(trashPath, fmt.Sprintf("trash item %d: file entry has no uuid_filename", i), false)
+				continue
+			}
+			referenced[uuid] = true
+			if !blobs[uuid] {
+				f.error(trashPath, fmt.Sprintf("trash item %d: file %s does not exist", i, uuid), false)
+			}
+		}
+	}
+}
+
+// readDocument reads and decodes a JSON document. A document that can't be decoded is reported
+// and, when repairing, moved to quarantine and restored from its backup.
+// Returns nil as content if the document is missing or broken.
+func (f *fsck) readDocument(relPath string) (map[string]any, bool) {
+	fullPath := filepath.Join(f.dataPath, relPath)
+
+	data, err := os.ReadFile(fullPath)
+	if err != nil {
+		if !errors.Is(err, fs.ErrNotExist) {
+			f.error(relPath, fmt.Sprintf("could not be read: %v", err), false)
+			return nil, true
+		}
+		return nil, false
+	}
+
+	content := map[string]any{}
+	decodeErr := json.Unmarshal(data, &content)
+	if decodeErr == nil {
+		return content, true
+	}
+
+	message := fmt.Sprintf("could not be parsed: %v", decodeErr)
+	if !f.repair {
+		f.error(relPath, message, false)
+		return nil, true
+	}
+
+	// Keep the broken file in quarantine and go back to the backup, if there is a usable one
+	if err := f.quarantine(relPath); err != nil {
+		f.error(relPath, fmt.Sprintf("%s, quarantine failed: %v", message, err), false)
+		return nil, true
+	}
+	backup, err := os.ReadFile(fullPath + ".bak")
+	if err == nil && json.Unmarshal(backup, &content) == nil {
+		if err := writeBytesAtomic(fullPath, false, backup); err == nil {
+			f.error(relPath, message+", moved to quarantine and restored from .bak", true)
+			return content, true
+		}
+	}
+	f.error(relPath, message+", moved to quarantine", true)
+	return nil, true
+}
+
+// readUserDocument reads and decodes a document of a user, from the document store or the JSON tree.
+// Returns nil as content if the document is missing or broken.
+func (f *fsck) readUserDocument(userID int, name string) (map[string]any, bool) {
+	relPath := filepath.Join(strconv.Itoa(userID), name)
+	if f.docs == nil {
+		return f.readDocument(relPath)
+	}
+	return f.readStoredDocument(relPath, func() ([]byte, error) { return f.docs.ReadUserDoc(userID, name) })
+}
+
+// readStoredDocument reads and decodes a document of the document store, path names it in the report.
+// A broken document is only reported, it can't be moved to quarantine.
+// Returns nil as content if the document is missing or broken.
+func (f *fsck) readStoredDocument(path string, read func() ([]byte, error)) (map[string]any, bool) {
+	data, err := read()
+	if err != nil {
+		if !errors.Is(err, fs.ErrNotExist) {
+			f.error(path, fmt.Sprintf("could not be read: %v", err), false)
+			return nil, true
+		}
+		return nil, false
+	}
+
+	content := map[string]any{}
+	if err := json.Unmarshal(data, &content); err != nil {
+		f.error(path, fmt.Sprintf("could not be parsed: %v", err), false)
+		return nil, true
+	}
+	return content, true
+}
+
+// checkTempFiles reports temporary files left behind by interrupted writes
+func (f *fsck) checkTempFiles(relDir string) {
+	entries, err := os.ReadDir(filepath.Join(f.dataPath, relDir))
+	if err != nil {
+		return
+	}
+
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasPrefix(entry.Name(), ".") || !strings.Contains(entry.Name(), ".tmp-") {
+			continue
+		}
+		relPath := filepath.Join(relDir, entry.Name())
+		if !f.repair {
+			f.warn(relPath, "leftover temporary file")
+			continue
+		}
+		if err := f.quarantine(relPath); err != nil {
+			f.warn(relPath, fmt.Sprintf("leftover temporary file, quarantine failed: %v", err))
+			continue
+		}
+		f.report.Issues = append(f.report.Issues, FsckIssue{Severity: "warning", Path: relPath, Message: "leftover temporary file, moved to quarantine", Repaired: true})
+	}
+}
+
+// quarantine moves a file below the data directory into the quarantine directory
+func (f *fsck) quarantine(relPath string) error {
+	target := filepath.Join(f.quarantineDir, relPath)
+	if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+		return err
+	}
+	if err := os.Rename(filepath.Join(f.dataPath, relPath), target); err != nil {
+		return err
+	}
+	f.report.QuarantineDir = f.quarantineDir
+	return nil
+}
+
+// quarantineBlob copies a blob into the quarantine directory and removes it from the blob store
+func (f *fsck) quarantineBlob(userID int, name string) error {
+	data, err := f.blobs.ReadBlob(userID, name)
+	if err != nil {
+		return err
+	}
+	if err := writeBytesAtomic(filepath.Join(f.quarantineDir, strconv.Itoa(userID), "files", name), false, data); err != nil {
+		return err
+	}
+	f.report.QuarantineDir = f.quarantineDir
+	return f.blobs.RemoveBlob(userID, name)
+}
+
+func (f *fsck) error(relPath, message string, repaired bool) {
+	f.report.Issues = append(f.report.Issues, FsckIssue{Severity: "error", Path: relPath, Message: message, Repaired: repaired})
+}
+
+func (f *fsck) warn(relPath, message string) {
+	f.report.Issues = append(f.report.Issues, FsckIssue{Severity: "warning", Path: relPath, Message: message})
+}
@@ -0,0 +1,97 @@
+package utils
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// setupFsckStore writes a user with a month that references one of two blobs
+func setupFsckStore(t *testing.T, store Storage) {
+	t.Helper()
+
+	must := func(err error) {
+		t.Helper()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	must(store.WriteDoc("users.json", []byte(`{"users": [{"user_id": 1, "username": "alice"}]}`)))
+	must(store.WriteMonth(1, 2024, 5, []byte(`{"days": [{"day": 3, "files": [{"uuid_filename": "used"}]}]}`)))
+	must(store.WriteBlob(1, "used", []byte("used")))
+	must(store.WriteBlob(1, "orphan", []byte("orphan")))
+}
+
+// The documents are not in the data directory (e.g. STORAGE=sqlite), the references are read from the store
+func TestFsckDocumentStore(t *testing.T) {
+	store := NewMemoryStorage()
+	setupFsckStore(t, store)
+	dataPath := t.TempDir()
+
+	report, err := RunFsck(dataPath, store, store, true)
+	if err != nil {
+		t.Fatalf("RunFsck: %v", err)
+	}
+	if len(report.Issues) != 1 || !report.Issues[0].Repaired || !strings.Contains(report.Issues[0].Path, "orphan") {
+		t.Fatalf("issues = %+v, want the quarantined orphan", report.Issues)
+	}
+
+	if _, err := store.ReadBlob(1, "used"); err != nil {
+		t.Errorf("the referenced blob is gone: %v", err)
+	}
+	if _, err := store.ReadBlob(1, "orphan"); err == nil {
+		t.Errorf("the orphan is still in the store")
+	}
+	if _, err := os.Stat(filepath.Join(report.QuarantineDir, "1", "files", "orphan")); err != nil {
+		t.Errorf("the orphan is not in quarantine: %v", err)
+	}
+}
+
+// A month that can't be parsed might reference any blob, so nothing is quarantined
+func TestFsckBrokenStoredMonth(t *testing.T) {
+	store := NewMemoryStorage()
+	setupFsckStore(t, store)
+	if err := store.WriteMonth(1, 2024, 6, []byte(`{"days": [`)); err != nil {
+		t.Fatal(err)
+	}
+
+	report, err := RunFsck(t.TempDir(), store, store, true)
+	if err != nil {
+		t.Fatalf("RunFsck: %v", err)
+	}
+	if report.Errors() != 2 {
+		t.Errorf("issues = %+v, want the broken month and the orphan", report.Issues)
+	}
+	for _, name := range []string{"used", "orphan"} {
+		if _, err := store.ReadBlob(1, name); err != nil {
+			t.Errorf("blob %s is gone: %v", name, err)
+		}
+	}
+}
+
+func TestFsckJSONTree(t *testing.T) {
+	dataPath := t.TempDir()
+	store := NewFilesystemStorage(dataPath)
+	setupFsckStore(t, store)
+
+	// A broken month is moved to quarantine
+	monthPath := filepath.Join(dataPath, "1", "2024", "06.json")
+	if err := os.WriteFile(monthPath, []byte(`{"days": [`), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	report, err := RunFsck(dataPath, nil, store, true)
+	if err != nil {
+		t.Fatalf("RunFsck: %v", err)
+	}
+	if _, err := os.Stat(monthPath); err == nil {
+		t.Errorf("the broken month is still in place")
+	}
+	if _, err := store.ReadBlob(1, "orphan"); err != nil {
+		t.Errorf("the orphan was quarantined although a month was unreadable: %v", err)
+	}
+	if report.Errors() != 1 {
+		t.Errorf("issues = %+v, want the unreferenced blob as the only error left", report.Issues)
+	}
+}
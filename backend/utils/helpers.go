@@ -5,8 +5,11 @@ import (
 	"fmt"
 	"io"
 	"log"
+	"net"
 	"net/http"
+	"net/netip"
 	"os"
+	"path/filepath"
 	"strconv"
 	"strings"
 	"sync"
@@ -32,15 +35,27 @@ const (
 	UserIDKey     ContextKey = "userID"
 	UsernameKey   ContextKey = "username"
 	DerivedKeyKey ContextKey = "derivedKey"
+	SessionIDKey  ContextKey = "sessionID"
 )
 
 // Settings holds the application settings
 type AppSettings struct {
 	DataPath            string   `json:"data_path"`
+	Storage             string   `json:"storage"`
+	SQLitePath          string   `json:"sqlite_path"`
+	FilesStorage        string   `json:"files_storage"`
+	S3Endpoint          string   `json:"s3_endpoint"`
+	S3Region            string   `json:"s3_region"`
+	S3Bucket            string   `json:"s3_bucket"`
+	S3AccessKey         string   `json:"s3_access_key"`
+	S3SecretKey         string   `json:"s3_secret_key"`
+	S3Prefix            string   `json:"s3_prefix"`
+	S3PathStyle         bool     `json:"s3_path_style"`
 	Development         bool     `json:"development"`
 	SecretToken         string   `json:"secret_token"`
 	LogoutAfterDays     int      `json:"logout_after_days"`
 	AllowedHosts        []string `json:"allowed_hosts"`
+	TrustedProxies      []string `json:"trusted_proxies"`
 	Indent              int      `json:"indent"`
 	AllowRegistration   bool     `json:"allow_registration"`
 	BasePath            string   `json:"base_path"`
@@ -51,6 +66,12 @@ type AppSettings struct {
 	SMTPUsername        string   `json:"smtp_username"`
 	SMTPPassword        string   `json:"smtp_password"`
 	SMTPFrom            string   `json:"smtp_from"`
+	LoginMaxAttempts    int      `json:"login_max_attempts"`
+	LoginLockoutMinutes int      `json:"login_lockout_minutes"`
+	Argon2Time          int      `json:"argon2_time"`
+	Argon2MemoryKiB     int      `json:"argon2_memory_kib"`
+	Argon2Threads       int      `json:"argon2_threads"`
+	TrashRetentionDays  int      `json:"trash_retention_days"`
 }
 
 // Global settings
@@ -62,29 +83,54 @@ var (
 	registrationOverrideMu    sync.RWMutex
 )
 
+// registrationOverrideDoc persists the override, so that it is shared with the admin command line
+const registrationOverrideDoc = "registration.json"
+
 // SetRegistrationOverride opens registration for the given duration
-func SetRegistrationOverride(d time.Duration) {
+func SetRegistrationOverride(d time.Duration) error {
 	registrationOverrideMu.Lock()
 	defer registrationOverrideMu.Unlock()
 	registrationOverrideUntil = time.Now().Add(d)
 	Logger.Printf("Registration temporarily opened until %s", registrationOverrideUntil.Format(time.RFC3339))
+
+	data, err := encodeDocument(map[string]any{"until": registrationOverrideUntil.Format(time.RFC3339)}, false)
+	if err != nil {
+		return err
+	}
+	if err := Store.WriteDoc(registrationOverrideDoc, data); err != nil {
+		Logger.Printf("Error writing %s: %v", registrationOverrideDoc, err)
+		return fmt.Errorf("internal server error when trying to write %s", registrationOverrideDoc)
+	}
+
+	return nil
 }
 
+// GetRegistrationOverrideUntil returns the end of the temporary registration window
 func GetRegistrationOverrideUntil() time.Time {
 	registrationOverrideMu.RLock()
-	defer registrationOverrideMu.RUnlock()
-	return registrationOverrideUntil
+	until := registrationOverrideUntil
+	registrationOverrideMu.RUnlock()
+
+	// The window might have been opened by another process
+	if data, err := Store.ReadDoc(registrationOverrideDoc); err == nil {
+		content, err := decodeDocument(data)
+		if err == nil {
+			if value, ok := content["until"].(string); ok {
+				if stored, err := time.Parse(time.RFC3339, value); err == nil && stored.After(until) {
+					until = stored
+				}
+			}
+		}
+	}
+
+	return until
 }
 
 // IsRegistrationAllowed returns whether registration is
 // overall allowed or temporarily allowed
 func IsRegistrationAllowed() (bool, bool) {
 	allowed := Settings.AllowRegistration
-
-	registrationOverrideMu.RLock()
-	until := registrationOverrideUntil
-	registrationOverrideMu.RUnlock()
-	tempAllowed := time.Now().Before(until)
+	tempAllowed := time.Now().Before(GetRegistrationOverrideUntil())
 
 	return allowed, tempAllowed
 }
@@ -104,16 +150,27 @@ func InitSettings() error {
 	// Default settings
 	Settings = AppSettings{
 		DataPath:            "/data",
+		Storage:             "filesystem",
+		FilesStorage:        "filesystem",
+		S3Region:            "us-east-1",
+		S3PathStyle:         true,
 		Development:         false,
 		SecretToken:         GenerateSecretToken(),
 		LogoutAfterDays:     30,
 		AllowedHosts:        []string{},
+		TrustedProxies:      defaultTrustedProxies,
 		Indent:              0,
 		AllowRegistration:   false,
 		BasePath:            "/",
 		ShareCodeTTLMinutes: 10,
 		ShareCookieDays:     30,
 		SMTPPort:            587,
+		LoginMaxAttempts:    5,
+		LoginLockoutMinutes: 15,
+		Argon2Time:          3,
+		Argon2MemoryKiB:     64 * 1024,
+		Argon2Threads:       4,
+		TrashRetentionDays:  30,
 	}
 
 	fmt.Print("\nDetected the following settings:\n================\n")
@@ -124,6 +181,50 @@ func InitSettings() error {
 	}
 	fmt.Printf("Data Path: %s\n", Settings.DataPath)
 
+	if storage := os.Getenv("STORAGE"); storage != "" {
+		Settings.Storage = strings.ToLower(storage)
+	}
+	if Settings.Storage != "filesystem" && Settings.Storage != "sqlite" {
+		return fmt.Errorf("unknown STORAGE %q (use filesystem or sqlite)", Settings.Storage)
+	}
+	fmt.Printf("Storage: %s\n", Settings.Storage)
+
+	Settings.SQLitePath = filepath.Join(Settings.DataPath, "dailytxt.db")
+	if sqlitePath := os.Getenv("SQLITE_PATH"); sqlitePath != "" {
+		Settings.SQLitePath = sqlitePath
+	}
+	if Settings.Storage == "sqlite" {
+		fmt.Printf("SQLite Path: %s\n", Settings.SQLitePath)
+	}
+
+	if filesStorage := os.Getenv("FILES_STORAGE"); filesStorage != "" {
+		Settings.FilesStorage = strings.ToLower(filesStorage)
+	}
+	if Settings.FilesStorage != "filesystem" && Settings.FilesStorage != "s3" {
+		return fmt.Errorf("unknown FILES_STORAGE %q (use filesystem or s3)", Settings.FilesStorage)
+	}
+	fmt.Printf("Files Storage: %s\n", Settings.FilesStorage)
+
+	if Settings.FilesStorage == "s3" {
+		Settings.S3Endpoint = os.Getenv("S3_ENDPOINT")
+		Settings.S3Bucket = os.Getenv("S3_BUCKET")
+		Settings.S3AccessKey = os.Getenv("S3_ACCESS_KEY")
+		Settings.S3SecretKey = os.Getenv("S3_SECRET_KEY")
+		Settings.S3Prefix = os.Getenv("S3_PREFIX")
+		if region := os.Getenv("S3_REGION"); region != "" {
+			Settings.S3Region = region
+		}
+		if pathStyle := os.Getenv("S3_PATH_STYLE"); pathStyle != "" {
+			Settings.S3PathStyle = pathStyle == "true"
+		}
+		fmt.Printf("S3 Endpoint: %s\n", Settings.S3Endpoint)
+		fmt.Printf("S3 Region: %s\n", Settings.S3Region)
+		fmt.Printf("S3 Bucket: %s\n", Settings.S3Bucket)
+		fmt.Printf("S3 Prefix: %s\n", Settings.S3Prefix)
+		fmt.Printf("S3 Path Style: %t\n", Settings.S3PathStyle)
+		fmt.Printf("S3 Credentials configured: %t\n", Settings.S3AccessKey != "" && Settings.S3SecretKey != "")
+	}
+
 	if os.Getenv("DEVELOPMENT") == "true" {
 		Settings.Development = true
 	}
@@ -153,6 +254,13 @@ func InitSettings() error {
 	}
 	fmt.Printf("Allowed Hosts: %v\n", Settings.AllowedHosts)
 
+	trustedProxies, err := parseTrustedProxies(os.Getenv("TRUSTED_PROXIES"))
+	if err != nil {
+		return err
+	}
+	Settings.TrustedProxies = trustedProxies
+	fmt.Printf("Trusted Proxies: %v\n", Settings.TrustedProxies)
+
 	if indent := os.Getenv("INDENT"); indent != "" {
 		// Parse indent to int
 		var ind int
@@ -221,6 +329,50 @@ func InitSettings() error {
 	}
 	fmt.Printf("SMTP From: %s\n", Settings.SMTPFrom)
 
+	if loginMaxAttempts := os.Getenv("LOGIN_MAX_ATTEMPTS"); loginMaxAttempts != "" {
+		var attempts int
+		if _, err := fmt.Sscanf(loginMaxAttempts, "%d", &attempts); err == nil && attempts > 0 {
+			Settings.LoginMaxAttempts = attempts
+		}
+	}
+	fmt.Printf("Login Max Attempts: %d\n", Settings.LoginMaxAttempts)
+
+	if loginLockoutMinutes := os.Getenv("LOGIN_LOCKOUT_MINUTES"); loginLockoutMinutes != "" {
+		var minutes int
+		if _, err := fmt.Sscanf(loginLockoutMinutes, "%d", &minutes); err == nil && minutes > 0 {
+			Settings.LoginLockoutMinutes = minutes
+		}
+	}
+	fmt.Printf("Login Lockout Minutes: %d\n", Settings.LoginLockoutMinutes)
+
+	if argon2Time := os.Getenv("ARGON2_TIME"); argon2Time != "" {
+		var t int
+		if _, err := fmt.Sscanf(argon2Time, "%d", &t); err == nil && t > 0 {
+			Settings.Argon2Time = t
+		}
+	}
+	if argon2Memory := os.Getenv("ARGON2_MEMORY_KIB"); argon2Memory != "" {
+		var m int
+		if _, err := fmt.Sscanf(argon2Memory, "%d", &m); err == nil && m >= 8*1024 {
+			Settings.Argon2MemoryKiB = m
+		}
+	}
+	if argon2Threads := os.Getenv("ARGON2_THREADS"); argon2Threads != "" {
+		var p int
+		if _, err := fmt.Sscanf(argon2Threads, "%d", &p); err == nil && p > 0 && p <= 255 {
+			Settings.Argon2Threads = p
+		}
+	}
+	fmt.Printf("Argon2: time=%d, memory=%d KiB, threads=%d\n", Settings.Argon2Time, Settings.Argon2MemoryKiB, Settings.Argon2Threads)
+
+	if trashRetentionDays := os.Getenv("TRASH_RETENTION_DAYS"); trashRetentionDays != "" {
+		var days int
+		if _, err := fmt.Sscanf(trashRetentionDays, "%d", &days); err == nil && days > 0 {
+			Settings.TrashRetentionDays = days
+		}
+	}
+	fmt.Printf("Trash Retention Days: %d\n", Settings.TrashRetentionDays)
+
 	fmt.Print("================\n\n")
 
 	// Create data directory if it doesn't exist
@@ -237,8 +389,10 @@ func GetAppSettings() AppSettings {
 	data, _ := json.Marshal(Settings)
 	json.Unmarshal(data, &tempSettings)
 
-	// dont't show secret - remove it!
+	// dont't show secrets - remove them!
 	tempSettings.SecretToken = ""
+	tempSettings.S3SecretKey = ""
+	tempSettings.SMTPPassword = ""
 	return tempSettings
 }
 
@@ -707,3 +861,87 @@ func GetVersionInfo(w http.ResponseWriter, r *http.Request) {
 		"latest_overall_version": latest_overall,
 	})
 }
+
+// GetClientIP returns the IP of the client.
+// X-Forwarded-For and X-Real-IP are only respected if the request comes from loopback (the nginx of the
+// Docker image) or one of the TRUSTED_PROXIES, otherwise any client could set them.
+func GetClientIP(r *http.Request) string {
+	remoteIP := r.RemoteAddr
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil && host != "" {
+		remoteIP = host
+	}
+	if !isTrustedProxy(remoteIP) {
+		return remoteIP
+	}
+
+	// Every proxy appends the address it got the request from, so the client is
+	// the rightmost address that is not one of the trusted proxies
+	forwardedFor := strings.TrimSpace(r.Header.Get("X-Forwarded-For"))
+	if forwardedFor != "" {
+		parts := strings.Split(forwardedFor, ",")
+		for i := len(parts) - 1; i >= 0; i-- {
+			ip := strings.TrimSpace(parts[i])
+			if ip != "" && (i == 0 || !isTrustedProxy(ip)) {
+				return ip
+			}
+		}
+	}
+
+	realIP := strings.TrimSpace(r.Header.Get("X-Real-IP"))
+	if realIP != "" {
+		return realIP
+	}
+
+	return remoteIP
+}
+
+// defaultTrustedProxies are always trusted: the nginx of the Docker image proxies to the backend over loopback
+var defaultTrustedProxies = []string{"127.0.0.0/8", "::1"}
+
+// parseTrustedProxies returns the default trusted proxies followed by the comma separated entries of TRUSTED_PROXIES
+func parseTrustedProxies(value string) ([]string, error) {
+	proxies := append([]string{}, defaultTrustedProxies...)
+	for _, proxy := range strings.Split(value, ",") {
+		proxy = strings.TrimSpace(proxy)
+		if proxy == "" {
+			continue
+		}
+		if _, err := parseTrustedProxy(proxy); err != nil {
+			return nil, fmt.Errorf("invalid TRUSTED_PROXIES entry %q: %v", proxy, err)
+		}
+		proxies = append(proxies, proxy)
+	}
+	return proxies, nil
+}
+
+// parseTrustedProxy parses an entry of TRUSTED_PROXIES, an IP or a CIDR range
+func parseTrustedProxy(proxy string) (netip.Prefix, error) {
+	if strings.Contains(proxy, "/") {
+		prefix, err := netip.ParsePrefix(proxy)
+		return prefix.Masked(), err
+	}
+	addr, err := netip.ParseAddr(proxy)
+	if err != nil {
+		return netip.Prefix{}, err
+	}
+	addr = addr.Unmap()
+	return netip.PrefixFrom(addr, addr.BitLen()), nil
+}
+
+// isTrustedProxy returns whether ip is a loopback address or one of the TRUSTED_PROXIES
+func isTrustedProxy(ip string) bool {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return false
+	}
+	addr = addr.Unmap()
+
+	for _, proxy := range Settings.TrustedProxies {
+		prefix, err := parseTrustedProxy(proxy)
+		if err == nil && prefix.Contains(addr) {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,105 @@
+package utils
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestGetAppSettingsHidesSecrets(t *testing.T) {
+	saved := Settings
+	defer func() { Settings = saved }()
+
+	Settings.SecretToken = "hidden-token"
+	Settings.S3SecretKey = "hidden-s3-key"
+	Settings.SMTPPassword = "hidden-smtp-password"
+	Settings.SMTPUsername = "mailer"
+
+	data, err := json.Marshal(GetAppSettings())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(data), "hidden") {
+		t.Errorf("settings contain a secret: %s", data)
+	}
+	if !strings.Contains(string(data), "mailer") {
+		t.Errorf("settings lost the other values: %s", data)
+	}
+}
+
+func TestGetClientIP(t *testing.T) {
+	saved := Settings
+	defer func() { Settings = saved }()
+	Settings.TrustedProxies = []string{"10.0.0.1", "172.16.0.0/12"}
+
+	tests := []struct {
+		remoteAddr, forwardedFor, realIP, want string
+	}{
+		// Headers of untrusted peers are ignored
+		{"203.0.113.7:4000", "198.51.100.1", "198.51.100.2", "203.0.113.7"},
+		// A trusted proxy is believed
+		{"10.0.0.1:4000", "198.51.100.1", "", "198.51.100.1"},
+		{"10.0.0.1:4000", "", "198.51.100.2", "198.51.100.2"},
+		{"10.0.0.1:4000", "", "", "10.0.0.1"},
+		// Addresses the client made up in front of the ones added by the trusted proxies are skipped
+		{"10.0.0.1:4000", "192.0.2.99, 198.51.100.1, 172.17.0.2", "", "198.51.100.1"},
+		// Only trusted proxies in the chain
+		{"172.17.0.3:4000", "172.17.0.2", "", "172.17.0.2"},
+		{"[::ffff:10.0.0.1]:4000", "198.51.100.1", "", "198.51.100.1"},
+	}
+	for _, test := range tests {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.RemoteAddr = test.remoteAddr
+		if test.forwardedFor != "" {
+			r.Header.Set("X-Forwarded-For", test.forwardedFor)
+		}
+		if test.realIP != "" {
+			r.Header.Set("X-Real-IP", test.realIP)
+		}
+		if got := GetClientIP(r); got != test.want {
+			t.Errorf("GetClientIP(%s, X-Forwarded-For %q, X-Real-IP %q) = %s, want %s", test.remoteAddr, test.forwardedFor, test.realIP, got, test.want)
+		}
+	}
+}
+
+// Without TRUSTED_PROXIES, the nginx of the Docker image (on loopback) is trusted, but nothing else
+func TestGetClientIPDefaultProxies(t *testing.T) {
+	saved := Settings
+	defer func() { Settings = saved }()
+	proxies, err := parseTrustedProxies("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	Settings.TrustedProxies = proxies
+
+	tests := []struct {
+		remoteAddr, forwardedFor, want string
+	}{
+		// nginx appends the address of the client to X-Forwarded-For
+		{"127.0.0.1:51234", "198.51.100.1", "198.51.100.1"},
+		{"127.0.0.1:51234", "127.0.0.1, 198.51.100.1", "198.51.100.1"},
+		{"[::1]:51234", "198.51.100.1", "198.51.100.1"},
+		{"172.17.0.1:51234", "198.51.100.1", "172.17.0.1"},
+	}
+	for _, test := range tests {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.RemoteAddr = test.remoteAddr
+		r.Header.Set("X-Forwarded-For", test.forwardedFor)
+		if got := GetClientIP(r); got != test.want {
+			t.Errorf("GetClientIP(%s, X-Forwarded-For %q) = %s, want %s", test.remoteAddr, test.forwardedFor, got, test.want)
+		}
+	}
+
+	proxies, err = parseTrustedProxies(" 10.0.0.1, 172.16.0.0/12")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"127.0.0.0/8", "::1", "10.0.0.1", "172.16.0.0/12"}; !reflect.DeepEqual(proxies, want) {
+		t.Errorf("parseTrustedProxies = %v, want %v", proxies, want)
+	}
+	if _, err := parseTrustedProxies("10.0.0.1,proxy.local"); err == nil {
+		t.Errorf("parseTrustedProxies accepted a hostname")
+	}
+}
@@ -0,0 +1,204 @@
+package utils
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// Every save moves the previous text of a day into its history. The save time of a version is
+// kept encrypted in "saved_at" (RFC 3339), so the history can be thinned out with a retention policy:
+// all versions of the last KeepAllHours, then the newest version of each hour for KeepHourlyDays,
+// then the newest version of each day for KeepDailyDays (0 keeps them forever).
+// Versions without saved_at (saved before it existed) are always kept.
+//
+// Besides versions, the history holds events. A restore of a version is recorded as
+// {"event": "restore", "restored_from": N, "saved_at": ...}. Events have no text and no version
+// number, they are always kept.
+
+// HistoryRetention is the retention policy for the history of the days
+type HistoryRetention struct {
+	Enabled        bool
+	KeepAllHours   int
+	KeepHourlyDays int
+	KeepDailyDays  int
+}
+
+// HistoryCompactionProgress reports the progress of a history compaction
+type HistoryCompactionProgress struct {
+	ProcessedMonths int   `json:"processed_months"`
+	TotalMonths     int   `json:"total_months"`
+	RemovedVersions int   `json:"removed_versions"`
+	ReclaimedBytes  int64 `json:"reclaimed_bytes"`
+}
+
+// HistoryEventRestore is the event of a history entry that records the restore of a version
+const HistoryEventRestore = "restore"
+
+// IsHistoryEvent reports whether a history entry records an event instead of holding a version
+func IsHistoryEvent(entry map[string]any) bool {
+	_, ok := entry["event"]
+	return ok
+}
+
+// EncryptSavedAt encrypts a save time for the saved_at field of a day
+func EncryptSavedAt(t time.Time, encKey string) (string, error) {
+	return EncryptText(t.UTC().Format(time.RFC3339), encKey)
+}
+
+// pruneHistory returns the history entries to keep according to the policy
+func pruneHistory(history []any, policy HistoryRetention, encKey string, now time.Time) []any {
+	type version struct {
+		index   int
+		savedAt time.Time
+	}
+	var timed []version
+	keep := make([]bool, len(history))
+	for i, item := range history {
+		entry, ok := item.(map[string]any)
+		encryptedSavedAt, _ := entry["saved_at"].(string)
+		if !ok || encryptedSavedAt == "" || IsHistoryEvent(entry) {
+			keep[i] = true
+			continue
+		}
+		savedAt, err := DecryptText(encryptedSavedAt, encKey)
+		if err != nil {
+			keep[i] = true
+			continue
+		}
+		t, err := time.Parse(time.RFC3339, savedAt)
+		if err != nil {
+			keep[i] = true
+			continue
+		}
+		timed = append(timed, version{i, t})
+	}
+
+	// Newest first, so that the newest version of each bucket is kept (the later entry on equal times)
+	sort.Slice(timed, func(a, b int) bool {
+		if !timed[a].savedAt.Equal(timed[b].savedAt) {
+			return timed[a].savedAt.After(timed[b].savedAt)
+		}
+		return timed[a].index > timed[b].index
+	})
+
+	buckets := map[string]bool{}
+	for _, v := range timed {
+		age := now.Sub(v.savedAt)
+		var bucket string
+		switch {
+		case age < time.Duration(policy.KeepAllHours)*time.Hour:
+			keep[v.index] = true
+			continue
+		case age < time.Duration(policy.KeepHourlyDays)*24*time.Hour:
+			bucket = "hour " + v.savedAt.UTC().Truncate(time.Hour).Format(time.RFC3339)
+		case policy.KeepDailyDays == 0 || age < time.Duration(policy.KeepDailyDays)*24*time.Hour:
+			bucket = "day " + v.savedAt.UTC().Format(time.DateOnly)
+		default:
+			continue
+		}
+		if !buckets[bucket] {
+			buckets[bucket] = true
+			keep[v.index] = true
+		}
+	}
+
+	kept := make([]any, 0, len(history))
+	for i, item := range history {
+		if keep[i] {
+			kept = append(kept, item)
+		}
+	}
+	return kept
+}
+
+// CompactMonthHistory prunes the history of all days (and their entries) of a month.
+// Returns the number of removed versions and the bytes reclaimed in the month document.
+func CompactMonthHistory(userID, year, month int, policy HistoryRetention, encKey string, now time.Time) (int, int64, error) {
+	defer LockMonth(userID, year, month)()
+
+	content, err := GetMonth(userID, year, month)
+	if err != nil {
+		return 0, 0, err
+	}
+	before, err := encodeDocument(content, false)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	removed := 0
+	days, _ := content["days"].([]any)
+	for _, d := range days {
+		day, ok := d.(map[string]any)
+		if !ok {
+			continue
+		}
+		for _, part := range DayParts(day) {
+			history, ok := part["history"].([]any)
+			if !ok || len(history) == 0 {
+				continue
+			}
+			kept := pruneHistory(history, policy, encKey, now)
+			if len(kept) < len(history) {
+				removed += len(history) - len(kept)
+				part["history"] = kept
+			}
+		}
+	}
+	if removed == 0 {
+		return 0, 0, nil
+	}
+
+	after, err := encodeDocument(content, false)
+	if err != nil {
+		return 0, 0, err
+	}
+	if err := WriteMonth(userID, year, month, content); err != nil {
+		return 0, 0, err
+	}
+	return removed, int64(len(before) - len(after)), nil
+}
+
+// CompactUserHistory prunes the history of all months of a user and reports the progress after each month
+func CompactUserHistory(userID int, policy HistoryRetention, encKey string, now time.Time, report func(HistoryCompactionProgress)) (HistoryCompactionProgress, error) {
+	var progress HistoryCompactionProgress
+
+	type yearMonth struct{ year, month int }
+	var months []yearMonth
+	years, err := GetYears(userID)
+	if err != nil {
+		return progress, err
+	}
+	for _, year := range years {
+		yearMonths, err := GetMonths(userID, year)
+		if err != nil {
+			return progress, err
+		}
+		y, _ := strconv.Atoi(year)
+		for _, month := range yearMonths {
+			m, _ := strconv.Atoi(month)
+			months = append(months, yearMonth{y, m})
+		}
+	}
+	progress.TotalMonths = len(months)
+	report(progress)
+
+	var errs int
+	for _, ym := range months {
+		removed, reclaimed, err := CompactMonthHistory(userID, ym.year, ym.month, policy, encKey, now)
+		if err != nil {
+			Logger.Printf("History compaction of user %d, %d-%02d: %v", userID, ym.year, ym.month, err)
+			errs++
+		}
+		progress.RemovedVersions += removed
+		progress.ReclaimedBytes += reclaimed
+		progress.ProcessedMonths++
+		report(progress)
+	}
+
+	if errs > 0 {
+		return progress, fmt.Errorf("%d months could not be compacted", errs)
+	}
+	return progress, nil
+}
@@ -0,0 +1,108 @@
+package utils
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestPruneHistory(t *testing.T) {
+	key := testKey(t)
+	now := time.Date(2024, 5, 10, 12, 0, 0, 0, time.UTC)
+
+	// The history of a day, oldest first, with the labels of the entries
+	type historyEntry struct {
+		label   string
+		savedAt string // RFC 3339, "" for none
+		event   bool
+	}
+	entries := []historyEntry{
+		{label: "2023 restore", savedAt: "2023-01-01T10:00:00Z", event: true},
+		{label: "2023", savedAt: "2023-01-01T09:00:00Z"},
+		{label: "no saved_at"},
+		{label: "broken saved_at", savedAt: "broken"},
+		{label: "04-09 22:00", savedAt: "2024-04-09T22:00:00Z"},
+		{label: "04-09 23:00", savedAt: "2024-04-09T23:00:00Z"},
+		{label: "30 days", savedAt: "2024-04-10T12:00:00Z"},
+		{label: "30 days - 1s", savedAt: "2024-04-10T12:00:01Z"},
+		{label: "05-03 09:00", savedAt: "2024-05-03T09:00:00Z"},
+		{label: "7 days", savedAt: "2024-05-03T12:00:00Z"},
+		{label: "7 days - 30m", savedAt: "2024-05-03T12:30:00Z"},
+		{label: "05-09 10:59:59", savedAt: "2024-05-09T10:59:59Z"},
+		{label: "05-09 11:00", savedAt: "2024-05-09T11:00:00Z"},
+		{label: "05-09 11:40", savedAt: "2024-05-09T11:40:00Z"},
+		{label: "24 hours", savedAt: "2024-05-09T12:00:00Z"},
+		{label: "24 hours - 1m", savedAt: "2024-05-09T12:01:00Z"},
+		{label: "30 minutes", savedAt: "2024-05-10T11:30:00Z"},
+		{label: "30 minutes again", savedAt: "2024-05-10T11:30:00Z"},
+	}
+
+	history := make([]any, 0, len(entries))
+	for i, e := range entries {
+		entry := map[string]any{"version": i + 1, "text": "enc:" + e.label, "label": e.label}
+		if e.event {
+			entry = map[string]any{"event": HistoryEventRestore, "restored_from": 1, "label": e.label}
+		}
+		switch {
+		case e.savedAt == "broken":
+			entry["saved_at"] = "not encrypted"
+		case e.savedAt != "":
+			savedAt, err := time.Parse(time.RFC3339, e.savedAt)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if entry["saved_at"], err = EncryptSavedAt(savedAt, key); err != nil {
+				t.Fatal(err)
+			}
+		}
+		history = append(history, entry)
+	}
+	keptLabels := func(kept []any) []string {
+		result := []string{}
+		for _, entry := range kept {
+			result = append(result, entry.(map[string]any)["label"].(string))
+		}
+		return result
+	}
+
+	// Entries without a usable save time and events are always kept
+	always := []string{"2023 restore", "no saved_at", "broken saved_at"}
+	tests := []struct {
+		name   string
+		policy HistoryRetention
+		want   []string
+	}{
+		{
+			"24 hours, hourly for 7 days, daily for 30 days",
+			HistoryRetention{Enabled: true, KeepAllHours: 24, KeepHourlyDays: 7, KeepDailyDays: 30},
+			append(always, "30 days - 1s", "7 days", "7 days - 30m", "05-09 10:59:59", "05-09 11:40",
+				"24 hours", "24 hours - 1m", "30 minutes", "30 minutes again"),
+		},
+		{
+			"daily versions forever",
+			HistoryRetention{Enabled: true, KeepAllHours: 24, KeepHourlyDays: 7, KeepDailyDays: 0},
+			append([]string{"2023 restore", "2023", "no saved_at", "broken saved_at"}, "04-09 23:00", "30 days - 1s",
+				"7 days", "7 days - 30m", "05-09 10:59:59", "05-09 11:40", "24 hours", "24 hours - 1m",
+				"30 minutes", "30 minutes again"),
+		},
+		{
+			"only the newest version of each hour",
+			HistoryRetention{Enabled: true, KeepAllHours: 0, KeepHourlyDays: 7, KeepDailyDays: 30},
+			append(always, "30 days - 1s", "7 days", "7 days - 30m", "05-09 10:59:59", "05-09 11:40",
+				"24 hours - 1m", "30 minutes again"),
+		},
+		{
+			"the last hour and a day",
+			HistoryRetention{Enabled: true, KeepAllHours: 1, KeepHourlyDays: 0, KeepDailyDays: 1},
+			append(always, "24 hours - 1m", "30 minutes", "30 minutes again"),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := keptLabels(pruneHistory(history, tt.policy, key, now))
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("kept %q\nwant %q", got, tt.want)
+			}
+		})
+	}
+}
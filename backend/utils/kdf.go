@@ -0,0 +1,245 @@
+package utils
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+)
+
+// KDFParams are the Argon2id parameters used for password hashes and derived keys
+type KDFParams struct {
+	Time      uint32
+	MemoryKiB uint32
+	Threads   uint8
+}
+
+// legacyKDFParams were used for all derived keys before the parameters became configurable.
+// Users without a "kdf" entry in users.json (and backup codes without one) use them.
+var legacyKDFParams = KDFParams{Time: 3, MemoryKiB: 64 * 1024, Threads: 4}
+
+// legacyPasswordHashParams were used for all password hashes before the parameters became configurable.
+// New password hashes never fall below them, see PasswordHashParams.
+var legacyPasswordHashParams = KDFParams{Time: 5, MemoryKiB: 64 * 1024}
+
+// CurrentKDFParams returns the configured parameters (ARGON2_TIME, ARGON2_MEMORY_KIB, ARGON2_THREADS)
+func CurrentKDFParams() KDFParams {
+	return KDFParams{
+		Time:      uint32(Settings.Argon2Time),
+		MemoryKiB: uint32(Settings.Argon2MemoryKiB),
+		Threads:   uint8(Settings.Argon2Threads),
+	}
+}
+
+// WeakerThan reports whether p costs less time or memory than other.
+// The threads don't change the cost of an attack, so they are not compared.
+func (p KDFParams) WeakerThan(other KDFParams) bool {
+	return p.Time < other.Time || p.MemoryKiB < other.MemoryKiB
+}
+
+// atLeast returns p with the time and memory raised to those of other, where they are lower
+func (p KDFParams) atLeast(other KDFParams) KDFParams {
+	p.Time = max(p.Time, other.Time)
+	p.MemoryKiB = max(p.MemoryKiB, other.MemoryKiB)
+	return p
+}
+
+// PasswordHashParams returns the parameters of a new password hash: the configured ones, but never weaker
+// than the password hashes before the parameters became configurable, or than previousHash, the hash that
+// is replaced (if any)
+func PasswordHashParams(previousHash string) KDFParams {
+	params := CurrentKDFParams().atLeast(legacyPasswordHashParams)
+	if config, err := parseArgon2Hash(previousHash); err == nil {
+		params = params.atLeast(KDFParams{Time: config.TimeCost, MemoryKiB: config.MemoryCost})
+	}
+	return params
+}
+
+// ToMap returns the parameters as they are stored in users.json
+func (p KDFParams) ToMap() map[string]any {
+	return map[string]any{
+		"t": p.Time,
+		"m": p.MemoryKiB,
+		"p": p.Threads,
+	}
+}
+
+// KDFParamsOf returns the parameters stored in the "kdf" entry of a user or backup code
+func KDFParamsOf(entry map[string]any) KDFParams {
+	kdf, ok := entry["kdf"].(map[string]any)
+	if !ok {
+		return legacyKDFParams
+	}
+
+	params := legacyKDFParams
+	if t, ok := kdf["t"].(float64); ok && t > 0 {
+		params.Time = uint32(t)
+	}
+	if m, ok := kdf["m"].(float64); ok && m > 0 {
+		params.MemoryKiB = uint32(m)
+	}
+	if p, ok := kdf["p"].(float64); ok && p > 0 {
+		params.Threads = uint8(p)
+	}
+	return params
+}
+
+// wrapEncryptionKey encrypts the encryption key of a user with a derived key (the format of "enc_enc_key")
+func wrapEncryptionKey(encKey, derivedKey []byte) (string, error) {
+	aead, err := CreateAEAD(derivedKey)
+	if err != nil {
+		return "", fmt.Errorf("error creating cipher: %v", err)
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", fmt.Errorf("error generating nonce: %v", err)
+	}
+	return base64.StdEncoding.EncodeToString(aead.Seal(nonce, nonce, encKey, nil)), nil
+}
+
+// unwrapEncryptionKey decrypts an "enc_enc_key" with a derived key
+func unwrapEncryptionKey(encEncKey string, derivedKey []byte) ([]byte, error) {
+	aead, err := CreateAEAD(derivedKey)
+	if err != nil {
+		return nil, fmt.Errorf("error creating cipher: %v", err)
+	}
+
+	encEncKeyBytes, err := base64.StdEncoding.DecodeString(encEncKey)
+	if err != nil {
+		return nil, fmt.Errorf("error decoding encrypted key: %v", err)
+	}
+	if len(encEncKeyBytes) < aead.NonceSize() {
+		return nil, fmt.Errorf("encrypted key too short")
+	}
+	nonce, encKeyBytes := encEncKeyBytes[:aead.NonceSize()], encEncKeyBytes[aead.NonceSize():]
+
+	keyBytes, err := aead.Open(nil, nonce, encKeyBytes, nil)
+	if err != nil {
+		return nil, fmt.Errorf("error decrypting key: %v", err)
+	}
+	return keyBytes, nil
+}
+
+// UnwrapEncryptionKey decrypts the encryption key of a user (an entry of users.json) with a derived key
+func UnwrapEncryptionKey(user map[string]any, derivedKey string) ([]byte, error) {
+	encEncKey, ok := user["enc_enc_key"].(string)
+	if !ok {
+		return nil, fmt.Errorf("user data is not in the correct format")
+	}
+
+	derivedKeyBytes, err := base64.StdEncoding.DecodeString(derivedKey)
+	if err != nil {
+		return nil, fmt.Errorf("error decoding derived key: %v", err)
+	}
+
+	return unwrapEncryptionKey(encEncKey, derivedKeyBytes)
+}
+
+// passwordHashWeak reports whether the password hash of a user was made with weaker parameters than a new one
+func passwordHashWeak(user map[string]any) bool {
+	passwordHash, _ := user["password"].(string)
+	config, err := parseArgon2Hash(passwordHash)
+	if err != nil {
+		return false
+	}
+	hashParams := KDFParams{Time: config.TimeCost, MemoryKiB: config.MemoryCost, Threads: config.Threads}
+	return hashParams.WeakerThan(PasswordHashParams(""))
+}
+
+// kdfUpgradeBlocker returns what still holds the derived key of a user and can't be re-wrapped
+// without a secret the server doesn't know. Empty if the derived key can be replaced.
+func kdfUpgradeBlocker(user map[string]any) string {
+	if codes, ok := user["backup_codes"].([]any); ok && len(codes) > 0 {
+		return "backup codes"
+	}
+	if _, ok := user["share_token_hash"]; ok {
+		return "share link"
+	}
+	if _, ok := user["key_rotation"]; ok {
+		return "unfinished key rotation"
+	}
+	return ""
+}
+
+// UpgradeUserKDF upgrades the password hash and the derived key of a user, if they were made with weaker than
+// the current parameters. Called on login with the (already verified) password. Returns the derived key to use
+// from now on.
+//
+// The derived key is replaced and the encryption key re-wrapped with the new one, the old derived key is dropped.
+// Sessions still hold the old derived key, so all sessions of the user end. Backup codes and the share link hold
+// it as well, but they can only be re-wrapped with their own secrets. For users with either, the derived key
+// is only upgraded by the next key rotation, which issues both again.
+func UpgradeUserKDF(userID int, password, derivedKey string) (string, error) {
+	UsersFileMutex.Lock()
+	defer UsersFileMutex.Unlock()
+
+	users, err := GetUsers()
+	if err != nil {
+		return derivedKey, fmt.Errorf("error getting users: %v", err)
+	}
+	user, err := findUser(users, userID)
+	if err != nil {
+		return derivedKey, err
+	}
+
+	params := CurrentKDFParams()
+	upgradeHash := passwordHashWeak(user)
+	upgradeKey := KDFParamsOf(user).WeakerThan(params)
+	if blocker := kdfUpgradeBlocker(user); upgradeKey && blocker != "" {
+		Logger.Printf("Argon2 parameters of the derived key of user %d are upgraded with the next key rotation (%s)", userID, blocker)
+		upgradeKey = false
+	}
+	if !upgradeHash && !upgradeKey {
+		return derivedKey, nil
+	}
+
+	if upgradeHash {
+		previousHash, _ := user["password"].(string)
+		hash, err := HashPassword(password, previousHash)
+		if err != nil {
+			return derivedKey, fmt.Errorf("error hashing password: %v", err)
+		}
+		user["password"] = hash
+	}
+
+	newDerivedKey := derivedKey
+	if upgradeKey {
+		encKey, err := UnwrapEncryptionKey(user, derivedKey)
+		if err != nil {
+			return derivedKey, err
+		}
+
+		salt := make([]byte, 16)
+		if _, err := rand.Read(salt); err != nil {
+			return derivedKey, fmt.Errorf("error generating salt: %v", err)
+		}
+		saltBase64 := base64.StdEncoding.EncodeToString(salt)
+
+		newDerivedKeyBytes, err := DeriveKeyFromPassword(password, saltBase64, params)
+		if err != nil {
+			return derivedKey, fmt.Errorf("error deriving key from password: %v", err)
+		}
+		encEncKey, err := wrapEncryptionKey(encKey, newDerivedKeyBytes)
+		if err != nil {
+			return derivedKey, err
+		}
+
+		user["salt"] = saltBase64
+		user["kdf"] = params.ToMap()
+		user["enc_enc_key"] = encEncKey
+		newDerivedKey = base64.StdEncoding.EncodeToString(newDerivedKeyBytes)
+	}
+
+	if err := WriteUsers(users); err != nil {
+		return derivedKey, err
+	}
+
+	// The sessions hold the old derived key
+	if upgradeKey {
+		if err := DeleteUserSessions(userID); err != nil {
+			Logger.Printf("Error ending the sessions of user %d after the Argon2 upgrade: %v", userID, err)
+		}
+	}
+	Logger.Printf("Upgraded Argon2 parameters of user %d (password hash: %t, derived key: %t)", userID, upgradeHash, upgradeKey)
+
+	return newDerivedKey, nil
+}
@@ -0,0 +1,46 @@
+package utils
+
+import (
+	"strings"
+	"testing"
+)
+
+// Password hashes keep the strength they had before the parameters became configurable (t=5)
+// and never get weaker than the hash they replace
+func TestPasswordHashParams(t *testing.T) {
+	saved := Settings
+	defer func() { Settings = saved }()
+	Settings.Argon2Time = 3
+	Settings.Argon2MemoryKiB = 64 * 1024
+	Settings.Argon2Threads = 4
+
+	strongHash := "$argon2id$v=19$m=131072,t=7,p=4$c2FsdHNhbHRzYWx0c2FsdA$aGFzaGhhc2hoYXNoaGFzaGhhc2hoYXNoaGFzaGhhc2g"
+	tests := []struct {
+		name         string
+		time, memory int
+		previousHash string
+		want         KDFParams
+	}{
+		{"defaults", 3, 64 * 1024, "", KDFParams{Time: 5, MemoryKiB: 64 * 1024, Threads: 4}},
+		{"lowered", 1, 1024, "", KDFParams{Time: 5, MemoryKiB: 64 * 1024, Threads: 4}},
+		{"raised", 8, 256 * 1024, "", KDFParams{Time: 8, MemoryKiB: 256 * 1024, Threads: 4}},
+		{"stronger previous hash", 3, 64 * 1024, strongHash, KDFParams{Time: 7, MemoryKiB: 128 * 1024, Threads: 4}},
+		{"broken previous hash", 3, 64 * 1024, "plain", KDFParams{Time: 5, MemoryKiB: 64 * 1024, Threads: 4}},
+	}
+	for _, tt := range tests {
+		Settings.Argon2Time = tt.time
+		Settings.Argon2MemoryKiB = tt.memory
+		if got := PasswordHashParams(tt.previousHash); got != tt.want {
+			t.Errorf("%s: PasswordHashParams = %+v, want %+v", tt.name, got, tt.want)
+		}
+	}
+
+	// A hash with the old parameters is not weak, one made while new hashes used t=3 is
+	Settings.Argon2Time = 3
+	if passwordHashWeak(map[string]any{"password": strings.Replace(strongHash, "m=131072,t=7", "m=65536,t=5", 1)}) {
+		t.Errorf("a hash with t=5 is weak")
+	}
+	if !passwordHashWeak(map[string]any{"password": strings.Replace(strongHash, "m=131072,t=7", "m=65536,t=3", 1)}) {
+		t.Errorf("a hash with t=3 is not weak")
+	}
+}
@@ -0,0 +1,623 @@
+package utils
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io/fs"
+	"strconv"
+	"sync"
+)
+
+// Rotation of the encryption key of a user.
+//
+// When the rotation starts, the new key replaces the old one in "enc_enc_key" right away (wrapped with a
+// new derived key) and the old key is kept in "key_rotation", encrypted with the new key. All new data is
+// encrypted with the new key, data that isn't rotated yet is still decrypted with the old key (see
+// keyFallbacks). The data is then re-encrypted item by item in the background. Every item that already
+// decrypts with the new key is skipped, so an interrupted rotation (e.g. by a restart) simply starts over.
+// When all items are rotated, "key_rotation" is removed and the old key is gone.
+
+// ErrKeyRotationPending is returned when a rotation is started while the last one isn't finished
+var ErrKeyRotationPending = errors.New("key rotation not finished yet")
+
+// keyFallbacks maps the new encryption key of a user to the old one while the key is rotated
+var keyFallbacks sync.Map
+
+// KeyRotation holds what is issued when a rotation starts
+type KeyRotation struct {
+	DerivedKey  string   // new derived key for the session
+	OldKey      string   // old encryption key
+	NewKey      string   // new encryption key
+	BackupCodes []string // new backup codes, nil if the user had none
+	ShareToken  string   // new share token, empty if the user had none
+}
+
+// registerKeyFallback makes the old key of a running rotation available for decryption
+func registerKeyFallback(user map[string]any, encKey string) {
+	rotation, ok := user["key_rotation"].(map[string]any)
+	if !ok {
+		return
+	}
+	encOldKey, ok := rotation["enc_old_key"].(string)
+	if !ok {
+		return
+	}
+	oldKey, err := decryptText(encOldKey, encKey)
+	if err != nil {
+		return
+	}
+	keyFallbacks.Store(encKey, oldKey)
+}
+
+// StartKeyRotation replaces the encryption key of a user by a new one. The derived key changes as well, so the
+// old derived key (held by sessions, backup codes and the share token) becomes worthless. Backup codes and the
+// share token are issued again, if the user had them. The TOTP secret is re-encrypted right away, all other data
+// has to be re-encrypted with RotateUserData afterwards.
+func StartKeyRotation(userID int, password, derivedKey string) (*KeyRotation, error) {
+	UsersFileMutex.Lock()
+	defer UsersFileMutex.Unlock()
+
+	users, err := GetUsers()
+	if err != nil {
+		return nil, fmt.Errorf("error getting users: %v", err)
+	}
+	user, err := findUser(users, userID)
+	if err != nil {
+		return nil, err
+	}
+	if _, pending := user["key_rotation"]; pending {
+		return nil, ErrKeyRotationPending
+	}
+
+	oldKeyBytes, err := UnwrapEncryptionKey(user, derivedKey)
+	if err != nil {
+		return nil, err
+	}
+	oldKey := base64.URLEncoding.EncodeToString(oldKeyBytes)
+
+	// New encryption key
+	newKeyBytes := make([]byte, 32)
+	if _, err := rand.Read(newKeyBytes); err != nil {
+		return nil, fmt.Errorf("error generating encryption key: %v", err)
+	}
+	newKey := base64.URLEncoding.EncodeToString(newKeyBytes)
+
+	// New derived key
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, fmt.Errorf("error generating salt: %v", err)
+	}
+	saltBase64 := base64.StdEncoding.EncodeToString(salt)
+	kdfParams := CurrentKDFParams()
+	newDerivedKeyBytes, err := DeriveKeyFromPassword(password, saltBase64, kdfParams)
+	if err != nil {
+		return nil, fmt.Errorf("error deriving key from password: %v", err)
+	}
+	newDerivedKey := base64.StdEncoding.EncodeToString(newDerivedKeyBytes)
+
+	encEncKey, err := wrapEncryptionKey(newKeyBytes, newDerivedKeyBytes)
+	if err != nil {
+		return nil, err
+	}
+	encOldKey, err := EncryptText(oldKey, newKey)
+	if err != nil {
+		return nil, fmt.Errorf("error encrypting old key: %v", err)
+	}
+
+	rotation := &KeyRotation{
+		DerivedKey: newDerivedKey,
+		OldKey:     oldKey,
+		NewKey:     newKey,
+	}
+
+	// TOTP secrets
+	for _, field := range []string{"totp", "totp_pending"} {
+		var encSecret string
+		var totp map[string]any
+		switch value := user[field].(type) {
+		case map[string]any:
+			totp = value
+			encSecret, _ = value["enc_secret"].(string)
+		case string:
+			encSecret = value
+		default:
+			continue
+		}
+		secret, err := decryptText(encSecret, oldKey)
+		if err != nil {
+			return nil, fmt.Errorf("error decrypting TOTP secret: %v", err)
+		}
+		if encSecret, err = EncryptText(secret, newKey); err != nil {
+			return nil, fmt.Errorf("error encrypting TOTP secret: %v", err)
+		}
+		if totp != nil {
+			totp["enc_secret"] = encSecret
+		} else {
+			user[field] = encSecret
+		}
+	}
+
+	// Backup codes hold the old derived key
+	if codes, ok := user["backup_codes"].([]any); ok && len(codes) > 0 {
+		backupCodes, codeData, err := GenerateBackupCodes(newDerivedKey)
+		if err != nil {
+			return nil, err
+		}
+		user["backup_codes"] = codeData
+		rotation.BackupCodes = backupCodes
+	}
+
+	// So does the share token
+	if _, ok := user["share_token_hash"]; ok {
+		token, tokenHash, encDerivedKey, err := NewShareToken(newDerivedKey)
+		if err != nil {
+			return nil, fmt.Errorf("error generating share token: %v", err)
+		}
+		user["share_token_hash"] = tokenHash
+		user["share_enc_derived_key"] = encDerivedKey
+		rotation.ShareToken = token
+	}
+
+	// Finish an Argon2 upgrade that was postponed because of the backup codes or the share token
+	if passwordHashWeak(user) {
+		previousHash, _ := user["password"].(string)
+		hash, err := HashPassword(password, previousHash)
+		if err != nil {
+			return nil, fmt.Errorf("error hashing password: %v", err)
+		}
+		user["password"] = hash
+	}
+
+	user["salt"] = saltBase64
+	user["kdf"] = kdfParams.ToMap()
+	user["enc_enc_key"] = encEncKey
+	user["key_rotation"] = map[string]any{
+		"enc_old_key": encOldKey,
+	}
+
+	if err := WriteUsers(users); err != nil {
+		return nil, err
+	}
+
+	keyFallbacks.Store(newKey, oldKey)
+
+	return rotation, nil
+}
+
+// PendingKeyRotation returns the old and new encryption key of an unfinished rotation.
+// Returns empty keys if no rotation is pending.
+func PendingKeyRotation(userID int, derivedKey string) (string, string, error) {
+	UsersFileMutex.RLock()
+	defer UsersFileMutex.RUnlock()
+
+	users, err := GetUsers()
+	if err != nil {
+		return "", "", fmt.Errorf("error getting users: %v", err)
+	}
+	user, err := findUser(users, userID)
+	if err != nil {
+		return "", "", err
+	}
+
+	rotation, ok := user["key_rotation"].(map[string]any)
+	if !ok {
+		return "", "", nil
+	}
+	encOldKey, _ := rotation["enc_old_key"].(string)
+
+	newKeyBytes, err := UnwrapEncryptionKey(user, derivedKey)
+	if err != nil {
+		return "", "", err
+	}
+	newKey := base64.URLEncoding.EncodeToString(newKeyBytes)
+
+	oldKey, err := decryptText(encOldKey, newKey)
+	if err != nil {
+		return "", "", fmt.Errorf("error decrypting old key: %v", err)
+	}
+
+	return oldKey, newKey, nil
+}
+
+// finishKeyRotation forgets the old key of a user
+func finishKeyRotation(userID int, newKey string) error {
+	UsersFileMutex.Lock()
+	defer UsersFileMutex.Unlock()
+
+	users, err := GetUsers()
+	if err != nil {
+		return fmt.Errorf("error getting users: %v", err)
+	}
+	user, err := findUser(users, userID)
+	if err != nil {
+		return err
+	}
+
+	delete(user, "key_rotation")
+	if err := WriteUsers(users); err != nil {
+		return err
+	}
+
+	keyFallbacks.Delete(newKey)
+	return nil
+}
+
+// rotateText re-encrypts a text that is still encrypted with oldKey.
+// Returns whether the text was changed.
+func rotateText(container map[string]any, field, oldKey, newKey string) (bool, error) {
+	ciphertext, ok := container[field].(string)
+	if !ok || ciphertext == "" {
+		return false, nil
+	}
+	if _, err := decryptText(ciphertext, newKey); err == nil {
+		return false, nil
+	}
+
+	plaintext, err := decryptText(ciphertext, oldKey)
+	if err != nil {
+		return false, fmt.Errorf("%s can't be decrypted with the old or the new key", field)
+	}
+	if container[field], err = EncryptText(plaintext, newKey); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// rotateTexts re-encrypts several fields, see rotateText
+func rotateTexts(container map[string]any, oldKey, newKey string, fields ...string) (bool, error) {
+	changed := false
+	for _, field := range fields {
+		fieldChanged, err := rotateText(container, field, oldKey, newKey)
+		if err != nil {
+			return changed, err
+		}
+		changed = changed || fieldChanged
+	}
+	return changed, nil
+}
+
+// rotateBlob re-encrypts an uploaded file that is still encrypted with oldKey.
+// The file is streamed, so large files are never held in memory.
+func rotateBlob(userID int, uuid, oldKey, newKey string) error {
+	plaintext, _, err := openDecryptedFile(userID, uuid, newKey)
+	if err == nil {
+		plaintext.Close()
+		return nil
+	}
+	if errors.Is(err, fs.ErrNotExist) {
+		// Missing files are reported by fsck
+		return nil
+	}
+
+	plaintext, size, err := openDecryptedFile(userID, uuid, oldKey)
+	if err != nil {
+		return fmt.Errorf("file %s can't be decrypted with the old or the new key", uuid)
+	}
+	defer plaintext.Close()
+
+	encrypter, err := NewEncryptingReader(plaintext, newKey)
+	if err != nil {
+		return err
+	}
+	return Store.WriteBlobFrom(userID, uuid, encrypter, StreamCiphertextSize(size))
+}
+
+// rotateDay re-encrypts a day or an entry of a day (text, history, files and entries) and its uploaded files.
+// The caller holds the lock of the document the day belongs to.
+func rotateDay(userID int, day map[string]any, oldKey, newKey string) (bool, int, []error) {
+	var errs []error
+	files := 0
+
+	changed, err := rotateTexts(day, oldKey, newKey, "time", "text", "date_written", "saved_at")
+	if err != nil {
+		errs = append(errs, err)
+	}
+
+	history, _ := day["history"].([]any)
+	for _, h := range history {
+		version, ok := h.(map[string]any)
+		if !ok {
+			continue
+		}
+		versionChanged, err := rotateTexts(version, oldKey, newKey, "text", "date_written", "saved_at")
+		changed = changed || versionChanged
+		if err != nil {
+			errs = append(errs, fmt.Errorf("history: %v", err))
+		}
+	}
+
+	dayFiles, _ := day["files"].([]any)
+	for _, f := range dayFiles {
+		file, ok := f.(map[string]any)
+		if !ok {
+			continue
+		}
+		fileChanged, fileErrs := rotateFileEntry(userID, file, oldKey, newKey)
+		changed = changed || fileChanged
+		errs = append(errs, fileErrs...)
+		files++
+	}
+
+	// The entries of a day have the same fields, plus their time
+	for _, entry := range DayEntries(day) {
+		entryChanged, entryFiles, entryErrs := rotateDay(userID, entry, oldKey, newKey)
+		changed = changed || entryChanged
+		files += entryFiles
+		for _, err := range entryErrs {
+			errs = append(errs, fmt.Errorf("entry %v: %v", entry["id"], err))
+		}
+	}
+
+	return changed, files, errs
+}
+
+// rotateFileEntry re-encrypts the filename of a file entry and the uploaded file itself.
+// The caller holds the lock of the document, so the file can't be deleted meanwhile.
+func rotateFileEntry(userID int, file map[string]any, oldKey, newKey string) (bool, []error) {
+	var errs []error
+	changed, err := rotateText(file, "enc_filename", oldKey, newKey)
+	if err != nil {
+		errs = append(errs, err)
+	}
+	if uuid, ok := file["uuid_filename"].(string); ok && uuid != "" {
+		if err := rotateBlob(userID, uuid, oldKey, newKey); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return changed, errs
+}
+
+// rotateMonth re-encrypts a month with its history and uploaded files.
+// Returns the number of rotated files and the errors.
+func rotateMonth(userID, year, month int, oldKey, newKey string) (int, []error) {
+	defer LockMonth(userID, year, month)()
+
+	content, err := GetMonth(userID, year, month)
+	if err != nil {
+		return 0, []error{err}
+	}
+
+	var errs []error
+	changed := false
+	files := 0
+
+	days, _ := content["days"].([]any)
+	for _, d := range days {
+		day, ok := d.(map[string]any)
+		if !ok {
+			continue
+		}
+
+		dayChanged, dayFiles, dayErrs := rotateDay(userID, day, oldKey, newKey)
+		changed = changed || dayChanged
+		files += dayFiles
+		for _, err := range dayErrs {
+			errs = append(errs, fmt.Errorf("%d-%02d day %v: %v", year, month, day["day"], err))
+		}
+	}
+
+	if changed {
+		if err := WriteMonth(userID, year, month, content); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	return files, errs
+}
+
+// rotateTrash re-encrypts the deleted days and files of a user
+func rotateTrash(userID int, oldKey, newKey string) []error {
+	defer LockTrash(userID)()
+
+	content, err := GetTrash(userID)
+	if err != nil {
+		return []error{err}
+	}
+
+	var errs []error
+	changed := false
+	for _, item := range TrashItems(content) {
+		entry, ok := item["entry"].(map[string]any)
+		if !ok {
+			continue
+		}
+
+		var itemChanged bool
+		var itemErrs []error
+		if itemType, _ := item["type"].(string); itemType == TrashFile {
+			itemChanged, itemErrs = rotateFileEntry(userID, entry, oldKey, newKey)
+		} else {
+			itemChanged, _, itemErrs = rotateDay(userID, entry, oldKey, newKey)
+		}
+		changed = changed || itemChanged
+		for _, err := range itemErrs {
+			errs = append(errs, fmt.Errorf("trash item %v: %v", item["id"], err))
+		}
+	}
+
+	if changed {
+		if err := WriteTrash(userID, content); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	return errs
+}
+
+// rotateTags re-encrypts the tags of a user
+func rotateTags(userID int, oldKey, newKey string) []error {
+	defer LockTags(userID)()
+
+	content, err := GetTags(userID)
+	if err != nil {
+		return []error{err}
+	}
+
+	var errs []error
+	changed := false
+	tags, _ := content["tags"].([]any)
+	for _, t := range tags {
+		tag, ok := t.(map[string]any)
+		if !ok {
+			continue
+		}
+		tagChanged, err := rotateTexts(tag, oldKey, newKey, "icon", "name", "color")
+		changed = changed || tagChanged
+		if err != nil {
+			errs = append(errs, fmt.Errorf("tag %v: %v", tag["id"], err))
+		}
+	}
+
+	if changed {
+		if err := WriteTags(userID, content); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errs
+}
+
+// rotateTemplates re-encrypts the templates of a user
+func rotateTemplates(userID int, oldKey, newKey string) []error {
+	defer LockTemplates(userID)()
+
+	content, err := GetTemplates(userID)
+	if err != nil {
+		return []error{err}
+	}
+
+	var errs []error
+	changed := false
+	templates, _ := content["templates"].([]any)
+	for i, t := range templates {
+		template, ok := t.(map[string]any)
+		if !ok {
+			continue
+		}
+		templateChanged, err := rotateTexts(template, oldKey, newKey, "name", "text")
+		changed = changed || templateChanged
+		if err != nil {
+			errs = append(errs, fmt.Errorf("template %d: %v", i, err))
+		}
+	}
+
+	if changed {
+		if err := WriteTemplates(userID, content); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errs
+}
+
+// rotateSettings re-encrypts the settings of a user
+func rotateSettings(userID int, oldKey, newKey string) error {
+	defer LockSettings(userID)()
+
+	encryptedSettings, err := GetUserSettings(userID)
+	if err != nil {
+		return err
+	}
+
+	settings := map[string]any{"settings": encryptedSettings}
+	changed, err := rotateText(settings, "settings", oldKey, newKey)
+	if err != nil || !changed {
+		return err
+	}
+	return WriteUserSettings(userID, settings["settings"].(string))
+}
+
+// RotateUserData re-encrypts all data of a user from oldKey to newKey and reports the progress like MigrateUserData.
+// When everything is rotated, the old key is dropped. Otherwise the rotation stays pending and can be run again.
+func RotateUserData(userID int, oldKey, newKey string, progressChan chan<- MigrationProgress) error {
+	progress := MigrationProgress{Phase: "counting"}
+	report := func() {
+		if progressChan != nil {
+			progressChan <- progress
+		}
+	}
+	report()
+
+	// Collect the months first, to know the total
+	type yearMonth struct{ year, month int }
+	var months []yearMonth
+	years, err := GetYears(userID)
+	if err != nil {
+		return err
+	}
+	for _, year := range years {
+		yearMonths, err := GetMonths(userID, year)
+		if err != nil {
+			return err
+		}
+		y, _ := strconv.Atoi(year)
+		for _, month := range yearMonths {
+			m, _ := strconv.Atoi(month)
+			months = append(months, yearMonth{y, m})
+		}
+	}
+
+	// tags, templates, settings, trash and the months
+	progress.TotalItems = 4 + len(months)
+
+	logErrors := func(errs ...error) {
+		for _, err := range errs {
+			if err != nil {
+				Logger.Printf("Key rotation of user %d: %v", userID, err)
+				progress.ErrorCount++
+			}
+		}
+	}
+
+	progress.Phase = "rotating_tags"
+	report()
+	logErrors(rotateTags(userID, oldKey, newKey)...)
+	progress.ProcessedItems++
+
+	progress.Phase = "rotating_templates"
+	report()
+	logErrors(rotateTemplates(userID, oldKey, newKey)...)
+	progress.ProcessedItems++
+
+	progress.Phase = "rotating_settings"
+	report()
+	logErrors(rotateSettings(userID, oldKey, newKey))
+	progress.ProcessedItems++
+
+	// Before the months, so that a day restored meanwhile is already re-encrypted
+	progress.Phase = "rotating_trash"
+	report()
+	logErrors(rotateTrash(userID, oldKey, newKey)...)
+	progress.ProcessedItems++
+
+	progress.Phase = "rotating_logs"
+	report()
+	files := 0
+	for _, ym := range months {
+		monthFiles, errs := rotateMonth(userID, ym.year, ym.month, oldKey, newKey)
+		logErrors(errs...)
+		files += monthFiles
+		progress.ProcessedItems++
+		report()
+	}
+
+	// The search index is rebuilt from the rotated months by the next search
+	logErrors(InvalidateSearchIndex(userID))
+
+	if progress.ErrorCount > 0 {
+		progress.Phase = "failed"
+		report()
+		return fmt.Errorf("%d items could not be rotated, the old key is kept", progress.ErrorCount)
+	}
+
+	if err := finishKeyRotation(userID, newKey); err != nil {
+		return err
+	}
+
+	Logger.Printf("Key rotation of user %d finished (%d months, %d files)", userID, len(months), files)
+
+	progress.Phase = "completed"
+	progress.ProcessedItems = progress.TotalItems
+	report()
+	return nil
+}
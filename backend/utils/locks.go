@@ -0,0 +1,79 @@
+package utils
+
+import (
+	"fmt"
+	"sync"
+)
+
+// KeyedMutex hands out one mutex per key, so that unrelated keys never block each other
+type KeyedMutex struct {
+	mu    sync.Mutex
+	locks map[string]*keyedLock
+}
+
+type keyedLock struct {
+	mu   sync.Mutex
+	refs int
+}
+
+// Lock locks the mutex for key and returns the function that unlocks it again
+func (k *KeyedMutex) Lock(key string) func() {
+	k.mu.Lock()
+	if k.locks == nil {
+		k.locks = map[string]*keyedLock{}
+	}
+	lock, ok := k.locks[key]
+	if !ok {
+		lock = &keyedLock{}
+		k.locks[key] = lock
+	}
+	lock.refs++
+	k.mu.Unlock()
+
+	lock.mu.Lock()
+
+	return func() {
+		lock.mu.Unlock()
+
+		// Drop the entry once nobody holds or waits for it
+		k.mu.Lock()
+		lock.refs--
+		if lock.refs == 0 {
+			delete(k.locks, key)
+		}
+		k.mu.Unlock()
+	}
+}
+
+// dataLocks guards the read-modify-write cycles on the user's data files
+var dataLocks KeyedMutex
+
+// LockMonth locks the month file of a user. Usage: defer utils.LockMonth(userID, year, month)()
+func LockMonth(userID, year, month int) func() {
+	return dataLocks.Lock(fmt.Sprintf("%d/month/%d/%02d", userID, year, month))
+}
+
+// LockTags locks the tags of a user
+func LockTags(userID int) func() {
+	return dataLocks.Lock(fmt.Sprintf("%d/tags", userID))
+}
+
+// LockTemplates locks the templates of a user
+func LockTemplates(userID int) func() {
+	return dataLocks.Lock(fmt.Sprintf("%d/templates", userID))
+}
+
+// LockSettings locks the settings of a user
+func LockSettings(userID int) func() {
+	return dataLocks.Lock(fmt.Sprintf("%d/settings", userID))
+}
+
+// LockTrash locks the trash of a user
+func LockTrash(userID int) func() {
+	return dataLocks.Lock(fmt.Sprintf("%d/trash", userID))
+}
+
+// LockSearchIndex locks the search index of a user
+func LockSearchIndex(userID int) func() {
+	return dataLocks.Lock(fmt.Sprintf("%d/search_index", userID))
+}
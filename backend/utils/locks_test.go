@@ -0,0 +1,32 @@
+package utils
+
+import (
+	"sync"
+	"testing"
+)
+
+func TestKeyedMutex(t *testing.T) {
+	var locks KeyedMutex
+	var wg sync.WaitGroup
+	counters := map[string]int{}
+
+	// The counters are not synchronized otherwise, -race reports overlapping holders of a key
+	for i := range 100 {
+		key := []string{"a", "b", "c"}[i%3]
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer locks.Lock("counters")()
+			defer locks.Lock(key)()
+			counters[key]++
+		}()
+	}
+	wg.Wait()
+
+	if total := counters["a"] + counters["b"] + counters["c"]; total != 100 {
+		t.Errorf("counted %d, want 100", total)
+	}
+	if len(locks.locks) != 0 {
+		t.Errorf("%d locks are left after all were unlocked", len(locks.locks))
+	}
+}
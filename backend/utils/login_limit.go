@@ -0,0 +1,213 @@
+package utils
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Login throttling: every failed login of an IP or username doubles the waiting time until the next attempt,
+// after Settings.LoginMaxAttempts failures the username is locked for Settings.LoginLockoutMinutes.
+// As several users may share an IP (NAT), an IP is only locked after loginIPAttemptsFactor times as many failures.
+// The state is kept in memory only, a restart resets it.
+const (
+	loginBackoffBase      = time.Second
+	loginIPAttemptsFactor = 4
+	maxFailedLoginsStored = 20
+)
+
+// LoginResult is the outcome of a login attempt
+type LoginResult int
+
+const (
+	// LoginAborted is neither a success nor a failure, e.g. an internal error or a pending second factor
+	LoginAborted LoginResult = iota
+	LoginFailed
+	LoginSucceeded
+)
+
+// loginAttempts counts the failed logins of an IP or username
+type loginAttempts struct {
+	failures     int
+	lastFailure  time.Time
+	blockedUntil time.Time
+	running      bool
+}
+
+var (
+	loginLimits      = map[string]*loginAttempts{}
+	loginLimitsMutex sync.Mutex
+)
+
+// loginLimitKeys returns the keys under which the attempts of an IP and a username are counted
+func loginLimitKeys(ip, username string) (string, string) {
+	return "ip:" + ip, "user:" + strings.ToLower(username)
+}
+
+// loginLockout returns the lockout duration
+func loginLockout() time.Duration {
+	return time.Duration(Settings.LoginLockoutMinutes) * time.Minute
+}
+
+// getLoginAttempts returns the attempts of key, attempts older than the lockout duration are forgotten
+func getLoginAttempts(key string, now time.Time) *loginAttempts {
+	attempts, ok := loginLimits[key]
+	if !ok {
+		return nil
+	}
+	if attempts.running || now.Before(attempts.blockedUntil) || now.Sub(attempts.lastFailure) < loginLockout() {
+		return attempts
+	}
+	delete(loginLimits, key)
+	return nil
+}
+
+// StartLoginAttempt checks whether an IP may try to log in as username now.
+// If not, it returns the time to wait. Otherwise the attempt is registered and must be
+// finished with FinishLoginAttempt. Only one attempt per IP runs at a time, so that
+// a single client can't keep several Argon2 verifications busy.
+func StartLoginAttempt(ip, username string, now time.Time) (time.Duration, bool) {
+	loginLimitsMutex.Lock()
+	defer loginLimitsMutex.Unlock()
+
+	ipKey, userKey := loginLimitKeys(ip, username)
+
+	var wait time.Duration
+	for _, key := range []string{ipKey, userKey} {
+		attempts := getLoginAttempts(key, now)
+		if attempts == nil {
+			continue
+		}
+		if key == ipKey && attempts.running {
+			wait = max(wait, loginBackoffBase)
+		}
+		if now.Before(attempts.blockedUntil) {
+			wait = max(wait, attempts.blockedUntil.Sub(now))
+		}
+	}
+	if wait > 0 {
+		return wait, false
+	}
+
+	attempts := getLoginAttempts(ipKey, now)
+	if attempts == nil {
+		attempts = &loginAttempts{}
+		loginLimits[ipKey] = attempts
+	}
+	attempts.running = true
+
+	return 0, true
+}
+
+// FinishLoginAttempt records the result of an attempt started with StartLoginAttempt.
+// A success forgets the failures of the IP and username.
+func FinishLoginAttempt(ip, username string, result LoginResult, now time.Time) {
+	loginLimitsMutex.Lock()
+	defer loginLimitsMutex.Unlock()
+
+	ipKey, userKey := loginLimitKeys(ip, username)
+
+	switch result {
+	case LoginSucceeded:
+		delete(loginLimits, ipKey)
+		delete(loginLimits, userKey)
+		return
+	case LoginAborted:
+		if attempts, ok := loginLimits[ipKey]; ok {
+			attempts.running = false
+		}
+		getLoginAttempts(ipKey, now)
+		return
+	}
+
+	for _, key := range []string{ipKey, userKey} {
+		attempts := getLoginAttempts(key, now)
+		if attempts == nil {
+			attempts = &loginAttempts{}
+			loginLimits[key] = attempts
+		}
+		attempts.running = false
+		attempts.failures++
+		attempts.lastFailure = now
+
+		maxAttempts := Settings.LoginMaxAttempts
+		if key == ipKey {
+			maxAttempts *= loginIPAttemptsFactor
+		}
+		if attempts.failures >= maxAttempts {
+			attempts.blockedUntil = now.Add(loginLockout())
+			if attempts.failures == maxAttempts {
+				Logger.Printf("Too many failed logins for %s, locked for %d minutes", key, Settings.LoginLockoutMinutes)
+			}
+		} else {
+			attempts.blockedUntil = now.Add(min(loginBackoffBase<<(attempts.failures-1), loginLockout()))
+		}
+	}
+
+	// Forget old entries
+	for key := range loginLimits {
+		getLoginAttempts(key, now)
+	}
+}
+
+// RecordFailedLogin stores a failed login in users.json, so that the user is informed after the next successful login
+// reason is the failed step ("password" or "totp").
+func RecordFailedLogin(userID int, ip, reason string, at time.Time) error {
+	UsersFileMutex.Lock()
+	defer UsersFileMutex.Unlock()
+
+	users, err := GetUsers()
+	if err != nil {
+		return fmt.Errorf("error getting users: %v", err)
+	}
+	user, err := findUser(users, userID)
+	if err != nil {
+		return err
+	}
+
+	failedLogins, _ := user["failed_logins"].([]any)
+	failedLogins = append(failedLogins, map[string]any{
+		"time":   at.UTC().Format(time.RFC3339),
+		"ip":     ip,
+		"reason": reason,
+	})
+	if len(failedLogins) > maxFailedLoginsStored {
+		failedLogins = failedLogins[len(failedLogins)-maxFailedLoginsStored:]
+	}
+	user["failed_logins"] = failedLogins
+
+	count, _ := user["failed_logins_count"].(float64)
+	user["failed_logins_count"] = count + 1
+
+	return WriteUsers(users)
+}
+
+// TakeFailedLogins returns the failed logins since the last successful login (the latest ones and their total count) and clears them
+func TakeFailedLogins(userID int) ([]any, int, error) {
+	UsersFileMutex.Lock()
+	defer UsersFileMutex.Unlock()
+
+	users, err := GetUsers()
+	if err != nil {
+		return nil, 0, fmt.Errorf("error getting users: %v", err)
+	}
+	user, err := findUser(users, userID)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	failedLogins, _ := user["failed_logins"].([]any)
+	count, _ := user["failed_logins_count"].(float64)
+	if failedLogins == nil {
+		return []any{}, 0, nil
+	}
+
+	delete(user, "failed_logins")
+	delete(user, "failed_logins_count")
+	if err := WriteUsers(users); err != nil {
+		return nil, 0, err
+	}
+
+	return failedLogins, int(count), nil
+}
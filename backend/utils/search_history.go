@@ -0,0 +1,125 @@
+package utils
+
+import "strconv"
+
+// Besides the index, a search can look into the history of the days and entries and into the trash.
+// Both are read and decrypted for every such search instead of being indexed, as they are only
+// searched on request and the index would grow with every autosave.
+
+// eachMonth calls fn with the content of every month of a user
+func eachMonth(userID int, fn func(year, month int, content map[string]any)) error {
+	years, err := GetYears(userID)
+	if err != nil {
+		return err
+	}
+	for _, year := range years {
+		yearInt, _ := strconv.Atoi(year)
+		months, err := GetMonths(userID, year)
+		if err != nil {
+			return err
+		}
+		for _, month := range months {
+			monthInt, _ := strconv.Atoi(month)
+			content, err := GetMonth(userID, yearInt, monthInt)
+			if err != nil {
+				return err
+			}
+			fn(yearInt, monthInt, content)
+		}
+	}
+	return nil
+}
+
+// HistorySearchDocs returns a doc for every version in the history of the days and entries of a user.
+// The doc of a version has its text and the date, time, files, tags and bookmark of the current day or entry.
+func HistorySearchDocs(userID int, encKey string) ([]*SearchDoc, error) {
+	var docs []*SearchDoc
+	err := eachMonth(userID, func(year, month int, content map[string]any) {
+		days, _ := content["days"].([]any)
+		for _, d := range days {
+			day, ok := d.(map[string]any)
+			if !ok {
+				continue
+			}
+			dayNum, ok := jsonInt(day["day"])
+			if !ok {
+				continue
+			}
+			bookmarked, _ := day["isBookmarked"].(bool)
+
+			for i, part := range DayParts(day) {
+				history, _ := part["history"].([]any)
+				if len(history) == 0 {
+					continue
+				}
+				current := partDoc(year, month, dayNum, bookmarked, part, i > 0, encKey)
+				for _, item := range history {
+					entry, ok := item.(map[string]any)
+					if !ok {
+						continue
+					}
+					version, _ := jsonInt(entry["version"])
+					encryptedText, _ := entry["text"].(string)
+					if version == 0 || encryptedText == "" {
+						continue
+					}
+					text, err := DecryptText(encryptedText, encKey)
+					if err != nil {
+						continue
+					}
+
+					doc := *current
+					doc.Text, doc.Version = text, version
+					docs = append(docs, &doc)
+				}
+			}
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	return docs, nil
+}
+
+// TrashSearchDocs returns the docs of the deleted days, entries and files in the trash of a user.
+// A deleted file is a doc with only its filename.
+func TrashSearchDocs(userID int, encKey string) ([]*SearchDoc, error) {
+	content, err := GetTrash(userID)
+	if err != nil {
+		return nil, err
+	}
+
+	var docs []*SearchDoc
+	for _, item := range TrashItems(content) {
+		entry, _ := item["entry"].(map[string]any)
+		if entry == nil {
+			continue
+		}
+		id, _ := item["id"].(string)
+		year, _ := jsonInt(item["year"])
+		month, _ := jsonInt(item["month"])
+		day, _ := jsonInt(item["day"])
+
+		var itemDocs []*SearchDoc
+		switch itemType, _ := item["type"].(string); itemType {
+		case TrashDay:
+			bookmarked, _ := entry["isBookmarked"].(bool)
+			for i, part := range DayParts(entry) {
+				itemDocs = append(itemDocs, partDoc(year, month, day, bookmarked, part, i > 0, encKey))
+			}
+		case TrashEntry:
+			itemDocs = append(itemDocs, partDoc(year, month, day, false, entry, true, encKey))
+		case TrashFile:
+			doc := &SearchDoc{Year: year, Month: month, Day: day}
+			if filename, ok := fileDocName(entry, encKey); ok {
+				doc.Files = []string{filename}
+			}
+			itemDocs = append(itemDocs, doc)
+		}
+		for _, doc := range itemDocs {
+			doc.TrashID = id
+			docs = append(docs, doc)
+		}
+	}
+	return docs, nil
+}
@@ -0,0 +1,657 @@
+package utils
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// The search index of a user keeps the texts, filenames and tags of all days and their entries, together
+// with a trigram index over the folded (lowercased, without diacritics) texts and filenames. A search only
+// looks at the days that contain all trigrams of a term instead of decrypting every month.
+// The docs are stored per month, encrypted with the key of the user, so that a change of a day only rewrites
+// the chunk of its month. search_index.json lists the chunks with a tag that changes on every write of a chunk,
+// the trigrams are built when the chunks are read. The index stays in memory for a while after it was used.
+// The handlers that change a day update it, and it can always be rebuilt from the months, so a missing,
+// outdated or broken index is simply rebuilt by the next search.
+//
+//	search_index.json:         {"version": 3, "months": {"2024-05": "<tag>", ...}}
+//	search_index_2024-05.json: {"tag": "<tag>", "data": "<encrypted JSON of the docs of the month>"}
+
+// searchIndexVersion is increased whenever the content of the index changes
+const searchIndexVersion = 3
+
+// searchIndexCacheTTL is how long a decrypted index stays in memory after it was last used
+const searchIndexCacheTTL = 15 * time.Minute
+
+// searchIndexDoc lists the stored chunks of the index
+const searchIndexDoc = "search_index.json"
+
+// searchChunkName returns the document of the chunk of a month ("2006-01")
+func searchChunkName(month string) string {
+	return "search_index_" + month + ".json"
+}
+
+// searchMonth returns the key of a month in the index, "2006-01"
+func searchMonth(year, month int) string {
+	return fmt.Sprintf("%04d-%02d", year, month)
+}
+
+// SearchDoc is the searchable content of a day or of an entry of a day
+type SearchDoc struct {
+	Year       int      `json:"year"`
+	Month      int      `json:"month"`
+	Day        int      `json:"day"`
+	EntryID    string   `json:"entry_id,omitempty"`
+	Time       string   `json:"time,omitempty"`
+	Text       string   `json:"text,omitempty"`
+	Files      []string `json:"files,omitempty"`
+	Tags       []int    `json:"tags,omitempty"`
+	Bookmarked bool     `json:"bookmarked,omitempty"`
+
+	// Docs of older versions and of the trash are never indexed, see HistorySearchDocs and TrashSearchDocs
+	Version int    `json:"-"` // the version in the history of the day or entry
+	TrashID string `json:"-"` // the item of the trash
+}
+
+// Date returns the date of a doc as "2006-01-02"
+func (d *SearchDoc) Date() string {
+	return fmt.Sprintf("%04d-%02d-%02d", d.Year, d.Month, d.Day)
+}
+
+// SearchIndex is the decrypted search index of a user. Docs are never modified once they are
+// part of the index, an update replaces them.
+type SearchIndex struct {
+	mu       sync.RWMutex
+	NextID   int
+	Docs     map[int]*SearchDoc
+	Trigrams map[string][]int
+
+	// dates maps a date to the ids of its docs
+	dates map[string][]int
+
+	// chunks maps a month to the tag of the stored chunk the docs of the month belong to.
+	// It is only used while the lock of the index (LockSearchIndex) is held.
+	chunks map[string]string
+}
+
+// newSearchIndex returns an empty index
+func newSearchIndex() *SearchIndex {
+	return &SearchIndex{
+		NextID:   1,
+		Docs:     map[int]*SearchDoc{},
+		Trigrams: map[string][]int{},
+		dates:    map[string][]int{},
+		chunks:   map[string]string{},
+	}
+}
+
+// trigrams adds the trigrams of the folded text (see FoldText) to set
+func trigrams(text string, set map[string]bool) {
+	runes, _ := FoldRunes([]rune(text))
+	for i := 0; i+3 <= len(runes); i++ {
+		set[string(runes[i:i+3])] = true
+	}
+}
+
+// docTrigrams returns the trigrams of the text and the filenames of a doc
+func docTrigrams(doc *SearchDoc) map[string]bool {
+	set := map[string]bool{}
+	trigrams(doc.Text, set)
+	for _, file := range doc.Files {
+		trigrams(file, set)
+	}
+	return set
+}
+
+// addPosting inserts id into a sorted list of ids
+func addPosting(list []int, id int) []int {
+	i := sort.SearchInts(list, id)
+	if i < len(list) && list[i] == id {
+		return list
+	}
+	list = append(list, 0)
+	copy(list[i+1:], list[i:])
+	list[i] = id
+	return list
+}
+
+// removePosting removes id from a sorted list of ids
+func removePosting(list []int, id int) []int {
+	i := sort.SearchInts(list, id)
+	if i < len(list) && list[i] == id {
+		return append(list[:i], list[i+1:]...)
+	}
+	return list
+}
+
+// addDoc adds a doc to the index. The caller holds the write lock.
+func (idx *SearchIndex) addDoc(doc *SearchDoc) {
+	id := idx.NextID
+	idx.NextID++
+	idx.Docs[id] = doc
+	idx.dates[doc.Date()] = append(idx.dates[doc.Date()], id)
+	for trigram := range docTrigrams(doc) {
+		idx.Trigrams[trigram] = addPosting(idx.Trigrams[trigram], id)
+	}
+}
+
+// removeDoc removes a doc from the index. The caller holds the write lock.
+func (idx *SearchIndex) removeDoc(id int) {
+	doc, ok := idx.Docs[id]
+	if !ok {
+		return
+	}
+	for trigram := range docTrigrams(doc) {
+		if list := removePosting(idx.Trigrams[trigram], id); len(list) > 0 {
+			idx.Trigrams[trigram] = list
+		} else {
+			delete(idx.Trigrams, trigram)
+		}
+	}
+	delete(idx.Docs, id)
+}
+
+// removeDate removes the docs of a date. The caller holds the write lock.
+func (idx *SearchIndex) removeDate(date string) {
+	for _, id := range idx.dates[date] {
+		idx.removeDoc(id)
+	}
+	delete(idx.dates, date)
+}
+
+// setDay replaces the docs of a date
+func (idx *SearchIndex) setDay(year, month, day int, docs []*SearchDoc) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+
+	idx.removeDate(fmt.Sprintf("%s-%02d", searchMonth(year, month), day))
+	for _, doc := range docs {
+		idx.addDoc(doc)
+	}
+}
+
+// setMonth replaces the docs of a month ("2006-01")
+func (idx *SearchIndex) setMonth(month string, docs []*SearchDoc) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+
+	for day := 1; day <= 31; day++ {
+		idx.removeDate(fmt.Sprintf("%s-%02d", month, day))
+	}
+	for _, doc := range docs {
+		idx.addDoc(doc)
+	}
+}
+
+// monthDocs returns the docs of a month ("2006-01"), ordered by date
+func (idx *SearchIndex) monthDocs(month string) []*SearchDoc {
+	idx.mu.RLock()
+	docs := []*SearchDoc{}
+	for day := 1; day <= 31; day++ {
+		for _, id := range idx.dates[fmt.Sprintf("%s-%02d", month, day)] {
+			docs = append(docs, idx.Docs[id])
+		}
+	}
+	idx.mu.RUnlock()
+
+	SortSearchDocs(docs)
+	return docs
+}
+
+// SortSearchDocs orders docs by date, the day itself before its entries in the order of their time
+func SortSearchDocs(docs []*SearchDoc) {
+	sort.SliceStable(docs, func(i, j int) bool {
+		if docs[i].Date() != docs[j].Date() {
+			return docs[i].Date() < docs[j].Date()
+		}
+		if (docs[i].EntryID == "") != (docs[j].EntryID == "") {
+			return docs[i].EntryID == ""
+		}
+		if docs[i].Time != docs[j].Time {
+			return docs[i].Time < docs[j].Time
+		}
+		return docs[i].EntryID < docs[j].EntryID
+	})
+}
+
+// AllDocs returns all docs of the index, ordered by date
+func (idx *SearchIndex) AllDocs() []*SearchDoc {
+	idx.mu.RLock()
+	docs := make([]*SearchDoc, 0, len(idx.Docs))
+	for _, doc := range idx.Docs {
+		docs = append(docs, doc)
+	}
+	idx.mu.RUnlock()
+
+	SortSearchDocs(docs)
+	return docs
+}
+
+// Candidates returns the docs whose text or filenames may contain all terms (or any term, if all is false),
+// ordered by date. The docs still have to be checked, terms shorter than a trigram match every doc.
+func (idx *SearchIndex) Candidates(terms []string, all bool) []*SearchDoc {
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+
+	var result map[int]bool
+	for _, term := range terms {
+		set := map[string]bool{}
+		trigrams(term, set)
+
+		// The docs containing every trigram of the term
+		var matches map[int]bool
+		if len(set) == 0 {
+			matches = make(map[int]bool, len(idx.Docs))
+			for id := range idx.Docs {
+				matches[id] = true
+			}
+		}
+		for trigram := range set {
+			next := map[int]bool{}
+			for _, id := range idx.Trigrams[trigram] {
+				if matches == nil || matches[id] {
+					next[id] = true
+				}
+			}
+			matches = next
+			if len(matches) == 0 {
+				break
+			}
+		}
+
+		switch {
+		case result == nil:
+			result = matches
+		case all:
+			for id := range result {
+				if !matches[id] {
+					delete(result, id)
+				}
+			}
+		default:
+			for id := range matches {
+				result[id] = true
+			}
+		}
+	}
+
+	docs := make([]*SearchDoc, 0, len(result))
+	for id := range result {
+		docs = append(docs, idx.Docs[id])
+	}
+	SortSearchDocs(docs)
+	return docs
+}
+
+// FuzzyCandidates returns the docs whose text or filenames may contain a word within the given edit
+// distance of term, ordered by date. Every edit changes at most three trigrams of the term.
+func (idx *SearchIndex) FuzzyCandidates(term string, distance int) []*SearchDoc {
+	set := map[string]bool{}
+	trigrams(term, set)
+	minShared := len(set) - 3*distance
+	if minShared <= 0 {
+		return idx.AllDocs()
+	}
+
+	idx.mu.RLock()
+	shared := map[int]int{}
+	for trigram := range set {
+		for _, id := range idx.Trigrams[trigram] {
+			shared[id]++
+		}
+	}
+	var docs []*SearchDoc
+	for id, count := range shared {
+		if count >= minShared {
+			docs = append(docs, idx.Docs[id])
+		}
+	}
+	idx.mu.RUnlock()
+
+	SortSearchDocs(docs)
+	return docs
+}
+
+// DocsWithTag returns the docs that have a tag, ordered by date
+func (idx *SearchIndex) DocsWithTag(tagID int) []*SearchDoc {
+	var docs []*SearchDoc
+	for _, doc := range idx.AllDocs() {
+		for _, tag := range doc.Tags {
+			if tag == tagID {
+				docs = append(docs, doc)
+				break
+			}
+		}
+	}
+	return docs
+}
+
+// jsonInt reads a number of a document, a float64 when it was read from storage
+func jsonInt(value any) (int, bool) {
+	switch n := value.(type) {
+	case float64:
+		return int(n), true
+	case int:
+		return n, true
+	}
+	return 0, false
+}
+
+// partDoc returns the doc of a day or, with entry set, of an entry of a day (see DayParts).
+// Texts and filenames that can't be decrypted are left out.
+func partDoc(year, month, day int, bookmarked bool, part map[string]any, entry bool, encKey string) *SearchDoc {
+	doc := &SearchDoc{Year: year, Month: month, Day: day, Bookmarked: bookmarked}
+	if entry {
+		doc.EntryID, _ = part["id"].(string)
+		if encryptedTime, ok := part["time"].(string); ok && encryptedTime != "" {
+			doc.Time, _ = DecryptText(encryptedTime, encKey)
+		}
+	}
+	if encryptedText, ok := part["text"].(string); ok && encryptedText != "" {
+		doc.Text, _ = DecryptText(encryptedText, encKey)
+	}
+	files, _ := part["files"].([]any)
+	for _, f := range files {
+		if file, ok := f.(map[string]any); ok {
+			if filename, ok := fileDocName(file, encKey); ok {
+				doc.Files = append(doc.Files, filename)
+			}
+		}
+	}
+	tags, _ := part["tags"].([]any)
+	for _, tag := range tags {
+		if id, ok := tag.(float64); ok {
+			doc.Tags = append(doc.Tags, int(id))
+		}
+	}
+	return doc
+}
+
+// fileDocName returns the decrypted filename of a file entry
+func fileDocName(file map[string]any, encKey string) (string, bool) {
+	encFilename, ok := file["enc_filename"].(string)
+	if !ok {
+		return "", false
+	}
+	filename, err := DecryptText(encFilename, encKey)
+	return filename, err == nil
+}
+
+// dayDocs returns the docs of a day and its entries. Texts and filenames that can't be decrypted are left out.
+func dayDocs(year, month int, day map[string]any, encKey string) []*SearchDoc {
+	dayNum, ok := jsonInt(day["day"])
+	if !ok {
+		return nil
+	}
+	bookmarked, _ := day["isBookmarked"].(bool)
+
+	var docs []*SearchDoc
+	for i, part := range DayParts(day) {
+		doc := partDoc(year, month, dayNum, bookmarked, part, i > 0, encKey)
+
+		// The day itself is only indexed if there is something to find
+		if i == 0 && doc.Text == "" && len(doc.Files) == 0 && len(doc.Tags) == 0 && !bookmarked {
+			continue
+		}
+		docs = append(docs, doc)
+	}
+	return docs
+}
+
+// searchIndexCache keeps the decrypted indexes. A cached index is checked against the tags of the
+// stored chunks before it is used, see readSearchIndex.
+var searchIndexCache = struct {
+	sync.Mutex
+	entries map[int]*cachedSearchIndex
+}{entries: map[int]*cachedSearchIndex{}}
+
+type cachedSearchIndex struct {
+	index *SearchIndex
+	used  time.Time
+}
+
+// cachedIndex returns the cached index of a user, and drops expired entries
+func cachedIndex(userID int) *SearchIndex {
+	searchIndexCache.Lock()
+	defer searchIndexCache.Unlock()
+
+	now := time.Now()
+	for id, entry := range searchIndexCache.entries {
+		if now.Sub(entry.used) > searchIndexCacheTTL {
+			delete(searchIndexCache.entries, id)
+		}
+	}
+
+	entry, ok := searchIndexCache.entries[userID]
+	if !ok {
+		return nil
+	}
+	entry.used = now
+	return entry.index
+}
+
+// cacheIndex remembers the decrypted index of a user, a nil index drops it
+func cacheIndex(userID int, index *SearchIndex) {
+	searchIndexCache.Lock()
+	defer searchIndexCache.Unlock()
+
+	if index == nil {
+		delete(searchIndexCache.entries, userID)
+		return
+	}
+	searchIndexCache.entries[userID] = &cachedSearchIndex{index: index, used: time.Now()}
+}
+
+// readSearchChunk reads and decrypts the docs of a month, the chunk has to have the tag listed in search_index.json
+func readSearchChunk(userID int, encKey, month, tag string) ([]*SearchDoc, error) {
+	content, err := getUserDocument(userID, searchChunkName(month))
+	if err != nil {
+		return nil, err
+	}
+	if stored, _ := content["tag"].(string); stored != tag {
+		return nil, fmt.Errorf("chunk %s does not match search_index.json", month)
+	}
+	data, _ := content["data"].(string)
+	plaintext, err := DecryptText(data, encKey)
+	if err != nil {
+		return nil, fmt.Errorf("error decrypting chunk %s: %v", month, err)
+	}
+
+	var docs []*SearchDoc
+	if err := json.Unmarshal([]byte(plaintext), &docs); err != nil {
+		return nil, fmt.Errorf("error decoding chunk %s: %v", month, err)
+	}
+	for _, doc := range docs {
+		if doc == nil || searchMonth(doc.Year, doc.Month) != month {
+			return nil, fmt.Errorf("chunk %s contains a doc of another month", month)
+		}
+	}
+	return docs, nil
+}
+
+// readSearchIndex returns the index of a user. Only the chunks that changed since the index was cached
+// (e.g. by another process) are read. Returns nil if there is no usable index.
+// The caller holds the lock of the index.
+func readSearchIndex(userID int, encKey string) *SearchIndex {
+	content, err := getUserDocument(userID, searchIndexDoc)
+	if err != nil {
+		return nil
+	}
+	months, _ := content["months"].(map[string]any)
+	if version, _ := content["version"].(float64); int(version) != searchIndexVersion || months == nil {
+		return nil
+	}
+
+	index := cachedIndex(userID)
+	if index == nil {
+		index = newSearchIndex()
+	}
+	for month, value := range months {
+		tag, _ := value.(string)
+		if tag != "" && index.chunks[month] == tag {
+			continue
+		}
+		docs, err := readSearchChunk(userID, encKey, month, tag)
+		if err != nil {
+			Logger.Printf("Error reading the search index of user %d: %v", userID, err)
+			cacheIndex(userID, nil)
+			return nil
+		}
+		index.setMonth(month, docs)
+		index.chunks[month] = tag
+	}
+	for month := range index.chunks {
+		if _, ok := months[month]; !ok {
+			index.setMonth(month, nil)
+			delete(index.chunks, month)
+		}
+	}
+
+	cacheIndex(userID, index)
+	return index
+}
+
+// writeSearchIndex encrypts and writes the chunks of the given months, followed by the list of chunks.
+// The caller holds the lock of the index.
+func writeSearchIndex(userID int, encKey string, index *SearchIndex, months []string) error {
+	err := func() error {
+		for _, month := range months {
+			plaintext, err := json.Marshal(index.monthDocs(month))
+			if err != nil {
+				return err
+			}
+			data, err := EncryptText(string(plaintext), encKey)
+			if err != nil {
+				return err
+			}
+			tag, err := GenerateUUID()
+			if err != nil {
+				return err
+			}
+			if err := writeUserDocument(userID, searchChunkName(month), map[string]any{
+				"tag":  tag,
+				"data": data,
+			}); err != nil {
+				return err
+			}
+			index.chunks[month] = tag
+		}
+
+		chunks := make(map[string]any, len(index.chunks))
+		for month, tag := range index.chunks {
+			chunks[month] = tag
+		}
+		return writeUserDocument(userID, searchIndexDoc, map[string]any{
+			"version": searchIndexVersion,
+			"months":  chunks,
+		})
+	}()
+	if err != nil {
+		cacheIndex(userID, nil)
+		return err
+	}
+
+	cacheIndex(userID, index)
+	return nil
+}
+
+// invalidateSearchIndex drops the index of a user, it is rebuilt by the next search.
+// The caller holds the lock of the index.
+func invalidateSearchIndex(userID int) error {
+	cacheIndex(userID, nil)
+	return writeUserDocument(userID, searchIndexDoc, map[string]any{})
+}
+
+// InvalidateSearchIndex drops the index of a user, e.g. after changes to many days at once
+func InvalidateSearchIndex(userID int) error {
+	defer LockSearchIndex(userID)()
+	return invalidateSearchIndex(userID)
+}
+
+// rebuildSearchIndex builds the index of a user from all months and writes it. Every month gets a chunk,
+// so that the chunks of an earlier index are replaced. The caller holds the lock of the index.
+func rebuildSearchIndex(userID int, encKey string) (*SearchIndex, error) {
+	index := newSearchIndex()
+	var chunks []string
+
+	years, err := GetYears(userID)
+	if err != nil {
+		return nil, err
+	}
+	for _, year := range years {
+		yearInt, _ := strconv.Atoi(year)
+		months, err := GetMonths(userID, year)
+		if err != nil {
+			return nil, err
+		}
+		for _, month := range months {
+			monthInt, _ := strconv.Atoi(month)
+			content, err := GetMonth(userID, yearInt, monthInt)
+			if err != nil {
+				return nil, err
+			}
+			days, _ := content["days"].([]any)
+			for _, d := range days {
+				if day, ok := d.(map[string]any); ok {
+					for _, doc := range dayDocs(yearInt, monthInt, day, encKey) {
+						index.addDoc(doc)
+					}
+				}
+			}
+			chunks = append(chunks, searchMonth(yearInt, monthInt))
+		}
+	}
+
+	if err := writeSearchIndex(userID, encKey, index, chunks); err != nil {
+		return nil, err
+	}
+	return index, nil
+}
+
+// RebuildSearchIndex builds the index of a user from scratch
+func RebuildSearchIndex(userID int, encKey string) (*SearchIndex, error) {
+	defer LockSearchIndex(userID)()
+	return rebuildSearchIndex(userID, encKey)
+}
+
+// OpenSearchIndex returns the index of a user, it is built first if there is none
+func OpenSearchIndex(userID int, encKey string) (*SearchIndex, error) {
+	defer LockSearchIndex(userID)()
+
+	if index := readSearchIndex(userID, encKey); index != nil {
+		return index, nil
+	}
+	return rebuildSearchIndex(userID, encKey)
+}
+
+// UpdateSearchIndexDay indexes a day of a month document again, after it was changed or removed. Only the
+// chunk of the month is written. Nothing is done while the user has no index. After an error, the index
+// should be invalidated. The caller holds the lock of the month, so the month content is the one that was written.
+func UpdateSearchIndexDay(userID int, encKey string, year, month int, content map[string]any, dayValue int) error {
+	defer LockSearchIndex(userID)()
+
+	index := readSearchIndex(userID, encKey)
+	if index == nil {
+		return nil
+	}
+
+	var docs []*SearchDoc
+	days, _ := content["days"].([]any)
+	for _, d := range days {
+		day, ok := d.(map[string]any)
+		if !ok {
+			continue
+		}
+		if docs = dayDocs(year, month, day, encKey); len(docs) > 0 && docs[0].Day == dayValue {
+			break
+		}
+		docs = nil
+	}
+	index.setDay(year, month, dayValue, docs)
+
+	return writeSearchIndex(userID, encKey, index, []string{searchMonth(year, month)})
+}
@@ -0,0 +1,86 @@
+package utils
+
+import (
+	"encoding/base64"
+	"reflect"
+	"testing"
+)
+
+// writeRecorder records the names of the user documents written to a store
+type writeRecorder struct {
+	Storage
+	written []string
+}
+
+func (s *writeRecorder) WriteUserDoc(userID int, name string, data []byte) error {
+	s.written = append(s.written, name)
+	return s.Storage.WriteUserDoc(userID, name, data)
+}
+
+// A change of a day only rewrites the chunk of its month, the index is read back from the chunks
+func TestSearchIndexChunks(t *testing.T) {
+	store := &writeRecorder{Storage: NewMemoryStorage()}
+	Store = store
+	encKey := base64.URLEncoding.EncodeToString(make([]byte, 32))
+	t.Cleanup(func() { cacheIndex(1, nil) })
+
+	monthWithText := func(text string) map[string]any {
+		t.Helper()
+		encText, err := EncryptText(text, encKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return map[string]any{"days": []any{map[string]any{"day": 3, "text": encText}}}
+	}
+	writeMonth := func(month int, content map[string]any) {
+		t.Helper()
+		if err := WriteMonth(1, 2024, month, content); err != nil {
+			t.Fatal(err)
+		}
+	}
+	search := func(term string) []*SearchDoc {
+		t.Helper()
+		index, err := OpenSearchIndex(1, encKey)
+		if err != nil {
+			t.Fatalf("OpenSearchIndex: %v", err)
+		}
+		return index.Candidates([]string{term}, true)
+	}
+
+	writeMonth(5, monthWithText("apple pie"))
+	writeMonth(6, monthWithText("banana bread"))
+	if docs := search("banana"); len(docs) != 1 || docs[0].Month != 6 {
+		t.Fatalf("banana: %+v, want the day in June", docs)
+	}
+
+	store.written = nil
+	june := monthWithText("cherry cake")
+	writeMonth(6, june)
+	if err := UpdateSearchIndexDay(1, encKey, 2024, 6, june, 3); err != nil {
+		t.Fatalf("UpdateSearchIndexDay: %v", err)
+	}
+	if want := []string{"search_index_2024-06.json", "search_index.json"}; !reflect.DeepEqual(store.written, want) {
+		t.Errorf("written = %v, want %v", store.written, want)
+	}
+
+	// Without the cached index, the chunks are read
+	cacheIndex(1, nil)
+	store.written = nil
+	for term, want := range map[string]int{"apple": 1, "banana": 0, "cherry": 1} {
+		if docs := search(term); len(docs) != want {
+			t.Errorf("%s: %d docs, want %d", term, len(docs), want)
+		}
+	}
+	if len(store.written) != 0 {
+		t.Errorf("the index was written again: %v", store.written)
+	}
+
+	// A chunk that doesn't match the list of chunks leads to a rebuild
+	if err := Store.WriteUserDoc(1, "search_index_2024-05.json", []byte(`{"tag": "other", "data": ""}`)); err != nil {
+		t.Fatal(err)
+	}
+	cacheIndex(1, nil)
+	if docs := search("apple"); len(docs) != 1 {
+		t.Errorf("apple after a broken chunk: %d docs, want 1", len(docs))
+	}
+}
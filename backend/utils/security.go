@@ -3,80 +3,19 @@ package utils
 import (
 	"crypto/cipher"
 	"crypto/rand"
+	"crypto/sha256"
 	"crypto/subtle"
 	"encoding/base64"
 	"fmt"
 	"io"
 	"math/big"
-	"runtime"
 	"strings"
-	"time"
 
-	"github.com/golang-jwt/jwt/v5"
 	"github.com/google/uuid"
 	"golang.org/x/crypto/argon2"
 	"golang.org/x/crypto/chacha20poly1305"
 )
 
-// Claims represents the JWT claims
-type Claims struct {
-	UserID     int    `json:"user_id"`
-	Username   string `json:"name"`
-	DerivedKey string `json:"derived_key"`
-	jwt.RegisteredClaims
-}
-
-// GenerateToken creates a new JWT token
-func GenerateToken(userID int, username, derivedKey string) (string, error) {
-	// Create expiration time
-	expirationTime := time.Now().Add(time.Duration(Settings.LogoutAfterDays) * 24 * time.Hour)
-
-	// Create claims
-	claims := &Claims{
-		UserID:     userID,
-		Username:   username,
-		DerivedKey: derivedKey,
-		RegisteredClaims: jwt.RegisteredClaims{
-			ExpiresAt: jwt.NewNumericDate(expirationTime),
-		},
-	}
-
-	// Create token
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-
-	// Sign token with secret key
-	tokenString, err := token.SignedString([]byte(Settings.SecretToken))
-	if err != nil {
-		return "", err
-	}
-
-	return tokenString, nil
-}
-
-// ValidateToken validates a JWT token and returns the claims
-func ValidateToken(tokenString string) (*Claims, error) {
-	// Parse token
-	claims := &Claims{}
-	token, err := jwt.ParseWithClaims(tokenString, claims, func(token *jwt.Token) (any, error) {
-		// Validate signing method
-		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
-			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
-		}
-
-		return []byte(Settings.SecretToken), nil
-	})
-
-	if err != nil {
-		return nil, err
-	}
-
-	if !token.Valid {
-		return nil, fmt.Errorf("invalid token")
-	}
-
-	return claims, nil
-}
-
 type Argon2Configuration struct {
 	HashRaw    []byte
 	Salt       []byte
@@ -86,18 +25,19 @@ type Argon2Configuration struct {
 	KeyLength  uint32
 }
 
-func getArgon2Configuration() *Argon2Configuration {
+func getArgon2Configuration(params KDFParams) *Argon2Configuration {
 	return &Argon2Configuration{
-		TimeCost:   5,
-		MemoryCost: 64 * 1024,
-		Threads:    uint8(runtime.NumCPU()),
+		TimeCost:   params.Time,
+		MemoryCost: params.MemoryKiB,
+		Threads:    params.Threads,
 		KeyLength:  32,
 	}
 }
 
-// HashPassword hashes a password using Argon2
-func HashPassword(password string) (string, error) {
-	config := getArgon2Configuration()
+// HashPassword hashes a password using Argon2, with the parameters of PasswordHashParams.
+// previousHash is the hash that the new one replaces, empty for a new password.
+func HashPassword(password, previousHash string) (string, error) {
+	config := getArgon2Configuration(PasswordHashParams(previousHash))
 
 	// Generate a random salt
 	salt := make([]byte, 16)
@@ -185,7 +125,7 @@ func VerifyPassword(password, hashBase64 string) bool {
 }
 
 // DeriveKeyFromPassword derives a key from a password and salt
-func DeriveKeyFromPassword(password, saltBase64 string) ([]byte, error) {
+func DeriveKeyFromPassword(password, saltBase64 string, params KDFParams) ([]byte, error) {
 	// Decode salt
 	salt, err := base64.StdEncoding.DecodeString(saltBase64)
 	if err != nil {
@@ -193,7 +133,7 @@ func DeriveKeyFromPassword(password, saltBase64 string) ([]byte, error) {
 	}
 
 	// Derive key
-	key := argon2.IDKey([]byte(password), salt, 3, 64*1024, 4, 32)
+	key := argon2.IDKey([]byte(password), salt, params.Time, params.MemoryKiB, params.Threads, 32)
 	return key, nil
 }
 
@@ -206,6 +146,29 @@ func GenerateSecretToken() string {
 	return base64.URLEncoding.EncodeToString(b)
 }
 
+// NewShareToken creates a share token for a derived key.
+// Returns the token (for the link), its hash and the derived key encrypted with the token (both for users.json).
+func NewShareToken(derivedKey string) (string, string, string, error) {
+	// Generate a new random token (32 bytes, base64 URL-encoded)
+	token := GenerateSecretToken()
+
+	// Compute SHA-256 hash of the raw token bytes for storage
+	tokenBytes, err := base64.URLEncoding.DecodeString(token)
+	if err != nil {
+		return "", "", "", err
+	}
+	hash := sha256.Sum256(tokenBytes)
+	tokenHash := base64.URLEncoding.EncodeToString(hash[:])
+
+	// Encrypt the user's derived key using the share token as the encryption key
+	encDerivedKey, err := EncryptText(derivedKey, token)
+	if err != nil {
+		return "", "", "", err
+	}
+
+	return token, tokenHash, encDerivedKey, nil
+}
+
 // Generate a UUID v7 and base64-encode it (url-safe)
 func GenerateUUID() (string, error) {
 	// Generate a UUID v7
@@ -257,8 +220,22 @@ func EncryptText(text, key string) (string, error) {
 	return base64.URLEncoding.EncodeToString(ciphertext), nil
 }
 
-// DecryptText decrypts text using the provided key
+// DecryptText decrypts text using the provided key.
+// While the key of the user is rotated, text that is still encrypted with the old key is decrypted as well.
 func DecryptText(ciphertext, key string) (string, error) {
+	plaintext, err := decryptText(ciphertext, key)
+	if err != nil {
+		if oldKey, ok := keyFallbacks.Load(key); ok {
+			if plaintext, err := decryptText(ciphertext, oldKey.(string)); err == nil {
+				return plaintext, nil
+			}
+		}
+	}
+	return plaintext, err
+}
+
+// decryptText decrypts text with exactly the provided key
+func decryptText(ciphertext, key string) (string, error) {
 	// Decode key and ciphertext
 	keyBytes, err := base64.URLEncoding.DecodeString(key)
 	if err != nil {
@@ -291,33 +268,43 @@ func DecryptText(ciphertext, key string) (string, error) {
 	return string(plaintext), nil
 }
 
-// EncryptFile encrypts a file using the provided key
+// EncryptFile encrypts a file in memory using the provided key (in the chunked format, see NewEncryptingReader)
 func EncryptFile(data []byte, key string) ([]byte, error) {
-	// Decode key
-	keyBytes, err := base64.URLEncoding.DecodeString(key)
-	if err != nil {
-		return nil, fmt.Errorf("error decoding key: %v", err)
-	}
+	return encryptStream(data, key)
+}
 
-	// Create AEAD cipher
-	aead, err := chacha20poly1305.New(keyBytes)
+// DecryptFile decrypts a file using the provided key.
+// While the key of the user is rotated, files that are still encrypted with the old key are decrypted as well.
+func DecryptFile(ciphertext []byte, key string) ([]byte, error) {
+	plaintext, err := decryptFile(ciphertext, key)
 	if err != nil {
-		return nil, fmt.Errorf("error creating cipher: %v", err)
+		if oldKey, ok := keyFallbacks.Load(key); ok {
+			if plaintext, err := decryptFile(ciphertext, oldKey.(string)); err == nil {
+				return plaintext, nil
+			}
+		}
 	}
+	return plaintext, err
+}
 
-	// Create nonce
-	nonce := make([]byte, aead.NonceSize())
-	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
-		return nil, fmt.Errorf("error creating nonce: %v", err)
+// decryptFile decrypts a file with exactly the provided key
+func decryptFile(ciphertext []byte, key string) ([]byte, error) {
+	if isStreamCiphertext(ciphertext) {
+		plaintext, err := decryptStream(ciphertext, key)
+		if err == nil {
+			return plaintext, nil
+		}
+		// A file in the old format could start with the magic bytes by chance
+		if plaintext, legacyErr := decryptLegacyFile(ciphertext, key); legacyErr == nil {
+			return plaintext, nil
+		}
+		return nil, err
 	}
-
-	// Encrypt file
-	ciphertext := aead.Seal(nonce, nonce, data, nil)
-	return ciphertext, nil
+	return decryptLegacyFile(ciphertext, key)
 }
 
-// DecryptFile decrypts a file using the provided key
-func DecryptFile(ciphertext []byte, key string) ([]byte, error) {
+// decryptLegacyFile decrypts a file that was encrypted as a whole (nonce | ciphertext)
+func decryptLegacyFile(ciphertext []byte, key string) ([]byte, error) {
 	// Decode key
 	keyBytes, err := base64.URLEncoding.DecodeString(key)
 	if err != nil {
@@ -366,43 +353,17 @@ func GetEncryptionKey(userID int, derivedKey string) (string, error) {
 		}
 
 		if id, ok := user["user_id"].(float64); ok && int(id) == userID {
-			encEncKey, ok := user["enc_enc_key"].(string)
-			if !ok {
-				return "", fmt.Errorf("user data is not in the correct format")
-			}
-
-			// Decode derived key
-			derivedKeyBytes, err := base64.StdEncoding.DecodeString(derivedKey)
-			if err != nil {
-				return "", fmt.Errorf("error decoding derived key: %v", err)
-			}
-
-			// Create Fernet cipher
-			aead, err := CreateAEAD(derivedKeyBytes)
-			if err != nil {
-				return "", fmt.Errorf("error creating cipher: %v", err)
-			}
-
-			// Decode encrypted key
-			encEncKeyBytes, err := base64.StdEncoding.DecodeString(encEncKey)
+			keyBytes, err := UnwrapEncryptionKey(user, derivedKey)
 			if err != nil {
-				return "", fmt.Errorf("error decoding encrypted key: %v", err)
+				return "", err
 			}
+			encKey := base64.URLEncoding.EncodeToString(keyBytes)
 
-			// Extract nonce from encrypted key
-			if len(encEncKeyBytes) < aead.NonceSize() {
-				return "", fmt.Errorf("encrypted key too short")
-			}
-			nonce, encKeyBytes := encEncKeyBytes[:aead.NonceSize()], encEncKeyBytes[aead.NonceSize():]
-
-			// Decrypt key
-			keyBytes, err := aead.Open(nil, nonce, encKeyBytes, nil)
-			if err != nil {
-				return "", fmt.Errorf("error decrypting key: %v", err)
-			}
+			// Data that is not rotated yet stays readable (also after a restart)
+			registerKeyFallback(user, encKey)
 
 			// Return base64-encoded key
-			return base64.URLEncoding.EncodeToString(keyBytes), nil
+			return encKey, nil
 		}
 	}
 
@@ -442,7 +403,8 @@ func CheckPasswordForUser(userID int, password string) (string, int, error) {
 
 			if VerifyPassword(password, passwordHash) {
 				// Calculate derived key
-				derKey, err := DeriveKeyFromPassword(password, user["salt"].(string))
+				kdfParams := KDFParamsOf(user)
+				derKey, err := DeriveKeyFromPassword(password, user["salt"].(string), kdfParams)
 				if err != nil {
 					return "", -1, fmt.Errorf("error deriving key from password: %v", err)
 				}
@@ -477,7 +439,7 @@ func CheckPasswordForUser(userID int, password string) (string, int, error) {
 				}
 
 				// Calculate derived key
-				tempKey, err := DeriveKeyFromPassword(password, code.(map[string]any)["salt"].(string))
+				tempKey, err := DeriveKeyFromPassword(password, code.(map[string]any)["salt"].(string), KDFParamsOf(code.(map[string]any)))
 				if err != nil {
 					return "", -1, fmt.Errorf("error deriving key from password: %v", err)
 				}
@@ -517,6 +479,7 @@ func CreatePasswordString() string {
 func GenerateBackupCodes(derived_key string) ([]string, []map[string]any, error) {
 	backupCodes := make([]string, 6)
 	codeData := make([]map[string]any, 6)
+	kdfParams := CurrentKDFParams()
 	for i := range 6 {
 		// Initialize the map for this index
 		codeData[i] = make(map[string]any)
@@ -525,7 +488,7 @@ func GenerateBackupCodes(derived_key string) ([]string, []map[string]any, error)
 		code := CreatePasswordString()
 
 		// create hash
-		hash, err := HashPassword(code)
+		hash, err := HashPassword(code, "")
 		if err != nil {
 			return nil, nil, fmt.Errorf("error hashing backup code: %v", err)
 		}
@@ -539,7 +502,7 @@ func GenerateBackupCodes(derived_key string) ([]string, []map[string]any, error)
 		saltBase64 := base64.StdEncoding.EncodeToString(salt)
 
 		// Create derived encryption key to later encrypt the original derived key
-		intermediateKey, err := DeriveKeyFromPassword(code, saltBase64)
+		intermediateKey, err := DeriveKeyFromPassword(code, saltBase64, kdfParams)
 		if err != nil {
 			return nil, nil, fmt.Errorf("error deriving key from password: %v", err)
 		}
@@ -554,6 +517,7 @@ func GenerateBackupCodes(derived_key string) ([]string, []map[string]any, error)
 		codeData[i]["password"] = hash
 		codeData[i]["salt"] = saltBase64
 		codeData[i]["enc_derived_key"] = encDerivedKey
+		codeData[i]["kdf"] = kdfParams.ToMap()
 	}
 
 	return backupCodes, codeData, nil
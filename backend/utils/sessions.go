@@ -0,0 +1,382 @@
+package utils
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Session is a login of a user. The session token itself is only known to the browser (cookie),
+// the server keeps its hash and the derived key wrapped with a key derived from the token.
+type Session struct {
+	ID         string    `json:"id"` // sha256 of the token
+	UserID     int       `json:"user_id"`
+	Username   string    `json:"username"`
+	WrappedKey string    `json:"wrapped_key"`
+	CreatedAt  time.Time `json:"created_at"`
+	ExpiresAt  time.Time `json:"expires_at"`
+	LastSeen   time.Time `json:"last_seen"`
+	IP         string    `json:"ip"`
+	UserAgent  string    `json:"user_agent"`
+}
+
+// ErrSessionNotFound is returned for unknown, expired or revoked sessions
+var ErrSessionNotFound = errors.New("session not found")
+
+// sessionsDoc is the document holding all sessions
+const sessionsDoc = "sessions.json"
+
+// sessionsMutex guards the cached sessions and the read-modify-write cycles on the sessions
+var sessionsMutex sync.Mutex
+
+// sessionFlushInterval is how often changed last-seen times, IPs and user agents are written
+const sessionFlushInterval = time.Minute
+
+// maxUserAgentLength limits the stored user agent
+const maxUserAgentLength = 256
+
+// sessionCache holds the sessions in memory, keyed by their ID, so that requests don't have to read the sessions document.
+// Changes from TouchSession only mark it dirty, they are written by FlushSessions.
+var sessionCache struct {
+	store    Storage // the store the sessions were read from
+	sessions map[string]Session
+	dirty    bool
+}
+
+// sessionID returns the ID under which the session of token is stored
+func sessionID(token string) string {
+	hash := sha256.Sum256([]byte("id:" + token))
+	return hex.EncodeToString(hash[:])
+}
+
+// sessionWrapKey derives the key that wraps the derived key of a session. It can't be computed from the ID.
+func sessionWrapKey(token string) []byte {
+	mac := hmac.New(sha256.New, []byte(token))
+	mac.Write([]byte("dailytxt session key"))
+	return mac.Sum(nil)
+}
+
+// loadSessions returns the cached sessions, reading them from the store first if needed.
+// sessionsMutex must be held.
+func loadSessions() (map[string]Session, error) {
+	if sessionCache.sessions != nil && sessionCache.store == Store {
+		return sessionCache.sessions, nil
+	}
+
+	sessions, err := readSessions()
+	if err != nil {
+		return nil, err
+	}
+	sessionCache.store = Store
+	sessionCache.sessions = make(map[string]Session, len(sessions))
+	sessionCache.dirty = false
+	for _, session := range sessions {
+		sessionCache.sessions[session.ID] = session
+	}
+
+	return sessionCache.sessions, nil
+}
+
+// readSessions reads all sessions from the store
+func readSessions() ([]Session, error) {
+	data, err := Store.ReadDoc(sessionsDoc)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return []Session{}, nil
+		}
+		Logger.Printf("Error reading %s: %v", sessionsDoc, err)
+		return nil, fmt.Errorf("internal server error when trying to read sessions")
+	}
+
+	var content struct {
+		Sessions []Session `json:"sessions"`
+	}
+	if err := json.Unmarshal(data, &content); err != nil {
+		Logger.Printf("Error decoding %s: %v", sessionsDoc, err)
+		return nil, fmt.Errorf("internal server error when trying to read sessions")
+	}
+	if content.Sessions == nil {
+		content.Sessions = []Session{}
+	}
+
+	return content.Sessions, nil
+}
+
+// writeSessions writes the cached sessions, expired sessions are dropped.
+// sessionsMutex must be held.
+func writeSessions() error {
+	now := time.Now()
+	active := make([]Session, 0, len(sessionCache.sessions))
+	for id, session := range sessionCache.sessions {
+		if now.Before(session.ExpiresAt) {
+			active = append(active, session)
+		} else {
+			delete(sessionCache.sessions, id)
+		}
+	}
+	sort.Slice(active, func(i, j int) bool {
+		return active[i].CreatedAt.Before(active[j].CreatedAt)
+	})
+
+	data, err := json.Marshal(map[string]any{"sessions": active})
+	if err != nil {
+		return err
+	}
+	if err := Store.WriteDoc(sessionsDoc, data); err != nil {
+		Logger.Printf("Error writing %s: %v", sessionsDoc, err)
+		// Read the sessions again on the next access
+		sessionCache.sessions = nil
+		return fmt.Errorf("internal server error when trying to write sessions")
+	}
+	sessionCache.dirty = false
+
+	return nil
+}
+
+// FlushSessions writes the last-seen times, IPs and user agents changed since the last write
+func FlushSessions() error {
+	sessionsMutex.Lock()
+	defer sessionsMutex.Unlock()
+
+	if !sessionCache.dirty || sessionCache.store != Store {
+		return nil
+	}
+	return writeSessions()
+}
+
+// StartSessionFlush writes the changed sessions every sessionFlushInterval
+func StartSessionFlush() {
+	go func() {
+		for {
+			time.Sleep(sessionFlushInterval)
+			if err := FlushSessions(); err != nil {
+				Logger.Printf("Error flushing sessions: %v", err)
+			}
+		}
+	}()
+}
+
+// CreateSession starts a new session and returns its token for the cookie
+func CreateSession(userID int, username, derivedKey, ip, userAgent string) (string, error) {
+	// Create a random token
+	tokenBytes := make([]byte, 32)
+	if _, err := rand.Read(tokenBytes); err != nil {
+		return "", fmt.Errorf("error generating session token: %v", err)
+	}
+	token := base64.RawURLEncoding.EncodeToString(tokenBytes)
+
+	// Wrap the derived key with a key that only the token holder can derive
+	aead, err := CreateAEAD(sessionWrapKey(token))
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	wrappedKey := aead.Seal(nonce, nonce, []byte(derivedKey), nil)
+
+	now := time.Now()
+	session := Session{
+		ID:         sessionID(token),
+		UserID:     userID,
+		Username:   username,
+		WrappedKey: base64.StdEncoding.EncodeToString(wrappedKey),
+		CreatedAt:  now,
+		ExpiresAt:  now.Add(time.Duration(Settings.LogoutAfterDays) * 24 * time.Hour),
+		LastSeen:   now,
+		IP:         ip,
+		UserAgent:  truncateUserAgent(userAgent),
+	}
+
+	sessionsMutex.Lock()
+	defer sessionsMutex.Unlock()
+
+	sessions, err := loadSessions()
+	if err != nil {
+		return "", err
+	}
+	sessions[session.ID] = session
+	if err := writeSessions(); err != nil {
+		return "", err
+	}
+
+	return token, nil
+}
+
+// GetSession returns the session of token and its derived key
+func GetSession(token string) (*Session, string, error) {
+	if token == "" {
+		return nil, "", ErrSessionNotFound
+	}
+
+	sessionsMutex.Lock()
+	sessions, err := loadSessions()
+	if err != nil {
+		sessionsMutex.Unlock()
+		return nil, "", err
+	}
+	session, ok := sessions[sessionID(token)]
+	sessionsMutex.Unlock()
+
+	if !ok || !time.Now().Before(session.ExpiresAt) {
+		return nil, "", ErrSessionNotFound
+	}
+
+	// Unwrap the derived key
+	wrappedKey, err := base64.StdEncoding.DecodeString(session.WrappedKey)
+	if err != nil {
+		return nil, "", ErrSessionNotFound
+	}
+	aead, err := CreateAEAD(sessionWrapKey(token))
+	if err != nil {
+		return nil, "", err
+	}
+	if len(wrappedKey) < aead.NonceSize() {
+		return nil, "", ErrSessionNotFound
+	}
+	derivedKey, err := aead.Open(nil, wrappedKey[:aead.NonceSize()], wrappedKey[aead.NonceSize():], nil)
+	if err != nil {
+		return nil, "", ErrSessionNotFound
+	}
+
+	return &session, string(derivedKey), nil
+}
+
+// TouchSession updates the last-seen time, IP and user agent of a session.
+// Only the cache is changed, the sessions are written by the next FlushSessions.
+func TouchSession(session *Session, ip, userAgent string) error {
+	userAgent = truncateUserAgent(userAgent)
+
+	sessionsMutex.Lock()
+	defer sessionsMutex.Unlock()
+
+	sessions, err := loadSessions()
+	if err != nil {
+		return err
+	}
+	cached, ok := sessions[session.ID]
+	if !ok {
+		return nil
+	}
+	cached.LastSeen = time.Now()
+	cached.IP = ip
+	cached.UserAgent = userAgent
+	sessions[session.ID] = cached
+	sessionCache.dirty = true
+
+	return nil
+}
+
+// ListUserSessions returns the active sessions of a user, the most recently used first
+func ListUserSessions(userID int) ([]Session, error) {
+	sessionsMutex.Lock()
+	defer sessionsMutex.Unlock()
+
+	sessions, err := loadSessions()
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	result := []Session{}
+	for _, session := range sessions {
+		if session.UserID == userID && now.Before(session.ExpiresAt) {
+			result = append(result, session)
+		}
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].LastSeen.After(result[j].LastSeen)
+	})
+
+	return result, nil
+}
+
+// DeleteSession ends the session of token
+func DeleteSession(token string) error {
+	id := sessionID(token)
+	return removeSessions(func(session Session) bool {
+		return session.ID == id
+	})
+}
+
+// DeleteUserSession ends the session with the given ID, if it belongs to the user
+func DeleteUserSession(userID int, id string) error {
+	return removeSessions(func(session Session) bool {
+		return session.UserID == userID && session.ID == id
+	})
+}
+
+// DeleteOtherSessions ends all sessions of a user except the one with the given ID
+func DeleteOtherSessions(userID int, keepID string) error {
+	return removeSessions(func(session Session) bool {
+		return session.UserID == userID && session.ID != keepID
+	})
+}
+
+// DeleteUserSessions ends all sessions of a user
+func DeleteUserSessions(userID int) error {
+	return removeSessions(func(session Session) bool {
+		return session.UserID == userID
+	})
+}
+
+// removeSessions removes all sessions matching remove
+func removeSessions(remove func(session Session) bool) error {
+	sessionsMutex.Lock()
+	defer sessionsMutex.Unlock()
+
+	sessions, err := loadSessions()
+	if err != nil {
+		return err
+	}
+
+	removed := false
+	for id, session := range sessions {
+		if remove(session) {
+			delete(sessions, id)
+			removed = true
+		}
+	}
+	if !removed {
+		return nil
+	}
+
+	return writeSessions()
+}
+
+// truncateUserAgent limits the length of a user agent
+func truncateUserAgent(userAgent string) string {
+	if len(userAgent) > maxUserAgentLength {
+		return userAgent[:maxUserAgentLength]
+	}
+	return userAgent
+}
+
+// UpdateSessionsUsername changes the username in all sessions of a user
+func UpdateSessionsUsername(userID int, username string) error {
+	sessionsMutex.Lock()
+	defer sessionsMutex.Unlock()
+
+	sessions, err := loadSessions()
+	if err != nil {
+		return err
+	}
+	for id, session := range sessions {
+		if session.UserID == userID {
+			session.Username = username
+			sessions[id] = session
+		}
+	}
+
+	return writeSessions()
+}
@@ -0,0 +1,71 @@
+package utils
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+// readStoredSessions reads the sessions document, bypassing the cache
+func readStoredSessions(t *testing.T) []Session {
+	t.Helper()
+	data, err := Store.ReadDoc(sessionsDoc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var content struct {
+		Sessions []Session `json:"sessions"`
+	}
+	if err := json.Unmarshal(data, &content); err != nil {
+		t.Fatal(err)
+	}
+	return content.Sessions
+}
+
+func TestSessionCache(t *testing.T) {
+	Store = NewMemoryStorage()
+	Settings.LogoutAfterDays = 30
+
+	token, err := CreateSession(1, "alice", "derived", "10.0.0.1", "agent")
+	if err != nil {
+		t.Fatalf("CreateSession: %v", err)
+	}
+	if stored := readStoredSessions(t); len(stored) != 1 || stored[0].IP != "10.0.0.1" {
+		t.Fatalf("stored sessions = %+v, want the new session", stored)
+	}
+
+	session, derivedKey, err := GetSession(token)
+	if err != nil || derivedKey != "derived" {
+		t.Fatalf("GetSession = %q, %v", derivedKey, err)
+	}
+
+	// Touching only changes the cache
+	if err := TouchSession(session, "10.0.0.2", "other agent"); err != nil {
+		t.Fatalf("TouchSession: %v", err)
+	}
+	if stored := readStoredSessions(t); stored[0].IP != "10.0.0.1" {
+		t.Errorf("the touch was written right away: %+v", stored[0])
+	}
+	sessions, err := ListUserSessions(1)
+	if err != nil || len(sessions) != 1 || sessions[0].IP != "10.0.0.2" {
+		t.Errorf("ListUserSessions = %+v, %v, want the touched session", sessions, err)
+	}
+
+	// The flush writes it
+	if err := FlushSessions(); err != nil {
+		t.Fatalf("FlushSessions: %v", err)
+	}
+	if stored := readStoredSessions(t); stored[0].IP != "10.0.0.2" || stored[0].UserAgent != "other agent" {
+		t.Errorf("stored session after the flush = %+v", stored[0])
+	}
+
+	// A removed session is gone from the cache and the document
+	if err := DeleteSession(token); err != nil {
+		t.Fatalf("DeleteSession: %v", err)
+	}
+	if _, _, err := GetSession(token); err != ErrSessionNotFound {
+		t.Errorf("GetSession after DeleteSession: %v, want ErrSessionNotFound", err)
+	}
+	if stored := readStoredSessions(t); len(stored) != 0 {
+		t.Errorf("stored sessions after DeleteSession = %+v", stored)
+	}
+}
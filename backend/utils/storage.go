@@ -0,0 +1,132 @@
+package utils
+
+import (
+	"fmt"
+	"io"
+	"io/fs"
+	"strings"
+)
+
+// Storage persists all user data. Missing documents and blobs are reported as fs.ErrNotExist.
+type Storage interface {
+	DocumentStore
+	BlobStore
+}
+
+// DocumentStore stores the JSON documents (users.json, month files, tags, templates and settings)
+type DocumentStore interface {
+	// ReadDoc reads a global document like users.json
+	ReadDoc(name string) ([]byte, error)
+	// WriteDoc replaces a global document
+	WriteDoc(name string, data []byte) error
+
+	// ReadUserDoc reads a per-user document like tags.json
+	ReadUserDoc(userID int, name string) ([]byte, error)
+	// WriteUserDoc replaces a per-user document
+	WriteUserDoc(userID int, name string, data []byte) error
+
+	// ReadMonth reads the month document of a user
+	ReadMonth(userID, year, month int) ([]byte, error)
+	// WriteMonth replaces the month document of a user
+	WriteMonth(userID, year, month int, data []byte) error
+
+	// ListYears returns the years with month documents of a user, sorted ascending
+	ListYears(userID int) ([]int, error)
+	// ListMonths returns the months with a document in a year, sorted ascending
+	ListMonths(userID, year int) ([]int, error)
+
+	// UserDocsSize returns the number of bytes used by the documents of a user
+	UserDocsSize(userID int) (int64, error)
+	// DeleteUserDocs removes all documents of a user
+	DeleteUserDocs(userID int) error
+}
+
+// BlobStore stores the (encrypted) uploaded files
+type BlobStore interface {
+	// ReadBlob reads a blob of a user
+	ReadBlob(userID int, name string) ([]byte, error)
+	// WriteBlob stores a blob of a user
+	WriteBlob(userID int, name string, data []byte) error
+	// OpenBlob opens a blob of a user for reading (and seeking) and returns its size
+	OpenBlob(userID int, name string) (io.ReadSeekCloser, int64, error)
+	// WriteBlobFrom stores a blob of a user read from r, which yields exactly size bytes
+	WriteBlobFrom(userID int, name string, r io.Reader, size int64) error
+	// RemoveBlob removes a blob of a user
+	RemoveBlob(userID int, name string) error
+	// ListBlobs returns all blobs of a user
+	ListBlobs(userID int) ([]BlobInfo, error)
+	// DeleteUserBlobs removes all blobs of a user
+	DeleteUserBlobs(userID int) error
+}
+
+// BlobInfo describes a stored blob
+type BlobInfo struct {
+	Name string
+	Size int64
+}
+
+// Store is the storage used by the file handling functions
+var Store Storage
+
+// combinedStorage joins a DocumentStore and a BlobStore from different backends
+type combinedStorage struct {
+	DocumentStore
+	BlobStore
+}
+
+// NewStorage combines a document and a blob store into one Storage
+func NewStorage(docs DocumentStore, blobs BlobStore) Storage {
+	return combinedStorage{DocumentStore: docs, BlobStore: blobs}
+}
+
+// InitStorage sets up the storage backend configured in the settings
+func InitStorage() error {
+	filesystem := NewFilesystemStorage(Settings.DataPath)
+
+	var docs DocumentStore = filesystem
+	if Settings.Storage == "sqlite" {
+		db, err := NewSQLiteStorage(Settings.SQLitePath)
+		if err != nil {
+			return fmt.Errorf("error opening SQLite database: %v", err)
+		}
+		docs = db
+	}
+
+	var blobs BlobStore = filesystem
+	if Settings.FilesStorage == "s3" {
+		bucket, err := NewS3BlobStore(s3ConfigFromSettings())
+		if err != nil {
+			return fmt.Errorf("error setting up S3 storage: %v", err)
+		}
+		blobs = bucket
+	}
+
+	Store = NewStorage(docs, blobs)
+	return nil
+}
+
+// UserDiskUsage returns the number of bytes used by all documents and blobs of a user
+func UserDiskUsage(userID int) (int64, error) {
+	total, err := Store.UserDocsSize(userID)
+	if err != nil {
+		return 0, err
+	}
+
+	blobs, err := Store.ListBlobs(userID)
+	if err != nil {
+		return total, err
+	}
+	for _, blob := range blobs {
+		total += blob.Size
+	}
+
+	return total, nil
+}
+
+// checkStorageName rejects document and blob names that could escape their directory
+func checkStorageName(name string) error {
+	if name == "" || name == "." || name == ".." || strings.ContainsAny(name, "/\\\x00") {
+		return fmt.Errorf("invalid name %q: %w", name, fs.ErrInvalid)
+	}
+	return nil
+}
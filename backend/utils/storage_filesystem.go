@@ -0,0 +1,388 @@
+package utils
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// FilesystemStorage keeps all data in the directory layout below DATA_PATH:
+// users.json, <user>/<year>/<month>.json, <user>/tags.json, ... and <user>/files/<uuid>
+type FilesystemStorage struct {
+	root string
+}
+
+// NewFilesystemStorage creates a storage backend that works on the directory tree at root
+func NewFilesystemStorage(root string) *FilesystemStorage {
+	return &FilesystemStorage{root: root}
+}
+
+func (s *FilesystemStorage) userDir(userID int) string {
+	return filepath.Join(s.root, strconv.Itoa(userID))
+}
+
+func (s *FilesystemStorage) monthPath(userID, year, month int) string {
+	return filepath.Join(s.userDir(userID), strconv.Itoa(year), fmt.Sprintf("%02d.json", month))
+}
+
+func (s *FilesystemStorage) filesDir(userID int) string {
+	return filepath.Join(s.userDir(userID), "files")
+}
+
+// ReadDoc reads a document in the root of the data directory
+func (s *FilesystemStorage) ReadDoc(name string) ([]byte, error) {
+	if err := checkStorageName(name); err != nil {
+		return nil, err
+	}
+	return readWithBackup(filepath.Join(s.root, name))
+}
+
+// WriteDoc writes a document in the root of the data directory
+func (s *FilesystemStorage) WriteDoc(name string, data []byte) error {
+	if err := checkStorageName(name); err != nil {
+		return err
+	}
+	return writeBytesAtomic(filepath.Join(s.root, name), true, data)
+}
+
+// ReadUserDoc reads a document in the directory of a user
+func (s *FilesystemStorage) ReadUserDoc(userID int, name string) ([]byte, error) {
+	if err := checkStorageName(name); err != nil {
+		return nil, err
+	}
+	return readWithBackup(filepath.Join(s.userDir(userID), name))
+}
+
+// WriteUserDoc writes a document in the directory of a user
+func (s *FilesystemStorage) WriteUserDoc(userID int, name string, data []byte) error {
+	if err := checkStorageName(name); err != nil {
+		return err
+	}
+	return writeBytesAtomic(filepath.Join(s.userDir(userID), name), true, data)
+}
+
+// ReadMonth reads <user>/<year>/<month>.json
+func (s *FilesystemStorage) ReadMonth(userID, year, month int) ([]byte, error) {
+	return readWithBackup(s.monthPath(userID, year, month))
+}
+
+// WriteMonth writes <user>/<year>/<month>.json
+func (s *FilesystemStorage) WriteMonth(userID, year, month int, data []byte) error {
+	return writeBytesAtomic(s.monthPath(userID, year, month), true, data)
+}
+
+// ListYears returns the year directories of a user
+func (s *FilesystemStorage) ListYears(userID int) ([]int, error) {
+	entries, err := os.ReadDir(s.userDir(userID))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return []int{}, nil
+		}
+		return nil, err
+	}
+
+	years := []int{}
+	for _, entry := range entries {
+		// A year directory has 4 digits
+		if !entry.IsDir() || len(entry.Name()) != 4 || !isNumeric(entry.Name()) {
+			continue
+		}
+		year, _ := strconv.Atoi(entry.Name())
+		years = append(years, year)
+	}
+	sort.Ints(years)
+
+	return years, nil
+}
+
+// ListMonths returns the month files in a year directory of a user
+func (s *FilesystemStorage) ListMonths(userID, year int) ([]int, error) {
+	entries, err := os.ReadDir(filepath.Join(s.userDir(userID), strconv.Itoa(year)))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return []int{}, nil
+		}
+		return nil, err
+	}
+
+	months := []int{}
+	for _, entry := range entries {
+		// A month file is named like 01.json
+		name := strings.TrimSuffix(entry.Name(), ".json")
+		if entry.IsDir() || name == entry.Name() || len(name) != 2 || !isNumeric(name) {
+			continue
+		}
+		month, _ := strconv.Atoi(name)
+		months = append(months, month)
+	}
+	sort.Ints(months)
+
+	return months, nil
+}
+
+// UserDocsSize returns the size of the user directory without the uploaded files
+func (s *FilesystemStorage) UserDocsSize(userID int) (int64, error) {
+	var total int64
+	filesDir := s.filesDir(userID)
+
+	err := filepath.WalkDir(s.userDir(userID), func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return nil // Continue on errors
+		}
+		if entry.IsDir() {
+			if path == filesDir {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if info, err := entry.Info(); err == nil {
+			total += info.Size()
+		}
+		return nil
+	})
+
+	return total, err
+}
+
+// DeleteUserDocs removes the directory of a user
+func (s *FilesystemStorage) DeleteUserDocs(userID int) error {
+	return os.RemoveAll(s.userDir(userID))
+}
+
+// ReadBlob reads <user>/files/<name>
+func (s *FilesystemStorage) ReadBlob(userID int, name string) ([]byte, error) {
+	if err := checkStorageName(name); err != nil {
+		return nil, err
+	}
+	return os.ReadFile(filepath.Join(s.filesDir(userID), name))
+}
+
+// WriteBlob writes <user>/files/<name>. Blobs are never overwritten, so no backup is kept.
+func (s *FilesystemStorage) WriteBlob(userID int, name string, data []byte) error {
+	if err := checkStorageName(name); err != nil {
+		return err
+	}
+	return writeBytesAtomic(filepath.Join(s.filesDir(userID), name), false, data)
+}
+
+// OpenBlob opens <user>/files/<name>
+func (s *FilesystemStorage) OpenBlob(userID int, name string) (io.ReadSeekCloser, int64, error) {
+	if err := checkStorageName(name); err != nil {
+		return nil, 0, err
+	}
+	file, err := os.Open(filepath.Join(s.filesDir(userID), name))
+	if err != nil {
+		return nil, 0, err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, 0, err
+	}
+	return file, info.Size(), nil
+}
+
+// WriteBlobFrom writes <user>/files/<name> from r
+func (s *FilesystemStorage) WriteBlobFrom(userID int, name string, r io.Reader, size int64) error {
+	if err := checkStorageName(name); err != nil {
+		return err
+	}
+	filePath := filepath.Join(s.filesDir(userID), name)
+	if err := os.MkdirAll(filepath.Dir(filePath), 0755); err != nil {
+		return err
+	}
+	return writeFileAtomic(filePath, false, func(file *os.File) error {
+		written, err := io.Copy(file, r)
+		if err != nil {
+			return err
+		}
+		if written != size {
+			return fmt.Errorf("wrote %d bytes instead of %d", written, size)
+		}
+		return nil
+	})
+}
+
+// RemoveBlob removes <user>/files/<name>
+func (s *FilesystemStorage) RemoveBlob(userID int, name string) error {
+	if err := checkStorageName(name); err != nil {
+		return err
+	}
+	return os.Remove(filepath.Join(s.filesDir(userID), name))
+}
+
+// ListBlobs returns the files in <user>/files
+func (s *FilesystemStorage) ListBlobs(userID int) ([]BlobInfo, error) {
+	entries, err := os.ReadDir(s.filesDir(userID))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return []BlobInfo{}, nil
+		}
+		return nil, err
+	}
+
+	blobs := []BlobInfo{}
+	for _, entry := range entries {
+		// Skip directories and unfinished temporary files
+		if entry.IsDir() || strings.HasPrefix(entry.Name(), ".") {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+		blobs = append(blobs, BlobInfo{Name: entry.Name(), Size: info.Size()})
+	}
+
+	return blobs, nil
+}
+
+// DeleteUserBlobs removes <user>/files
+func (s *FilesystemStorage) DeleteUserBlobs(userID int) error {
+	return os.RemoveAll(s.filesDir(userID))
+}
+
+// readWithBackup reads a file and falls back to <file>.bak if the file can't be decoded
+func readWithBackup(filePath string) ([]byte, error) {
+	data, err := os.ReadFile(filePath)
+	if err != nil && os.IsNotExist(err) {
+		return nil, err
+	}
+	if err == nil && validDocument(filePath, data) {
+		return data, nil
+	}
+
+	// Try the backup of the previous version
+	if backup, backupErr := os.ReadFile(filePath + ".bak"); backupErr == nil && validDocument(filePath, backup) {
+		Logger.Printf("Using backup %s.bak, as %s could not be decoded", filePath, filePath)
+		return backup, nil
+	}
+
+	return data, err
+}
+
+// validDocument checks if the content of a document is complete.
+// JSON documents must decode, other documents must not be empty.
+func validDocument(filePath string, data []byte) bool {
+	if len(bytes.TrimSpace(data)) == 0 {
+		return false
+	}
+	if strings.HasSuffix(filePath, ".json") {
+		return json.Valid(data)
+	}
+	return true
+}
+
+// writeBytesAtomic creates the parent directory and writes data atomically
+func writeBytesAtomic(filePath string, keepBackup bool, data []byte) error {
+	if err := os.MkdirAll(filepath.Dir(filePath), 0755); err != nil {
+		return err
+	}
+	return writeFileAtomic(filePath, keepBackup, func(file *os.File) error {
+		_, err := file.Write(data)
+		return err
+	})
+}
+
+// writeFileAtomic writes a file via a temporary file in the same directory, which is
+// fsynced and renamed over the target. If keepBackup is set, the previous version is kept as <file>.bak
+func writeFileAtomic(filePath string, keepBackup bool, write func(file *os.File) error) error {
+	dirPath := filepath.Dir(filePath)
+
+	// Create the temporary file next to the target, so that the rename stays on one filesystem
+	tmpFile, err := os.CreateTemp(dirPath, "."+filepath.Base(filePath)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	tmpPath := tmpFile.Name()
+	success := false
+	defer func() {
+		if !success {
+			tmpFile.Close()
+			os.Remove(tmpPath)
+		}
+	}()
+
+	// Write and flush the content to disk
+	if err := write(tmpFile); err != nil {
+		return err
+	}
+	if err := tmpFile.Sync(); err != nil {
+		return err
+	}
+	if err := tmpFile.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmpPath, 0644); err != nil {
+		return err
+	}
+
+	// Keep the previous version as .bak
+	if keepBackup {
+		if err := backupFile(filePath); err != nil {
+			return err
+		}
+	}
+
+	// Replace the target and persist the rename
+	if err := os.Rename(tmpPath, filePath); err != nil {
+		return err
+	}
+	success = true
+
+	return syncDir(dirPath)
+}
+
+// backupFile keeps the current content of filePath as <file>.bak (if the file exists)
+func backupFile(filePath string) error {
+	backupPath := filePath + ".bak"
+
+	// Don't replace a good backup with a broken file
+	data, err := os.ReadFile(filePath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	if !validDocument(filePath, data) {
+		Logger.Printf("Not backing up %s, as it can't be decoded", filePath)
+		return nil
+	}
+
+	// A hard link keeps the old content once the target is renamed over
+	if err := os.Remove(backupPath); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err := os.Link(filePath, backupPath); err == nil {
+		return nil
+	}
+
+	// Fall back to copying on filesystems without hard links
+	return writeFileAtomic(backupPath, false, func(file *os.File) error {
+		_, err := file.Write(data)
+		return err
+	})
+}
+
+// syncDir fsyncs a directory, so that a rename inside of it survives a crash
+func syncDir(dirPath string) error {
+	dir, err := os.Open(dirPath)
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+
+	if err := dir.Sync(); err != nil && !errors.Is(err, os.ErrInvalid) {
+		return err
+	}
+	return nil
+}
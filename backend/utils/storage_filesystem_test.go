@@ -0,0 +1,115 @@
+package utils
+
+import (
+	"errors"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// tempFiles returns the temporary files of atomic writes below dir
+func tempFiles(t *testing.T, dir string) []string {
+	t.Helper()
+
+	var found []string
+	err := filepath.WalkDir(dir, func(path string, entry os.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if strings.Contains(entry.Name(), ".tmp-") {
+			found = append(found, path)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return found
+}
+
+func TestReadWithBackup(t *testing.T) {
+	dataPath := t.TempDir()
+	store := NewFilesystemStorage(dataPath)
+	monthPath := filepath.Join(dataPath, "1", "2024", "05.json")
+
+	for _, content := range []string{`{"days": [1]}`, `{"days": [2]}`} {
+		if err := store.WriteMonth(1, 2024, 5, []byte(content)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if backup, err := os.ReadFile(monthPath + ".bak"); err != nil || string(backup) != `{"days": [1]}` {
+		t.Fatalf("backup = %q, %v, want the first version", backup, err)
+	}
+
+	tests := []struct {
+		name    string
+		primary string
+	}{
+		{"truncated", `{"days": [`},
+		{"corrupted", "\x00\x00\x00\x00"},
+		{"empty", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := os.WriteFile(monthPath, []byte(tt.primary), 0644); err != nil {
+				t.Fatal(err)
+			}
+			data, err := store.ReadMonth(1, 2024, 5)
+			if err != nil || string(data) != `{"days": [1]}` {
+				t.Errorf("ReadMonth = %q, %v, want the backup", data, err)
+			}
+		})
+	}
+
+	// A broken primary doesn't replace the good backup on the next write
+	if err := store.WriteMonth(1, 2024, 5, []byte(`{"days": [3]}`)); err != nil {
+		t.Fatal(err)
+	}
+	if backup, _ := os.ReadFile(monthPath + ".bak"); string(backup) != `{"days": [1]}` {
+		t.Errorf("backup after writing over a broken file = %q, want the first version", backup)
+	}
+
+	if _, err := store.ReadMonth(1, 2024, 6); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("ReadMonth of a missing month: %v, want not exist", err)
+	}
+	if files := tempFiles(t, dataPath); len(files) != 0 {
+		t.Errorf("temporary files are left: %v", files)
+	}
+}
+
+func TestWriteFileAtomicFailure(t *testing.T) {
+	dir := t.TempDir()
+	filePath := filepath.Join(dir, "tags.json")
+	if err := writeBytesAtomic(filePath, true, []byte(`{"tags": []}`)); err != nil {
+		t.Fatal(err)
+	}
+
+	// A failed write leaves the file as it was
+	err := writeFileAtomic(filePath, true, func(file *os.File) error {
+		file.Write([]byte(`{"tags": [`))
+		return errors.New("encoding failed")
+	})
+	if err == nil {
+		t.Fatal("writeFileAtomic succeeded although the write failed")
+	}
+	if data, _ := os.ReadFile(filePath); string(data) != `{"tags": []}` {
+		t.Errorf("content after the failed write = %q", data)
+	}
+	if files := tempFiles(t, dir); len(files) != 0 {
+		t.Errorf("temporary files are left: %v", files)
+	}
+
+	// A document that can't be encoded is not written at all
+	Store = NewFilesystemStorage(dir)
+	if err := writeUserDocument(1, "tags.json", map[string]any{"value": math.NaN()}); err == nil {
+		t.Fatal("writeUserDocument succeeded with a value that can't be encoded")
+	}
+	if _, err := os.Stat(filepath.Join(dir, "1", "tags.json")); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("the document was written: %v", err)
+	}
+	if files := tempFiles(t, dir); len(files) != 0 {
+		t.Errorf("temporary files are left: %v", files)
+	}
+}
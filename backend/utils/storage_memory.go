@@ -0,0 +1,214 @@
+package utils
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/fs"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// MemoryStorage keeps all data in memory. It is meant for tests and throwaway instances.
+type MemoryStorage struct {
+	mu    sync.RWMutex
+	docs  map[string][]byte
+	blobs map[string][]byte
+}
+
+// NewMemoryStorage creates an empty in-memory storage backend
+func NewMemoryStorage() *MemoryStorage {
+	return &MemoryStorage{
+		docs:  map[string][]byte{},
+		blobs: map[string][]byte{},
+	}
+}
+
+func (s *MemoryStorage) read(m map[string][]byte, key string) ([]byte, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	data, ok := m[key]
+	if !ok {
+		return nil, fmt.Errorf("%s: %w", key, fs.ErrNotExist)
+	}
+	return append([]byte(nil), data...), nil
+}
+
+func (s *MemoryStorage) write(m map[string][]byte, key string, data []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	m[key] = append([]byte(nil), data...)
+	return nil
+}
+
+// deletePrefix removes all entries of m starting with prefix
+func (s *MemoryStorage) deletePrefix(m map[string][]byte, prefix string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for key := range m {
+		if strings.HasPrefix(key, prefix) {
+			delete(m, key)
+		}
+	}
+}
+
+// ReadDoc reads a global document
+func (s *MemoryStorage) ReadDoc(name string) ([]byte, error) {
+	return s.read(s.docs, name)
+}
+
+// WriteDoc writes a global document
+func (s *MemoryStorage) WriteDoc(name string, data []byte) error {
+	return s.write(s.docs, name, data)
+}
+
+// ReadUserDoc reads a per-user document
+func (s *MemoryStorage) ReadUserDoc(userID int, name string) ([]byte, error) {
+	return s.read(s.docs, fmt.Sprintf("%d/%s", userID, name))
+}
+
+// WriteUserDoc writes a per-user document
+func (s *MemoryStorage) WriteUserDoc(userID int, name string, data []byte) error {
+	return s.write(s.docs, fmt.Sprintf("%d/%s", userID, name), data)
+}
+
+// ReadMonth reads a month document
+func (s *MemoryStorage) ReadMonth(userID, year, month int) ([]byte, error) {
+	return s.read(s.docs, fmt.Sprintf("%d/%d/%02d", userID, year, month))
+}
+
+// WriteMonth writes a month document
+func (s *MemoryStorage) WriteMonth(userID, year, month int, data []byte) error {
+	return s.write(s.docs, fmt.Sprintf("%d/%d/%02d", userID, year, month), data)
+}
+
+// ListYears returns the years with month documents of a user
+func (s *MemoryStorage) ListYears(userID int) ([]int, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	seen := map[int]bool{}
+	years := []int{}
+	for key := range s.docs {
+		var id, year, month int
+		if n, _ := fmt.Sscanf(key, "%d/%d/%d", &id, &year, &month); n != 3 || id != userID || seen[year] {
+			continue
+		}
+		seen[year] = true
+		years = append(years, year)
+	}
+	sort.Ints(years)
+
+	return years, nil
+}
+
+// ListMonths returns the months with a document in a year
+func (s *MemoryStorage) ListMonths(userID, year int) ([]int, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	months := []int{}
+	for key := range s.docs {
+		var id, y, month int
+		if n, _ := fmt.Sscanf(key, "%d/%d/%d", &id, &y, &month); n != 3 || id != userID || y != year {
+			continue
+		}
+		months = append(months, month)
+	}
+	sort.Ints(months)
+
+	return months, nil
+}
+
+// UserDocsSize returns the size of all documents of a user
+func (s *MemoryStorage) UserDocsSize(userID int) (int64, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var total int64
+	prefix := fmt.Sprintf("%d/", userID)
+	for key, data := range s.docs {
+		if strings.HasPrefix(key, prefix) {
+			total += int64(len(data))
+		}
+	}
+
+	return total, nil
+}
+
+// DeleteUserDocs removes all documents of a user
+func (s *MemoryStorage) DeleteUserDocs(userID int) error {
+	s.deletePrefix(s.docs, fmt.Sprintf("%d/", userID))
+	return nil
+}
+
+// ReadBlob reads a blob
+func (s *MemoryStorage) ReadBlob(userID int, name string) ([]byte, error) {
+	return s.read(s.blobs, fmt.Sprintf("%d/%s", userID, name))
+}
+
+// WriteBlob writes a blob
+func (s *MemoryStorage) WriteBlob(userID int, name string, data []byte) error {
+	return s.write(s.blobs, fmt.Sprintf("%d/%s", userID, name), data)
+}
+
+// OpenBlob opens a blob for reading
+func (s *MemoryStorage) OpenBlob(userID int, name string) (io.ReadSeekCloser, int64, error) {
+	data, err := s.ReadBlob(userID, name)
+	if err != nil {
+		return nil, 0, err
+	}
+	return readSeekCloser{bytes.NewReader(data), io.NopCloser(nil)}, int64(len(data)), nil
+}
+
+// WriteBlobFrom writes a blob read from r
+func (s *MemoryStorage) WriteBlobFrom(userID int, name string, r io.Reader, size int64) error {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	if int64(len(data)) != size {
+		return fmt.Errorf("read %d bytes instead of %d", len(data), size)
+	}
+	return s.WriteBlob(userID, name, data)
+}
+
+// RemoveBlob removes a blob
+func (s *MemoryStorage) RemoveBlob(userID int, name string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	key := fmt.Sprintf("%d/%s", userID, name)
+	if _, ok := s.blobs[key]; !ok {
+		return fmt.Errorf("%s: %w", key, fs.ErrNotExist)
+	}
+	delete(s.blobs, key)
+	return nil
+}
+
+// ListBlobs returns all blobs of a user
+func (s *MemoryStorage) ListBlobs(userID int) ([]BlobInfo, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	blobs := []BlobInfo{}
+	prefix := fmt.Sprintf("%d/", userID)
+	for key, data := range s.blobs {
+		if name, ok := strings.CutPrefix(key, prefix); ok {
+			blobs = append(blobs, BlobInfo{Name: name, Size: int64(len(data))})
+		}
+	}
+	sort.Slice(blobs, func(i, j int) bool { return blobs[i].Name < blobs[j].Name })
+
+	return blobs, nil
+}
+
+// DeleteUserBlobs removes all blobs of a user
+func (s *MemoryStorage) DeleteUserBlobs(userID int) error {
+	s.deletePrefix(s.blobs, fmt.Sprintf("%d/", userID))
+	return nil
+}
@@ -0,0 +1,523 @@
+package utils
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/fs"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// S3Config holds the connection settings of an S3-compatible bucket
+type S3Config struct {
+	Endpoint  string // e.g. https://s3.eu-central-1.amazonaws.com or http://minio:9000
+	Region    string
+	Bucket    string
+	AccessKey string
+	SecretKey string
+	Prefix    string // Prepended to all object keys
+	PathStyle bool   // Use <endpoint>/<bucket>/<key> instead of <bucket>.<endpoint>/<key>
+}
+
+// S3BlobStore keeps the blobs in an S3-compatible bucket as <prefix><user>/files/<name>.
+// The blobs are encrypted before they are stored, so the bucket only ever sees ciphertext.
+type S3BlobStore struct {
+	config   S3Config
+	endpoint *url.URL
+	client   *http.Client
+	now      func() time.Time
+}
+
+// s3RequestTimeout limits the requests without a blob in their body or response (HEAD, DELETE, listing).
+// Uploads and downloads of blobs take as long as they need, the transport only limits the
+// time to connect and to wait for the response.
+const s3RequestTimeout = time.Minute
+
+// newS3Transport returns the transport of the S3 client
+func newS3Transport() *http.Transport {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DialContext = (&net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second}).DialContext
+	transport.TLSHandshakeTimeout = 10 * time.Second
+	transport.ResponseHeaderTimeout = time.Minute
+	return transport
+}
+
+// NewS3BlobStore creates a blob store for the configured bucket
+func NewS3BlobStore(config S3Config) (*S3BlobStore, error) {
+	if config.Endpoint == "" || config.Bucket == "" {
+		return nil, fmt.Errorf("S3 endpoint and bucket must be set")
+	}
+	endpoint, err := url.Parse(strings.TrimSuffix(config.Endpoint, "/"))
+	if err != nil || endpoint.Host == "" {
+		return nil, fmt.Errorf("invalid S3 endpoint %q", config.Endpoint)
+	}
+	if config.Region == "" {
+		config.Region = "us-east-1"
+	}
+
+	return &S3BlobStore{
+		config:   config,
+		endpoint: endpoint,
+		client:   &http.Client{Transport: newS3Transport()},
+		now:      time.Now,
+	}, nil
+}
+
+func (s *S3BlobStore) userPrefix(userID int) string {
+	return fmt.Sprintf("%s%d/files/", s.config.Prefix, userID)
+}
+
+// ReadBlob downloads a blob
+func (s *S3BlobStore) ReadBlob(userID int, name string) ([]byte, error) {
+	if err := checkStorageName(name); err != nil {
+		return nil, err
+	}
+
+	blob, _, err := s.OpenBlob(userID, name)
+	if err != nil {
+		return nil, err
+	}
+	defer blob.Close()
+
+	return io.ReadAll(blob)
+}
+
+// WriteBlob uploads a blob
+func (s *S3BlobStore) WriteBlob(userID int, name string, data []byte) error {
+	if err := checkStorageName(name); err != nil {
+		return err
+	}
+
+	payloadHash := sha256.Sum256(data)
+	resp, err := s.send(http.MethodPut, s.userPrefix(userID)+name, nil, nil, bytes.NewReader(data), int64(len(data)), hex.EncodeToString(payloadHash[:]), 0)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// OpenBlob starts the download of a blob. Seeking starts a new download at the position.
+func (s *S3BlobStore) OpenBlob(userID int, name string) (io.ReadSeekCloser, int64, error) {
+	if err := checkStorageName(name); err != nil {
+		return nil, 0, err
+	}
+	key := s.userPrefix(userID) + name
+
+	payloadHash := sha256.Sum256(nil)
+	resp, err := s.send(http.MethodGet, key, nil, nil, nil, 0, hex.EncodeToString(payloadHash[:]), 0)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	// A chunked response has no length
+	size := resp.ContentLength
+	if size < 0 {
+		if size, err = s.objectSize(key, resp.Header); err != nil {
+			resp.Body.Close()
+			return nil, 0, err
+		}
+	}
+	return &s3BlobReader{store: s, key: key, size: size, body: resp.Body}, size, nil
+}
+
+// objectSize returns the size of an object from the Content-Range of a response or, without it,
+// from the Content-Length of a HEAD request
+func (s *S3BlobStore) objectSize(key string, header http.Header) (int64, error) {
+	if _, total, ok := strings.Cut(header.Get("Content-Range"), "/"); ok {
+		if size, err := strconv.ParseInt(total, 10, 64); err == nil {
+			return size, nil
+		}
+	}
+
+	resp, err := s.do(http.MethodHead, key, nil, nil)
+	if err != nil {
+		return 0, err
+	}
+	resp.Body.Close()
+	if resp.ContentLength < 0 {
+		return 0, fmt.Errorf("S3 HEAD %s: no Content-Length", key)
+	}
+	return resp.ContentLength, nil
+}
+
+// s3BlobReader reads a blob, seeking is done with ranged GET requests
+type s3BlobReader struct {
+	store *S3BlobStore
+	key   string
+	size  int64
+	pos   int64
+	body  io.ReadCloser // download starting at pos, nil after seeking
+}
+
+func (b *s3BlobReader) Read(p []byte) (int, error) {
+	if b.pos >= b.size {
+		return 0, io.EOF
+	}
+	if b.body == nil {
+		payloadHash := sha256.Sum256(nil)
+		header := http.Header{"Range": {fmt.Sprintf("bytes=%d-", b.pos)}}
+		resp, err := b.store.send(http.MethodGet, b.key, nil, header, nil, 0, hex.EncodeToString(payloadHash[:]), 0)
+		if err != nil {
+			return 0, err
+		}
+		if resp.StatusCode != http.StatusPartialContent {
+			resp.Body.Close()
+			return 0, fmt.Errorf("S3 GET %s: range not supported (%s)", b.key, resp.Status)
+		}
+		b.body = resp.Body
+	}
+
+	n, err := b.body.Read(p)
+	b.pos += int64(n)
+	if err == io.EOF && b.pos < b.size {
+		err = io.ErrUnexpectedEOF
+	}
+	return n, err
+}
+
+func (b *s3BlobReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += b.pos
+	case io.SeekEnd:
+		offset += b.size
+	default:
+		return 0, fmt.Errorf("invalid whence %d", whence)
+	}
+	if offset < 0 {
+		return 0, fmt.Errorf("negative position")
+	}
+	if offset != b.pos && b.body != nil {
+		b.body.Close()
+		b.body = nil
+	}
+	b.pos = offset
+	return offset, nil
+}
+
+func (b *s3BlobReader) Close() error {
+	if b.body == nil {
+		return nil
+	}
+	return b.body.Close()
+}
+
+// WriteBlobFrom uploads a blob read from r. The payload is not part of the signature,
+// as it would have to be read twice for that.
+func (s *S3BlobStore) WriteBlobFrom(userID int, name string, r io.Reader, size int64) error {
+	if err := checkStorageName(name); err != nil {
+		return err
+	}
+
+	resp, err := s.send(http.MethodPut, s.userPrefix(userID)+name, nil, nil, r, size, s3UnsignedPayload, 0)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// RemoveBlob deletes a blob. Like on the filesystem, removing a missing blob is an error.
+func (s *S3BlobStore) RemoveBlob(userID int, name string) error {
+	if err := checkStorageName(name); err != nil {
+		return err
+	}
+	key := s.userPrefix(userID) + name
+
+	// S3 doesn't report missing objects on DELETE
+	resp, err := s.do(http.MethodHead, key, nil, nil)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	return s.deleteObject(key)
+}
+
+// ListBlobs lists the blobs of a user
+func (s *S3BlobStore) ListBlobs(userID int) ([]BlobInfo, error) {
+	prefix := s.userPrefix(userID)
+
+	blobs := []BlobInfo{}
+	err := s.listObjects(prefix, func(key string, size int64) {
+		blobs = append(blobs, BlobInfo{Name: strings.TrimPrefix(key, prefix), Size: size})
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return blobs, nil
+}
+
+// DeleteUserBlobs deletes all blobs of a user
+func (s *S3BlobStore) DeleteUserBlobs(userID int) error {
+	keys := []string{}
+	err := s.listObjects(s.userPrefix(userID), func(key string, size int64) {
+		keys = append(keys, key)
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, key := range keys {
+		if err := s.deleteObject(key); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (s *S3BlobStore) deleteObject(key string) error {
+	resp, err := s.do(http.MethodDelete, key, nil, nil)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// listBucketResult is the response of ListObjectsV2
+type listBucketResult struct {
+	Contents []struct {
+		Key  string `xml:"Key"`
+		Size int64  `xml:"Size"`
+	} `xml:"Contents"`
+	IsTruncated           bool   `xml:"IsTruncated"`
+	NextContinuationToken string `xml:"NextContinuationToken"`
+}
+
+// listObjects calls found for every object below prefix, following the pagination of ListObjectsV2
+func (s *S3BlobStore) listObjects(prefix string, found func(key string, size int64)) error {
+	token := ""
+	for {
+		query := url.Values{}
+		query.Set("list-type", "2")
+		query.Set("prefix", prefix)
+		if token != "" {
+			query.Set("continuation-token", token)
+		}
+
+		resp, err := s.do(http.MethodGet, "", query, nil)
+		if err != nil {
+			return err
+		}
+		var result listBucketResult
+		err = xml.NewDecoder(resp.Body).Decode(&result)
+		resp.Body.Close()
+		if err != nil {
+			return fmt.Errorf("error decoding S3 object list: %v", err)
+		}
+
+		for _, object := range result.Contents {
+			found(object.Key, object.Size)
+		}
+
+		if !result.IsTruncated || result.NextContinuationToken == "" {
+			return nil
+		}
+		token = result.NextContinuationToken
+	}
+}
+
+// s3UnsignedPayload replaces the payload hash in requests with a streamed body
+const s3UnsignedPayload = "UNSIGNED-PAYLOAD"
+
+// do sends a short signed request for key (or the bucket, if key is empty), limited to s3RequestTimeout.
+// Missing objects are reported as fs.ErrNotExist, other unsuccessful responses as errors.
+func (s *S3BlobStore) do(method, key string, query url.Values, body []byte) (*http.Response, error) {
+	payloadHash := sha256.Sum256(body)
+	return s.send(method, key, query, nil, bytes.NewReader(body), int64(len(body)), hex.EncodeToString(payloadHash[:]), s3RequestTimeout)
+}
+
+// cancelOnClose ends the context of a request when its response body is closed
+type cancelOnClose struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (b cancelOnClose) Close() error {
+	err := b.ReadCloser.Close()
+	b.cancel()
+	return err
+}
+
+// send sends a request with a body of size bytes, signed with payloadHash (see do).
+// The header is added unsigned. A timeout limits the whole request including the response body,
+// without one only the transport limits it. The context of the request ends when the body is closed.
+func (s *S3BlobStore) send(method, key string, query url.Values, header http.Header, body io.Reader, size int64, payloadHash string, timeout time.Duration) (*http.Response, error) {
+	// Build the URL
+	target := *s.endpoint
+	path := target.Path
+	if s.config.PathStyle {
+		path += "/" + s.config.Bucket
+	} else {
+		target.Host = s.config.Bucket + "." + target.Host
+	}
+	path += "/" + key
+	target.Path = path
+	target.RawPath = s3EscapePath(path)
+	target.RawQuery = s3EncodeQuery(query)
+
+	var ctx context.Context
+	var cancel context.CancelFunc
+	if timeout > 0 {
+		ctx, cancel = context.WithTimeout(context.Background(), timeout)
+	} else {
+		ctx, cancel = context.WithCancel(context.Background())
+	}
+	req, err := http.NewRequestWithContext(ctx, method, target.String(), body)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	if size == 0 {
+		req.Body = http.NoBody
+	}
+	req.ContentLength = size
+	s.sign(req, payloadHash)
+	for name, values := range header {
+		req.Header[name] = values
+	}
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		cancel()
+		return nil, fmt.Errorf("S3 %s %s: %v", method, key, err)
+	}
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		resp.Body = cancelOnClose{ReadCloser: resp.Body, cancel: cancel}
+		return resp, nil
+	}
+	defer cancel()
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound && key != "" {
+		return nil, fmt.Errorf("%s: %w", key, fs.ErrNotExist)
+	}
+	message, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+	return nil, fmt.Errorf("S3 %s %s: %s %s", method, key, resp.Status, strings.TrimSpace(string(message)))
+}
+
+// sign adds an AWS Signature Version 4 to the request
+func (s *S3BlobStore) sign(req *http.Request, payloadHex string) {
+	now := s.now().UTC()
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHex)
+
+	// Canonical request
+	headers := map[string]string{
+		"host":                 req.URL.Host,
+		"x-amz-content-sha256": payloadHex,
+		"x-amz-date":           amzDate,
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHex,
+	}, "\n")
+
+	// String to sign
+	scope := date + "/" + s.config.Region + "/s3/aws4_request"
+	canonicalHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(canonicalHash[:])
+
+	// Signing key and signature
+	key := hmacSHA256([]byte("AWS4"+s.config.SecretKey), date)
+	key = hmacSHA256(key, s.config.Region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s.config.AccessKey, scope, signedHeaders, signature))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// s3EscapePath escapes a path like SigV4 expects it: everything except unreserved characters and "/"
+func s3EscapePath(path string) string {
+	var escaped strings.Builder
+	for i := 0; i < len(path); i++ {
+		c := path[i]
+		if c == '/' || isUnreserved(c) {
+			escaped.WriteByte(c)
+		} else {
+			fmt.Fprintf(&escaped, "%%%02X", c)
+		}
+	}
+	return escaped.String()
+}
+
+// s3EncodeQuery encodes the query sorted by key, with SigV4 escaping
+func s3EncodeQuery(query url.Values) string {
+	keys := make([]string, 0, len(query))
+	for key := range query {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	parts := []string{}
+	for _, key := range keys {
+		for _, value := range query[key] {
+			parts = append(parts, s3EscapeQuery(key)+"="+s3EscapeQuery(value))
+		}
+	}
+	return strings.Join(parts, "&")
+}
+
+func s3EscapeQuery(value string) string {
+	return strings.ReplaceAll(s3EscapePath(value), "/", "%2F")
+}
+
+func isUnreserved(c byte) bool {
+	return 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' ||
+		c == '-' || c == '_' || c == '.' || c == '~'
+}
+
+// s3ConfigFromSettings builds the bucket configuration from the settings
+func s3ConfigFromSettings() S3Config {
+	return S3Config{
+		Endpoint:  Settings.S3Endpoint,
+		Region:    Settings.S3Region,
+		Bucket:    Settings.S3Bucket,
+		AccessKey: Settings.S3AccessKey,
+		SecretKey: Settings.S3SecretKey,
+		Prefix:    Settings.S3Prefix,
+		PathStyle: Settings.S3PathStyle,
+	}
+}
@@ -0,0 +1,439 @@
+package utils
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+
+	_ "modernc.org/sqlite"
+)
+
+// SQLiteStorage keeps the documents in an SQLite database. Days and their files are stored as rows,
+// with exactly the same (encrypted) field values as in the JSON month files. Blobs are not part of it.
+type SQLiteStorage struct {
+	db *sql.DB
+}
+
+const sqliteSchema = `
+CREATE TABLE IF NOT EXISTS docs (
+	name TEXT PRIMARY KEY,
+	data BLOB NOT NULL
+);
+CREATE TABLE IF NOT EXISTS user_docs (
+	user_id INTEGER NOT NULL,
+	name    TEXT NOT NULL,
+	data    BLOB NOT NULL,
+	PRIMARY KEY (user_id, name)
+);
+CREATE TABLE IF NOT EXISTS months (
+	user_id INTEGER NOT NULL,
+	year    INTEGER NOT NULL,
+	month   INTEGER NOT NULL,
+	extra   TEXT NOT NULL,
+	split   INTEGER NOT NULL,
+	PRIMARY KEY (user_id, year, month)
+);
+CREATE TABLE IF NOT EXISTS days (
+	user_id       INTEGER NOT NULL,
+	year          INTEGER NOT NULL,
+	month         INTEGER NOT NULL,
+	position      INTEGER NOT NULL,
+	day           INTEGER,
+	text          TEXT,
+	date_written  TEXT,
+	tags          TEXT,
+	is_bookmarked INTEGER,
+	extra         TEXT NOT NULL,
+	PRIMARY KEY (user_id, year, month, position)
+);
+CREATE TABLE IF NOT EXISTS day_files (
+	user_id       INTEGER NOT NULL,
+	year          INTEGER NOT NULL,
+	month         INTEGER NOT NULL,
+	day_position  INTEGER NOT NULL,
+	position      INTEGER NOT NULL,
+	uuid_filename TEXT,
+	enc_filename  TEXT,
+	size          INTEGER,
+	extra         TEXT NOT NULL,
+	PRIMARY KEY (user_id, year, month, day_position, position)
+);
+CREATE TABLE IF NOT EXISTS migration_state (
+	source   TEXT PRIMARY KEY,
+	size     INTEGER NOT NULL,
+	mod_time INTEGER NOT NULL
+);
+`
+
+// NewSQLiteStorage opens (and if needed creates) the SQLite database at path
+func NewSQLiteStorage(path string) (*SQLiteStorage, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+
+	dsn := "file:" + path + "?_pragma=busy_timeout(10000)&_pragma=journal_mode(WAL)&_pragma=synchronous(FULL)"
+	db, err := sql.Open("sqlite", dsn)
+	if err != nil {
+		return nil, err
+	}
+
+	// SQLite allows one writer at a time, a single connection avoids busy errors
+	db.SetMaxOpenConns(1)
+
+	if _, err := db.Exec(sqliteSchema); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("error creating database schema: %v", err)
+	}
+
+	return &SQLiteStorage{db: db}, nil
+}
+
+// Close closes the database
+func (s *SQLiteStorage) Close() error {
+	return s.db.Close()
+}
+
+// notFound returns fs.ErrNotExist for missing rows
+func notFound(err error, what string) error {
+	if errors.Is(err, sql.ErrNoRows) {
+		return fmt.Errorf("%s: %w", what, fs.ErrNotExist)
+	}
+	return err
+}
+
+// ReadDoc reads a global document
+func (s *SQLiteStorage) ReadDoc(name string) ([]byte, error) {
+	var data []byte
+	err := s.db.QueryRow(`SELECT data FROM docs WHERE name = ?`, name).Scan(&data)
+	return data, notFound(err, name)
+}
+
+// WriteDoc writes a global document
+func (s *SQLiteStorage) WriteDoc(name string, data []byte) error {
+	_, err := s.db.Exec(`INSERT INTO docs (name, data) VALUES (?, ?)
+		ON CONFLICT (name) DO UPDATE SET data = excluded.data`, name, data)
+	return err
+}
+
+// ReadUserDoc reads a per-user document
+func (s *SQLiteStorage) ReadUserDoc(userID int, name string) ([]byte, error) {
+	var data []byte
+	err := s.db.QueryRow(`SELECT data FROM user_docs WHERE user_id = ? AND name = ?`, userID, name).Scan(&data)
+	return data, notFound(err, fmt.Sprintf("%d/%s", userID, name))
+}
+
+// WriteUserDoc writes a per-user document
+func (s *SQLiteStorage) WriteUserDoc(userID int, name string, data []byte) error {
+	_, err := s.db.Exec(`INSERT INTO user_docs (user_id, name, data) VALUES (?, ?, ?)
+		ON CONFLICT (user_id, name) DO UPDATE SET data = excluded.data`, userID, name, data)
+	return err
+}
+
+// ReadMonth assembles the month document from its rows, encoded like the month files of the JSON tree
+func (s *SQLiteStorage) ReadMonth(userID, year, month int) ([]byte, error) {
+	var extra string
+	var split bool
+	err := s.db.QueryRow(`SELECT extra, split FROM months WHERE user_id = ? AND year = ? AND month = ?`,
+		userID, year, month).Scan(&extra, &split)
+	if err != nil {
+		return nil, notFound(err, fmt.Sprintf("%d/%d/%02d", userID, year, month))
+	}
+
+	content := map[string]any{}
+	if err := json.Unmarshal([]byte(extra), &content); err != nil {
+		return nil, err
+	}
+	if !split {
+		return encodeDocument(content, false)
+	}
+
+	// Read the days
+	days := []any{}
+	rows, err := s.db.Query(`SELECT position, day, text, date_written, tags, is_bookmarked, extra FROM days
+		WHERE user_id = ? AND year = ? AND month = ? ORDER BY position`, userID, year, month)
+	if err != nil {
+		return nil, err
+	}
+	positions := map[int]map[string]any{}
+	for rows.Next() {
+		var position int
+		var dayNum sql.NullInt64
+		var text, dateWritten, tags sql.NullString
+		var isBookmarked sql.NullBool
+		var dayExtra string
+		if err := rows.Scan(&position, &dayNum, &text, &dateWritten, &tags, &isBookmarked, &dayExtra); err != nil {
+			rows.Close()
+			return nil, err
+		}
+
+		day := map[string]any{}
+		if err := json.Unmarshal([]byte(dayExtra), &day); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		if dayNum.Valid {
+			day["day"] = dayNum.Int64
+		}
+		if text.Valid {
+			day["text"] = text.String
+		}
+		if dateWritten.Valid {
+			day["date_written"] = dateWritten.String
+		}
+		if tags.Valid {
+			day["tags"] = json.RawMessage(tags.String)
+		}
+		if isBookmarked.Valid {
+			day["isBookmarked"] = isBookmarked.Bool
+		}
+
+		positions[position] = day
+		days = append(days, day)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	// Read the files of the days
+	rows, err = s.db.Query(`SELECT day_position, uuid_filename, enc_filename, size, extra FROM day_files
+		WHERE user_id = ? AND year = ? AND month = ? ORDER BY day_position, position`, userID, year, month)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var dayPosition int
+		var uuidFilename, encFilename sql.NullString
+		var size sql.NullInt64
+		var fileExtra string
+		if err := rows.Scan(&dayPosition, &uuidFilename, &encFilename, &size, &fileExtra); err != nil {
+			return nil, err
+		}
+
+		file := map[string]any{}
+		if err := json.Unmarshal([]byte(fileExtra), &file); err != nil {
+			return nil, err
+		}
+		if uuidFilename.Valid {
+			file["uuid_filename"] = uuidFilename.String
+		}
+		if encFilename.Valid {
+			file["enc_filename"] = encFilename.String
+		}
+		if size.Valid {
+			file["size"] = size.Int64
+		}
+
+		if day, ok := positions[dayPosition]; ok {
+			files, _ := day["files"].([]any)
+			day["files"] = append(files, file)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	content["days"] = days
+	return encodeDocument(content, false)
+}
+
+// WriteMonth splits the month document into rows and replaces the stored month
+func (s *SQLiteStorage) WriteMonth(userID, year, month int, data []byte) error {
+	content := map[string]any{}
+	if err := json.Unmarshal(data, &content); err != nil {
+		return fmt.Errorf("error decoding month document: %v", err)
+	}
+
+	// Only split well-formed months into rows, anything else is kept as it is
+	days, split := splitDays(content["days"])
+	if split {
+		delete(content, "days")
+	}
+	extra, err := json.Marshal(content)
+	if err != nil {
+		return err
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// Replace the month
+	for _, query := range []string{
+		`DELETE FROM day_files WHERE user_id = ? AND year = ? AND month = ?`,
+		`DELETE FROM days WHERE user_id = ? AND year = ? AND month = ?`,
+		`DELETE FROM months WHERE user_id = ? AND year = ? AND month = ?`,
+	} {
+		if _, err := tx.Exec(query, userID, year, month); err != nil {
+			return err
+		}
+	}
+	if _, err := tx.Exec(`INSERT INTO months (user_id, year, month, extra, split) VALUES (?, ?, ?, ?, ?)`,
+		userID, year, month, string(extra), split); err != nil {
+		return err
+	}
+
+	for position, day := range days {
+		files, filesSplit := splitDays(day["files"])
+		if filesSplit {
+			delete(day, "files")
+		}
+
+		// Take the known fields out of the day, the rest is kept as JSON
+		dayNum := takeInt(day, "day")
+		text := takeString(day, "text")
+		dateWritten := takeString(day, "date_written")
+		isBookmarked := takeBool(day, "isBookmarked")
+		var tags sql.NullString
+		if rawTags, ok := day["tags"].([]any); ok {
+			encoded, err := json.Marshal(rawTags)
+			if err != nil {
+				return err
+			}
+			tags = sql.NullString{String: string(encoded), Valid: true}
+			delete(day, "tags")
+		}
+		dayExtra, err := json.Marshal(day)
+		if err != nil {
+			return err
+		}
+
+		if _, err := tx.Exec(`INSERT INTO days (user_id, year, month, position, day, text, date_written, tags, is_bookmarked, extra)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+			userID, year, month, position, dayNum, text, dateWritten, tags, isBookmarked, string(dayExtra)); err != nil {
+			return err
+		}
+
+		for filePosition, file := range files {
+			uuidFilename := takeString(file, "uuid_filename")
+			encFilename := takeString(file, "enc_filename")
+			size := takeInt(file, "size")
+			fileExtra, err := json.Marshal(file)
+			if err != nil {
+				return err
+			}
+
+			if _, err := tx.Exec(`INSERT INTO day_files (user_id, year, month, day_position, position, uuid_filename, enc_filename, size, extra)
+				VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+				userID, year, month, position, filePosition, uuidFilename, encFilename, size, string(fileExtra)); err != nil {
+				return err
+			}
+		}
+	}
+
+	return tx.Commit()
+}
+
+// splitDays returns the entries of a JSON array, if all of them are objects
+func splitDays(value any) ([]map[string]any, bool) {
+	list, ok := value.([]any)
+	if !ok {
+		return nil, false
+	}
+
+	entries := make([]map[string]any, 0, len(list))
+	for _, item := range list {
+		entry, ok := item.(map[string]any)
+		if !ok {
+			return nil, false
+		}
+		entries = append(entries, entry)
+	}
+
+	return entries, true
+}
+
+// takeString removes a string field from an entry
+func takeString(entry map[string]any, key string) sql.NullString {
+	value, ok := entry[key].(string)
+	if !ok {
+		return sql.NullString{}
+	}
+	delete(entry, key)
+	return sql.NullString{String: value, Valid: true}
+}
+
+// takeInt removes an integral number field from an entry
+func takeInt(entry map[string]any, key string) sql.NullInt64 {
+	value, ok := entry[key].(float64)
+	if !ok || value != float64(int64(value)) {
+		return sql.NullInt64{}
+	}
+	delete(entry, key)
+	return sql.NullInt64{Int64: int64(value), Valid: true}
+}
+
+// takeBool removes a boolean field from an entry
+func takeBool(entry map[string]any, key string) sql.NullBool {
+	value, ok := entry[key].(bool)
+	if !ok {
+		return sql.NullBool{}
+	}
+	delete(entry, key)
+	return sql.NullBool{Bool: value, Valid: true}
+}
+
+// ListYears returns the years with months of a user
+func (s *SQLiteStorage) ListYears(userID int) ([]int, error) {
+	return s.queryInts(`SELECT DISTINCT year FROM months WHERE user_id = ? ORDER BY year`, userID)
+}
+
+// ListMonths returns the months of a user in a year
+func (s *SQLiteStorage) ListMonths(userID, year int) ([]int, error) {
+	return s.queryInts(`SELECT month FROM months WHERE user_id = ? AND year = ? ORDER BY month`, userID, year)
+}
+
+func (s *SQLiteStorage) queryInts(query string, args ...any) ([]int, error) {
+	rows, err := s.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	values := []int{}
+	for rows.Next() {
+		var value int
+		if err := rows.Scan(&value); err != nil {
+			return nil, err
+		}
+		values = append(values, value)
+	}
+
+	return values, rows.Err()
+}
+
+// UserDocsSize returns the number of bytes stored for the documents of a user
+func (s *SQLiteStorage) UserDocsSize(userID int) (int64, error) {
+	var total int64
+	err := s.db.QueryRow(`SELECT
+		(SELECT COALESCE(SUM(LENGTH(data)), 0) FROM user_docs WHERE user_id = ?1) +
+		(SELECT COALESCE(SUM(LENGTH(extra)), 0) FROM months WHERE user_id = ?1) +
+		(SELECT COALESCE(SUM(COALESCE(LENGTH(text), 0) + COALESCE(LENGTH(date_written), 0) + COALESCE(LENGTH(tags), 0) + LENGTH(extra)), 0) FROM days WHERE user_id = ?1) +
+		(SELECT COALESCE(SUM(COALESCE(LENGTH(uuid_filename), 0) + COALESCE(LENGTH(enc_filename), 0) + LENGTH(extra)), 0) FROM day_files WHERE user_id = ?1)`,
+		userID).Scan(&total)
+	return total, err
+}
+
+// DeleteUserDocs removes all documents of a user
+func (s *SQLiteStorage) DeleteUserDocs(userID int) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, table := range []string{"day_files", "days", "months", "user_docs"} {
+		if _, err := tx.Exec(`DELETE FROM `+table+` WHERE user_id = ?`, userID); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
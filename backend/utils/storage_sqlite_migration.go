@@ -0,0 +1,233 @@
+package utils
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// SQLiteMigrationCounts holds the number of migrated items of one user
+type SQLiteMigrationCounts struct {
+	Months int
+	Days   int
+	Files  int
+	Docs   int
+}
+
+// MigrateToSQLite copies the JSON tree in dataPath into the SQLite database at dbPath.
+// Already migrated files are skipped, unless they changed since, so an interrupted migration can be run again.
+// Afterwards the row counts in the database are verified against the JSON tree.
+// The server must not be running during the migration.
+func MigrateToSQLite(dataPath, dbPath string) error {
+	src := NewFilesystemStorage(dataPath)
+	dst, err := NewSQLiteStorage(dbPath)
+	if err != nil {
+		return fmt.Errorf("error opening database: %v", err)
+	}
+	defer dst.Close()
+
+	// Migrate the global documents
+	entries, err := os.ReadDir(dataPath)
+	if err != nil {
+		return fmt.Errorf("error reading data directory: %v", err)
+	}
+	userIDs := []int{}
+	for _, entry := range entries {
+		if entry.IsDir() {
+			if userID, err := strconv.Atoi(entry.Name()); err == nil && isNumeric(entry.Name()) {
+				userIDs = append(userIDs, userID)
+			}
+			continue
+		}
+		if !isMigratableDoc(entry.Name()) {
+			continue
+		}
+
+		name := entry.Name()
+		err := dst.migrateItem(filepath.Join(dataPath, name), func() error {
+			data, err := src.ReadDoc(name)
+			if err != nil {
+				return err
+			}
+			return dst.WriteDoc(name, data)
+		})
+		if err != nil {
+			return fmt.Errorf("error migrating %s: %v", name, err)
+		}
+	}
+
+	// Migrate the users
+	for _, userID := range userIDs {
+		expected, err := dst.migrateUser(src, dataPath, userID)
+		if err != nil {
+			return fmt.Errorf("error migrating user %d: %v", userID, err)
+		}
+
+		// Verify the row counts
+		actual, err := dst.countUserRows(userID)
+		if err != nil {
+			return fmt.Errorf("error counting rows of user %d: %v", userID, err)
+		}
+		if actual != expected {
+			return fmt.Errorf("verification of user %d failed: expected %+v, found %+v in the database", userID, expected, actual)
+		}
+		Logger.Printf("Migrated user %d: %d months, %d days, %d files, %d documents", userID, actual.Months, actual.Days, actual.Files, actual.Docs)
+	}
+
+	Logger.Printf("Migration to SQLite finished, %d users verified", len(userIDs))
+	return nil
+}
+
+// migrateUser migrates the documents of a user and returns the counts found in the JSON tree
+func (s *SQLiteStorage) migrateUser(src *FilesystemStorage, dataPath string, userID int) (SQLiteMigrationCounts, error) {
+	counts := SQLiteMigrationCounts{}
+	userDir := filepath.Join(dataPath, strconv.Itoa(userID))
+
+	// Per-user documents (tags, templates, settings)
+	entries, err := os.ReadDir(userDir)
+	if err != nil {
+		return counts, err
+	}
+	for _, entry := range entries {
+		if entry.IsDir() || !isMigratableDoc(entry.Name()) {
+			continue
+		}
+
+		name := entry.Name()
+		err := s.migrateItem(filepath.Join(userDir, name), func() error {
+			data, err := src.ReadUserDoc(userID, name)
+			if err != nil {
+				return err
+			}
+			return s.WriteUserDoc(userID, name, data)
+		})
+		if err != nil {
+			return counts, fmt.Errorf("error migrating %s: %v", name, err)
+		}
+		counts.Docs++
+	}
+
+	// Months
+	years, err := src.ListYears(userID)
+	if err != nil {
+		return counts, err
+	}
+	for _, year := range years {
+		months, err := src.ListMonths(userID, year)
+		if err != nil {
+			return counts, err
+		}
+
+		for _, month := range months {
+			data, err := src.ReadMonth(userID, year, month)
+			if err != nil {
+				return counts, fmt.Errorf("error reading %d/%02d: %v", year, month, err)
+			}
+
+			err = s.migrateItem(src.monthPath(userID, year, month), func() error {
+				return s.WriteMonth(userID, year, month, data)
+			})
+			if err != nil {
+				return counts, fmt.Errorf("error migrating %d/%02d: %v", year, month, err)
+			}
+
+			days, files := countDaysAndFiles(data)
+			counts.Months++
+			counts.Days += days
+			counts.Files += files
+		}
+	}
+
+	return counts, nil
+}
+
+// migrateItem runs migrate for a source file, unless it was already migrated in its current state
+func (s *SQLiteStorage) migrateItem(sourcePath string, migrate func() error) error {
+	info, err := os.Stat(sourcePath)
+	if err != nil {
+		return err
+	}
+
+	var size, modTime int64
+	err = s.db.QueryRow(`SELECT size, mod_time FROM migration_state WHERE source = ?`, sourcePath).Scan(&size, &modTime)
+	if err == nil && size == info.Size() && modTime == info.ModTime().UnixNano() {
+		return nil
+	}
+
+	if err := migrate(); err != nil {
+		return err
+	}
+
+	_, err = s.db.Exec(`INSERT INTO migration_state (source, size, mod_time) VALUES (?, ?, ?)
+		ON CONFLICT (source) DO UPDATE SET size = excluded.size, mod_time = excluded.mod_time`,
+		sourcePath, info.Size(), info.ModTime().UnixNano())
+	return err
+}
+
+// countUserRows counts the stored months, days, files and documents of a user
+func (s *SQLiteStorage) countUserRows(userID int) (SQLiteMigrationCounts, error) {
+	counts := SQLiteMigrationCounts{}
+
+	// Months that couldn't be split into rows are stored as a whole, their days are counted from the JSON
+	var unsplit []string
+	rows, err := s.db.Query(`SELECT extra FROM months WHERE user_id = ? AND split = 0`, userID)
+	if err != nil {
+		return counts, err
+	}
+	for rows.Next() {
+		var extra string
+		if err := rows.Scan(&extra); err != nil {
+			rows.Close()
+			return counts, err
+		}
+		unsplit = append(unsplit, extra)
+	}
+	rows.Close()
+	for _, extra := range unsplit {
+		days, files := countDaysAndFiles([]byte(extra))
+		counts.Days += days
+		counts.Files += files
+	}
+
+	var days, files int
+	err = s.db.QueryRow(`SELECT
+		(SELECT COUNT(*) FROM months WHERE user_id = ?1),
+		(SELECT COUNT(*) FROM days WHERE user_id = ?1),
+		(SELECT COUNT(*) FROM day_files WHERE user_id = ?1),
+		(SELECT COUNT(*) FROM user_docs WHERE user_id = ?1)`,
+		userID).Scan(&counts.Months, &days, &files, &counts.Docs)
+	counts.Days += days
+	counts.Files += files
+
+	return counts, err
+}
+
+// countDaysAndFiles counts the days and the files of the days in a month document
+func countDaysAndFiles(data []byte) (int, int) {
+	content := map[string]any{}
+	if err := json.Unmarshal(data, &content); err != nil {
+		return 0, 0
+	}
+
+	days, _ := content["days"].([]any)
+	files := 0
+	for _, day := range days {
+		if day, ok := day.(map[string]any); ok {
+			dayFiles, _ := day["files"].([]any)
+			files += len(dayFiles)
+		}
+	}
+
+	return len(days), files
+}
+
+// isMigratableDoc reports if a file in the data tree is a document (and not a backup, temporary file or database)
+func isMigratableDoc(name string) bool {
+	if strings.HasPrefix(name, ".") || strings.HasSuffix(name, ".bak") {
+		return false
+	}
+	return strings.HasSuffix(name, ".json") || strings.HasSuffix(name, ".encrypted")
+}
@@ -0,0 +1,136 @@
+package utils
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// migrationMonth is a month as the handlers write it, with entries, history, revisions and files
+var migrationMonth = map[string]any{
+	"days": []any{
+		map[string]any{
+			"day":          3,
+			"text":         "enc:main text",
+			"date_written": "enc:03.05.2024, 21:15",
+			"revision":     4,
+			"tags":         []any{1, 2},
+			"isBookmarked": true,
+			"files":        []any{map[string]any{"uuid_filename": "f1", "enc_filename": "enc:photo.jpg", "size": 1234}},
+			"history": []any{
+				map[string]any{"version": 1, "text": "enc:first", "saved_at": "enc:2024-05-03T21:00:00Z"},
+				map[string]any{"event": "restore", "restored_from": 1, "saved_at": "enc:2024-05-03T21:10:00Z"},
+			},
+			"entries": []any{
+				map[string]any{"id": "e1", "time": "enc:08:30", "text": "enc:morning", "revision": 2,
+					"history": []any{map[string]any{"version": 1, "text": "enc:early", "saved_at": "enc:2024-05-03T08:30:00Z"}}},
+			},
+		},
+		map[string]any{"day": 4, "text": "enc:short day"},
+	},
+}
+
+// setupMigrationTree writes a JSON tree with two users. The month of user 2 can't be decoded, so the first
+// migration stops there.
+func setupMigrationTree(t *testing.T, dataPath string) []byte {
+	t.Helper()
+
+	month, err := encodeDocument(migrationMonth, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	src := NewFilesystemStorage(dataPath)
+	must := func(err error) {
+		t.Helper()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	must(src.WriteDoc("users.json", []byte(`{"users": [{"user_id": 1}, {"user_id": 2}]}`)))
+	must(src.WriteUserDoc(1, "tags.json", []byte(`{"tags": [{"id": 1}]}`)))
+	must(src.WriteMonth(1, 2024, 5, month))
+	must(src.WriteMonth(1, 2024, 6, []byte(`{"days": []}`)))
+	must(os.MkdirAll(filepath.Join(dataPath, "2", "2024"), 0755))
+	must(os.WriteFile(filepath.Join(dataPath, "2", "2024", "01.json"), []byte(`{"days": [`), 0644))
+	return month
+}
+
+func TestMigrateToSQLiteResume(t *testing.T) {
+	dataPath := t.TempDir()
+	dbPath := filepath.Join(t.TempDir(), "dailytxt.db")
+	month := setupMigrationTree(t, dataPath)
+
+	if err := MigrateToSQLite(dataPath, dbPath); err == nil {
+		t.Fatal("the migration succeeded with a broken month")
+	}
+
+	// Mark the migrated documents in the database, a skipped item keeps its mark
+	db, err := NewSQLiteStorage(dbPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.WriteUserDoc(1, "tags.json", []byte(`{"marked": true}`)); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.WriteDoc("users.json", []byte(`{"marked": true}`)); err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+
+	// Run it again after the month was repaired
+	if err := os.WriteFile(filepath.Join(dataPath, "2", "2024", "01.json"), []byte(`{"days": [{"day": 1}]}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := MigrateToSQLite(dataPath, dbPath); err != nil {
+		t.Fatalf("second run: %v", err)
+	}
+
+	db, err = NewSQLiteStorage(dbPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if data, _ := db.ReadUserDoc(1, "tags.json"); string(data) != `{"marked": true}` {
+		t.Errorf("tags.json = %s, want it skipped", data)
+	}
+	if data, _ := db.ReadDoc("users.json"); string(data) != `{"marked": true}` {
+		t.Errorf("users.json = %s, want it skipped", data)
+	}
+	if data, err := db.ReadMonth(1, 2024, 5); err != nil || !bytes.Equal(data, month) {
+		t.Errorf("ReadMonth = %s, %v\nwant %s", data, err, month)
+	}
+	if _, err := db.ReadMonth(2, 2024, 1); err != nil {
+		t.Errorf("the repaired month was not migrated: %v", err)
+	}
+}
+
+func TestMigrateToSQLiteChangedSource(t *testing.T) {
+	dataPath := t.TempDir()
+	dbPath := filepath.Join(t.TempDir(), "dailytxt.db")
+	setupMigrationTree(t, dataPath)
+	if err := os.RemoveAll(filepath.Join(dataPath, "2")); err != nil {
+		t.Fatal(err)
+	}
+	if err := MigrateToSQLite(dataPath, dbPath); err != nil {
+		t.Fatalf("first run: %v", err)
+	}
+
+	// A month changed after the first run is migrated again
+	changed := []byte(`{"days":[{"day":4,"text":"enc:edited after the migration"}]}` + "\n")
+	if err := NewFilesystemStorage(dataPath).WriteMonth(1, 2024, 6, changed); err != nil {
+		t.Fatal(err)
+	}
+	if err := MigrateToSQLite(dataPath, dbPath); err != nil {
+		t.Fatalf("second run: %v", err)
+	}
+
+	db, err := NewSQLiteStorage(dbPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if data, err := db.ReadMonth(1, 2024, 6); err != nil || !bytes.Equal(data, changed) {
+		t.Errorf("ReadMonth = %s, %v, want the changed month %s", data, err, changed)
+	}
+}
@@ -0,0 +1,318 @@
+package utils
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"io"
+
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+// Uploaded files are encrypted in chunks (the STREAM construction), so that neither an upload
+// nor a download has to hold the whole file in memory:
+//
+//	header: "DTXTSTRM" | version (1 byte) | nonce prefix (19 random bytes)
+//	chunks: XChaCha20-Poly1305 of 64 KiB plaintext each, the last chunk may be shorter (or empty)
+//
+// The nonce of a chunk is the nonce prefix, the chunk counter (4 bytes big endian) and a flag
+// byte that is 1 for the last chunk. The header is authenticated with every chunk, so reordering,
+// truncating or appending chunks makes the decryption fail.
+// Files from before this format (nonce | ChaCha20-Poly1305 of the whole file) are still decrypted.
+const (
+	streamMagic      = "DTXTSTRM"
+	streamVersion    = 1
+	streamChunkSize  = 64 * 1024
+	streamPrefixSize = chacha20poly1305.NonceSizeX - 5
+	streamHeaderSize = len(streamMagic) + 1 + streamPrefixSize
+)
+
+// isStreamCiphertext reports whether data starts like a file in the chunked format
+func isStreamCiphertext(data []byte) bool {
+	return len(data) >= len(streamMagic) && string(data[:len(streamMagic)]) == streamMagic
+}
+
+// StreamCiphertextSize returns the size of a file with plaintextSize bytes in the chunked format
+func StreamCiphertextSize(plaintextSize int64) int64 {
+	chunks := max((plaintextSize+streamChunkSize-1)/streamChunkSize, 1)
+	return int64(streamHeaderSize) + plaintextSize + chunks*chacha20poly1305.Overhead
+}
+
+// streamPlaintextSize returns the plaintext size and the number of chunks of a file in the chunked format
+func streamPlaintextSize(ciphertextSize int64) (int64, int64, error) {
+	fullChunk := int64(streamChunkSize + chacha20poly1305.Overhead)
+	body := ciphertextSize - int64(streamHeaderSize)
+	chunks := (body + fullChunk - 1) / fullChunk
+	if body < chacha20poly1305.Overhead || body-(chunks-1)*fullChunk < chacha20poly1305.Overhead {
+		return 0, 0, fmt.Errorf("error decrypting ciphertext: file is truncated")
+	}
+	return body - chunks*chacha20poly1305.Overhead, chunks, nil
+}
+
+// streamNonce sets the counter and the last chunk flag of a chunk nonce
+func streamNonce(nonce []byte, chunk int64, last bool) ([]byte, error) {
+	if chunk > 0xFFFFFFFF {
+		return nil, fmt.Errorf("file too large")
+	}
+	binary.BigEndian.PutUint32(nonce[streamPrefixSize:], uint32(chunk))
+	nonce[len(nonce)-1] = 0
+	if last {
+		nonce[len(nonce)-1] = 1
+	}
+	return nonce, nil
+}
+
+// newStreamAEAD creates the cipher for the chunks
+func newStreamAEAD(key string) (cipher.AEAD, error) {
+	keyBytes, err := base64.URLEncoding.DecodeString(key)
+	if err != nil {
+		return nil, fmt.Errorf("error decoding key: %v", err)
+	}
+	aead, err := chacha20poly1305.NewX(keyBytes)
+	if err != nil {
+		return nil, fmt.Errorf("error creating cipher: %v", err)
+	}
+	return aead, nil
+}
+
+// streamEncrypter encrypts everything read from src into the chunked format
+type streamEncrypter struct {
+	src     *bufio.Reader
+	aead    cipher.AEAD
+	header  []byte
+	nonce   []byte
+	chunk   int64
+	in      []byte // plaintext chunk read from src
+	out     []byte // buffer for the encrypted chunk
+	pending []byte // output not yet returned by Read
+	done    bool
+}
+
+// NewEncryptingReader returns a reader that yields src encrypted with key in the chunked format
+func NewEncryptingReader(src io.Reader, key string) (io.Reader, error) {
+	aead, err := newStreamAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+
+	header := make([]byte, streamHeaderSize)
+	copy(header, streamMagic)
+	header[len(streamMagic)] = streamVersion
+	if _, err := rand.Read(header[len(streamMagic)+1:]); err != nil {
+		return nil, fmt.Errorf("error creating nonce: %v", err)
+	}
+	nonce := make([]byte, aead.NonceSize())
+	copy(nonce, header[len(streamMagic)+1:])
+
+	return &streamEncrypter{
+		src:     bufio.NewReaderSize(src, streamChunkSize),
+		aead:    aead,
+		header:  header,
+		nonce:   nonce,
+		in:      make([]byte, streamChunkSize),
+		out:     make([]byte, 0, streamChunkSize+aead.Overhead()),
+		pending: header,
+	}, nil
+}
+
+func (e *streamEncrypter) Read(p []byte) (int, error) {
+	for len(e.pending) == 0 {
+		if e.done {
+			return 0, io.EOF
+		}
+		if err := e.sealChunk(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, e.pending)
+	e.pending = e.pending[n:]
+	return n, nil
+}
+
+// sealChunk encrypts the next chunk of src
+func (e *streamEncrypter) sealChunk() error {
+	n, err := io.ReadFull(e.src, e.in)
+	last := false
+	switch err {
+	case nil:
+		// A full chunk is the last one, if nothing follows
+		if _, err := e.src.Peek(1); err == io.EOF {
+			last = true
+		} else if err != nil {
+			return err
+		}
+	case io.EOF, io.ErrUnexpectedEOF:
+		last = true
+	default:
+		return err
+	}
+
+	nonce, err := streamNonce(e.nonce, e.chunk, last)
+	if err != nil {
+		return err
+	}
+	e.pending = e.aead.Seal(e.out[:0], nonce, e.in[:n], e.header)
+	e.chunk++
+	e.done = last
+	return nil
+}
+
+// streamDecrypter decrypts a file in the chunked format. If the source can seek, so can the decrypter:
+// only the chunks holding the requested bytes are read and decrypted.
+type streamDecrypter struct {
+	src       io.Reader
+	aead      cipher.AEAD
+	header    []byte
+	nonce     []byte
+	chunks    int64  // number of chunks
+	size      int64  // plaintext size
+	pos       int64  // plaintext position of the next Read
+	chunk     int64  // index of the chunk in plaintext
+	srcChunk  int64  // index of the chunk src is positioned at
+	in        []byte // buffer for the encrypted chunk
+	plaintext []byte
+}
+
+// NewDecryptingReader returns a reader that yields the plaintext of a file in the chunked format.
+// size is the size of the whole file. The first chunk is decrypted right away, so that a wrong key
+// is reported here already. A damaged or truncated file makes Read fail.
+func NewDecryptingReader(src io.Reader, size int64, key string) (io.ReadSeeker, error) {
+	header := make([]byte, streamHeaderSize)
+	if _, err := io.ReadFull(src, header); err != nil {
+		return nil, fmt.Errorf("error reading header: %v", err)
+	}
+	return newStreamDecrypter(header, src, size, key)
+}
+
+// newStreamDecrypter creates the decrypter for a file whose header was read from src already
+func newStreamDecrypter(header []byte, src io.Reader, size int64, key string) (*streamDecrypter, error) {
+	if !isStreamCiphertext(header) || len(header) != streamHeaderSize {
+		return nil, fmt.Errorf("not an encrypted stream")
+	}
+	if header[len(streamMagic)] != streamVersion {
+		return nil, fmt.Errorf("unsupported stream version %d", header[len(streamMagic)])
+	}
+	plaintextSize, chunks, err := streamPlaintextSize(size)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := newStreamAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	copy(nonce, header[len(streamMagic)+1:])
+
+	d := &streamDecrypter{
+		src:       src,
+		aead:      aead,
+		header:    header,
+		nonce:     nonce,
+		chunks:    chunks,
+		size:      plaintextSize,
+		chunk:     -1,
+		in:        make([]byte, streamChunkSize+aead.Overhead()),
+		plaintext: make([]byte, 0, streamChunkSize),
+	}
+	if err := d.openChunk(0); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+func (d *streamDecrypter) Read(p []byte) (int, error) {
+	if d.pos >= d.size {
+		return 0, io.EOF
+	}
+	chunk := d.pos / streamChunkSize
+	if chunk != d.chunk {
+		if err := d.openChunk(chunk); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, d.plaintext[d.pos-chunk*streamChunkSize:])
+	d.pos += int64(n)
+	return n, nil
+}
+
+// Seek sets the plaintext position of the next Read
+func (d *streamDecrypter) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += d.pos
+	case io.SeekEnd:
+		offset += d.size
+	default:
+		return 0, fmt.Errorf("invalid whence %d", whence)
+	}
+	if offset < 0 {
+		return 0, fmt.Errorf("negative position")
+	}
+	d.pos = offset
+	return offset, nil
+}
+
+// openChunk reads and decrypts a chunk
+func (d *streamDecrypter) openChunk(chunk int64) error {
+	fullChunk := int64(streamChunkSize + d.aead.Overhead())
+	if chunk != d.srcChunk {
+		seeker, ok := d.src.(io.Seeker)
+		if !ok {
+			return fmt.Errorf("source can't seek")
+		}
+		if _, err := seeker.Seek(int64(streamHeaderSize)+chunk*fullChunk, io.SeekStart); err != nil {
+			return err
+		}
+	}
+
+	last := chunk == d.chunks-1
+	length := fullChunk
+	if last {
+		length = d.size - chunk*streamChunkSize + int64(d.aead.Overhead())
+	}
+	d.chunk = -1
+	d.srcChunk = -1
+	if _, err := io.ReadFull(d.src, d.in[:length]); err != nil {
+		return fmt.Errorf("error reading chunk %d: %v", chunk, err)
+	}
+	d.srcChunk = chunk + 1
+
+	nonce, err := streamNonce(d.nonce, chunk, last)
+	if err != nil {
+		return err
+	}
+	plaintext, err := d.aead.Open(d.plaintext[:0], nonce, d.in[:length], d.header)
+	if err != nil {
+		return fmt.Errorf("error decrypting ciphertext: %v", err)
+	}
+	d.plaintext = plaintext
+	d.chunk = chunk
+	return nil
+}
+
+// encryptStream encrypts data in memory into the chunked format
+func encryptStream(data []byte, key string) ([]byte, error) {
+	encrypter, err := NewEncryptingReader(bytes.NewReader(data), key)
+	if err != nil {
+		return nil, err
+	}
+	ciphertext := bytes.NewBuffer(make([]byte, 0, StreamCiphertextSize(int64(len(data)))))
+	if _, err := ciphertext.ReadFrom(encrypter); err != nil {
+		return nil, err
+	}
+	return ciphertext.Bytes(), nil
+}
+
+// decryptStream decrypts a file in the chunked format in memory
+func decryptStream(ciphertext []byte, key string) ([]byte, error) {
+	decrypter, err := NewDecryptingReader(bytes.NewReader(ciphertext), int64(len(ciphertext)), key)
+	if err != nil {
+		return nil, err
+	}
+	return io.ReadAll(decrypter)
+}
@@ -0,0 +1,237 @@
+package utils
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+// testKey returns a random encryption key
+func testKey(t *testing.T) string {
+	t.Helper()
+
+	key := make([]byte, chacha20poly1305.KeySize)
+	if _, err := rand.Read(key); err != nil {
+		t.Fatal(err)
+	}
+	return base64.URLEncoding.EncodeToString(key)
+}
+
+// testFileContent returns size bytes that differ from chunk to chunk
+func testFileContent(size int) []byte {
+	data := make([]byte, size)
+	for i := range data {
+		data[i] = byte(i*7 + i/streamChunkSize)
+	}
+	return data
+}
+
+// encryptLegacyFile encrypts a file as a whole, like uploads were encrypted before the chunked format
+func encryptLegacyFile(t *testing.T, data []byte, key string) []byte {
+	t.Helper()
+
+	keyBytes, _ := base64.URLEncoding.DecodeString(key)
+	aead, err := chacha20poly1305.New(keyBytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		t.Fatal(err)
+	}
+	return aead.Seal(nonce, nonce, data, nil)
+}
+
+func TestStreamRoundTrip(t *testing.T) {
+	key := testKey(t)
+	for _, size := range []int{0, 1, streamChunkSize - 1, streamChunkSize, streamChunkSize + 1, 3*streamChunkSize + 100} {
+		data := testFileContent(size)
+		ciphertext, err := encryptStream(data, key)
+		if err != nil {
+			t.Fatalf("%d bytes: %v", size, err)
+		}
+		if got := int64(len(ciphertext)); got != StreamCiphertextSize(int64(size)) {
+			t.Errorf("%d bytes: ciphertext has %d bytes, StreamCiphertextSize says %d", size, got, StreamCiphertextSize(int64(size)))
+		}
+		plaintext, err := decryptStream(ciphertext, key)
+		if err != nil || !bytes.Equal(plaintext, data) {
+			t.Errorf("%d bytes: round trip gives %d bytes, %v", size, len(plaintext), err)
+		}
+	}
+}
+
+func TestStreamRejectsTampering(t *testing.T) {
+	key := testKey(t)
+	ciphertext, err := encryptStream(testFileContent(3*streamChunkSize+100), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fullChunk := streamChunkSize + chacha20poly1305.Overhead
+	chunk := func(i int) []byte {
+		start := streamHeaderSize + i*fullChunk
+		return ciphertext[start:min(start+fullChunk, len(ciphertext))]
+	}
+	join := func(parts ...[]byte) []byte {
+		return bytes.Join(parts, nil)
+	}
+	header := ciphertext[:streamHeaderSize]
+
+	tests := []struct {
+		name       string
+		ciphertext []byte
+		key        string
+	}{
+		{"last chunk dropped", join(header, chunk(0), chunk(1), chunk(2)), key},
+		{"only the first chunk", join(header, chunk(0)), key},
+		{"truncated within a chunk", ciphertext[:len(ciphertext)-10], key},
+		{"reordered chunks", join(header, chunk(1), chunk(0), chunk(2), chunk(3)), key},
+		{"chunk appended", join(ciphertext, chunk(1)), key},
+		{"flipped bit", join(header, chunk(0), chunk(1), []byte{chunk(2)[0] ^ 1}, chunk(2)[1:], chunk(3)), key},
+		{"wrong key", ciphertext, testKey(t)},
+	}
+	for _, tt := range tests {
+		if _, err := decryptStream(tt.ciphertext, tt.key); err == nil {
+			t.Errorf("%s: decrypted without an error", tt.name)
+		}
+	}
+
+	if _, err := NewDecryptingReader(bytes.NewReader(ciphertext), int64(len(ciphertext)), testKey(t)); err == nil {
+		t.Error("NewDecryptingReader accepts a wrong key")
+	}
+}
+
+func TestStreamSeek(t *testing.T) {
+	key := testKey(t)
+	data := testFileContent(3*streamChunkSize + 100)
+	ciphertext, err := encryptStream(data, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decrypter, err := NewDecryptingReader(bytes.NewReader(ciphertext), int64(len(ciphertext)), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		offset int64
+		whence int
+		length int
+	}{
+		{streamChunkSize - 10, io.SeekStart, 20},
+		{2*streamChunkSize + 5, io.SeekStart, 10},
+		{0, io.SeekStart, 2*streamChunkSize + 1},
+		{-50, io.SeekEnd, 50},
+		{streamChunkSize, io.SeekStart, streamChunkSize},
+		{-streamChunkSize - 1, io.SeekCurrent, 3},
+	}
+	pos := int64(0)
+	for _, tt := range tests {
+		got, err := decrypter.Seek(tt.offset, tt.whence)
+		if err != nil {
+			t.Fatalf("Seek(%d, %d): %v", tt.offset, tt.whence, err)
+		}
+		switch tt.whence {
+		case io.SeekStart:
+			pos = tt.offset
+		case io.SeekCurrent:
+			pos += tt.offset
+		case io.SeekEnd:
+			pos = int64(len(data)) + tt.offset
+		}
+		if got != pos {
+			t.Fatalf("Seek(%d, %d) = %d, want %d", tt.offset, tt.whence, got, pos)
+		}
+
+		buf := make([]byte, tt.length)
+		if _, err := io.ReadFull(decrypter, buf); err != nil {
+			t.Fatalf("reading %d bytes at %d: %v", tt.length, pos, err)
+		}
+		if !bytes.Equal(buf, data[pos:pos+int64(tt.length)]) {
+			t.Errorf("%d bytes at %d differ from the plaintext", tt.length, pos)
+		}
+		pos += int64(tt.length)
+	}
+
+	if _, err := decrypter.Seek(-1, io.SeekStart); err == nil {
+		t.Error("seeking before the start succeeded")
+	}
+	decrypter.Seek(0, io.SeekEnd)
+	if n, err := decrypter.Read(make([]byte, 1)); n != 0 || err != io.EOF {
+		t.Errorf("Read at the end = %d, %v, want EOF", n, err)
+	}
+}
+
+// Downloads are served with http.ServeContent, which seeks for range requests
+func TestStreamServeContentRange(t *testing.T) {
+	Store = NewMemoryStorage()
+	key := testKey(t)
+	data := testFileContent(2*streamChunkSize + 100)
+	if err := WriteEncryptedFile(bytes.NewReader(data), int64(len(data)), 1, "file", key); err != nil {
+		t.Fatal(err)
+	}
+
+	file, size, err := OpenDecryptedFile(1, "file", key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	if size != int64(len(data)) {
+		t.Fatalf("size = %d, want %d", size, len(data))
+	}
+
+	r := httptest.NewRequest("GET", "/file", nil)
+	r.Header.Set("Range", "bytes=65530-131080")
+	w := httptest.NewRecorder()
+	http.ServeContent(w, r, "file.bin", time.Time{}, file)
+	if w.Code != http.StatusPartialContent {
+		t.Fatalf("status %d, want 206", w.Code)
+	}
+	if !bytes.Equal(w.Body.Bytes(), data[65530:131081]) {
+		t.Errorf("the range has %d bytes that differ from the plaintext", w.Body.Len())
+	}
+}
+
+// Files uploaded before the chunked format are still decrypted
+func TestLegacyFileFallback(t *testing.T) {
+	Store = NewMemoryStorage()
+	key := testKey(t)
+
+	for _, size := range []int{0, 10, streamChunkSize + 1} {
+		data := testFileContent(size)
+		ciphertext := encryptLegacyFile(t, data, key)
+
+		if plaintext, err := DecryptFile(ciphertext, key); err != nil || !bytes.Equal(plaintext, data) {
+			t.Errorf("DecryptFile of %d bytes: %d bytes, %v", size, len(plaintext), err)
+		}
+
+		if err := WriteFile(ciphertext, 1, "legacy"); err != nil {
+			t.Fatal(err)
+		}
+		file, fileSize, err := OpenDecryptedFile(1, "legacy", key)
+		if err != nil {
+			t.Fatalf("OpenDecryptedFile of %d bytes: %v", size, err)
+		}
+		if fileSize != int64(size) {
+			t.Errorf("size = %d, want %d", fileSize, size)
+		}
+		if size > 5 {
+			file.Seek(5, io.SeekStart)
+		}
+		plaintext, err := io.ReadAll(file)
+		file.Close()
+		if err != nil || !bytes.Equal(plaintext, data[min(size, 5):]) {
+			t.Errorf("reading the legacy file of %d bytes after a seek: %d bytes, %v", size, len(plaintext), err)
+		}
+
+		if _, err := DecryptFile(ciphertext, testKey(t)); err == nil {
+			t.Errorf("a legacy file of %d bytes decrypts with a wrong key", size)
+		}
+	}
+}
@@ -0,0 +1,65 @@
+package utils
+
+import (
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+// foldedRunes maps the letters that Unicode doesn't decompose into a base letter and a diacritic to the letters
+// a search should treat them as: ligatures and letters with a stroke. Letters are lowercased before.
+var foldedRunes = map[rune]string{
+	'ß': "ss", 'æ': "ae", 'œ': "oe", 'þ': "th",
+	'ø': "o", 'ł': "l", 'đ': "d", 'ð': "d", 'ħ': "h", 'ŧ': "t", 'ı': "i", 'ŀ': "l",
+}
+
+// FoldRunes lowercases a text and removes its diacritics, so that "Mädchen" and "madchen" or "Café" and
+// "cafe" are the same for a search. Letters are decomposed (NFD) and the combining marks dropped, so decomposed
+// letters fold like precomposed ones. origin holds the index of the rune of text each folded rune comes from.
+func FoldRunes(text []rune) (folded []rune, origin []int) {
+	folded = make([]rune, 0, len(text))
+	origin = make([]int, 0, len(text))
+	var buf [utf8.UTFMax]byte
+	for i, r := range text {
+		r = unicode.ToLower(r)
+		if r < utf8.RuneSelf {
+			folded = append(folded, r)
+			origin = append(origin, i)
+			continue
+		}
+		if replacement, ok := foldedRunes[r]; ok {
+			for _, f := range replacement {
+				folded = append(folded, f)
+				origin = append(origin, i)
+			}
+			continue
+		}
+
+		decomposed := norm.NFD.Properties(buf[:utf8.EncodeRune(buf[:], r)]).Decomposition()
+		if decomposed == nil {
+			decomposed = buf[:utf8.EncodeRune(buf[:], r)]
+		}
+		for len(decomposed) > 0 {
+			d, size := utf8.DecodeRune(decomposed)
+			decomposed = decomposed[size:]
+			if !unicode.Is(unicode.Mn, d) {
+				folded = append(folded, d)
+				origin = append(origin, i)
+			}
+		}
+	}
+	return folded, origin
+}
+
+// FoldText lowercases a text and removes its diacritics (see FoldRunes)
+func FoldText(text string) string {
+	folded, _ := FoldRunes([]rune(text))
+	return string(folded)
+}
+
+// ContainsFolded reports whether text contains term, ignoring case and diacritics
+func ContainsFolded(text, term string) bool {
+	return strings.Contains(FoldText(text), FoldText(term))
+}
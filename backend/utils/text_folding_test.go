@@ -0,0 +1,54 @@
+package utils
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestFoldText(t *testing.T) {
+	tests := []struct {
+		text, want string
+	}{
+		{"Mädchen", "madchen"},
+		{"café", "cafe"},
+		{"Cafe\u0301", "cafe"}, // decomposed é
+		{"Crème Brûlée", "creme brulee"},
+		{"ŁÓDŹ", "lodz"},
+		{"Ærøskøbing", "aeroskobing"},
+		{"Straße", "strasse"},
+		{"Œuvre", "oeuvre"},
+		{"Þing", "thing"},
+		{"Ǎ Ṣ ệ", "a s e"},
+		{"Ελληνικά", "ελληνικα"},
+		{"한국어", "한국어"},
+		{"12:30, ok?", "12:30, ok?"},
+	}
+	for _, tt := range tests {
+		if got := FoldText(tt.text); got != tt.want {
+			t.Errorf("FoldText(%q) = %q, want %q", tt.text, got, tt.want)
+		}
+	}
+
+	if !ContainsFolded("Ein MÄDCHEN im Café", "madchen im cafe") {
+		t.Error("ContainsFolded ignores neither case nor diacritics")
+	}
+}
+
+// Every folded rune points back to the rune of the text it comes from
+func TestFoldRunesOrigin(t *testing.T) {
+	tests := []struct {
+		text   string
+		folded string
+		origin []int
+	}{
+		{"Maße", "masse", []int{0, 1, 2, 2, 3}},
+		{"e\u0301té", "ete", []int{0, 2, 3}}, // decomposed and precomposed é
+		{"Œil", "oeil", []int{0, 0, 1, 2}},
+	}
+	for _, tt := range tests {
+		folded, origin := FoldRunes([]rune(tt.text))
+		if string(folded) != tt.folded || !reflect.DeepEqual(origin, tt.origin) {
+			t.Errorf("FoldRunes(%q) = %q %v, want %q %v", tt.text, string(folded), origin, tt.folded, tt.origin)
+		}
+	}
+}
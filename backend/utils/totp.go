@@ -0,0 +1,389 @@
+package utils
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// TOTP (RFC 6238) as optional second factor on login.
+// All functions take the current time as parameter, so they can be checked with a fixed clock.
+const (
+	totpDigits = 6
+	totpPeriod = 30 // seconds
+	totpSkew   = 1  // accepted periods before and after the current one
+	totpIssuer = "DailyTxT"
+)
+
+// loginChallengeLifetime is the time a user has to enter the TOTP code after the password
+const loginChallengeLifetime = 5 * time.Minute
+
+// maxLoginChallengeAttempts is the number of wrong TOTP codes before the password has to be entered again
+const maxLoginChallengeAttempts = 5
+
+// ErrLoginChallengeNotFound is returned for unknown, expired or exhausted login challenges
+var ErrLoginChallengeNotFound = errors.New("login challenge not found")
+
+var totpEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// GenerateTOTPSecret creates a new random base32 encoded TOTP secret (160 bit, as recommended by RFC 4226)
+func GenerateTOTPSecret() (string, error) {
+	secret := make([]byte, 20)
+	if _, err := rand.Read(secret); err != nil {
+		return "", fmt.Errorf("error generating TOTP secret: %v", err)
+	}
+	return totpEncoding.EncodeToString(secret), nil
+}
+
+// TOTPURI returns the otpauth:// URI of a secret, which authenticator apps read from a QR code
+func TOTPURI(secret, username string) string {
+	label := url.PathEscape(totpIssuer + ":" + username)
+	params := url.Values{}
+	params.Set("secret", secret)
+	params.Set("issuer", totpIssuer)
+	params.Set("algorithm", "SHA1")
+	params.Set("digits", fmt.Sprint(totpDigits))
+	params.Set("period", fmt.Sprint(totpPeriod))
+	return "otpauth://totp/" + label + "?" + params.Encode()
+}
+
+// decodeTOTPSecret decodes a base32 secret, ignoring case, spaces and padding
+func decodeTOTPSecret(secret string) ([]byte, error) {
+	secret = strings.ToUpper(strings.ReplaceAll(secret, " ", ""))
+	secret = strings.TrimRight(secret, "=")
+	return totpEncoding.DecodeString(secret)
+}
+
+// totpCounter returns the number of the period t is in
+func totpCounter(t time.Time) int64 {
+	return t.Unix() / totpPeriod
+}
+
+// hotp calculates the code for a counter (RFC 4226)
+func hotp(key []byte, counter int64) string {
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], uint64(counter))
+
+	mac := hmac.New(sha1.New, key)
+	mac.Write(msg[:])
+	sum := mac.Sum(nil)
+
+	// Dynamic truncation
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+
+	mod := uint32(1)
+	for range totpDigits {
+		mod *= 10
+	}
+	return fmt.Sprintf("%0*d", totpDigits, value%mod)
+}
+
+// TOTPCode returns the code of a secret at the time t
+func TOTPCode(secret string, t time.Time) (string, error) {
+	key, err := decodeTOTPSecret(secret)
+	if err != nil {
+		return "", fmt.Errorf("invalid TOTP secret: %v", err)
+	}
+	return hotp(key, totpCounter(t)), nil
+}
+
+// VerifyTOTP checks a code against the secret at the time now, allowing a clock skew of totpSkew periods.
+// Codes of periods up to lastCounter were already used and are rejected.
+// Returns the counter of the matching period, which is the new lastCounter.
+func VerifyTOTP(secret, code string, now time.Time, lastCounter int64) (int64, bool) {
+	code = strings.ReplaceAll(strings.TrimSpace(code), " ", "")
+	if len(code) != totpDigits {
+		return 0, false
+	}
+
+	key, err := decodeTOTPSecret(secret)
+	if err != nil {
+		return 0, false
+	}
+
+	current := totpCounter(now)
+	for counter := current - totpSkew; counter <= current+totpSkew; counter++ {
+		if counter <= lastCounter {
+			continue
+		}
+		if subtle.ConstantTimeCompare([]byte(hotp(key, counter)), []byte(code)) == 1 {
+			return counter, true
+		}
+	}
+
+	return 0, false
+}
+
+// findUser returns the user with the given ID from the content of users.json
+func findUser(users map[string]any, userID int) (map[string]any, error) {
+	usersList, ok := users["users"].([]any)
+	if !ok {
+		return nil, fmt.Errorf("invalid users format")
+	}
+
+	for _, u := range usersList {
+		uMap, ok := u.(map[string]any)
+		if !ok {
+			continue
+		}
+		if id, ok := uMap["user_id"].(float64); ok && int(id) == userID {
+			return uMap, nil
+		}
+	}
+
+	return nil, fmt.Errorf("user with ID %d does not exist", userID)
+}
+
+// IsTOTPEnabled returns whether a user has confirmed a TOTP secret
+func IsTOTPEnabled(userID int) (bool, error) {
+	UsersFileMutex.RLock()
+	defer UsersFileMutex.RUnlock()
+
+	users, err := GetUsers()
+	if err != nil {
+		return false, fmt.Errorf("error getting users: %v", err)
+	}
+	user, err := findUser(users, userID)
+	if err != nil {
+		return false, err
+	}
+
+	_, enabled := user["totp"].(map[string]any)
+	return enabled, nil
+}
+
+// SavePendingTOTP stores a new (encrypted) secret, that becomes active once a first code is confirmed
+func SavePendingTOTP(userID int, encSecret string) error {
+	UsersFileMutex.Lock()
+	defer UsersFileMutex.Unlock()
+
+	users, err := GetUsers()
+	if err != nil {
+		return fmt.Errorf("error getting users: %v", err)
+	}
+	user, err := findUser(users, userID)
+	if err != nil {
+		return err
+	}
+
+	user["totp_pending"] = encSecret
+
+	return WriteUsers(users)
+}
+
+// ConfirmTOTP checks a code against the pending secret and, if valid, enables TOTP for the user
+func ConfirmTOTP(userID int, encKey, code string, now time.Time) (bool, error) {
+	UsersFileMutex.Lock()
+	defer UsersFileMutex.Unlock()
+
+	users, err := GetUsers()
+	if err != nil {
+		return false, fmt.Errorf("error getting users: %v", err)
+	}
+	user, err := findUser(users, userID)
+	if err != nil {
+		return false, err
+	}
+
+	encSecret, ok := user["totp_pending"].(string)
+	if !ok {
+		return false, fmt.Errorf("no pending TOTP setup")
+	}
+	secret, err := DecryptText(encSecret, encKey)
+	if err != nil {
+		return false, fmt.Errorf("error decrypting TOTP secret: %v", err)
+	}
+
+	counter, valid := VerifyTOTP(secret, code, now, 0)
+	if !valid {
+		return false, nil
+	}
+
+	delete(user, "totp_pending")
+	user["totp"] = map[string]any{
+		"enc_secret":   encSecret,
+		"last_counter": counter,
+	}
+
+	if err := WriteUsers(users); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// VerifyUserTOTP checks a code of a user with enabled TOTP. Each code can only be used once.
+func VerifyUserTOTP(userID int, encKey, code string, now time.Time) (bool, error) {
+	UsersFileMutex.Lock()
+	defer UsersFileMutex.Unlock()
+
+	users, err := GetUsers()
+	if err != nil {
+		return false, fmt.Errorf("error getting users: %v", err)
+	}
+	user, err := findUser(users, userID)
+	if err != nil {
+		return false, err
+	}
+
+	totp, ok := user["totp"].(map[string]any)
+	if !ok {
+		return false, fmt.Errorf("TOTP is not enabled")
+	}
+	encSecret, _ := totp["enc_secret"].(string)
+	lastCounter, _ := totp["last_counter"].(float64)
+
+	secret, err := DecryptText(encSecret, encKey)
+	if err != nil {
+		return false, fmt.Errorf("error decrypting TOTP secret: %v", err)
+	}
+
+	counter, valid := VerifyTOTP(secret, code, now, int64(lastCounter))
+	if !valid {
+		return false, nil
+	}
+
+	// Remember the period, so the code can't be replayed
+	totp["last_counter"] = counter
+	if err := WriteUsers(users); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// DisableTOTP removes the TOTP secret (and a pending setup) of a user
+func DisableTOTP(userID int) error {
+	UsersFileMutex.Lock()
+	defer UsersFileMutex.Unlock()
+
+	users, err := GetUsers()
+	if err != nil {
+		return fmt.Errorf("error getting users: %v", err)
+	}
+	user, err := findUser(users, userID)
+	if err != nil {
+		return err
+	}
+
+	delete(user, "totp")
+	delete(user, "totp_pending")
+
+	return WriteUsers(users)
+}
+
+// loginChallenge is a login where the password was correct, but the TOTP code is still missing
+type loginChallenge struct {
+	userID          int
+	username        string
+	wrappedKey      []byte
+	wrappedPassword []byte // for the Argon2 upgrade when the login is completed
+	expiresAt       time.Time
+	attempts        int
+}
+
+var (
+	loginChallenges      = map[string]*loginChallenge{}
+	loginChallengesMutex sync.Mutex
+)
+
+// CreateLoginChallenge remembers a login until the TOTP code is entered and returns the token for the second step.
+// Like for sessions, the derived key and the password are wrapped with a key that only the token holder can derive.
+func CreateLoginChallenge(userID int, username, derivedKey, password string, now time.Time) (string, error) {
+	tokenBytes := make([]byte, 32)
+	if _, err := rand.Read(tokenBytes); err != nil {
+		return "", fmt.Errorf("error generating login challenge: %v", err)
+	}
+	token := base64.RawURLEncoding.EncodeToString(tokenBytes)
+
+	aead, err := CreateAEAD(sessionWrapKey(token))
+	if err != nil {
+		return "", err
+	}
+	seal := func(value string) ([]byte, error) {
+		nonce := make([]byte, aead.NonceSize())
+		if _, err := rand.Read(nonce); err != nil {
+			return nil, err
+		}
+		return aead.Seal(nonce, nonce, []byte(value), nil), nil
+	}
+	wrappedKey, err := seal(derivedKey)
+	if err != nil {
+		return "", err
+	}
+	wrappedPassword, err := seal(password)
+	if err != nil {
+		return "", err
+	}
+
+	loginChallengesMutex.Lock()
+	defer loginChallengesMutex.Unlock()
+
+	// Drop expired challenges
+	for id, challenge := range loginChallenges {
+		if !now.Before(challenge.expiresAt) {
+			delete(loginChallenges, id)
+		}
+	}
+
+	loginChallenges[sessionID(token)] = &loginChallenge{
+		userID:          userID,
+		username:        username,
+		wrappedKey:      wrappedKey,
+		wrappedPassword: wrappedPassword,
+		expiresAt:       now.Add(loginChallengeLifetime),
+	}
+
+	return token, nil
+}
+
+// UseLoginChallenge returns the user, derived key and password of a login challenge and counts the attempt.
+// After maxLoginChallengeAttempts attempts the challenge is dropped.
+func UseLoginChallenge(token string, now time.Time) (int, string, string, string, error) {
+	loginChallengesMutex.Lock()
+	defer loginChallengesMutex.Unlock()
+
+	id := sessionID(token)
+	challenge, ok := loginChallenges[id]
+	if !ok {
+		return 0, "", "", "", ErrLoginChallengeNotFound
+	}
+	if !now.Before(challenge.expiresAt) || challenge.attempts >= maxLoginChallengeAttempts {
+		delete(loginChallenges, id)
+		return 0, "", "", "", ErrLoginChallengeNotFound
+	}
+	challenge.attempts++
+
+	aead, err := CreateAEAD(sessionWrapKey(token))
+	if err != nil {
+		return 0, "", "", "", err
+	}
+	nonceSize := aead.NonceSize()
+	derivedKey, err := aead.Open(nil, challenge.wrappedKey[:nonceSize], challenge.wrappedKey[nonceSize:], nil)
+	if err != nil {
+		return 0, "", "", "", ErrLoginChallengeNotFound
+	}
+	password, err := aead.Open(nil, challenge.wrappedPassword[:nonceSize], challenge.wrappedPassword[nonceSize:], nil)
+	if err != nil {
+		return 0, "", "", "", ErrLoginChallengeNotFound
+	}
+
+	return challenge.userID, challenge.username, string(derivedKey), string(password), nil
+}
+
+// DeleteLoginChallenge drops a login challenge after the login is completed
+func DeleteLoginChallenge(token string) {
+	loginChallengesMutex.Lock()
+	defer loginChallengesMutex.Unlock()
+
+	delete(loginChallenges, sessionID(token))
+}
@@ -0,0 +1,126 @@
+package utils
+
+import (
+	"encoding/base64"
+	"testing"
+	"time"
+)
+
+// rfc6238Secret is the SHA1 seed of the test vectors of RFC 6238, base32 encoded ("12345678901234567890")
+const rfc6238Secret = "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+
+// TestTOTPCodeRFC6238 checks the SHA1 vectors of RFC 6238, Appendix B.
+// The RFC lists 8 digits, the 6 digit codes are their last 6 digits.
+func TestTOTPCodeRFC6238(t *testing.T) {
+	vectors := []struct {
+		unix int64
+		code string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1111111111, "050471"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+		{20000000000, "353130"},
+	}
+	for _, v := range vectors {
+		code, err := TOTPCode(rfc6238Secret, time.Unix(v.unix, 0))
+		if err != nil {
+			t.Fatalf("TOTPCode(%d): %v", v.unix, err)
+		}
+		if code != v.code {
+			t.Errorf("TOTPCode(%d) = %s, want %s", v.unix, code, v.code)
+		}
+	}
+
+	// Case, spaces and padding of the secret don't matter
+	if code, _ := TOTPCode("gezd gnbv gy3t qojq gezd gnbv gy3t qojq====", time.Unix(59, 0)); code != "287082" {
+		t.Errorf("TOTPCode with a formatted secret = %s, want 287082", code)
+	}
+}
+
+func TestVerifyTOTPWindow(t *testing.T) {
+	now := time.Unix(1111111111, 0)
+	current := totpCounter(now)
+	codeAt := func(offset int) string {
+		code, err := TOTPCode(rfc6238Secret, now.Add(time.Duration(offset*totpPeriod)*time.Second))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return code
+	}
+
+	// The clock of the authenticator may drift by totpSkew periods in both directions
+	for offset := -totpSkew; offset <= totpSkew; offset++ {
+		counter, valid := VerifyTOTP(rfc6238Secret, codeAt(offset), now, 0)
+		if !valid || counter != current+int64(offset) {
+			t.Errorf("code of period %+d: counter %d, valid %v, want counter %d", offset, counter, valid, current+int64(offset))
+		}
+	}
+	for _, offset := range []int{-totpSkew - 1, totpSkew + 1} {
+		if _, valid := VerifyTOTP(rfc6238Secret, codeAt(offset), now, 0); valid {
+			t.Errorf("code of period %+d was accepted", offset)
+		}
+	}
+
+	// Spaces in the entered code are ignored, wrong lengths are rejected
+	code := codeAt(0)
+	if _, valid := VerifyTOTP(rfc6238Secret, " "+code[:3]+" "+code[3:]+" ", now, 0); !valid {
+		t.Errorf("code with spaces was rejected")
+	}
+	if _, valid := VerifyTOTP(rfc6238Secret, code[:5], now, 0); valid {
+		t.Errorf("code with 5 digits was accepted")
+	}
+
+	// Periods up to lastCounter are used already
+	if _, valid := VerifyTOTP(rfc6238Secret, code, now, current); valid {
+		t.Errorf("code of the last used period was accepted")
+	}
+	if counter, valid := VerifyTOTP(rfc6238Secret, codeAt(1), now, current); !valid || counter != current+1 {
+		t.Errorf("code of the next period after lastCounter: counter %d, valid %v", counter, valid)
+	}
+}
+
+// TestVerifyUserTOTPReplay checks that last_counter keeps a code from being used twice
+func TestVerifyUserTOTPReplay(t *testing.T) {
+	Store = NewMemoryStorage()
+	encKey := base64.URLEncoding.EncodeToString(make([]byte, 32))
+	if err := WriteUsers(map[string]any{"users": []any{map[string]any{"user_id": 1, "username": "alice"}}}); err != nil {
+		t.Fatal(err)
+	}
+
+	encSecret, err := EncryptText(rfc6238Secret, encKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := SavePendingTOTP(1, encSecret); err != nil {
+		t.Fatalf("SavePendingTOTP: %v", err)
+	}
+
+	now := time.Unix(1111111111, 0)
+	code, _ := TOTPCode(rfc6238Secret, now)
+	if valid, err := ConfirmTOTP(1, encKey, code, now); err != nil || !valid {
+		t.Fatalf("ConfirmTOTP = %v, %v", valid, err)
+	}
+
+	// The code that confirmed the setup can't be used for a login
+	if valid, err := VerifyUserTOTP(1, encKey, code, now); err != nil || valid {
+		t.Errorf("replayed setup code: %v, %v", valid, err)
+	}
+
+	// A new code is accepted once, also when it is entered again within its period
+	later := now.Add(totpPeriod * time.Second)
+	code, _ = TOTPCode(rfc6238Secret, later)
+	if valid, err := VerifyUserTOTP(1, encKey, code, later); err != nil || !valid {
+		t.Fatalf("VerifyUserTOTP = %v, %v", valid, err)
+	}
+	if valid, err := VerifyUserTOTP(1, encKey, code, later.Add(10*time.Second)); err != nil || valid {
+		t.Errorf("replayed login code: %v, %v", valid, err)
+	}
+
+	// An older code within the window is rejected as well
+	older, _ := TOTPCode(rfc6238Secret, now)
+	if valid, err := VerifyUserTOTP(1, encKey, older, later); err != nil || valid {
+		t.Errorf("code of an earlier period after a login: %v, %v", valid, err)
+	}
+}
@@ -0,0 +1,252 @@
+package utils
+
+import (
+	"fmt"
+	"time"
+)
+
+// Deleted days, entries and files are kept in the trash (trash.json of the user) until they are restored or purged.
+// An item holds the day or file entry exactly as it was in the month document, so everything that was
+// encrypted stays encrypted, and the uploaded files stay in the blob store. Items older than
+// Settings.TrashRetentionDays are purged automatically.
+//
+//	{"items": [{"id": ..., "type": "day"|"entry"|"file", "year": ..., "month": ..., "day": ..., "deleted_at": ..., "entry": {...}}]}
+
+// Types of trash items
+const (
+	TrashDay   = "day"
+	TrashEntry = "entry"
+	TrashFile  = "file"
+)
+
+// trashPurgeInterval is the interval of the automatic purge
+const trashPurgeInterval = time.Hour
+
+// GetTrash retrieves the trash of a specific user
+func GetTrash(userID int) (map[string]any, error) {
+	return getUserDocument(userID, "trash.json")
+}
+
+// WriteTrash writes the trash of a specific user
+func WriteTrash(userID int, content map[string]any) error {
+	return writeUserDocument(userID, "trash.json", content)
+}
+
+// TrashItems returns the items of a trash document
+func TrashItems(content map[string]any) []map[string]any {
+	list, _ := content["items"].([]any)
+	items := make([]map[string]any, 0, len(list))
+	for _, item := range list {
+		if itemMap, ok := item.(map[string]any); ok {
+			items = append(items, itemMap)
+		}
+	}
+	return items
+}
+
+// setTrashItems replaces the items of a trash document
+func setTrashItems(content map[string]any, items []map[string]any) {
+	list := make([]any, len(items))
+	for i, item := range items {
+		list[i] = item
+	}
+	content["items"] = list
+}
+
+// FindTrashItem returns the item with the given id, or nil
+func FindTrashItem(content map[string]any, id string) map[string]any {
+	for _, item := range TrashItems(content) {
+		if itemID, _ := item["id"].(string); itemID == id {
+			return item
+		}
+	}
+	return nil
+}
+
+// TrashItemDeletedAt returns when an item was moved to the trash.
+// Returns false if deleted_at is missing or can't be parsed.
+func TrashItemDeletedAt(item map[string]any) (time.Time, bool) {
+	deletedAt, _ := item["deleted_at"].(string)
+	t, err := time.Parse(time.RFC3339, deletedAt)
+	if err != nil {
+		return time.Time{}, false
+	}
+	return t, true
+}
+
+// TrashItemPurgeAt returns when an item will be purged automatically.
+// Returns false if the age of the item is unknown, such items are never purged automatically.
+func TrashItemPurgeAt(item map[string]any) (time.Time, bool) {
+	deletedAt, ok := TrashItemDeletedAt(item)
+	if !ok {
+		return time.Time{}, false
+	}
+	return deletedAt.AddDate(0, 0, Settings.TrashRetentionDays), true
+}
+
+// TrashItemFiles returns the uploaded files of an item (the file itself or the files of a day or entry)
+func TrashItemFiles(item map[string]any) []map[string]any {
+	entry, _ := item["entry"].(map[string]any)
+	if entry == nil {
+		return nil
+	}
+
+	if itemType, _ := item["type"].(string); itemType == TrashFile {
+		return []map[string]any{entry}
+	}
+	return DayFiles(entry)
+}
+
+// MoveToTrash adds a deleted day, entry or file of a date to the trash and returns the id of the item.
+// The entry has to be removed from the month afterwards. The caller holds the lock of the month.
+func MoveToTrash(userID int, itemType string, year, month, day int, entry map[string]any, now time.Time) (string, error) {
+	defer LockTrash(userID)()
+
+	content, err := GetTrash(userID)
+	if err != nil {
+		return "", err
+	}
+
+	id, err := GenerateUUID()
+	if err != nil {
+		return "", fmt.Errorf("error generating id: %v", err)
+	}
+
+	items := TrashItems(content)
+	items = append(items, map[string]any{
+		"id":         id,
+		"type":       itemType,
+		"year":       year,
+		"month":      month,
+		"day":        day,
+		"deleted_at": now.UTC().Format(time.RFC3339),
+		"entry":      entry,
+	})
+	setTrashItems(content, items)
+
+	if err := WriteTrash(userID, content); err != nil {
+		return "", err
+	}
+	return id, nil
+}
+
+// RemoveFromTrash removes an item from the trash without touching its files (to restore it) and returns
+// the removed item. Returns nil if the item doesn't exist (anymore).
+func RemoveFromTrash(userID int, id string) (map[string]any, error) {
+	defer LockTrash(userID)()
+
+	content, err := GetTrash(userID)
+	if err != nil {
+		return nil, err
+	}
+
+	items := TrashItems(content)
+	for i, item := range items {
+		if itemID, _ := item["id"].(string); itemID == id {
+			setTrashItems(content, append(items[:i], items[i+1:]...))
+			if err := WriteTrash(userID, content); err != nil {
+				return nil, err
+			}
+			return item, nil
+		}
+	}
+	return nil, nil
+}
+
+// PurgeTrash deletes the items of the trash for which purge returns true, including their files.
+// Returns the number of purged items.
+func PurgeTrash(userID int, purge func(item map[string]any) bool) (int, error) {
+	defer LockTrash(userID)()
+
+	content, err := GetTrash(userID)
+	if err != nil {
+		return 0, err
+	}
+
+	items := TrashItems(content)
+	kept := make([]map[string]any, 0, len(items))
+	for _, item := range items {
+		if !purge(item) {
+			kept = append(kept, item)
+		}
+	}
+	if len(kept) == len(items) {
+		return 0, nil
+	}
+
+	// Write the trash first, a file that can't be removed afterwards is only an orphan (reported by fsck)
+	setTrashItems(content, kept)
+	if err := WriteTrash(userID, content); err != nil {
+		return 0, err
+	}
+
+	for _, item := range items {
+		if !purge(item) {
+			continue
+		}
+		for _, file := range TrashItemFiles(item) {
+			if uuid, ok := file["uuid_filename"].(string); ok && uuid != "" {
+				if err := RemoveFile(userID, uuid); err != nil {
+					Logger.Printf("Warning: Failed to delete file %s of purged trash item for user %d: %v", uuid, userID, err)
+				}
+			}
+		}
+	}
+
+	return len(items) - len(kept), nil
+}
+
+// PurgeExpiredTrash deletes the items of a user that are in the trash for longer than the retention period
+func PurgeExpiredTrash(userID int, now time.Time) (int, error) {
+	return PurgeTrash(userID, func(item map[string]any) bool {
+		purgeAt, ok := TrashItemPurgeAt(item)
+		if !ok {
+			// Unknown age, rather keep it than delete something that was just moved to the trash
+			Logger.Printf("Warning: Trash item %v of user %d has an invalid deleted_at %q, it is not purged", item["id"], userID, item["deleted_at"])
+			return false
+		}
+		return !now.Before(purgeAt)
+	})
+}
+
+// StartTrashPurge purges the expired trash items of all users now and then every trashPurgeInterval
+func StartTrashPurge() {
+	go func() {
+		for {
+			purgeExpiredTrashOfAllUsers(time.Now())
+			time.Sleep(trashPurgeInterval)
+		}
+	}()
+}
+
+// purgeExpiredTrashOfAllUsers runs PurgeExpiredTrash for every user
+func purgeExpiredTrashOfAllUsers(now time.Time) {
+	UsersFileMutex.RLock()
+	users, err := GetUsers()
+	UsersFileMutex.RUnlock()
+	if err != nil {
+		Logger.Printf("Error getting users for the trash purge: %v", err)
+		return
+	}
+
+	usersList, _ := users["users"].([]any)
+	for _, u := range usersList {
+		user, ok := u.(map[string]any)
+		if !ok {
+			continue
+		}
+		id, ok := user["user_id"].(float64)
+		if !ok {
+			continue
+		}
+
+		purged, err := PurgeExpiredTrash(int(id), now)
+		if err != nil {
+			Logger.Printf("Error purging the trash of user %d: %v", int(id), err)
+			continue
+		}
+		if purged > 0 {
+			Logger.Printf("Purged %d expired trash items of user %d", purged, int(id))
+		}
+	}
+}
@@ -0,0 +1,50 @@
+package utils
+
+import (
+	"testing"
+	"time"
+)
+
+func TestPurgeExpiredTrash(t *testing.T) {
+	Store = NewMemoryStorage()
+	Settings.TrashRetentionDays = 30
+	now := time.Date(2024, 5, 31, 12, 0, 0, 0, time.UTC)
+
+	item := func(id string, deletedAt any) any {
+		return map[string]any{"id": id, "type": TrashDay, "deleted_at": deletedAt, "entry": map[string]any{"day": 1}}
+	}
+	content := map[string]any{"items": []any{
+		item("expired", now.AddDate(0, 0, -31).Format(time.RFC3339)),
+		item("recent", now.AddDate(0, 0, -1).Format(time.RFC3339)),
+		item("invalid", "yesterday"),
+		item("missing", nil),
+	}}
+	if err := WriteTrash(1, content); err != nil {
+		t.Fatal(err)
+	}
+
+	purged, err := PurgeExpiredTrash(1, now)
+	if err != nil {
+		t.Fatalf("PurgeExpiredTrash: %v", err)
+	}
+	if purged != 1 {
+		t.Errorf("purged %d items, want 1", purged)
+	}
+
+	content, err = GetTrash(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	kept := map[string]bool{}
+	for _, item := range TrashItems(content) {
+		kept[item["id"].(string)] = true
+	}
+	for _, id := range []string{"recent", "invalid", "missing"} {
+		if !kept[id] {
+			t.Errorf("item %s was purged", id)
+		}
+	}
+	if kept["expired"] {
+		t.Errorf("the expired item was kept")
+	}
+}